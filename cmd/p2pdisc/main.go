@@ -0,0 +1,486 @@
+// Command p2pdisc queries discovery nodes for debugging.
+//
+//	p2pdisc [flags] peers [-page n] [-page-size n] <topic>
+//	p2pdisc [flags] check <topic>
+//	p2pdisc [flags] services
+//	p2pdisc [flags] call [-token t] <protocol> <Service.Method> [json]
+//	p2pdisc [flags] ping [-count n] [peer-multiaddr]
+//	p2pdisc [flags] discover [-wait d] <topic>
+//	p2pdisc genpsk <path>
+//
+// peers and check issue peer exchange calls to the node given with -peer;
+// services lists the protocols it serves through the reflection protocol,
+// which the node must enable.
+// call fetches the protobuf descriptors the node publishes for protocol,
+// calls the method with the JSON request, {} by default, and prints the
+// JSON response.
+// ping pings -peer or the given address. discover joins the network through
+// the -peer nodes as a watch-only node and lists the providers it finds; a
+// version range such as /calculator/^1.0 lists the providers of any version
+// in it.
+// genpsk saves a new private network key; -psk joins a private network.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/jibuji/p2p-service-discover/pkg/discovery"
+	"github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	"github.com/jibuji/p2p-service-discover/pkg/types"
+)
+
+// peerList collects repeated -peer flags
+type peerList []peer.AddrInfo
+
+func (l *peerList) String() string {
+	addrs := make([]string, len(*l))
+	for i, info := range *l {
+		addrs[i] = info.String()
+	}
+	return strings.Join(addrs, ",")
+}
+
+func (l *peerList) Set(s string) error {
+	info, err := peer.AddrInfoFromString(s)
+	if err != nil {
+		return fmt.Errorf("invalid peer address %s: %w", s, err)
+	}
+	*l = append(*l, *info)
+	return nil
+}
+
+type cli struct {
+	peers   peerList
+	json    bool
+	timeout time.Duration
+	verbose bool
+	pskFile string
+	out     io.Writer
+}
+
+var errUsage = errors.New("usage")
+
+func main() {
+	c := &cli{out: os.Stdout}
+	flag.Var(&c.peers, "peer", "multiaddr of a node to query, including /p2p/ (repeatable)")
+	flag.BoolVar(&c.json, "json", false, "print results as JSON")
+	flag.DurationVar(&c.timeout, "timeout", 30*time.Second, "timeout for the whole command")
+	flag.BoolVar(&c.verbose, "v", false, "log node activity to stderr")
+	flag.StringVar(&c.pskFile, "psk", "", "private network key file of the nodes")
+	flag.Usage = usage
+	flag.Parse()
+
+	if err := c.run(flag.Args()); err != nil {
+		if errors.Is(err, errUsage) {
+			usage()
+			os.Exit(2)
+		}
+		fmt.Fprintln(os.Stderr, "p2pdisc:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, `usage: p2pdisc [flags] <command> [args]
+
+commands:
+  peers [-page n] [-page-size n] <topic>  fetch providers of topic from -peer
+  check <topic>                           ask -peer whether it knows providers of topic
+  services                                list the protocols -peer serves and advertises
+  call [-token t] <protocol> <Service.Method> [json]
+                                          call a method of -peer described by its descriptors
+  ping [-count n] [peer-multiaddr]        ping -peer or the given peer
+  discover [-wait d] <topic>              join the network via -peer and discover providers
+  genpsk <path>                           save a new private network key to path
+
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+func (c *cli) run(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	switch args[0] {
+	case "peers":
+		return c.fetchPeers(ctx, args[1:])
+	case "check":
+		return c.check(ctx, args[1:])
+	case "services":
+		return c.services(ctx, args[1:])
+	case "call":
+		return c.call(ctx, args[1:])
+	case "ping":
+		return c.ping(ctx, args[1:])
+	case "discover":
+		return c.discover(ctx, args[1:])
+	case "genpsk":
+		return c.genPSK(args[1:])
+	}
+	return fmt.Errorf("unknown command %q: %w", args[0], errUsage)
+}
+
+func (c *cli) fetchPeers(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("peers", flag.ContinueOnError)
+	page := fs.Int("page", 0, "zero-based page to fetch")
+	pageSize := fs.Int("page-size", 0, "providers per page; 0 asks for the peer's largest page")
+	topic, err := parseTopic(fs, args)
+	if err != nil {
+		return err
+	}
+
+	target, err := c.target()
+	if err != nil {
+		return err
+	}
+	node, err := c.newNode(ctx, discovery.WithDHT(false), discovery.WithPubSub(false))
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	if err := node.Host().Connect(ctx, target); err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", target.ID, err)
+	}
+	infos, err := node.FetchPeerList(ctx, target.ID, topic, int32(*page), int32(*pageSize))
+	if err != nil {
+		return err
+	}
+
+	peers := make([]types.PeerInfo, 0, len(infos))
+	for _, info := range infos {
+		id, err := peer.IDFromBytes(info.PeerId)
+		if err != nil {
+			continue
+		}
+		peers = append(peers, types.PeerInfo{
+			ID:       id,
+			Addrs:    info.Addresses,
+			LastSeen: time.Unix(0, info.LastSeen),
+		})
+	}
+	return c.printPeers(peers)
+}
+
+func (c *cli) check(ctx context.Context, args []string) error {
+	topic, err := parseTopic(flag.NewFlagSet("check", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	target, err := c.target()
+	if err != nil {
+		return err
+	}
+	node, err := c.newNode(ctx, discovery.WithDHT(false), discovery.WithPubSub(false))
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	if err := node.Host().Connect(ctx, target); err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", target.ID, err)
+	}
+	provides, err := node.CheckService(ctx, target.ID, topic)
+	if err != nil {
+		return err
+	}
+	return c.printCheck(target.ID, topic, provides)
+}
+
+func (c *cli) services(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	target, err := c.target()
+	if err != nil {
+		return err
+	}
+	node, err := c.newNode(ctx, discovery.WithDHT(false), discovery.WithPubSub(false))
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	if err := node.Host().Connect(ctx, target); err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", target.ID, err)
+	}
+	services, err := node.FetchServices(ctx, target.ID)
+	if err != nil {
+		return err
+	}
+	return c.printServices(services)
+}
+
+func (c *cli) call(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("call", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	token := fs.String("token", "", "capability token presented to -peer")
+	if err := fs.Parse(args); err != nil || fs.NArg() < 2 || fs.NArg() > 3 {
+		return errUsage
+	}
+	protocolID, method, request := fs.Arg(0), fs.Arg(1), "{}"
+	if fs.NArg() == 3 {
+		request = fs.Arg(2)
+	}
+
+	target, err := c.target()
+	if err != nil {
+		return err
+	}
+	node, err := c.newNode(ctx, discovery.WithDHT(false), discovery.WithPubSub(false))
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	if err := node.Host().Connect(ctx, target); err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", target.ID, err)
+	}
+	files, err := node.FetchDescriptors(ctx, target.ID, protocolID)
+	if err != nil {
+		return err
+	}
+	md, err := findMethod(files, method)
+	if err != nil {
+		return err
+	}
+	req := dynamicpb.NewMessage(md.Input())
+	if err := protojson.Unmarshal([]byte(request), req); err != nil {
+		return fmt.Errorf("invalid %s: %w", md.Input().FullName(), err)
+	}
+
+	node.Registry().RegisterClientToken(protocolID, *token)
+	rpcPeer, err := node.Registry().OpenPeer(ctx, protocolID, target.ID)
+	if err != nil {
+		return err
+	}
+	defer rpcPeer.Close()
+	resp := dynamicpb.NewMessage(md.Output())
+	if err := rpcPeer.Call(string(md.Parent().Name())+"."+string(md.Name()), req, resp); err != nil {
+		return err
+	}
+	return c.printMessage(resp)
+}
+
+// findMethod looks up a method named Service.Method, or with the service's
+// full name such as calculator.Calculator.Add
+func findMethod(files *protoregistry.Files, name string) (protoreflect.MethodDescriptor, error) {
+	var found protoreflect.MethodDescriptor
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		services := fd.Services()
+		for i := 0; i < services.Len() && found == nil; i++ {
+			sd := services.Get(i)
+			methods := sd.Methods()
+			for j := 0; j < methods.Len(); j++ {
+				md := methods.Get(j)
+				if name == string(sd.Name())+"."+string(md.Name()) || name == string(md.FullName()) {
+					found = md
+					break
+				}
+			}
+		}
+		return found == nil
+	})
+	if found == nil {
+		return nil, fmt.Errorf("method %s not found in the descriptors", name)
+	}
+	return found, nil
+}
+
+func (c *cli) ping(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("ping", flag.ContinueOnError)
+	count := fs.Int("count", 3, "number of pings")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	var target peer.AddrInfo
+	switch fs.NArg() {
+	case 0:
+		t, err := c.target()
+		if err != nil {
+			return err
+		}
+		target = t
+	case 1:
+		info, err := peer.AddrInfoFromString(fs.Arg(0))
+		if err != nil {
+			return fmt.Errorf("invalid peer address %s: %w", fs.Arg(0), err)
+		}
+		target = *info
+	default:
+		return errUsage
+	}
+
+	h, err := discovery.NewHost(discovery.DefaultConfig(c.hostOptions()...).Host)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	if err := h.Connect(ctx, target); err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", target.ID, err)
+	}
+
+	pingCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := ping.Ping(pingCtx, h, target.ID)
+
+	rtts := make([]time.Duration, 0, *count)
+	for len(rtts) < *count {
+		res, ok := <-results
+		if !ok {
+			return ctx.Err()
+		}
+		if res.Error != nil {
+			return res.Error
+		}
+		rtts = append(rtts, res.RTT)
+		if !c.json {
+			fmt.Fprintf(c.out, "%s: time=%s\n", target.ID, res.RTT)
+		}
+	}
+	if c.json {
+		return c.printJSON(pingResult{Peer: target.ID.String(), RTTs: rtts})
+	}
+	return nil
+}
+
+func (c *cli) discover(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("discover", flag.ContinueOnError)
+	wait := fs.Duration("wait", 10*time.Second, "how long to look for providers")
+	topic, err := parseTopic(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(c.peers) == 0 {
+		return errors.New("discover needs at least one -peer to join the network")
+	}
+
+	node, err := c.newNode(ctx, discovery.WithPeerExchange(false))
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	connected := 0
+	for _, info := range c.peers {
+		if err := node.Host().Connect(ctx, info); err != nil {
+			fmt.Fprintf(os.Stderr, "p2pdisc: failed to connect to %s: %v\n", info.ID, err)
+			continue
+		}
+		connected++
+	}
+	if connected == 0 {
+		return errors.New("could not connect to any -peer")
+	}
+
+	if err := node.WatchService(topic); err != nil {
+		return err
+	}
+
+	// Give the DHT and pubsub a moment to see the connections before the
+	// first lookup, then look again until the wait is over
+	waitCtx, cancel := context.WithTimeout(ctx, *wait)
+	defer cancel()
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-waitCtx.Done():
+			find := node.FindPeers
+			if service.IsProtocolRange(topic) {
+				find = node.FindCompatiblePeers
+			}
+			peers, err := find(topic)
+			if err != nil {
+				return err
+			}
+			return c.printPeers(peers)
+		case <-ticker.C:
+			node.Refresh(topic)
+		}
+	}
+}
+
+func parseTopic(fs *flag.FlagSet, args []string) (string, error) {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return "", errUsage
+	}
+	return fs.Arg(0), nil
+}
+
+// target returns the single node named with -peer
+func (c *cli) target() (peer.AddrInfo, error) {
+	if len(c.peers) != 1 {
+		return peer.AddrInfo{}, errors.New("exactly one -peer is required")
+	}
+	return c.peers[0], nil
+}
+
+// genPSK saves a new private network key, which the nodes load with their
+// PSK file setting
+func (c *cli) genPSK(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	psk, err := discovery.GeneratePSK()
+	if err != nil {
+		return err
+	}
+	if err := discovery.SavePSK(args[0], psk); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Saved private network key to %s\n", args[0])
+	return nil
+}
+
+// listenAddrs are random ports, as the CLI only dials out. Private networks
+// cannot use QUIC, so they only listen on TCP.
+var (
+	listenAddrs        = []string{"/ip4/0.0.0.0/tcp/0", "/ip4/0.0.0.0/udp/0/quic-v1"}
+	privateListenAddrs = []string{"/ip4/0.0.0.0/tcp/0"}
+)
+
+// hostOptions configure the CLI's host, in the private network of -psk if set
+func (c *cli) hostOptions() []discovery.Option {
+	if c.pskFile == "" {
+		return []discovery.Option{discovery.WithListenAddrs(listenAddrs...)}
+	}
+	return []discovery.Option{discovery.WithListenAddrs(privateListenAddrs...), discovery.WithPSKFile(c.pskFile)}
+}
+
+// newNode starts a short-lived discovery node on a fresh host
+func (c *cli) newNode(ctx context.Context, opts ...discovery.Option) (*discovery.ServiceNode, error) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if c.verbose {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+
+	opts = append(opts, c.hostOptions()...)
+	opts = append(opts, discovery.WithLogger(logger))
+	return discovery.NewNode(ctx, opts...)
+}
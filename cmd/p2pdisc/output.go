@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/jibuji/p2p-service-discover/pkg/types"
+)
+
+type peerResult struct {
+	ID        string    `json:"id"`
+	Addrs     []string  `json:"addrs"`
+	LastSeen  time.Time `json:"last_seen"`
+	Protocols []string  `json:"protocols,omitempty"`
+}
+
+type checkResult struct {
+	Peer     string `json:"peer"`
+	Topic    string `json:"topic"`
+	Provides bool   `json:"provides"`
+}
+
+type serviceResult struct {
+	Protocol   string            `json:"protocol"`
+	Version    string            `json:"version,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Registered time.Time         `json:"registered"`
+	Handler    bool              `json:"handler"`
+	Advertised bool              `json:"advertised"`
+}
+
+type pingResult struct {
+	Peer string          `json:"peer"`
+	RTTs []time.Duration `json:"-"`
+}
+
+func (r pingResult) MarshalJSON() ([]byte, error) {
+	ms := make([]float64, len(r.RTTs))
+	for i, rtt := range r.RTTs {
+		ms[i] = float64(rtt) / float64(time.Millisecond)
+	}
+	return json.Marshal(struct {
+		Peer  string    `json:"peer"`
+		RTTMs []float64 `json:"rtt_ms"`
+	}{r.Peer, ms})
+}
+
+func (c *cli) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (c *cli) printPeers(peers []types.PeerInfo) error {
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+
+	if c.json {
+		results := make([]peerResult, len(peers))
+		for i, p := range peers {
+			results[i] = peerResult{ID: p.ID.String(), Addrs: p.Addrs, LastSeen: p.LastSeen, Protocols: p.Protocols}
+			if results[i].Addrs == nil {
+				results[i].Addrs = []string{}
+			}
+		}
+		return c.printJSON(results)
+	}
+
+	// Versions are only known for protocol ranges
+	versions := false
+	for _, p := range peers {
+		versions = versions || len(p.Protocols) > 0
+	}
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	if versions {
+		fmt.Fprintln(w, "PEER\tLAST SEEN\tPROTOCOLS\tADDRESSES")
+	} else {
+		fmt.Fprintln(w, "PEER\tLAST SEEN\tADDRESSES")
+	}
+	for _, p := range peers {
+		if versions {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.ID, p.LastSeen.Format(time.RFC3339), strings.Join(p.Protocols, ","), strings.Join(p.Addrs, ","))
+		} else {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", p.ID, p.LastSeen.Format(time.RFC3339), strings.Join(p.Addrs, ","))
+		}
+	}
+	return w.Flush()
+}
+
+func (c *cli) printServices(services []types.ServiceDescription) error {
+	if c.json {
+		results := make([]serviceResult, len(services))
+		for i, s := range services {
+			results[i] = serviceResult{
+				Protocol:   s.Protocol,
+				Version:    s.Version,
+				Metadata:   s.Metadata,
+				Registered: s.Registered,
+				Handler:    s.Handler,
+				Advertised: s.Advertised,
+			}
+		}
+		return c.printJSON(results)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROTOCOL\tVERSION\tHANDLER\tADVERTISED\tREGISTERED\tMETADATA")
+	for _, s := range services {
+		metadata := make([]string, 0, len(s.Metadata))
+		for k, v := range s.Metadata {
+			metadata = append(metadata, k+"="+v)
+		}
+		sort.Strings(metadata)
+		fmt.Fprintf(w, "%s\t%s\t%t\t%t\t%s\t%s\n", s.Protocol, s.Version, s.Handler, s.Advertised,
+			s.Registered.Format(time.RFC3339), strings.Join(metadata, ","))
+	}
+	return w.Flush()
+}
+
+// printMessage prints a response as JSON, with the fields left at their zero
+// value. protojson varies its whitespace, so the output is indented again.
+func (c *cli) printMessage(m proto.Message) error {
+	b, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(m)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, b, "", "  "); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err = buf.WriteTo(c.out)
+	return err
+}
+
+func (c *cli) printCheck(p peer.ID, topic string, provides bool) error {
+	if c.json {
+		return c.printJSON(checkResult{Peer: p.String(), Topic: topic, Provides: provides})
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tTOPIC\tPROVIDERS KNOWN")
+	fmt.Fprintf(w, "%s\t%s\t%t\n", p, topic, provides)
+	return w.Flush()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/jibuji/p2p-service-discover/pkg/discovery"
+)
+
+// defaultListenAddrs are listened on when the file sets neither
+// host.listen_addrs nor host.transports, so the node keeps its port across
+// restarts. Private networks do not support QUIC and listen on TCP only.
+var defaultListenAddrs = []string{"/ip4/0.0.0.0/tcp/4001", "/ip4/0.0.0.0/udp/4001/quic-v1"}
+
+// config is the daemon configuration file: the node settings read by
+// discovery.LoadAppConfig and the daemon's own
+type config struct {
+	node *discovery.Config
+	daemonConfig
+}
+
+// daemonConfig holds the settings of the daemon itself, read from the
+// top-level keys next to the node's
+type daemonConfig struct {
+	Bootstrap []string `yaml:"bootstrap"`
+	Topics    struct {
+		// Advertise lists the topics the node provides
+		Advertise []string `yaml:"advertise"`
+		// Watch lists the topics whose providers are discovered only
+		Watch []string `yaml:"watch"`
+	} `yaml:"topics"`
+	Metrics struct {
+		Addr string `yaml:"addr"`
+	} `yaml:"metrics"`
+	Log struct {
+		Level  string `yaml:"level"`
+		Format string `yaml:"format"`
+	} `yaml:"log"`
+}
+
+// loadConfig reads the configuration at path over the defaults. The node
+// settings may be overridden by P2PDISCOVER_* environment variables.
+func loadConfig(path string) (*config, error) {
+	cfg := &config{}
+	cfg.Log.Level = "info"
+	cfg.Log.Format = "text"
+
+	node, err := discovery.LoadAppConfig(path, &cfg.daemonConfig, withDefaultListenAddrs)
+	if err != nil {
+		return nil, err
+	}
+	cfg.node = node
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func withDefaultListenAddrs(c *discovery.Config) {
+	if len(c.Host.ListenAddrs) > 0 || len(c.Host.Transports) > 0 {
+		return
+	}
+	c.Host.ListenAddrs = slices.Clone(defaultListenAddrs)
+	if len(c.Host.PSK) > 0 || c.Host.PSKFile != "" || c.Host.PSKEnv != "" {
+		c.Host.ListenAddrs = slices.DeleteFunc(c.Host.ListenAddrs, func(addr string) bool {
+			return strings.Contains(addr, "/quic")
+		})
+	}
+}
+
+// validate checks the daemon settings; the node settings are checked by
+// discovery.LoadAppConfig
+func (c *config) validate() error {
+	if _, err := parseLevel(c.Log.Level); err != nil {
+		return err
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		return fmt.Errorf("log.format must be text or json, got %q", c.Log.Format)
+	}
+	if _, err := c.bootstrapPeers(); err != nil {
+		return err
+	}
+	for _, topic := range c.Topics.Watch {
+		if slices.Contains(c.Topics.Advertise, topic) {
+			return fmt.Errorf("topic %s is both advertised and watched", topic)
+		}
+	}
+	return nil
+}
+
+// bootstrapPeers parses the bootstrap addresses, which must include /p2p/
+func (c *config) bootstrapPeers() ([]peer.AddrInfo, error) {
+	peers := make([]peer.AddrInfo, 0, len(c.Bootstrap))
+	for _, s := range c.Bootstrap {
+		info, err := peer.AddrInfoFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap address %s: %w", s, err)
+		}
+		peers = append(peers, *info)
+	}
+	return peers, nil
+}
+
+// topics returns the configured topics, mapped to whether they are advertised
+func (c *config) topics() map[string]bool {
+	topics := make(map[string]bool)
+	for _, t := range c.Topics.Watch {
+		topics[t] = false
+	}
+	for _, t := range c.Topics.Advertise {
+		topics[t] = true
+	}
+	return topics
+}
+
+// restartRequired lists the settings that differ from old and only take
+// effect on restart: node settings by their Config field name, then metrics
+// and log.format
+func (c *config) restartRequired(old *config) []string {
+	var changed []string
+	cur, prev := reflect.ValueOf(c.node).Elem(), reflect.ValueOf(old.node).Elem()
+	for i := 0; i < cur.NumField(); i++ {
+		if !reflect.DeepEqual(cur.Field(i).Interface(), prev.Field(i).Interface()) {
+			changed = append(changed, cur.Type().Field(i).Name)
+		}
+	}
+	if c.Metrics != old.Metrics {
+		changed = append(changed, "metrics")
+	}
+	if c.Log.Format != old.Log.Format {
+		changed = append(changed, "log.format")
+	}
+	return changed
+}
+
+func parseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log.level %q", s)
+	}
+	return level, nil
+}
+
+func newLogger(format string, level *slog.LevelVar) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if strings.EqualFold(format, "json") {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
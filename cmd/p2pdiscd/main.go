@@ -0,0 +1,227 @@
+// Command p2pdiscd runs a long-lived service discovery node configured from a
+// YAML file. It can serve as a bootstrap, rendezvous or peer exchange node.
+// The file holds the keys read by discovery.LoadConfig, which P2PDISCOVER_*
+// environment variables override, and the daemon's bootstrap, topics,
+// metrics and log keys.
+//
+// SIGINT and SIGTERM shut the node down. SIGHUP reloads the configuration:
+// topics, bootstrap peers and the log level are applied in place, other
+// changes are reported and need a restart.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+
+	"github.com/jibuji/p2p-service-discover/internal/logging"
+	"github.com/jibuji/p2p-service-discover/pkg/discovery"
+	"github.com/jibuji/p2p-service-discover/pkg/metrics"
+)
+
+// bootstrapInterval is how often disconnected bootstrap peers are redialed
+const bootstrapInterval = time.Minute
+
+type daemon struct {
+	path    string
+	logger  *slog.Logger
+	level   *slog.LevelVar
+	limiter *logging.Limiter
+	host    host.Host
+	node    *discovery.ServiceNode
+
+	mu  sync.Mutex
+	cfg *config
+}
+
+func main() {
+	path := flag.String("config", "p2pdiscd.yaml", "path to the configuration file")
+	flag.Parse()
+
+	if err := run(*path); err != nil {
+		fmt.Fprintln(os.Stderr, "p2pdiscd:", err)
+		os.Exit(1)
+	}
+}
+
+func run(path string) error {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	level := new(slog.LevelVar)
+	lvl, _ := parseLevel(cfg.Log.Level)
+	level.Set(lvl)
+	logger := newLogger(cfg.Log.Format, level)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	d := &daemon{
+		path:    path,
+		logger:  logger,
+		level:   level,
+		limiter: logging.NewLimiter(30 * time.Minute),
+		cfg:     cfg,
+	}
+	if err := d.start(ctx); err != nil {
+		return err
+	}
+	defer d.node.Close()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	go d.bootstrapLoop(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("Shutting down")
+			return nil
+		case <-hup:
+			d.reload()
+		}
+	}
+}
+
+func (d *daemon) start(ctx context.Context) error {
+	cfg := d.cfg
+
+	// The loaded configuration is kept unchanged to compare on reload
+	nodeCfg := *cfg.node
+	nodeCfg.Logger = d.logger
+
+	var reg *prometheus.Registry
+	if cfg.Metrics.Addr != "" {
+		reg = prometheus.NewRegistry()
+		reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+		nodeCfg.MetricsRegisterer = reg
+	}
+
+	node, err := discovery.NewNodeFromConfig(ctx, &nodeCfg)
+	if err != nil {
+		return err
+	}
+	d.node = node
+	d.host = node.Host()
+
+	if reg != nil {
+		go func() {
+			if err := metrics.ListenAndServe(ctx, cfg.Metrics.Addr, reg); err != nil {
+				d.logger.Error("Metrics server stopped", "error", err)
+			}
+		}()
+	}
+
+	for _, addr := range d.host.Addrs() {
+		d.logger.Info("Listening", "addr", fmt.Sprintf("%s/p2p/%s", addr, d.host.ID()))
+	}
+
+	d.connectBootstrap(ctx)
+	d.applyTopics(nil, cfg.topics())
+	return nil
+}
+
+// reload rereads the configuration file and applies what can change at
+// runtime
+func (d *daemon) reload() {
+	cfg, err := loadConfig(d.path)
+	if err != nil {
+		d.logger.Error("Reload failed, keeping current configuration", "error", err)
+		return
+	}
+
+	d.mu.Lock()
+	old := d.cfg
+	d.cfg = cfg
+	d.mu.Unlock()
+
+	lvl, _ := parseLevel(cfg.Log.Level)
+	d.level.Set(lvl)
+	d.applyTopics(old.topics(), cfg.topics())
+	if changed := cfg.restartRequired(old); len(changed) > 0 {
+		d.logger.Warn("Some settings changed and need a restart", "settings", changed)
+	}
+	d.logger.Info("Configuration reloaded")
+}
+
+// applyTopics moves the node from the old topic set to the new one
+func (d *daemon) applyTopics(old, topics map[string]bool) {
+	for topic, advertise := range old {
+		if now, ok := topics[topic]; ok && now == advertise {
+			continue
+		}
+		if err := d.node.UnregisterService(topic); err != nil {
+			d.logger.Warn("Failed to unregister topic", logging.KeyTopic, topic, "error", err)
+		}
+	}
+
+	for topic, advertise := range topics {
+		if was, ok := old[topic]; ok && was == advertise {
+			continue
+		}
+		register := d.node.WatchService
+		if advertise {
+			register = d.node.RegisterService
+		}
+		if err := register(topic); err != nil {
+			d.logger.Error("Failed to register topic", logging.KeyTopic, topic, "error", err)
+		}
+	}
+}
+
+func (d *daemon) bootstrapLoop(ctx context.Context) {
+	ticker := time.NewTicker(bootstrapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.connectBootstrap(ctx)
+		}
+	}
+}
+
+// connectBootstrap dials the bootstrap peers the host is not connected to
+func (d *daemon) connectBootstrap(ctx context.Context) {
+	d.mu.Lock()
+	peers, _ := d.cfg.bootstrapPeers()
+	d.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, info := range peers {
+		if info.ID == d.host.ID() || d.host.Network().Connectedness(info.ID) == network.Connected {
+			continue
+		}
+		wg.Add(1)
+		go func(info peer.AddrInfo) {
+			defer wg.Done()
+			dialCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			defer cancel()
+			if err := d.host.Connect(dialCtx, info); err != nil {
+				d.limiter.Log(d.logger, slog.LevelWarn, "bootstrap:"+info.ID.String(),
+					"Failed to connect to bootstrap peer", logging.KeyPeer, info.ID, "error", err)
+				return
+			}
+			d.logger.Info("Connected to bootstrap peer", logging.KeyPeer, info.ID)
+		}(info)
+	}
+	wg.Wait()
+}
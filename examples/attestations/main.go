@@ -0,0 +1,129 @@
+// Command attestations shows provider attestations. An authority attests
+// one of two calculator providers; a watcher trusting the authority for the
+// calculator topic discovers only that provider, through announcements and
+// through peer exchange, while a node without the policy sees both.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto/service"
+	"github.com/jibuji/p2p-service-discover/pkg/discovery"
+	baseservice "github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func main() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	dir, err := os.MkdirTemp("", "attestations")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	authority, err := baseservice.NewAuthority(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The provider's identity is created first, so the authority can attest
+	// its peer ID
+	keyFile := filepath.Join(dir, "provider.key")
+	providerKey, err := discovery.LoadIdentity(keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	providerID, err := peer.IDFromPrivateKey(providerKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	att, err := authority.Attest(baseservice.Attestation{
+		Subject: providerID,
+		Topics:  []string{service.CalculatorProtocolID},
+		Expires: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	common := []discovery.Option{
+		discovery.WithDHT(false),
+		discovery.WithAnnounceInterval(2 * time.Second),
+		discovery.WithListenAddrs("/ip4/127.0.0.1/tcp/0"),
+	}
+	newNode := func(opts ...discovery.Option) *discovery.ServiceNode {
+		node, err := discovery.NewNode(ctx, append(common, opts...)...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return node
+	}
+
+	attested := newNode(discovery.WithIdentityFile(keyFile), discovery.WithAttestations(att))
+	defer attested.Close()
+	unattested := newNode()
+	defer unattested.Close()
+	for _, p := range []*discovery.ServiceNode{attested, unattested} {
+		if err := p.RegisterServiceHandler(service.NewCalculatorService()); err != nil {
+			log.Fatal(err)
+		}
+	}
+	fmt.Printf("Attested provider:   %s\n", attested.Host().ID())
+	fmt.Printf("Unattested provider: %s\n", unattested.Host().ID())
+
+	open := newNode()
+	defer open.Close()
+	watcher := newNode(discovery.WithProviderAuthorities(service.CalculatorProtocolID, authority.ID()))
+	defer watcher.Close()
+
+	for _, n := range []*discovery.ServiceNode{open, watcher} {
+		for _, p := range []*discovery.ServiceNode{attested, unattested} {
+			if err := n.Host().Connect(ctx, peer.AddrInfo{ID: p.Host().ID(), Addrs: p.Host().Addrs()}); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := n.WatchService(service.CalculatorProtocolID); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := watcher.Host().Connect(ctx, peer.AddrInfo{ID: open.Host().ID(), Addrs: open.Host().Addrs()}); err != nil {
+		log.Fatal(err)
+	}
+
+	// Give the providers a few announcement intervals
+	time.Sleep(6 * time.Second)
+	for _, c := range []struct {
+		name string
+		node *discovery.ServiceNode
+	}{{"Node without a policy", open}, {"Watcher", watcher}} {
+		peers, err := c.node.FindPeers(service.CalculatorProtocolID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s discovered %d provider(s)\n", c.name, len(peers))
+		for _, p := range peers {
+			fmt.Printf("  %s (attested: %t)\n", p.ID, p.Attestation != "")
+		}
+	}
+
+	// The node without a policy passes on both providers; the watcher drops
+	// the one without an attestation
+	infos, err := watcher.FetchPeerList(ctx, open.Host().ID(), service.CalculatorProtocolID, 0, 10)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Watcher kept %d provider(s) from peer exchange\n", len(infos))
+}
@@ -13,7 +13,6 @@ import (
 	"github.com/jibuji/p2p-service-discover/examples/calculator/proto"
 	"github.com/jibuji/p2p-service-discover/examples/calculator/proto/service"
 	"github.com/jibuji/p2p-service-discover/pkg/discovery"
-	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
@@ -22,13 +21,7 @@ func main() {
 	defer cancel()
 
 	// Create first node (service provider)
-	host1, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	config := discovery.DefaultConfig()
-	node1, err := discovery.NewServiceNode(ctx, host1, *config)
+	node1, err := discovery.NewNode(ctx, discovery.WithListenAddrs("/ip4/127.0.0.1/tcp/0"))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -49,12 +42,7 @@ func main() {
 	)
 
 	// Create second node (client)
-	host2, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	node2, err := discovery.NewServiceNode(ctx, host2, *config)
+	node2, err := discovery.NewNode(ctx, discovery.WithListenAddrs("/ip4/127.0.0.1/tcp/0"))
 	if err != nil {
 		log.Fatal(err)
 	}
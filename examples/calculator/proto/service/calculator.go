@@ -26,6 +26,11 @@ func (s *CalculatorService) RegisterWithPeer(peer *srpc.RpcPeer) {
 	proto.RegisterCalculatorServer(peer, s)
 }
 
+// Servers implements ServerProvider interface
+func (s *CalculatorService) Servers() map[string]interface{} {
+	return map[string]interface{}{"Calculator": s}
+}
+
 func (s *CalculatorService) Add(ctx context.Context, req *proto.AddRequest) *proto.AddResponse {
 	result := req.A + req.B
 	return &proto.AddResponse{Result: result}
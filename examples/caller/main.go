@@ -0,0 +1,123 @@
+// Command caller shows handlers reading the identity of the calling peer.
+// The provider prints who makes each call and gives every peer two
+// multiplications.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	rpc "github.com/jibuji/go-stream-rpc"
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto"
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto/service"
+	"github.com/jibuji/p2p-service-discover/pkg/discovery"
+	baseservice "github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// quotaCalculator allows each peer a fixed number of multiplications
+type quotaCalculator struct {
+	proto.UnimplementedCalculatorServer
+	*baseservice.BaseService
+
+	mu    sync.Mutex
+	quota int
+	used  map[peer.ID]int
+}
+
+func newQuotaCalculator(quota int) *quotaCalculator {
+	svc := &quotaCalculator{quota: quota, used: make(map[peer.ID]int)}
+	svc.BaseService = baseservice.NewBaseService(service.CalculatorProtocolID, svc)
+	return svc
+}
+
+// RegisterWithPeer implements RPCService interface
+func (s *quotaCalculator) RegisterWithPeer(peer *rpc.RpcPeer) {
+	proto.RegisterCalculatorServer(peer, s)
+}
+
+// Servers implements ServerProvider interface
+func (s *quotaCalculator) Servers() map[string]interface{} {
+	return map[string]interface{}{"Calculator": s}
+}
+
+func (s *quotaCalculator) Add(ctx context.Context, req *proto.AddRequest) *proto.AddResponse {
+	if caller, ok := discovery.CallerFromContext(ctx); ok {
+		fmt.Printf("  Add from %s at %s over %s, %s connection\n", short(caller.Peer), caller.Addr, caller.Protocol, caller.Direction)
+	}
+	return &proto.AddResponse{Result: req.A + req.B}
+}
+
+func (s *quotaCalculator) Multiply(ctx context.Context, req *proto.MultiplyRequest) *proto.MultiplyResponse {
+	p, ok := discovery.PeerFromContext(ctx)
+	if !ok {
+		return &proto.MultiplyResponse{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.used[p] >= s.quota {
+		fmt.Printf("  Multiply from %s: quota used up\n", short(p))
+		return &proto.MultiplyResponse{}
+	}
+	s.used[p]++
+	return &proto.MultiplyResponse{Result: req.A * req.B}
+}
+
+func short(id peer.ID) string {
+	s := id.String()
+	return s[len(s)-6:]
+}
+
+func main() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	common := []discovery.Option{
+		discovery.WithDHT(false),
+		discovery.WithListenAddrs("/ip4/127.0.0.1/tcp/0"),
+	}
+	provider, err := discovery.NewNode(ctx, common...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer provider.Close()
+	if err := provider.RegisterServiceHandler(newQuotaCalculator(2)); err != nil {
+		log.Fatal(err)
+	}
+	providerInfo := peer.AddrInfo{ID: provider.Host().ID(), Addrs: provider.Host().Addrs()}
+
+	for i := 1; i <= 2; i++ {
+		client, err := discovery.NewNode(ctx, common...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer client.Close()
+		if err := client.Host().Connect(ctx, providerInfo); err != nil {
+			log.Fatal(err)
+		}
+		client.Registry().RegisterClientConstructor(
+			service.CalculatorProtocolID,
+			func(peer *rpc.RpcPeer) interface{} {
+				return proto.NewCalculatorClient(peer)
+			},
+		)
+		c, err := client.NewServiceClient(ctx, service.CalculatorProtocolID, provider.Host().ID())
+		if err != nil {
+			log.Fatal(err)
+		}
+		calc := c.(*proto.CalculatorClient)
+
+		fmt.Printf("Client %d is %s\n", i, short(client.Host().ID()))
+		if resp := calc.Add(&proto.AddRequest{A: 5, B: 3}); resp != nil {
+			fmt.Printf("5 + 3 = %d\n", resp.Result)
+		}
+		for n := int32(2); n <= 4; n++ {
+			if resp := calc.Multiply(&proto.MultiplyRequest{A: n, B: n}); resp != nil {
+				fmt.Printf("%d * %d = %d\n", n, n, resp.Result)
+			}
+		}
+	}
+}
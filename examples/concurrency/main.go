@@ -0,0 +1,122 @@
+// Command concurrency shows concurrency and resource limits. The provider
+// runs one slow call at a time with room for one more in its queue, so of
+// three calls made together one fails at once. Its resource manager allows
+// two inbound streams of the calculator protocol, so a third stream is
+// reset.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	rpc "github.com/jibuji/go-stream-rpc"
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto"
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto/service"
+	"github.com/jibuji/p2p-service-discover/pkg/discovery"
+	baseservice "github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// slowCalculator takes a second for every call
+type slowCalculator struct {
+	proto.UnimplementedCalculatorServer
+	*baseservice.BaseService
+}
+
+func newSlowCalculator() *slowCalculator {
+	svc := &slowCalculator{}
+	svc.BaseService = baseservice.NewBaseService(service.CalculatorProtocolID, svc)
+	return svc
+}
+
+// RegisterWithPeer implements RPCService interface
+func (s *slowCalculator) RegisterWithPeer(peer *rpc.RpcPeer) {
+	proto.RegisterCalculatorServer(peer, s)
+}
+
+// Servers implements ServerProvider interface
+func (s *slowCalculator) Servers() map[string]interface{} {
+	return map[string]interface{}{"Calculator": s}
+}
+
+func (s *slowCalculator) Add(ctx context.Context, req *proto.AddRequest) *proto.AddResponse {
+	time.Sleep(time.Second)
+	return &proto.AddResponse{Result: req.A + req.B}
+}
+
+func main() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	common := []discovery.Option{
+		discovery.WithDHT(false),
+		discovery.WithListenAddrs("/ip4/127.0.0.1/tcp/0"),
+	}
+	provider, err := discovery.NewNode(ctx, append(common, discovery.WithServiceLimits(service.CalculatorProtocolID, discovery.ServiceLimit{
+		StreamsInbound: 2,
+	}))...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer provider.Close()
+	limits := baseservice.ConcurrencyLimits{
+		Calls:        1,
+		Queue:        1,
+		QueueTimeout: 2 * time.Second,
+	}
+	if err := provider.RegisterServiceHandler(newSlowCalculator(), baseservice.WithConcurrencyLimits(limits)); err != nil {
+		log.Fatal(err)
+	}
+
+	client, err := discovery.NewNode(ctx, common...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Host().Connect(ctx, peer.AddrInfo{ID: provider.Host().ID(), Addrs: provider.Host().Addrs()}); err != nil {
+		log.Fatal(err)
+	}
+	client.Registry().RegisterClientConstructor(
+		service.CalculatorProtocolID,
+		func(peer *rpc.RpcPeer) interface{} {
+			return proto.NewCalculatorClient(peer)
+		},
+	)
+	newCalculator := func() *proto.CalculatorClient {
+		c, err := client.NewServiceClient(ctx, service.CalculatorProtocolID, provider.Host().ID())
+		if err != nil {
+			log.Fatal(err)
+		}
+		return c.(*proto.CalculatorClient)
+	}
+
+	// The first call runs, the second waits for it and the third is rejected
+	calc := newCalculator()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := int32(1); i <= 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Duration(i) * 100 * time.Millisecond)
+			if resp := calc.Add(&proto.AddRequest{A: i, B: i}); resp != nil {
+				fmt.Printf("Call %d: %d + %d = %d after %s\n", i, i, i, resp.Result, time.Since(start).Round(100*time.Millisecond))
+			} else {
+				fmt.Printf("Call %d: rejected after %s\n", i, time.Since(start).Round(100*time.Millisecond))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The first stream is still open, so only one more is accepted
+	for i := 2; i <= 3; i++ {
+		if resp := newCalculator().Add(&proto.AddRequest{A: 1, B: 1}); resp != nil {
+			fmt.Printf("Stream %d: accepted\n", i)
+		} else {
+			fmt.Printf("Stream %d: rejected\n", i)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Command interceptors shows server and client interceptors. The provider
+// logs every call, recovers from panics in its handlers and only serves the
+// first client; the clients log their calls and the first one answers
+// repeated requests from a cache.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	rpc "github.com/jibuji/go-stream-rpc"
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto"
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto/service"
+	"github.com/jibuji/p2p-service-discover/pkg/discovery"
+	baseservice "github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	"github.com/libp2p/go-libp2p/core/peer"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// calculator panics when a product does not fit in an int32
+type calculator struct {
+	proto.UnimplementedCalculatorServer
+	*baseservice.BaseService
+}
+
+func newCalculator() *calculator {
+	svc := &calculator{}
+	svc.BaseService = baseservice.NewBaseService(service.CalculatorProtocolID, svc)
+	return svc
+}
+
+// RegisterWithPeer implements RPCService interface
+func (s *calculator) RegisterWithPeer(peer *rpc.RpcPeer) {
+	proto.RegisterCalculatorServer(peer, s)
+}
+
+// Servers implements ServerProvider interface
+func (s *calculator) Servers() map[string]interface{} {
+	return map[string]interface{}{"Calculator": s}
+}
+
+func (s *calculator) Add(ctx context.Context, req *proto.AddRequest) *proto.AddResponse {
+	return &proto.AddResponse{Result: req.A + req.B}
+}
+
+func (s *calculator) Multiply(ctx context.Context, req *proto.MultiplyRequest) *proto.MultiplyResponse {
+	product := int64(req.A) * int64(req.B)
+	if product > math.MaxInt32 || product < math.MinInt32 {
+		panic("int32 overflow")
+	}
+	return &proto.MultiplyResponse{Result: int32(product)}
+}
+
+// logCalls prints every call the provider dispatches
+func logCalls(ctx context.Context, req protobuf.Message, info *baseservice.CallInfo, handler baseservice.UnaryHandler) (protobuf.Message, error) {
+	resp, err := handler(ctx, req)
+	fmt.Printf("  server: %s from %s, error: %v\n", info.Method, short(info.Peer), err)
+	return resp, err
+}
+
+// recoverPanics turns a panicking handler into a failed call
+func recoverPanics(ctx context.Context, req protobuf.Message, info *baseservice.CallInfo, handler baseservice.UnaryHandler) (resp protobuf.Message, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s panicked: %v", info.Method, r)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// allowOnly answers calls from peers other than allowed without running them
+func allowOnly(allowed peer.ID) baseservice.UnaryServerInterceptor {
+	return func(ctx context.Context, req protobuf.Message, info *baseservice.CallInfo, handler baseservice.UnaryHandler) (protobuf.Message, error) {
+		if info.Peer != allowed {
+			return nil, &rpc.RPCError{Code: baseservice.ErrorCodePermissionDenied, Message: "not allowed"}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// logClientCalls prints every call a client makes
+func logClientCalls(ctx context.Context, req []byte, info *baseservice.CallInfo, invoker baseservice.UnaryInvoker) ([]byte, error) {
+	start := time.Now()
+	resp, err := invoker(ctx, req)
+	fmt.Printf("  client: %s to %s in %s, error: %v\n", info.Method, short(info.Peer), time.Since(start).Round(time.Millisecond), err)
+	return resp, err
+}
+
+// cache answers a request made before with the response it got then
+func cache() baseservice.UnaryClientInterceptor {
+	var mu sync.Mutex
+	responses := make(map[string][]byte)
+	return func(ctx context.Context, req []byte, info *baseservice.CallInfo, invoker baseservice.UnaryInvoker) ([]byte, error) {
+		key := info.Method + "/" + string(req)
+		mu.Lock()
+		resp, ok := responses[key]
+		mu.Unlock()
+		if ok {
+			fmt.Printf("  client: %s answered from the cache\n", info.Method)
+			return resp, nil
+		}
+		resp, err := invoker(ctx, req)
+		if err == nil {
+			mu.Lock()
+			responses[key] = resp
+			mu.Unlock()
+		}
+		return resp, err
+	}
+}
+
+func short(id peer.ID) string {
+	s := id.String()
+	return s[len(s)-6:]
+}
+
+func main() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	common := []discovery.Option{
+		discovery.WithDHT(false),
+		discovery.WithListenAddrs("/ip4/127.0.0.1/tcp/0"),
+	}
+	first, err := discovery.NewNode(ctx, append(common,
+		discovery.WithClientInterceptors(logClientCalls, cache()))...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer first.Close()
+	second, err := discovery.NewNode(ctx, append(common,
+		discovery.WithClientInterceptors(logClientCalls))...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer second.Close()
+
+	provider, err := discovery.NewNode(ctx, append(common,
+		discovery.WithServerInterceptors(logCalls))...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer provider.Close()
+	calc := newCalculator()
+	calc.UseInterceptors(recoverPanics, allowOnly(first.Host().ID()))
+	if err := provider.RegisterServiceHandler(calc); err != nil {
+		log.Fatal(err)
+	}
+	providerInfo := peer.AddrInfo{ID: provider.Host().ID(), Addrs: provider.Host().Addrs()}
+
+	clientOf := func(node *discovery.ServiceNode) *proto.CalculatorClient {
+		if err := node.Host().Connect(ctx, providerInfo); err != nil {
+			log.Fatal(err)
+		}
+		node.Registry().RegisterClientConstructor(
+			service.CalculatorProtocolID,
+			func(peer *rpc.RpcPeer) interface{} {
+				return proto.NewCalculatorClient(peer)
+			},
+		)
+		c, err := node.NewServiceClient(ctx, service.CalculatorProtocolID, provider.Host().ID())
+		if err != nil {
+			log.Fatal(err)
+		}
+		return c.(*proto.CalculatorClient)
+	}
+
+	fmt.Printf("First client %s\n", short(first.Host().ID()))
+	client := clientOf(first)
+	for i := 0; i < 2; i++ {
+		if resp := client.Add(&proto.AddRequest{A: 5, B: 3}); resp != nil {
+			fmt.Printf("5 + 3 = %d\n", resp.Result)
+		}
+	}
+	if resp := client.Multiply(&proto.MultiplyRequest{A: 1 << 20, B: 1 << 20}); resp == nil {
+		fmt.Println("2^20 * 2^20 failed")
+	}
+
+	fmt.Printf("Second client %s\n", short(second.Host().ID()))
+	client = clientOf(second)
+	if resp := client.Add(&proto.AddRequest{A: 5, B: 3}); resp == nil {
+		fmt.Println("5 + 3 failed")
+	}
+}
@@ -2,7 +2,7 @@ package node
 
 import (
 	"fmt"
-	"log"
+	"time"
 
 	libp2p "github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/host"
@@ -15,10 +15,10 @@ func NewNode() (host.Host, error) {
 	connManager, err := connmgr.NewConnManager(
 		100, // Lowwater
 		400, // HighWater
-		connmgr.WithGracePeriod(20),
+		connmgr.WithGracePeriod(20*time.Second),
 	)
 	if err != nil {
-		log.Fatalf("failed to create connection manager: %v", err)
+		return nil, fmt.Errorf("failed to create connection manager: %w", err)
 	}
 
 	// Create a new libp2p Host with a random TCP port
@@ -28,7 +28,7 @@ func NewNode() (host.Host, error) {
 		libp2p.ListenAddrStrings("/ip4/0.0.0.0/tcp/0"),
 	)
 	if err != nil {
-		log.Fatalf("failed to create libp2p host: %v", err)
+		return nil, fmt.Errorf("failed to create libp2p host: %w", err)
 	}
 
 	// Print the host's addresses
@@ -0,0 +1,106 @@
+// Command pexsync shows a node keeping its providers of a topic in sync with
+// another node's through peer exchange. Three providers announce themselves
+// to a hub over pubsub; a client without pubsub syncs with the hub. The
+// first sync returns every provider, the next ones only what changed, with
+// a tombstone for a provider that stopped announcing.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jibuji/p2p-service-discover/pkg/discovery"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const topic = "/storage/1.0.0"
+
+func main() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Providers expire from the hub a few seconds after their last
+	// announcement; the client keeps them for the default TTL, until a
+	// sync removes them
+	common := []discovery.Option{
+		discovery.WithDHT(false),
+		discovery.WithAnnounceInterval(time.Second),
+		discovery.WithPeerTTL(3 * time.Second),
+		discovery.WithListenAddrs("/ip4/127.0.0.1/tcp/0"),
+	}
+	hub, err := discovery.NewNode(ctx, common...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer hub.Close()
+	if err := hub.WatchService(topic); err != nil {
+		log.Fatal(err)
+	}
+	hubInfo := peer.AddrInfo{ID: hub.Host().ID(), Addrs: hub.Host().Addrs()}
+
+	var providers []*discovery.ServiceNode
+	for i := 0; i < 3; i++ {
+		provider, err := discovery.NewNode(ctx, common...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer provider.Close()
+		if err := provider.Host().Connect(ctx, hubInfo); err != nil {
+			log.Fatal(err)
+		}
+		if err := provider.RegisterService(topic); err != nil {
+			log.Fatal(err)
+		}
+		providers = append(providers, provider)
+	}
+	for {
+		if peers, _ := hub.FindPeers(topic); len(peers) == len(providers) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			log.Fatal("providers not announced")
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	client, err := discovery.NewNode(ctx,
+		discovery.WithDHT(false),
+		discovery.WithPubSub(false),
+		discovery.WithListenAddrs("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.WatchService(topic); err != nil {
+		log.Fatal(err)
+	}
+	if err := client.Host().Connect(ctx, hubInfo); err != nil {
+		log.Fatal(err)
+	}
+
+	sync := func(label string) {
+		updated, removed, err := client.SyncPeerList(ctx, hub.Host().ID(), topic)
+		if err != nil {
+			log.Fatal(err)
+		}
+		peers, err := client.FindPeers(topic)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s: %d added or updated, %d removed, %d providers known\n", label, updated, removed, len(peers))
+	}
+
+	sync("First sync")
+	// Right away, the hub has nothing the client does not know
+	sync("Second sync")
+
+	// Once the stopped provider expires from the hub, the sync removes it;
+	// the others come back with the sightings announced in the meantime
+	fmt.Println("Stopping a provider")
+	providers[2].Close()
+	time.Sleep(5 * time.Second)
+	sync("Third sync")
+}
@@ -0,0 +1,104 @@
+// Command pexverify shows a node verifying the providers it learns through
+// peer exchange. Three providers announce themselves to two hubs over
+// pubsub; a client without pubsub syncs with the hubs. The providers stay
+// unverified, and out of FindPeers, until both hubs have sent them.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jibuji/p2p-service-discover/pkg/discovery"
+	"github.com/jibuji/p2p-service-discover/pkg/types"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const topic = "/storage/1.0.0"
+
+func main() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	common := []discovery.Option{
+		discovery.WithDHT(false),
+		discovery.WithAnnounceInterval(time.Second),
+		discovery.WithListenAddrs("/ip4/127.0.0.1/tcp/0"),
+	}
+	var hubs []peer.AddrInfo
+	var hubNodes []*discovery.ServiceNode
+	for i := 0; i < 2; i++ {
+		hub, err := discovery.NewNode(ctx, common...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer hub.Close()
+		if err := hub.WatchService(topic); err != nil {
+			log.Fatal(err)
+		}
+		hubs = append(hubs, peer.AddrInfo{ID: hub.Host().ID(), Addrs: hub.Host().Addrs()})
+		hubNodes = append(hubNodes, hub)
+	}
+
+	const providers = 3
+	for i := 0; i < providers; i++ {
+		provider, err := discovery.NewNode(ctx, common...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer provider.Close()
+		for _, hub := range hubs {
+			if err := provider.Host().Connect(ctx, hub); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := provider.RegisterService(topic); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, hub := range hubNodes {
+		for {
+			if peers, _ := hub.FindPeers(topic); len(peers) == providers {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				log.Fatal("providers not announced")
+			case <-time.After(500 * time.Millisecond):
+			}
+		}
+	}
+
+	// Without probes, a provider is verified once two peers sent it
+	client, err := discovery.NewNode(ctx,
+		discovery.WithDHT(false),
+		discovery.WithPubSub(false),
+		discovery.WithListenAddrs("/ip4/127.0.0.1/tcp/0"),
+		discovery.WithPeerVerification(types.PeerVerification{
+			Reporters:         2,
+			ExcludeUnverified: true,
+		}))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.WatchService(topic); err != nil {
+		log.Fatal(err)
+	}
+
+	for i, hub := range hubs {
+		if err := client.Host().Connect(ctx, hub); err != nil {
+			log.Fatal(err)
+		}
+		updated, _, err := client.SyncPeerList(ctx, hub.ID, topic)
+		if err != nil {
+			log.Fatal(err)
+		}
+		peers, err := client.FindPeers(topic)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Sync with hub %d: %d added or updated, %d verified providers found\n", i+1, updated, len(peers))
+	}
+}
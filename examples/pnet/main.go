@@ -0,0 +1,111 @@
+// Command pnet runs three local nodes to show private networks. The provider
+// and the first client share a pre-shared key, given as a key file and an
+// environment variable; the second client has another key and can neither
+// connect to the provider nor discover it.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto/service"
+	"github.com/jibuji/p2p-service-discover/pkg/discovery"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func main() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	dir, err := os.MkdirTemp("", "pnet")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The network key is saved in the swarm.key format shared with other
+	// libp2p implementations, and also passed as hex in a variable
+	psk, err := discovery.GeneratePSK()
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "swarm.key")
+	if err := discovery.SavePSK(keyFile, psk); err != nil {
+		log.Fatal(err)
+	}
+	os.Setenv("PNET_EXAMPLE_KEY", hex.EncodeToString(psk))
+	otherPSK, err := discovery.GeneratePSK()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	common := []discovery.Option{
+		discovery.WithDHT(false),
+		discovery.WithAnnounceInterval(2 * time.Second),
+		discovery.WithListenAddrs("/ip4/127.0.0.1/tcp/0"),
+		discovery.WithRequirePSK(),
+	}
+
+	// Without a key the node refuses to start
+	if _, err := discovery.NewNode(ctx, common...); err != nil {
+		fmt.Printf("Node without a key: %v\n", err)
+	}
+
+	provider, err := discovery.NewNode(ctx, append(common, discovery.WithPSKFile(keyFile))...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer provider.Close()
+	fmt.Printf("Provider started with ID: %s\n", provider.Host().ID())
+	if err := provider.RegisterServiceHandler(service.NewCalculatorService()); err != nil {
+		log.Fatal(err)
+	}
+	providerInfo := peer.AddrInfo{ID: provider.Host().ID(), Addrs: provider.Host().Addrs()}
+
+	member, err := discovery.NewNode(ctx, append(common, discovery.WithPSKEnv("PNET_EXAMPLE_KEY"))...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer member.Close()
+
+	outsider, err := discovery.NewNode(ctx, append(common, discovery.WithPSK(otherPSK))...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer outsider.Close()
+
+	for _, c := range []struct {
+		name string
+		node *discovery.ServiceNode
+	}{{"Member", member}, {"Outsider", outsider}} {
+		connectCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err := c.node.Host().Connect(connectCtx, providerInfo)
+		cancel()
+		if err != nil {
+			fmt.Printf("%s cannot connect to the provider: %v\n", c.name, err)
+		} else {
+			fmt.Printf("%s connected to the provider\n", c.name)
+		}
+		if err := c.node.WatchService(service.CalculatorProtocolID); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Give the provider a few announcement intervals
+	time.Sleep(6 * time.Second)
+	for _, c := range []struct {
+		name string
+		node *discovery.ServiceNode
+	}{{"Member", member}, {"Outsider", outsider}} {
+		peers, err := c.node.FindPeers(service.CalculatorProtocolID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s discovered %d provider(s)\n", c.name, len(peers))
+	}
+}
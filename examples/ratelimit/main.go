@@ -0,0 +1,98 @@
+// Command ratelimit shows per-peer rate limits. The provider accepts a
+// burst of three calculator calls and two streams from each peer, then one
+// per second; calls over the limit fail at once instead of waiting, and
+// streams over the limit are reset. Peer exchange queries are limited the
+// same way.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	rpc "github.com/jibuji/go-stream-rpc"
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto"
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto/service"
+	"github.com/jibuji/p2p-service-discover/pkg/discovery"
+	baseservice "github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func main() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	common := []discovery.Option{
+		discovery.WithDHT(false),
+		discovery.WithListenAddrs("/ip4/127.0.0.1/tcp/0"),
+	}
+	provider, err := discovery.NewNode(ctx, append(common, discovery.WithPeerExchangeRateLimits(baseservice.RateLimits{
+		PeerStreams: baseservice.RateLimit{Rate: 1, Burst: 3},
+	}))...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer provider.Close()
+	limits := baseservice.RateLimits{
+		PeerStreams: baseservice.RateLimit{Rate: 1, Burst: 2},
+		PeerCalls:   baseservice.RateLimit{Rate: 1, Burst: 3},
+	}
+	if err := provider.RegisterServiceHandler(service.NewCalculatorService(), baseservice.WithRateLimits(limits)); err != nil {
+		log.Fatal(err)
+	}
+
+	client, err := discovery.NewNode(ctx, common...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Host().Connect(ctx, peer.AddrInfo{ID: provider.Host().ID(), Addrs: provider.Host().Addrs()}); err != nil {
+		log.Fatal(err)
+	}
+	client.Registry().RegisterClientConstructor(
+		service.CalculatorProtocolID,
+		func(peer *rpc.RpcPeer) interface{} {
+			return proto.NewCalculatorClient(peer)
+		},
+	)
+
+	c, err := client.NewServiceClient(ctx, service.CalculatorProtocolID, provider.Host().ID())
+	if err != nil {
+		log.Fatal(err)
+	}
+	calc := c.(*proto.CalculatorClient)
+	for i := int32(1); i <= 5; i++ {
+		start := time.Now()
+		if resp := calc.Add(&proto.AddRequest{A: i, B: i}); resp != nil {
+			fmt.Printf("Call %d: %d + %d = %d\n", i, i, i, resp.Result)
+		} else {
+			fmt.Printf("Call %d: rejected after %s\n", i, time.Since(start).Round(time.Millisecond))
+		}
+	}
+
+	// Once the buckets refill, two more streams are accepted and the third
+	// is reset
+	time.Sleep(3 * time.Second)
+	for i := 1; i <= 3; i++ {
+		c, err := client.NewServiceClient(ctx, service.CalculatorProtocolID, provider.Host().ID())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if resp := c.(*proto.CalculatorClient).Add(&proto.AddRequest{A: 1, B: 1}); resp != nil {
+			fmt.Printf("Stream %d: accepted\n", i)
+		} else {
+			fmt.Printf("Stream %d: rejected\n", i)
+		}
+	}
+
+	// Every peer exchange query opens a stream
+	for i := 1; i <= 5; i++ {
+		_, err := client.FetchPeerList(ctx, provider.Host().ID(), service.CalculatorProtocolID, 0, 10)
+		if err != nil {
+			fmt.Printf("Peer exchange query %d: %v\n", i, err)
+		} else {
+			fmt.Printf("Peer exchange query %d: answered\n", i)
+		}
+	}
+}
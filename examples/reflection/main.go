@@ -0,0 +1,100 @@
+// Command reflection shows a node asking another which services it hosts.
+// The provider serves a calculator described with metadata and its protobuf
+// descriptors, and watches and advertises other topics; the client lists
+// them with the reflection protocol and the calculator's methods with the
+// descriptor protocol.
+//
+// p2pdisc calls methods described this way:
+//
+//	p2pdisc -peer <provider> call /calculator/1.0.0 Calculator.Add '{"a":5,"b":3}'
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto"
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto/service"
+	"github.com/jibuji/p2p-service-discover/pkg/discovery"
+	baseservice "github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func main() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	common := []discovery.Option{
+		discovery.WithDHT(false),
+		discovery.WithListenAddrs("/ip4/127.0.0.1/tcp/0"),
+	}
+	// Reflection is off unless enabled; the client does not need it
+	provider, err := discovery.NewNode(ctx, append(common, discovery.WithReflection(true))...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer provider.Close()
+	err = provider.RegisterServiceHandler(service.NewCalculatorService(),
+		baseservice.WithMetadata(map[string]string{
+			"description": "adds and multiplies int32 numbers",
+			"owner":       "math-team",
+		}),
+		baseservice.WithDescriptors(proto.File_examples_calculator_proto_calculator_proto))
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Served elsewhere, or not yet: the provider only advertises the topic
+	if err := provider.RegisterService("/storage/2.1.0"); err != nil {
+		log.Fatal(err)
+	}
+	// Watched topics are not listed
+	if err := provider.WatchService("/chat/1.0.0"); err != nil {
+		log.Fatal(err)
+	}
+
+	client, err := discovery.NewNode(ctx, common...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+	providerInfo := peer.AddrInfo{ID: provider.Host().ID(), Addrs: provider.Host().Addrs()}
+	if err := client.Host().Connect(ctx, providerInfo); err != nil {
+		log.Fatal(err)
+	}
+
+	services, err := client.FetchServices(ctx, provider.Host().ID())
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Provider serves %d protocols:\n", len(services))
+	for _, s := range services {
+		kind := "discovery only"
+		if s.Handler {
+			kind = "stream handler"
+		}
+		fmt.Printf("  %s (version %q): %s, advertised: %t, registered %s ago\n",
+			s.Protocol, s.Version, kind, s.Advertised, time.Since(s.Registered).Round(time.Millisecond))
+		for k, v := range s.Metadata {
+			fmt.Printf("    %s: %s\n", k, v)
+		}
+	}
+
+	files, err := client.FetchDescriptors(ctx, provider.Host().ID(), service.CalculatorProtocolID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s methods:\n", service.CalculatorProtocolID)
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		for i := 0; i < fd.Services().Len(); i++ {
+			sd := fd.Services().Get(i)
+			for j := 0; j < sd.Methods().Len(); j++ {
+				md := sd.Methods().Get(j)
+				fmt.Printf("  %s.%s(%s) returns (%s)\n", sd.Name(), md.Name(), md.Input().FullName(), md.Output().FullName())
+			}
+		}
+		return true
+	})
+}
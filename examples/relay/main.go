@@ -0,0 +1,151 @@
+// Command relay runs three local nodes to show NAT traversal: a public relay,
+// a calculator provider that has no listen addresses and is reachable only
+// through the relay, and a client that discovers the provider's relay
+// address from its announcements and calls it over the relayed connection.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	rpc "github.com/jibuji/go-stream-rpc"
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto"
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto/service"
+	"github.com/jibuji/p2p-service-discover/pkg/discovery"
+	"github.com/jibuji/p2p-service-discover/pkg/types"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+func main() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Only pubsub is used, so the announcements carry the relay addresses
+	common := []discovery.Option{
+		discovery.WithDHT(false),
+		discovery.WithAnnounceInterval(2 * time.Second),
+	}
+
+	// The relay is publicly reachable and offers circuit relay v2. It also
+	// watches the topic so announcements travel through it.
+	relay, err := discovery.NewNode(ctx, append(common,
+		discovery.WithListenAddrs("/ip4/127.0.0.1/tcp/0"),
+		discovery.WithReachability(discovery.ReachabilityPublic),
+		discovery.WithRelayService(),
+	)...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer relay.Close()
+	relayInfo := peer.AddrInfo{ID: relay.Host().ID(), Addrs: relay.Host().Addrs()}
+	relayAddrs, err := peer.AddrInfoToP2pAddrs(&relayInfo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Relay started with ID: %s\n", relay.Host().ID())
+	if err := relay.WatchService(service.CalculatorProtocolID); err != nil {
+		log.Fatal(err)
+	}
+
+	// The provider does not listen at all, as if it were behind a NAT, and
+	// reserves a slot on the relay. AutoRelay only publishes circuit
+	// addresses through the relay's public addresses, so for this local run
+	// the provider adds the loopback one itself.
+	circuitAddr := relayAddrs[0].Encapsulate(multiaddr.StringCast("/p2p-circuit"))
+	provider, err := discovery.NewNode(ctx, append(common,
+		discovery.WithReachability(discovery.ReachabilityPrivate),
+		discovery.WithStaticRelays(relayAddrs[0].String()),
+		discovery.WithLibp2pOptions(
+			libp2p.NoListenAddrs,
+			libp2p.AddrsFactory(func(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+				return append(addrs, circuitAddr)
+			}),
+		),
+	)...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer provider.Close()
+	fmt.Printf("Provider started with ID: %s\n", provider.Host().ID())
+	if err := provider.Host().Connect(ctx, relayInfo); err != nil {
+		log.Fatal(err)
+	}
+	if err := provider.RegisterServiceHandler(service.NewCalculatorService()); err != nil {
+		log.Fatal(err)
+	}
+
+	// The client allows service streams over relayed connections
+	client, err := discovery.NewNode(ctx, append(common,
+		discovery.WithListenAddrs("/ip4/127.0.0.1/tcp/0"),
+		discovery.WithLimitedConns(true),
+	)...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+	fmt.Printf("Client started with ID: %s\n", client.Host().ID())
+	if err := client.Host().Connect(ctx, relayInfo); err != nil {
+		log.Fatal(err)
+	}
+	if err := client.WatchService(service.CalculatorProtocolID); err != nil {
+		log.Fatal(err)
+	}
+	client.Registry().RegisterClientConstructor(
+		service.CalculatorProtocolID,
+		func(peer *rpc.RpcPeer) interface{} {
+			return proto.NewCalculatorClient(peer)
+		},
+	)
+
+	// Wait for an announcement carrying the provider's relay address
+	found, err := waitForRelayedProvider(ctx, client, provider.Host().ID())
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Client discovered provider at: %v\n", found.Addrs)
+
+	c, err := client.NewServiceClient(ctx, service.CalculatorProtocolID, found.ID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	calcClient := c.(*proto.CalculatorClient)
+
+	addResp := calcClient.Add(&proto.AddRequest{A: 5, B: 3})
+	fmt.Printf("5 + 3 = %d (via relay)\n", addResp.Result)
+
+	for _, conn := range client.Host().Network().ConnsToPeer(found.ID) {
+		fmt.Printf("Connection to provider: %s (limited: %t)\n", conn.RemoteMultiaddr(), conn.Stat().Limited)
+	}
+}
+
+func waitForRelayedProvider(ctx context.Context, node *discovery.ServiceNode, id peer.ID) (types.PeerInfo, error) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		peers, err := node.FindPeers(service.CalculatorProtocolID)
+		if err != nil {
+			return types.PeerInfo{}, err
+		}
+		for _, p := range peers {
+			if p.ID != id {
+				continue
+			}
+			for _, addr := range p.Addrs {
+				if strings.Contains(addr, "/p2p-circuit") {
+					return p, nil
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return types.PeerInfo{}, fmt.Errorf("provider not discovered through the relay: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
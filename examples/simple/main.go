@@ -70,7 +70,10 @@ func main() {
 	// config = discovery.DefaultConfig(discovery.WithPeerExchange(false))
 
 	// create libp2p node with tcp port 0, which means the libp2p will choose a random port
-	host1, _ := node.NewNode()
+	host1, err := node.NewNode()
+	if err != nil {
+		log.Fatal(err)
+	}
 	// Create first node (bootstrap node)
 	node1, err := discovery.NewServiceNode(ctx, host1, *config)
 	if err != nil {
@@ -79,7 +82,10 @@ func main() {
 	fmt.Printf("Node 1 (bootstrap) started with ID: %s\n", node1.Host().ID().String())
 
 	// Create second node
-	host2, _ := node.NewNode()
+	host2, err := node.NewNode()
+	if err != nil {
+		log.Fatal(err)
+	}
 	node2, err := discovery.NewServiceNode(ctx, host2, *config)
 	if err != nil {
 		log.Fatal(err)
@@ -87,7 +93,10 @@ func main() {
 	fmt.Printf("Node 2 started with ID: %s\n", node2.Host().ID().String())
 
 	// Create third node
-	host3, _ := node.NewNode()
+	host3, err := node.NewNode()
+	if err != nil {
+		log.Fatal(err)
+	}
 	node3, err := discovery.NewServiceNode(ctx, host3, *config)
 	if err != nil {
 		log.Fatal(err)
@@ -122,7 +131,10 @@ func main() {
 	time.Sleep(5 * time.Second)
 
 	// Create a new node to demonstrate peer fetching
-	host4, _ := node.NewNode()
+	host4, err := node.NewNode()
+	if err != nil {
+		log.Fatal(err)
+	}
 	node4, err := discovery.NewServiceNode(ctx, host4, *config)
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,137 @@
+// Command timeouts shows server-side timeouts. Calculator.Add has a 500ms
+// timeout, after which the client gets an error and the handler's context
+// is cancelled. A stream without calls for two seconds is closed, and a
+// handler's context is cancelled when the client's connection goes away.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	rpc "github.com/jibuji/go-stream-rpc"
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto"
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto/service"
+	"github.com/jibuji/p2p-service-discover/pkg/discovery"
+	baseservice "github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// slowCalculator takes two seconds for every call unless its context is
+// cancelled first
+type slowCalculator struct {
+	proto.UnimplementedCalculatorServer
+	*baseservice.BaseService
+}
+
+func newSlowCalculator() *slowCalculator {
+	svc := &slowCalculator{}
+	svc.BaseService = baseservice.NewBaseService(service.CalculatorProtocolID, svc)
+	return svc
+}
+
+// RegisterWithPeer implements RPCService interface
+func (s *slowCalculator) RegisterWithPeer(peer *rpc.RpcPeer) {
+	proto.RegisterCalculatorServer(peer, s)
+}
+
+// Servers implements ServerProvider interface
+func (s *slowCalculator) Servers() map[string]interface{} {
+	return map[string]interface{}{"Calculator": s}
+}
+
+func (s *slowCalculator) Add(ctx context.Context, req *proto.AddRequest) *proto.AddResponse {
+	if !wait(ctx, "Add") {
+		return &proto.AddResponse{}
+	}
+	return &proto.AddResponse{Result: req.A + req.B}
+}
+
+func (s *slowCalculator) Multiply(ctx context.Context, req *proto.MultiplyRequest) *proto.MultiplyResponse {
+	if !wait(ctx, "Multiply") {
+		return &proto.MultiplyResponse{}
+	}
+	return &proto.MultiplyResponse{Result: req.A * req.B}
+}
+
+func wait(ctx context.Context, method string) bool {
+	start := time.Now()
+	select {
+	case <-time.After(2 * time.Second):
+		return true
+	case <-ctx.Done():
+		fmt.Printf("  %s handler: %v after %s\n", method, ctx.Err(), time.Since(start).Round(100*time.Millisecond))
+		return false
+	}
+}
+
+func main() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	common := []discovery.Option{
+		discovery.WithDHT(false),
+		discovery.WithListenAddrs("/ip4/127.0.0.1/tcp/0"),
+	}
+	provider, err := discovery.NewNode(ctx, common...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer provider.Close()
+	timeouts := baseservice.Timeouts{
+		Call:    5 * time.Second,
+		Methods: map[string]time.Duration{"Calculator.Add": 500 * time.Millisecond},
+		Idle:    2 * time.Second,
+	}
+	if err := provider.RegisterServiceHandler(newSlowCalculator(), baseservice.WithTimeouts(timeouts)); err != nil {
+		log.Fatal(err)
+	}
+	providerInfo := peer.AddrInfo{ID: provider.Host().ID(), Addrs: provider.Host().Addrs()}
+
+	client, err := discovery.NewNode(ctx, common...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Host().Connect(ctx, providerInfo); err != nil {
+		log.Fatal(err)
+	}
+	client.Registry().RegisterClientConstructor(
+		service.CalculatorProtocolID,
+		func(peer *rpc.RpcPeer) interface{} {
+			return proto.NewCalculatorClient(peer)
+		},
+	)
+	newCalculator := func() *proto.CalculatorClient {
+		c, err := client.NewServiceClient(ctx, service.CalculatorProtocolID, provider.Host().ID())
+		if err != nil {
+			log.Fatal(err)
+		}
+		return c.(*proto.CalculatorClient)
+	}
+
+	calc := newCalculator()
+	start := time.Now()
+	if resp := calc.Add(&proto.AddRequest{A: 5, B: 3}); resp == nil {
+		fmt.Printf("Add timed out after %s\n", time.Since(start).Round(100*time.Millisecond))
+	}
+	start = time.Now()
+	if resp := calc.Multiply(&proto.MultiplyRequest{A: 5, B: 3}); resp != nil {
+		fmt.Printf("Multiply: 5 * 3 = %d after %s\n", resp.Result, time.Since(start).Round(100*time.Millisecond))
+	}
+
+	// Left without calls, the stream is closed by the provider
+	time.Sleep(3 * time.Second)
+	if resp := calc.Multiply(&proto.MultiplyRequest{A: 2, B: 2}); resp == nil {
+		fmt.Println("Multiply on the idle stream failed: the provider closed it")
+	}
+
+	// Dropping the connection resets the stream, which cancels the handler
+	calc = newCalculator()
+	go calc.Multiply(&proto.MultiplyRequest{A: 6, B: 7})
+	time.Sleep(300 * time.Millisecond)
+	fmt.Println("Closing the connection during Multiply")
+	client.Host().Network().ClosePeer(provider.Host().ID())
+	time.Sleep(500 * time.Millisecond)
+}
@@ -0,0 +1,121 @@
+// Command tokens shows capability tokens. An authority issues a client a
+// token granting Calculator.Add on the calculator protocol; the provider
+// verifies it when the stream opens and checks every call against it. A
+// client without a token is rejected, calls outside the token's scope are
+// denied, and revoking the token stops further calls.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"time"
+
+	rpc "github.com/jibuji/go-stream-rpc"
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto"
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto/service"
+	"github.com/jibuji/p2p-service-discover/pkg/discovery"
+	baseservice "github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func main() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// The authority's key stays offline in practice; providers only need
+	// its peer ID
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	authority, err := baseservice.NewAuthority(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	verifier, err := baseservice.NewTokenVerifier(authority.ID())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	common := []discovery.Option{
+		discovery.WithDHT(false),
+		discovery.WithListenAddrs("/ip4/127.0.0.1/tcp/0"),
+	}
+	provider, err := discovery.NewNode(ctx, common...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer provider.Close()
+	if err := provider.RegisterServiceHandler(service.NewCalculatorService(), baseservice.WithTokens(verifier)); err != nil {
+		log.Fatal(err)
+	}
+	providerInfo := peer.AddrInfo{ID: provider.Host().ID(), Addrs: provider.Host().Addrs()}
+
+	newClient := func() *discovery.ServiceNode {
+		client, err := discovery.NewNode(ctx, common...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := client.Host().Connect(ctx, providerInfo); err != nil {
+			log.Fatal(err)
+		}
+		client.Registry().RegisterClientConstructor(
+			service.CalculatorProtocolID,
+			func(peer *rpc.RpcPeer) interface{} {
+				return proto.NewCalculatorClient(peer)
+			},
+		)
+		return client
+	}
+
+	// A client with a token for Calculator.Add on this provider only
+	member := newClient()
+	defer member.Close()
+	token, err := authority.Issue(baseservice.Token{
+		Subject:  member.Host().ID(),
+		Audience: []peer.ID{provider.Host().ID()},
+		Scopes: []baseservice.Scope{
+			{Protocol: service.CalculatorProtocolID, Methods: []string{"Calculator.Add"}},
+		},
+		Expires: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	member.Registry().RegisterClientToken(service.CalculatorProtocolID, token)
+
+	c, err := member.NewServiceClient(ctx, service.CalculatorProtocolID, provider.Host().ID())
+	if err != nil {
+		log.Fatal(err)
+	}
+	calc := c.(*proto.CalculatorClient)
+	if resp := calc.Add(&proto.AddRequest{A: 5, B: 3}); resp != nil {
+		fmt.Printf("With token: 5 + 3 = %d\n", resp.Result)
+	}
+	if resp := calc.Multiply(&proto.MultiplyRequest{A: 5, B: 3}); resp == nil {
+		fmt.Println("With token: Multiply is outside the token's scope and was denied")
+	}
+
+	parsed, err := baseservice.ParseToken(token)
+	if err != nil {
+		log.Fatal(err)
+	}
+	verifier.Revoke(parsed.ID)
+	if resp := calc.Add(&proto.AddRequest{A: 1, B: 1}); resp == nil {
+		fmt.Println("After revocation: Add was denied on the open stream")
+	}
+
+	// A client without a token cannot use the service at all
+	outsider := newClient()
+	defer outsider.Close()
+	c, err = outsider.NewServiceClient(ctx, service.CalculatorProtocolID, provider.Host().ID())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if resp := c.(*proto.CalculatorClient).Add(&proto.AddRequest{A: 5, B: 3}); resp == nil {
+		fmt.Println("Without token: the stream was rejected")
+	}
+}
@@ -0,0 +1,129 @@
+// Command versions shows discovery and negotiation of protocol versions.
+// One provider serves /calculator/1.0.0, another /calculator/1.2.0 and, for
+// older clients, 1.0.0 as well. A client watching /calculator/^1.0 finds
+// both and talks to each of them over the highest version it supports.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	rpc "github.com/jibuji/go-stream-rpc"
+	"github.com/jibuji/p2p-service-discover/examples/calculator/proto"
+	"github.com/jibuji/p2p-service-discover/pkg/discovery"
+	baseservice "github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	"github.com/jibuji/p2p-service-discover/pkg/types"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const calculatorRange = "/calculator/^1.0"
+
+// calculator reports the version each call was made over
+type calculator struct {
+	proto.UnimplementedCalculatorServer
+	*baseservice.BaseService
+}
+
+func newCalculator(protocolID string, older ...string) *calculator {
+	svc := &calculator{}
+	svc.BaseService = baseservice.NewBaseService(protocolID, svc)
+	svc.AddProtocols(older...)
+	return svc
+}
+
+// RegisterWithPeer implements RPCService interface
+func (s *calculator) RegisterWithPeer(peer *rpc.RpcPeer) {
+	proto.RegisterCalculatorServer(peer, s)
+}
+
+// Servers implements ServerProvider interface
+func (s *calculator) Servers() map[string]interface{} {
+	return map[string]interface{}{"Calculator": s}
+}
+
+func (s *calculator) Add(ctx context.Context, req *proto.AddRequest) *proto.AddResponse {
+	if caller, ok := discovery.CallerFromContext(ctx); ok {
+		fmt.Printf("  Add served over %s\n", caller.Protocol)
+	}
+	return &proto.AddResponse{Result: req.A + req.B}
+}
+
+func short(id peer.ID) string {
+	s := id.String()
+	return s[len(s)-6:]
+}
+
+func main() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	common := []discovery.Option{
+		discovery.WithDHT(false),
+		discovery.WithAnnounceInterval(time.Second),
+		discovery.WithListenAddrs("/ip4/127.0.0.1/tcp/0"),
+	}
+	handlers := []*calculator{
+		newCalculator("/calculator/1.0.0"),
+		newCalculator("/calculator/1.2.0", "/calculator/1.0.0"),
+	}
+	var providers []peer.AddrInfo
+	for _, handler := range handlers {
+		provider, err := discovery.NewNode(ctx, common...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer provider.Close()
+		if err := provider.RegisterServiceHandler(handler); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Provider %s serves %v\n", short(provider.Host().ID()), handler.Protocols())
+		providers = append(providers, peer.AddrInfo{ID: provider.Host().ID(), Addrs: provider.Host().Addrs()})
+	}
+
+	client, err := discovery.NewNode(ctx, common...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.WatchService(calculatorRange); err != nil {
+		log.Fatal(err)
+	}
+	for _, info := range providers {
+		if err := client.Host().Connect(ctx, info); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// One constructor serves every version in the range, the generated
+	// client does not depend on the protocol ID
+	client.Registry().RegisterClientConstructor(
+		calculatorRange,
+		func(peer *rpc.RpcPeer) interface{} {
+			return proto.NewCalculatorClient(peer)
+		},
+	)
+
+	var found []types.PeerInfo
+	for len(found) < len(providers) {
+		select {
+		case <-ctx.Done():
+			log.Fatal("providers not found")
+		case <-time.After(time.Second):
+		}
+		if found, err = client.FindCompatiblePeers(calculatorRange); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, p := range found {
+		fmt.Printf("Provider %s supports %v\n", short(p.ID), p.Protocols)
+		c, err := client.NewServiceClient(ctx, calculatorRange, p.ID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if resp := c.(*proto.CalculatorClient).Add(&proto.AddRequest{A: 5, B: 3}); resp != nil {
+			fmt.Printf("5 + 3 = %d\n", resp.Result)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Package bloom implements the Bloom filter peer exchange clients send to
+// summarize the providers they already know.
+//
+// A filter of m bits with k hashes holds a key by setting bits
+// (h1 + i*h2) mod m for i < k, where h1 and h2 are the two big-endian
+// halves of the FNV-128a hash of the 8-byte big-endian seed followed by the
+// key. Bit j is 1<<(j%8) of byte j/8.
+package bloom
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+const (
+	// Hashes is the number of hashes New uses, optimal for a 1% false
+	// positive rate
+	Hashes = 7
+	// MaxHashes bounds the hashes of a decoded filter
+	MaxHashes = 32
+	// bitsPerKey gives a 1% false positive rate with Hashes hashes
+	bitsPerKey = 9.6
+)
+
+// Filter is a Bloom filter over byte keys
+type Filter struct {
+	bits   []byte
+	hashes uint32
+	seed   uint64
+}
+
+// New returns an empty filter sized for n keys. Filters with different
+// seeds give false positives for different keys.
+func New(n int, seed uint64) *Filter {
+	m := max(64, int(math.Ceil(float64(n)*bitsPerKey)))
+	return &Filter{bits: make([]byte, (m+7)/8), hashes: Hashes, seed: seed}
+}
+
+// Decode returns the filter with the given bits, hashes and seed, as sent on
+// the wire. An empty filter holds no key.
+func Decode(bits []byte, hashes uint32, seed uint64) (*Filter, error) {
+	if len(bits) > 0 && (hashes == 0 || hashes > MaxHashes) {
+		return nil, fmt.Errorf("invalid number of hashes %d", hashes)
+	}
+	return &Filter{bits: bits, hashes: hashes, seed: seed}, nil
+}
+
+// Add adds key to the filter
+func (f *Filter) Add(key []byte) {
+	h1, h2 := f.hash(key)
+	m := uint64(len(f.bits)) * 8
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		j := (h1 + i*h2) % m
+		f.bits[j/8] |= 1 << (j % 8)
+	}
+}
+
+// Has reports whether key may have been added to the filter. Keys that were
+// added are always reported.
+func (f *Filter) Has(key []byte) bool {
+	if len(f.bits) == 0 {
+		return false
+	}
+	h1, h2 := f.hash(key)
+	m := uint64(len(f.bits)) * 8
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		j := (h1 + i*h2) % m
+		if f.bits[j/8]&(1<<(j%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *Filter) hash(key []byte) (uint64, uint64) {
+	h := fnv.New128a()
+	var seed [8]byte
+	binary.BigEndian.PutUint64(seed[:], f.seed)
+	h.Write(seed[:])
+	h.Write(key)
+	sum := h.Sum(nil)
+	return binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:])
+}
+
+// Bits returns the filter's bits
+func (f *Filter) Bits() []byte {
+	return f.bits
+}
+
+// NumHashes returns the number of hashes per key
+func (f *Filter) NumHashes() uint32 {
+	return f.hashes
+}
+
+// Seed returns the seed the hashes are computed with
+func (f *Filter) Seed() uint64 {
+	return f.seed
+}
+
+// PeerKey returns the key of a provider entry: the peer ID bytes followed by
+// its last sighting in Unix nanoseconds, 8 bytes big-endian
+func PeerKey(id []byte, lastSeen int64) []byte {
+	key := make([]byte, len(id)+8)
+	copy(key, id)
+	binary.BigEndian.PutUint64(key[len(id):], uint64(lastSeen))
+	return key
+}
@@ -0,0 +1,114 @@
+package bloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func key(i int) []byte {
+	return PeerKey([]byte{0x12, 0x20, byte(i >> 8), byte(i)}, int64(i)*1e9)
+}
+
+func TestDecodeRoundTrip(t *testing.T) {
+	f := New(100, 42)
+	for i := 0; i < 100; i++ {
+		f.Add(key(i))
+	}
+
+	d, err := Decode(f.Bits(), f.NumHashes(), f.Seed())
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !bytes.Equal(d.Bits(), f.Bits()) || d.NumHashes() != Hashes || d.Seed() != 42 {
+		t.Fatalf("decoded filter differs: %d hashes, seed %d", d.NumHashes(), d.Seed())
+	}
+	for i := 0; i < 100; i++ {
+		if !d.Has(key(i)) {
+			t.Errorf("decoded filter lost key %d", i)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		bits    []byte
+		hashes  uint32
+		wantErr bool
+	}{
+		{name: "empty", bits: nil, hashes: 0},
+		{name: "no hashes", bits: make([]byte, 8), hashes: 0, wantErr: true},
+		{name: "max hashes", bits: make([]byte, 8), hashes: MaxHashes},
+		{name: "too many hashes", bits: make([]byte, 8), hashes: MaxHashes + 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := Decode(tt.bits, tt.hashes, 1)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decode error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && f.Has(key(1)) {
+				t.Errorf("filter without keys has key")
+			}
+		})
+	}
+}
+
+func TestFalsePositiveRate(t *testing.T) {
+	const n = 1000
+	f := New(n, 7)
+	for i := 0; i < n; i++ {
+		f.Add(key(i))
+	}
+	for i := 0; i < n; i++ {
+		if !f.Has(key(i)) {
+			t.Fatalf("false negative for key %d", i)
+		}
+	}
+
+	const probes = 20000
+	fp := 0
+	for i := n; i < n+probes; i++ {
+		if f.Has(key(i)) {
+			fp++
+		}
+	}
+	// Sized for 1%; allow for variance
+	if rate := float64(fp) / probes; rate > 0.02 {
+		t.Errorf("false positive rate %.4f, want about 0.01", rate)
+	}
+}
+
+func TestSeedChangesFalsePositives(t *testing.T) {
+	const n = 200
+	a, b := New(n, 1), New(n, 2)
+	for i := 0; i < n; i++ {
+		a.Add(key(i))
+		b.Add(key(i))
+	}
+	if bytes.Equal(a.Bits(), b.Bits()) {
+		t.Fatal("filters with different seeds set the same bits")
+	}
+	both := 0
+	for i := n; i < n+20000; i++ {
+		if a.Has(key(i)) && b.Has(key(i)) {
+			both++
+		}
+	}
+	// Independent 1% rates give about 2 keys reported by both
+	if both > 20 {
+		t.Errorf("%d false positives shared by both seeds", both)
+	}
+}
+
+func TestPeerKey(t *testing.T) {
+	id := []byte{1, 2, 3}
+	k := PeerKey(id, 0x0102030405060708)
+	if !bytes.Equal(k[:3], id) || binary.BigEndian.Uint64(k[3:]) != 0x0102030405060708 {
+		t.Errorf("PeerKey = %x", k)
+	}
+	if bytes.Equal(PeerKey(id, 1), PeerKey(id, 2)) {
+		t.Error("keys of different sightings are equal")
+	}
+}
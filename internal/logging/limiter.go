@@ -0,0 +1,94 @@
+// Package logging holds helpers shared by the packages that log through a
+// caller supplied slog.Logger.
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Attribute keys used across packages so records can be filtered uniformly
+const (
+	KeyTopic    = "topic"
+	KeyPeer     = "peer"
+	KeyBackend  = "backend"
+	KeyProtocol = "protocol"
+)
+
+// maxLimiterKeys bounds the keys a Limiter tracks. Keys can name remote
+// peers, which are not bounded otherwise.
+const maxLimiterKeys = 4096
+
+// Limiter drops log records that repeat within an interval. Discovery loops
+// fail the same way on every tick, so only the first record of a burst is
+// written and the next one reports how many were suppressed in between.
+// Keys idle for an interval are forgotten once maxLimiterKeys are tracked,
+// and records with new keys are dropped while all of them are recent.
+type Limiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	seen map[string]*limitState
+}
+
+type limitState struct {
+	last       time.Time
+	suppressed int
+}
+
+// NewLimiter creates a limiter allowing one record per key every interval
+func NewLimiter(interval time.Duration) *Limiter {
+	return &Limiter{
+		interval: interval,
+		seen:     make(map[string]*limitState),
+	}
+}
+
+// Log writes msg to logger unless a record with the same key was written
+// less than the limiter's interval ago
+func (l *Limiter) Log(logger *slog.Logger, level slog.Level, key, msg string, args ...any) {
+	if !logger.Enabled(context.Background(), level) {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	state, ok := l.seen[key]
+	if !ok {
+		if len(l.seen) >= maxLimiterKeys {
+			l.prune(now)
+		}
+		if len(l.seen) >= maxLimiterKeys {
+			l.mu.Unlock()
+			return
+		}
+		state = &limitState{}
+		l.seen[key] = state
+	}
+	if ok && now.Sub(state.last) < l.interval {
+		state.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	suppressed := state.suppressed
+	state.last = now
+	state.suppressed = 0
+	l.mu.Unlock()
+
+	if suppressed > 0 {
+		args = append(args, slog.Int("suppressed", suppressed))
+	}
+	logger.Log(context.Background(), level, msg, args...)
+}
+
+// prune forgets the keys last written an interval ago or more, along with
+// the records they suppressed since. Must be called with l.mu held.
+func (l *Limiter) prune(now time.Time) {
+	for key, state := range l.seen {
+		if now.Sub(state.last) >= l.interval {
+			delete(l.seen, key)
+		}
+	}
+}
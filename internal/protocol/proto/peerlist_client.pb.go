@@ -30,3 +30,12 @@ func (c *ServicePeerClient) CheckService(req *ServiceCheckRequest) *ServiceCheck
 	}
 	return resp
 }
+
+func (c *ServicePeerClient) SyncPeers(req *PeerSyncRequest) *PeerSyncResponse {
+	resp := &PeerSyncResponse{}
+	err := c.peer.Call("ServicePeer.SyncPeers", req, resp)
+	if err != nil {
+		return nil
+	}
+	return resp
+}
@@ -13,6 +13,8 @@ type ServicePeerServer interface {
 	FetchPeerList(context.Context, *PeerListRequest) *PeerListResponse
 
 	CheckService(context.Context, *ServiceCheckRequest) *ServiceCheckResponse
+
+	SyncPeers(context.Context, *PeerSyncRequest) *PeerSyncResponse
 }
 
 type ServicePeerServerImpl struct {
@@ -32,6 +34,10 @@ func (s *UnimplementedServicePeerServer) CheckService(ctx context.Context, req *
 	return nil
 }
 
+func (s *UnimplementedServicePeerServer) SyncPeers(ctx context.Context, req *PeerSyncRequest) *PeerSyncResponse {
+	return nil
+}
+
 func (s *ServicePeerServerImpl) FetchPeerList(ctx context.Context, req *PeerListRequest) *PeerListResponse {
 	return s.impl.FetchPeerList(ctx, req)
 }
@@ -39,3 +45,7 @@ func (s *ServicePeerServerImpl) FetchPeerList(ctx context.Context, req *PeerList
 func (s *ServicePeerServerImpl) CheckService(ctx context.Context, req *ServiceCheckRequest) *ServiceCheckResponse {
 	return s.impl.CheckService(ctx, req)
 }
+
+func (s *ServicePeerServerImpl) SyncPeers(ctx context.Context, req *PeerSyncRequest) *PeerSyncResponse {
+	return s.impl.SyncPeers(ctx, req)
+}
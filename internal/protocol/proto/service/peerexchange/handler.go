@@ -1,27 +1,49 @@
 package peerexchange
 
 import (
+	"log/slog"
+
 	srpc "github.com/jibuji/go-stream-rpc"
+	"github.com/jibuji/p2p-service-discover/internal/logging"
 	"github.com/jibuji/p2p-service-discover/internal/protocol/proto"
 	"github.com/jibuji/p2p-service-discover/internal/protocol/proto/service"
 	interfaces "github.com/jibuji/p2p-service-discover/pkg/discovery/interfaces"
 	baseservice "github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	"github.com/jibuji/p2p-service-discover/pkg/metrics"
+	"github.com/jibuji/p2p-service-discover/pkg/types"
 )
 
-const PeerExchangeProtocolID = "/peer-exchange/1.0.1"
+const (
+	PeerExchangeProtocolID = "/peer-exchange/1.0.1"
+	// PeerExchangeSyncProtocolID adds SyncPeers; the handler serves both
+	PeerExchangeSyncProtocolID = "/peer-exchange/1.1.0"
+)
 
 type Handler struct {
 	*baseservice.BaseService
-	node interfaces.ServiceDiscovery
+	node    interfaces.ServiceDiscovery
+	limits  types.PeerExchangeLimits
+	metrics *metrics.Metrics
+	logger  *slog.Logger
 }
 
-func NewHandler(node interfaces.ServiceDiscovery) *Handler {
-	h := &Handler{node: node}
-	h.BaseService = baseservice.NewBaseService(PeerExchangeProtocolID, h)
+func NewHandler(node interfaces.ServiceDiscovery, limits types.PeerExchangeLimits, m *metrics.Metrics, logger *slog.Logger) *Handler {
+	h := &Handler{node: node, limits: limits, metrics: m, logger: logger.With(logging.KeyBackend, "peer-exchange")}
+	h.BaseService = baseservice.NewBaseService(PeerExchangeSyncProtocolID, h)
+	h.AddProtocols(PeerExchangeProtocolID)
 	return h
 }
 
 // RegisterWithPeer implements RPCService interface
 func (h *Handler) RegisterWithPeer(peer *srpc.RpcPeer) {
-	proto.RegisterServicePeerServer(peer, service.NewServicePeerService(h.node))
+	proto.RegisterServicePeerServer(peer, h.newService())
+}
+
+// Servers implements ServerProvider interface
+func (h *Handler) Servers() map[string]interface{} {
+	return map[string]interface{}{"ServicePeer": h.newService()}
+}
+
+func (h *Handler) newService() *service.ServicePeerService {
+	return service.NewServicePeerService(h.node, h.limits, h.metrics, h.logger)
 }
@@ -0,0 +1,60 @@
+package reflection
+
+import (
+	"context"
+
+	srpc "github.com/jibuji/go-stream-rpc"
+	"github.com/jibuji/p2p-service-discover/internal/protocol/proto"
+	interfaces "github.com/jibuji/p2p-service-discover/pkg/discovery/interfaces"
+	baseservice "github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const DescriptorProtocolID = "/descriptor/1.0.0"
+
+// DescriptorHandler answers the descriptor protocol with the protobuf files
+// node publishes
+type DescriptorHandler struct {
+	proto.UnimplementedDescriptorServer
+	*baseservice.BaseService
+	node interfaces.ServiceReflection
+}
+
+func NewDescriptorHandler(node interfaces.ServiceReflection) *DescriptorHandler {
+	h := &DescriptorHandler{node: node}
+	h.BaseService = baseservice.NewBaseService(DescriptorProtocolID, h)
+	return h
+}
+
+// RegisterWithPeer implements RPCService interface
+func (h *DescriptorHandler) RegisterWithPeer(peer *srpc.RpcPeer) {
+	proto.RegisterDescriptorServer(peer, h)
+}
+
+// Servers implements ServerProvider interface
+func (h *DescriptorHandler) Servers() map[string]interface{} {
+	return map[string]interface{}{"Descriptor": h}
+}
+
+func (h *DescriptorHandler) FileDescriptors(ctx context.Context, req *proto.FileDescriptorsRequest) *proto.FileDescriptorsResponse {
+	// Services the caller may not use are answered as unknown
+	var files []protoreflect.FileDescriptor
+	if caller, _ := baseservice.PeerFromContext(ctx); h.node.ServiceAllowed(req.ProtocolId, caller) {
+		files = h.node.Descriptors(req.ProtocolId)
+	}
+	encoded := make([][]byte, 0, len(files))
+	for _, fd := range files {
+		b, err := protobuf.Marshal(protodesc.ToFileDescriptorProto(fd))
+		if err != nil {
+			return nil
+		}
+		encoded = append(encoded, b)
+	}
+	return &proto.FileDescriptorsResponse{
+		ProtocolId:      req.ProtocolId,
+		FileDescriptors: encoded,
+		RequestId:       req.RequestId,
+	}
+}
@@ -0,0 +1,56 @@
+package reflection
+
+import (
+	"context"
+
+	srpc "github.com/jibuji/go-stream-rpc"
+	"github.com/jibuji/p2p-service-discover/internal/protocol/proto"
+	interfaces "github.com/jibuji/p2p-service-discover/pkg/discovery/interfaces"
+	baseservice "github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+)
+
+const ReflectionProtocolID = "/reflection/1.0.0"
+
+// Handler answers the reflection protocol with the services of node
+type Handler struct {
+	proto.UnimplementedReflectionServer
+	*baseservice.BaseService
+	node interfaces.ServiceReflection
+}
+
+func NewHandler(node interfaces.ServiceReflection) *Handler {
+	h := &Handler{node: node}
+	h.BaseService = baseservice.NewBaseService(ReflectionProtocolID, h)
+	return h
+}
+
+// RegisterWithPeer implements RPCService interface
+func (h *Handler) RegisterWithPeer(peer *srpc.RpcPeer) {
+	proto.RegisterReflectionServer(peer, h)
+}
+
+// Servers implements ServerProvider interface
+func (h *Handler) Servers() map[string]interface{} {
+	return map[string]interface{}{"Reflection": h}
+}
+
+func (h *Handler) ListServices(ctx context.Context, req *proto.ListServicesRequest) *proto.ListServicesResponse {
+	caller, _ := baseservice.PeerFromContext(ctx)
+	services := h.node.Services()
+	entries := make([]*proto.ServiceEntry, 0, len(services))
+	for _, s := range services {
+		// Services the caller may not use are left out
+		if !h.node.ServiceAllowed(s.Protocol, caller) {
+			continue
+		}
+		entries = append(entries, &proto.ServiceEntry{
+			ProtocolId:   s.Protocol,
+			Version:      s.Version,
+			Metadata:     s.Metadata,
+			RegisteredAt: s.Registered.UnixNano(),
+			Handler:      s.Handler,
+			Advertised:   s.Advertised,
+		})
+	}
+	return &proto.ListServicesResponse{Services: entries, RequestId: req.RequestId}
+}
@@ -1,44 +1,144 @@
-// Code generated by protoc-gen-stream-rpc. DO NOT EDIT.
 package service
 
 import (
 	"context"
+	"log/slog"
+	"sort"
+	"time"
+	"unicode/utf8"
 
+	srpc "github.com/jibuji/go-stream-rpc"
+	"github.com/jibuji/p2p-service-discover/internal/bloom"
+	"github.com/jibuji/p2p-service-discover/internal/logging"
 	proto "github.com/jibuji/p2p-service-discover/internal/protocol/proto"
 	interfaces "github.com/jibuji/p2p-service-discover/pkg/discovery/interfaces"
+	baseservice "github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	"github.com/jibuji/p2p-service-discover/pkg/metrics"
 	"github.com/jibuji/p2p-service-discover/pkg/types"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"google.golang.org/protobuf/encoding/protowire"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// Bounds of the request fields. Requests past them are rejected as
+// malformed.
+const (
+	maxTopicLength     = 256
+	maxRequestIDLength = 64
+	maxFilterBytes     = 256 << 10
 )
 
 // ServicePeerService implements the ServicePeer service
 type ServicePeerService struct {
 	proto.UnimplementedServicePeerServer
-	node interfaces.ServiceDiscovery
+	node    interfaces.ServiceDiscovery
+	limits  types.PeerExchangeLimits
+	metrics *metrics.Metrics
+	logger  *slog.Logger
 }
 
-func NewServicePeerService(node interfaces.ServiceDiscovery) *ServicePeerService {
-	return &ServicePeerService{node: node}
+func NewServicePeerService(node interfaces.ServiceDiscovery, limits types.PeerExchangeLimits, m *metrics.Metrics, logger *slog.Logger) *ServicePeerService {
+	return &ServicePeerService{node: node, limits: limits, metrics: m, logger: logger}
 }
 
 func (s *ServicePeerService) FetchPeerList(ctx context.Context, req *proto.PeerListRequest) *proto.PeerListResponse {
+	err := validateRequest(req.ServiceTopic, req.RequestId)
+	if err == nil && (req.Page < 0 || req.PageSize < 0) {
+		err = baseservice.Errorf(srpc.ErrorCodeMalformedRequest, "page and page size must not be negative")
+	}
 	// Get peers
-	peers, err := s.node.FindPeers(req.ServiceTopic)
+	var peers []types.PeerInfo
+	if err == nil {
+		peers, err = s.findPeers(req.ServiceTopic)
+	}
+	s.metrics.PeerExchangeServed("FetchPeerList", err)
 	if err != nil {
+		s.reject(ctx, "FetchPeerList", req.ServiceTopic, err)
 		return nil
 	}
-	
+
+	// Only the providers of the requested page are encoded
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	page, totalPages := paginate(peers, req.Page, s.pageSize(req.PageSize, peers))
+	infos := make([]*proto.PeerInfo, len(page))
+	for i, p := range page {
+		infos[i] = s.convertPeer(p)
+	}
+
 	// Create response
 	return &proto.PeerListResponse{
 		ServiceTopic: req.ServiceTopic,
 		Page:         req.Page,
+		TotalPages:   totalPages,
 		RequestId:    req.RequestId,
-		Peers:        s.convertPeers(peers),
+		Peers:        infos,
+	}
+}
+
+// pageSize returns the page size for a request asking for requested: at
+// most MaxPeers, and small enough for a page of the largest providers to fit
+// in MaxResponseBytes, so that the pages hold every provider. A page size of
+// 0 asks for the largest one.
+func (s *ServicePeerService) pageSize(requested int32, peers []types.PeerInfo) int32 {
+	size := requested
+	if limit := int32(s.limits.MaxPeers); limit > 0 && (size == 0 || size > limit) {
+		size = limit
+	}
+	if s.limits.MaxResponseBytes > 0 {
+		largest := 1
+		for _, p := range peers {
+			largest = max(largest, encodedSizeBound(p))
+		}
+		// A provider larger than the limit still gets a page of its own
+		if fit := int32(max(1, s.limits.MaxResponseBytes/largest)); size == 0 || size > fit {
+			size = fit
+		}
+	}
+	return size
+}
+
+// encodedSizeBound returns the size of p encoded by convertPeer without
+// redaction, which only makes it smaller. It is computed from the lengths of
+// the fields rather than by encoding p.
+func encodedSizeBound(p types.PeerInfo) int {
+	// Every field number is below 16, so tags take one byte
+	size := 1 + protowire.SizeBytes(len(p.ID)) + 1 + protowire.SizeVarint(uint64(p.LastSeen.UnixNano()))
+	for _, a := range p.Addrs {
+		size += 1 + protowire.SizeBytes(len(a))
 	}
+	if p.Attestation != "" {
+		size += 1 + protowire.SizeBytes(len(p.Attestation))
+	}
+	return size
+}
+
+// paginate returns the given zero-based page of items and the number of
+// pages. A non-positive pageSize returns every item in one page.
+func paginate[T any](items []T, page, pageSize int32) ([]T, int32) {
+	if pageSize <= 0 {
+		return items, 1
+	}
+
+	totalPages := int32((len(items) + int(pageSize) - 1) / int(pageSize))
+	start := int(page) * int(pageSize)
+	if page < 0 || start >= len(items) {
+		return nil, totalPages
+	}
+	end := min(start+int(pageSize), len(items))
+	return items[start:end], totalPages
 }
 
 func (s *ServicePeerService) CheckService(ctx context.Context, req *proto.ServiceCheckRequest) *proto.ServiceCheckResponse {
 	// Check if service is provided
-	peers, err := s.node.FindPeers(req.ServiceTopic)
+	err := validateRequest(req.ServiceTopic, req.RequestId)
+	var peers []types.PeerInfo
+	if err == nil {
+		peers, err = s.findPeers(req.ServiceTopic)
+	}
+	s.metrics.PeerExchangeServed("CheckService", err)
 	if err != nil {
+		s.reject(ctx, "CheckService", req.ServiceTopic, err)
 		return nil
 	}
 
@@ -50,14 +150,153 @@ func (s *ServicePeerService) CheckService(ctx context.Context, req *proto.Servic
 	}
 }
 
-func (s *ServicePeerService) convertPeers(peers []types.PeerInfo) []*proto.PeerInfo {
+func (s *ServicePeerService) SyncPeers(ctx context.Context, req *proto.PeerSyncRequest) *proto.PeerSyncResponse {
+	// Changes made while the response is built are sent again next time
+	now := time.Now()
+	filter, err := validateSync(req, now)
+	var updated, departed []types.PeerInfo
+	if err == nil {
+		updated, departed, err = s.node.PeersChangedSince(req.ServiceTopic, time.Unix(0, req.Since))
+		if err != nil {
+			err = notRegistered(req.ServiceTopic)
+		}
+	}
+	s.metrics.PeerExchangeServed("SyncPeers", err)
+	if err != nil {
+		s.reject(ctx, "SyncPeers", req.ServiceTopic, err)
+		return nil
+	}
+
+	resp := &proto.PeerSyncResponse{
+		ServiceTopic: req.ServiceTopic,
+		SyncTime:     now.UnixNano(),
+		RequestId:    req.RequestId,
+	}
+	sort.Slice(updated, func(i, j int) bool { return updated[i].ID < updated[j].ID })
+	var peers []types.PeerInfo
+	for _, p := range updated {
+		if p.Verified && !filter.Has(bloom.PeerKey([]byte(p.ID), p.LastSeen.UnixNano())) {
+			peers = append(peers, p)
+		}
+	}
+	resp.Peers, resp.Truncated = s.convertPeers(peers)
+	if resp.Truncated {
+		resp.SyncTime = req.Since
+	}
+
+	// A full sync has nothing to remove
+	if req.Since > 0 {
+		for _, p := range departed {
+			resp.Tombstones = append(resp.Tombstones, &proto.PeerTombstone{
+				PeerId:   []byte(p.ID),
+				LastSeen: p.LastSeen.UnixNano(),
+			})
+		}
+	}
+	return resp
+}
+
+// validateRequest rejects a malformed topic or request ID
+func validateRequest(topic string, requestID []byte) error {
+	switch {
+	case topic == "":
+		return baseservice.Errorf(srpc.ErrorCodeMalformedRequest, "missing service topic")
+	case len(topic) > maxTopicLength:
+		return baseservice.Errorf(srpc.ErrorCodeMalformedRequest, "service topic longer than %d bytes", maxTopicLength)
+	case !utf8.ValidString(topic):
+		return baseservice.Errorf(srpc.ErrorCodeMalformedRequest, "service topic is not valid UTF-8")
+	case len(requestID) > maxRequestIDLength:
+		return baseservice.Errorf(srpc.ErrorCodeMalformedRequest, "request ID longer than %d bytes", maxRequestIDLength)
+	}
+	return nil
+}
+
+// validateSync rejects a malformed sync request, and returns its filter
+func validateSync(req *proto.PeerSyncRequest, now time.Time) (*bloom.Filter, error) {
+	if err := validateRequest(req.ServiceTopic, req.RequestId); err != nil {
+		return nil, err
+	}
+	if req.Since < 0 || req.Since > now.UnixNano() {
+		return nil, baseservice.Errorf(srpc.ErrorCodeMalformedRequest, "since is not a past sync time")
+	}
+	if len(req.Filter) > maxFilterBytes {
+		return nil, baseservice.Errorf(srpc.ErrorCodeMalformedRequest, "filter longer than %d bytes", maxFilterBytes)
+	}
+	filter, err := bloom.Decode(req.Filter, req.FilterHashes, req.FilterSeed)
+	if err != nil {
+		return nil, baseservice.Errorf(srpc.ErrorCodeMalformedRequest, "invalid filter: %v", err)
+	}
+	return filter, nil
+}
+
+// findPeers returns the verified providers of a topic the node has
+// registered. Unverified ones are not relayed, so that a peer sending fake
+// providers cannot have them reported by several others.
+func (s *ServicePeerService) findPeers(topic string) ([]types.PeerInfo, error) {
+	peers, err := s.node.FindPeers(topic)
+	if err != nil {
+		return nil, notRegistered(topic)
+	}
+	verified := peers[:0]
+	for _, p := range peers {
+		if p.Verified {
+			verified = append(verified, p)
+		}
+	}
+	return verified, nil
+}
+
+func notRegistered(topic string) error {
+	return baseservice.Errorf(baseservice.ErrorCodeNotFound, "service topic %s is not registered", topic)
+}
+
+// reject fails the call handled with ctx with err
+func (s *ServicePeerService) reject(ctx context.Context, method, topic string, err error) {
+	s.logger.Debug("Rejected peer exchange request", "method", method, logging.KeyTopic, topic, "error", err)
+	baseservice.Fail(ctx, err)
+}
+
+// convertPeers encodes peers up to the response limits, without private
+// addresses when they are redacted. It reports whether peers were left out.
+func (s *ServicePeerService) convertPeers(peers []types.PeerInfo) ([]*proto.PeerInfo, bool) {
 	result := make([]*proto.PeerInfo, 0, len(peers))
+	size := 0
 	for _, p := range peers {
-		result = append(result, &proto.PeerInfo{
-			PeerId:   []byte(p.ID),
-			LastSeen: p.LastSeen.UnixNano(),
-			Addresses: p.Addrs,
-		})
+		info := s.convertPeer(p)
+		size += protobuf.Size(info)
+		if s.limits.MaxPeers > 0 && len(result) == s.limits.MaxPeers ||
+			s.limits.MaxResponseBytes > 0 && size > s.limits.MaxResponseBytes {
+			return result, true
+		}
+		result = append(result, info)
+	}
+	return result, false
+}
+
+// convertPeer encodes a provider, without private addresses when they are
+// redacted
+func (s *ServicePeerService) convertPeer(p types.PeerInfo) *proto.PeerInfo {
+	return &proto.PeerInfo{
+		PeerId:      []byte(p.ID),
+		LastSeen:    p.LastSeen.UnixNano(),
+		Addresses:   s.redact(p.Addrs),
+		Attestation: p.Attestation,
+	}
+}
+
+// redact drops loopback, private, link-local and unspecified addresses when
+// the limits ask for it
+func (s *ServicePeerService) redact(addrs []string) []string {
+	if !s.limits.RedactPrivateAddrs {
+		return addrs
+	}
+	public := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		addr, err := ma.NewMultiaddr(a)
+		if err != nil || manet.IsPrivateAddr(addr) || manet.IsIPUnspecified(addr) {
+			continue
+		}
+		public = append(public, a)
 	}
-	return result
+	return public
 }
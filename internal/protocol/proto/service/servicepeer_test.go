@@ -0,0 +1,549 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	srpc "github.com/jibuji/go-stream-rpc"
+	"github.com/jibuji/p2p-service-discover/internal/bloom"
+	proto "github.com/jibuji/p2p-service-discover/internal/protocol/proto"
+	baseservice "github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	"github.com/jibuji/p2p-service-discover/pkg/types"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	testProtocol = "/peer-exchange-test/1.0.0"
+	testTopic    = "/calculator/1.0.0"
+)
+
+// fakeDiscovery serves fixed providers for testTopic
+type fakeDiscovery struct {
+	peers    []types.PeerInfo
+	departed []types.PeerInfo
+}
+
+func (d *fakeDiscovery) RegisterService(string) error { return nil }
+
+func (d *fakeDiscovery) FindPeers(topic string) ([]types.PeerInfo, error) {
+	if topic != testTopic {
+		return nil, fmt.Errorf("service not found: %s", topic)
+	}
+	return slices.Clone(d.peers), nil
+}
+
+func (d *fakeDiscovery) CheckServiceProvider(context.Context, peer.ID, string) (bool, error) {
+	return false, nil
+}
+
+func (d *fakeDiscovery) PeersChangedSince(topic string, since time.Time) ([]types.PeerInfo, []types.PeerInfo, error) {
+	if topic != testTopic {
+		return nil, nil, fmt.Errorf("service not found: %s", topic)
+	}
+	return slices.Clone(d.peers), slices.Clone(d.departed), nil
+}
+
+// testHandler serves a ServicePeerService the way the peer exchange
+// handler does
+type testHandler struct {
+	*baseservice.BaseService
+	svc *ServicePeerService
+}
+
+func (h *testHandler) RegisterWithPeer(p *srpc.RpcPeer) {
+	proto.RegisterServicePeerServer(p, h.svc)
+}
+
+func (h *testHandler) Servers() map[string]interface{} {
+	return map[string]interface{}{"ServicePeer": h.svc}
+}
+
+// callFunc calls a ServicePeer method on the test server
+type callFunc func(method string, req, resp protobuf.Message) error
+
+// serve registers a ServicePeerService for d on a host and returns a
+// function calling it from another one
+func serve(t *testing.T, d *fakeDiscovery, limits types.PeerExchangeLimits) callFunc {
+	t.Helper()
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+	server, err := mn.GenPeer()
+	if err != nil {
+		t.Fatalf("GenPeer: %v", err)
+	}
+	client, err := mn.GenPeer()
+	if err != nil {
+		t.Fatalf("GenPeer: %v", err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatalf("LinkAll: %v", err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := &testHandler{svc: NewServicePeerService(d, limits, nil, logger)}
+	h.BaseService = baseservice.NewBaseService(testProtocol, h)
+	if err := baseservice.NewRegistry(server, baseservice.WithLogger(logger)).RegisterService(h); err != nil {
+		t.Fatalf("RegisterService: %v", err)
+	}
+	r := baseservice.NewRegistry(client, baseservice.WithLogger(logger))
+	return func(method string, req, resp protobuf.Message) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return r.Invoke(ctx, testProtocol, server.ID(), "ServicePeer."+method, req, resp)
+	}
+}
+
+// checkError fails the test unless err was answered with code and msg
+func checkError(t *testing.T, err error, code srpc.ErrorCode, msg string) {
+	t.Helper()
+	var rpcErr *srpc.RPCError
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("error = %v, want RPC error %d %q", err, code, msg)
+	}
+	if rpcErr.Code != code || rpcErr.Message != msg {
+		t.Errorf("error = %d %q, want %d %q", rpcErr.Code, rpcErr.Message, code, msg)
+	}
+}
+
+func randomPeer(t *testing.T) peer.ID {
+	t.Helper()
+	_, pub, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatalf("GenerateEd25519Key: %v", err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatalf("IDFromPublicKey: %v", err)
+	}
+	return id
+}
+
+// testPeers returns n verified providers ordered by peer ID
+func testPeers(t *testing.T, n int) []types.PeerInfo {
+	t.Helper()
+	peers := make([]types.PeerInfo, n)
+	for i := range peers {
+		peers[i] = types.PeerInfo{
+			ID:       randomPeer(t),
+			Addrs:    []string{"/ip4/203.0.113.1/tcp/4001"},
+			LastSeen: time.Unix(0, time.Now().UnixNano()),
+			Verified: true,
+		}
+	}
+	slices.SortFunc(peers, func(a, b types.PeerInfo) int { return strings.Compare(string(a.ID), string(b.ID)) })
+	return peers
+}
+
+func peerIDs(infos []*proto.PeerInfo) []peer.ID {
+	ids := make([]peer.ID, len(infos))
+	for i, info := range infos {
+		ids[i] = peer.ID(info.PeerId)
+	}
+	return ids
+}
+
+func infoIDs(peers []types.PeerInfo) []peer.ID {
+	ids := make([]peer.ID, len(peers))
+	for i, p := range peers {
+		ids[i] = p.ID
+	}
+	return ids
+}
+
+func TestSyncPeersValidation(t *testing.T) {
+	call := serve(t, &fakeDiscovery{}, types.PeerExchangeLimits{})
+	tests := []struct {
+		name string
+		req  *proto.PeerSyncRequest
+		code srpc.ErrorCode
+		msg  string
+	}{
+		{
+			name: "negative since",
+			req:  &proto.PeerSyncRequest{ServiceTopic: testTopic, Since: -1},
+			code: srpc.ErrorCodeMalformedRequest,
+			msg:  "since is not a past sync time",
+		},
+		{
+			name: "future since",
+			req:  &proto.PeerSyncRequest{ServiceTopic: testTopic, Since: time.Now().Add(time.Hour).UnixNano()},
+			code: srpc.ErrorCodeMalformedRequest,
+			msg:  "since is not a past sync time",
+		},
+		{
+			name: "oversized filter",
+			req:  &proto.PeerSyncRequest{ServiceTopic: testTopic, Filter: make([]byte, maxFilterBytes+1), FilterHashes: 7},
+			code: srpc.ErrorCodeMalformedRequest,
+			msg:  fmt.Sprintf("filter longer than %d bytes", maxFilterBytes),
+		},
+		{
+			name: "filter without hashes",
+			req:  &proto.PeerSyncRequest{ServiceTopic: testTopic, Filter: make([]byte, 8)},
+			code: srpc.ErrorCodeMalformedRequest,
+			msg:  "invalid filter: invalid number of hashes 0",
+		},
+		{
+			name: "too many hashes",
+			req:  &proto.PeerSyncRequest{ServiceTopic: testTopic, Filter: make([]byte, 8), FilterHashes: bloom.MaxHashes + 1},
+			code: srpc.ErrorCodeMalformedRequest,
+			msg:  fmt.Sprintf("invalid filter: invalid number of hashes %d", bloom.MaxHashes+1),
+		},
+		{
+			name: "missing topic",
+			req:  &proto.PeerSyncRequest{},
+			code: srpc.ErrorCodeMalformedRequest,
+			msg:  "missing service topic",
+		},
+		{
+			name: "unregistered topic",
+			req:  &proto.PeerSyncRequest{ServiceTopic: "/other/1.0.0"},
+			code: baseservice.ErrorCodeNotFound,
+			msg:  "service topic /other/1.0.0 is not registered",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := call("SyncPeers", tt.req, &proto.PeerSyncResponse{})
+			checkError(t, err, tt.code, tt.msg)
+		})
+	}
+}
+
+func TestSyncPeersFilter(t *testing.T) {
+	peers := testPeers(t, 3)
+	unverified := testPeers(t, 1)[0]
+	unverified.Verified = false
+	call := serve(t, &fakeDiscovery{peers: append(slices.Clone(peers), unverified)}, types.PeerExchangeLimits{})
+
+	// The client knows the first provider, at its current sighting, and
+	// the second one at an older sighting
+	filter := bloom.New(2, 1)
+	filter.Add(bloom.PeerKey([]byte(peers[0].ID), peers[0].LastSeen.UnixNano()))
+	filter.Add(bloom.PeerKey([]byte(peers[1].ID), peers[1].LastSeen.Add(-time.Second).UnixNano()))
+	before := time.Now()
+	resp := &proto.PeerSyncResponse{}
+	err := call("SyncPeers", &proto.PeerSyncRequest{
+		ServiceTopic: testTopic,
+		Filter:       filter.Bits(),
+		FilterHashes: filter.NumHashes(),
+		FilterSeed:   filter.Seed(),
+		RequestId:    []byte("sync-1"),
+	}, resp)
+	if err != nil {
+		t.Fatalf("SyncPeers: %v", err)
+	}
+
+	if got, want := peerIDs(resp.Peers), infoIDs(peers[1:]); !slices.Equal(got, want) {
+		t.Errorf("peers = %v, want %v", got, want)
+	}
+	if resp.Truncated || resp.SyncTime < before.UnixNano() || resp.SyncTime > time.Now().UnixNano() {
+		t.Errorf("truncated %v, sync time %d, want a complete response at the time of the call", resp.Truncated, resp.SyncTime)
+	}
+	if string(resp.RequestId) != "sync-1" || resp.ServiceTopic != testTopic {
+		t.Errorf("response for %q, %q", resp.RequestId, resp.ServiceTopic)
+	}
+}
+
+func TestSyncPeersTombstones(t *testing.T) {
+	departed := testPeers(t, 2)
+	call := serve(t, &fakeDiscovery{departed: departed}, types.PeerExchangeLimits{})
+
+	// A full sync has nothing to remove
+	resp := &proto.PeerSyncResponse{}
+	if err := call("SyncPeers", &proto.PeerSyncRequest{ServiceTopic: testTopic}, resp); err != nil {
+		t.Fatalf("SyncPeers: %v", err)
+	}
+	if len(resp.Tombstones) != 0 {
+		t.Errorf("full sync sent %d tombstones", len(resp.Tombstones))
+	}
+
+	resp = &proto.PeerSyncResponse{}
+	since := time.Now().Add(-time.Minute).UnixNano()
+	if err := call("SyncPeers", &proto.PeerSyncRequest{ServiceTopic: testTopic, Since: since}, resp); err != nil {
+		t.Fatalf("SyncPeers: %v", err)
+	}
+	if len(resp.Tombstones) != len(departed) {
+		t.Fatalf("sent %d tombstones, want %d", len(resp.Tombstones), len(departed))
+	}
+	for i, ts := range resp.Tombstones {
+		if peer.ID(ts.PeerId) != departed[i].ID || ts.LastSeen != departed[i].LastSeen.UnixNano() {
+			t.Errorf("tombstone %d = %s at %d, want %s at %d",
+				i, peer.ID(ts.PeerId), ts.LastSeen, departed[i].ID, departed[i].LastSeen.UnixNano())
+		}
+	}
+}
+
+func TestSyncPeersTruncated(t *testing.T) {
+	peers := testPeers(t, 3)
+	call := serve(t, &fakeDiscovery{peers: peers}, types.PeerExchangeLimits{MaxPeers: 2})
+
+	// A truncated response keeps the client's since, so that the next sync
+	// sends the providers left out again
+	since := time.Now().Add(-time.Minute).UnixNano()
+	resp := &proto.PeerSyncResponse{}
+	if err := call("SyncPeers", &proto.PeerSyncRequest{ServiceTopic: testTopic, Since: since}, resp); err != nil {
+		t.Fatalf("SyncPeers: %v", err)
+	}
+	if !resp.Truncated || resp.SyncTime != since {
+		t.Errorf("truncated %v, sync time %d, want truncated at %d", resp.Truncated, resp.SyncTime, since)
+	}
+	if got, want := peerIDs(resp.Peers), infoIDs(peers[:2]); !slices.Equal(got, want) {
+		t.Errorf("peers = %v, want %v", got, want)
+	}
+
+	// The next round leaves out the providers received
+	filter := bloom.New(2, 2)
+	for _, info := range resp.Peers {
+		filter.Add(bloom.PeerKey(info.PeerId, info.LastSeen))
+	}
+	resp = &proto.PeerSyncResponse{}
+	err := call("SyncPeers", &proto.PeerSyncRequest{
+		ServiceTopic: testTopic,
+		Since:        since,
+		Filter:       filter.Bits(),
+		FilterHashes: filter.NumHashes(),
+		FilterSeed:   filter.Seed(),
+	}, resp)
+	if err != nil {
+		t.Fatalf("SyncPeers: %v", err)
+	}
+	if resp.Truncated || resp.SyncTime == since {
+		t.Errorf("truncated %v, sync time %d, want a complete response", resp.Truncated, resp.SyncTime)
+	}
+	if got, want := peerIDs(resp.Peers), infoIDs(peers[2:]); !slices.Equal(got, want) {
+		t.Errorf("peers = %v, want %v", got, want)
+	}
+}
+
+func TestFetchPeerListValidation(t *testing.T) {
+	call := serve(t, &fakeDiscovery{}, types.PeerExchangeLimits{})
+	tests := []struct {
+		name string
+		req  *proto.PeerListRequest
+		code srpc.ErrorCode
+		msg  string
+	}{
+		{
+			name: "missing topic",
+			req:  &proto.PeerListRequest{},
+			code: srpc.ErrorCodeMalformedRequest,
+			msg:  "missing service topic",
+		},
+		{
+			name: "oversized topic",
+			req:  &proto.PeerListRequest{ServiceTopic: "/" + strings.Repeat("a", maxTopicLength)},
+			code: srpc.ErrorCodeMalformedRequest,
+			msg:  fmt.Sprintf("service topic longer than %d bytes", maxTopicLength),
+		},
+		{
+			name: "oversized request ID",
+			req:  &proto.PeerListRequest{ServiceTopic: testTopic, RequestId: make([]byte, maxRequestIDLength+1)},
+			code: srpc.ErrorCodeMalformedRequest,
+			msg:  fmt.Sprintf("request ID longer than %d bytes", maxRequestIDLength),
+		},
+		{
+			name: "negative page",
+			req:  &proto.PeerListRequest{ServiceTopic: testTopic, Page: -1},
+			code: srpc.ErrorCodeMalformedRequest,
+			msg:  "page and page size must not be negative",
+		},
+		{
+			name: "negative page size",
+			req:  &proto.PeerListRequest{ServiceTopic: testTopic, PageSize: -1},
+			code: srpc.ErrorCodeMalformedRequest,
+			msg:  "page and page size must not be negative",
+		},
+		{
+			name: "unregistered topic",
+			req:  &proto.PeerListRequest{ServiceTopic: "/other/1.0.0"},
+			code: baseservice.ErrorCodeNotFound,
+			msg:  "service topic /other/1.0.0 is not registered",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := call("FetchPeerList", tt.req, &proto.PeerListResponse{})
+			checkError(t, err, tt.code, tt.msg)
+		})
+	}
+
+	// The same checks apply to CheckService
+	err := call("CheckService", &proto.ServiceCheckRequest{ServiceTopic: ""}, &proto.ServiceCheckResponse{})
+	checkError(t, err, srpc.ErrorCodeMalformedRequest, "missing service topic")
+
+	// A topic that is not valid UTF-8 fails to decode, as the RPC peer
+	// answers it. The service topic is field 1, like the value of a
+	// BytesValue.
+	err = call("FetchPeerList", wrapperspb.Bytes([]byte("/calc\xff/1.0.0")), &proto.PeerListResponse{})
+	var rpcErr *srpc.RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != srpc.ErrorCodeInternalError ||
+		!strings.HasPrefix(rpcErr.Message, "failed to unmarshal request: ") {
+		t.Errorf("error = %v, want a request that fails to unmarshal", err)
+	}
+}
+
+func TestFetchPeerListVerifiedOnly(t *testing.T) {
+	peers := testPeers(t, 4)
+	d := &fakeDiscovery{peers: slices.Clone(peers)}
+	for i := range d.peers {
+		d.peers[i].Verified = i%2 == 0
+	}
+	call := serve(t, d, types.PeerExchangeLimits{})
+
+	resp := &proto.PeerListResponse{}
+	err := call("FetchPeerList", &proto.PeerListRequest{ServiceTopic: testTopic, RequestId: []byte("list-1")}, resp)
+	if err != nil {
+		t.Fatalf("FetchPeerList: %v", err)
+	}
+	if got, want := peerIDs(resp.Peers), []peer.ID{peers[0].ID, peers[2].ID}; !slices.Equal(got, want) {
+		t.Errorf("peers = %v, want the verified ones %v", got, want)
+	}
+	if resp.TotalPages != 1 || string(resp.RequestId) != "list-1" {
+		t.Errorf("total pages %d, request ID %q", resp.TotalPages, resp.RequestId)
+	}
+
+	// Unverified providers do not count for CheckService either
+	d.peers = d.peers[1:2]
+	check := &proto.ServiceCheckResponse{}
+	if err := call("CheckService", &proto.ServiceCheckRequest{ServiceTopic: testTopic}, check); err != nil {
+		t.Fatalf("CheckService: %v", err)
+	}
+	if check.ProvidesService {
+		t.Error("CheckService reports a provider that is not verified")
+	}
+}
+
+func TestFetchPeerListPagination(t *testing.T) {
+	peers := testPeers(t, 5)
+	tests := []struct {
+		name       string
+		limits     types.PeerExchangeLimits
+		page, size int32
+		want       []types.PeerInfo
+		totalPages int32
+	}{
+		{name: "no limits", want: peers, totalPages: 1},
+		{name: "page size", size: 2, page: 1, want: peers[2:4], totalPages: 3},
+		{name: "last page", size: 2, page: 2, want: peers[4:], totalPages: 3},
+		{name: "past the last page", size: 2, page: 3, want: nil, totalPages: 3},
+		{name: "max peers", limits: types.PeerExchangeLimits{MaxPeers: 3}, want: peers[:3], totalPages: 2},
+		{name: "page size over max peers", limits: types.PeerExchangeLimits{MaxPeers: 3}, size: 4, page: 1, want: peers[3:], totalPages: 2},
+		{
+			name:       "max response bytes",
+			limits:     types.PeerExchangeLimits{MaxResponseBytes: 2*encodedSizeBound(peers[0]) + 1},
+			page:       2,
+			want:       peers[4:],
+			totalPages: 3,
+		},
+		{
+			name:       "provider over max response bytes",
+			limits:     types.PeerExchangeLimits{MaxResponseBytes: 10},
+			page:       1,
+			want:       peers[1:2],
+			totalPages: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			call := serve(t, &fakeDiscovery{peers: peers}, tt.limits)
+			resp := &proto.PeerListResponse{}
+			err := call("FetchPeerList", &proto.PeerListRequest{ServiceTopic: testTopic, Page: tt.page, PageSize: tt.size}, resp)
+			if err != nil {
+				t.Fatalf("FetchPeerList: %v", err)
+			}
+			if got, want := peerIDs(resp.Peers), infoIDs(tt.want); !slices.Equal(got, want) {
+				t.Errorf("peers = %v, want %v", got, want)
+			}
+			if resp.Page != tt.page || resp.TotalPages != tt.totalPages {
+				t.Errorf("page %d of %d, want %d of %d", resp.Page, resp.TotalPages, tt.page, tt.totalPages)
+			}
+			if max := tt.limits.MaxResponseBytes; max > 0 && len(resp.Peers) > 1 {
+				size := 0
+				for _, info := range resp.Peers {
+					size += protobuf.Size(info)
+				}
+				if size > max {
+					t.Errorf("page of %d bytes exceeds the %d byte limit", size, max)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodedSizeBound(t *testing.T) {
+	const att = "attestation"
+	tests := []types.PeerInfo{
+		{ID: randomPeer(t)},
+		{ID: randomPeer(t), LastSeen: time.Now()},
+		{ID: randomPeer(t), LastSeen: time.Now(), Addrs: []string{"/ip4/203.0.113.1/tcp/4001", "/ip6/::1/udp/4001/quic-v1"}},
+		{ID: randomPeer(t), LastSeen: time.Now(), Attestation: att},
+		{ID: randomPeer(t), LastSeen: time.Now(), Addrs: []string{strings.Repeat("/dns4/a", 40)}, Attestation: strings.Repeat(att, 20)},
+	}
+	plain := &ServicePeerService{}
+	redacting := &ServicePeerService{limits: types.PeerExchangeLimits{RedactPrivateAddrs: true}}
+	for i, p := range tests {
+		// Exact without redaction, an upper bound with it
+		if got, want := encodedSizeBound(p), protobuf.Size(plain.convertPeer(p)); got != want {
+			t.Errorf("%d: encodedSizeBound = %d, want %d", i, got, want)
+		}
+		if got, redacted := encodedSizeBound(p), protobuf.Size(redacting.convertPeer(p)); got < redacted {
+			t.Errorf("%d: encodedSizeBound = %d, below the redacted size %d", i, got, redacted)
+		}
+	}
+}
+
+func TestConvertPeersTruncation(t *testing.T) {
+	peers := testPeers(t, 3)
+	size := encodedSizeBound(peers[0])
+	tests := []struct {
+		name      string
+		limits    types.PeerExchangeLimits
+		want      int
+		truncated bool
+	}{
+		{name: "no limits", want: 3},
+		{name: "max peers", limits: types.PeerExchangeLimits{MaxPeers: 2}, want: 2, truncated: true},
+		{name: "max peers reached exactly", limits: types.PeerExchangeLimits{MaxPeers: 3}, want: 3},
+		{name: "max response bytes", limits: types.PeerExchangeLimits{MaxResponseBytes: 2*size + 1}, want: 2, truncated: true},
+		{name: "max response bytes reached exactly", limits: types.PeerExchangeLimits{MaxResponseBytes: 3 * size}, want: 3},
+		{name: "provider over max response bytes", limits: types.PeerExchangeLimits{MaxResponseBytes: size - 1}, want: 0, truncated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &ServicePeerService{limits: tt.limits}
+			infos, truncated := s.convertPeers(peers)
+			if truncated != tt.truncated {
+				t.Errorf("truncated = %v, want %v", truncated, tt.truncated)
+			}
+			if got, want := peerIDs(infos), infoIDs(peers[:tt.want]); !slices.Equal(got, want) {
+				t.Errorf("peers = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRedactPrivateAddrs(t *testing.T) {
+	s := &ServicePeerService{limits: types.PeerExchangeLimits{RedactPrivateAddrs: true}}
+	got := s.redact([]string{
+		"/ip4/203.0.113.1/tcp/4001",
+		"/ip4/127.0.0.1/tcp/4001",
+		"/ip4/192.168.1.2/tcp/4001",
+		"/ip4/0.0.0.0/tcp/4001",
+		"/ip6/fe80::1/tcp/4001",
+		"not an address",
+	})
+	if want := []string{"/ip4/203.0.113.1/tcp/4001"}; !slices.Equal(got, want) {
+		t.Errorf("redact = %q, want %q", got, want)
+	}
+}
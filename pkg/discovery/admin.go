@@ -0,0 +1,416 @@
+package discovery
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Provider health reported by the admin API
+const (
+	healthLive    = "live"
+	healthExpired = "expired"
+)
+
+// maxAdminBody bounds the JSON bodies of admin API requests
+const maxAdminBody = 64 << 10
+
+// adminTopicRequest is the body of POST /services and POST /refresh
+type adminTopicRequest struct {
+	Topic string `json:"topic"`
+}
+
+// adminBanRequest is the body of POST /bans. Duration is a Go duration such
+// as "1h"; the ban does not expire when it is empty.
+type adminBanRequest struct {
+	Peer     string `json:"peer"`
+	Duration string `json:"duration"`
+}
+
+type adminService struct {
+	Topic      string `json:"topic"`
+	Advertised bool   `json:"advertised"`
+	Providers  int    `json:"providers"`
+}
+
+type adminProvider struct {
+	Topic     string    `json:"topic"`
+	ID        string    `json:"id"`
+	Addrs     []string  `json:"addrs"`
+	Sources   []string  `json:"sources"`
+	LastSeen  time.Time `json:"last_seen"`
+	Health    string    `json:"health"`
+	Connected bool      `json:"connected"`
+	// Verified is unset for providers known only through peer exchange
+	Verified bool `json:"verified"`
+	// AttestedUntil is the expiry of the provider's attestation, if any
+	AttestedUntil *time.Time `json:"attested_until,omitempty"`
+}
+
+type adminConn struct {
+	Addr      string    `json:"addr"`
+	Direction string    `json:"direction"`
+	Opened    time.Time `json:"opened"`
+}
+
+type adminPeer struct {
+	ID    string      `json:"id"`
+	Conns []adminConn `json:"conns"`
+}
+
+type adminHandlers struct {
+	Handlers []string `json:"handlers"`
+	Clients  []string `json:"clients"`
+}
+
+type adminBackends struct {
+	DHT struct {
+		Enabled          bool `json:"enabled"`
+		RoutingTableSize int  `json:"routing_table_size"`
+	} `json:"dht"`
+	PubSub struct {
+		Enabled bool `json:"enabled"`
+		// Topics maps each joined topic to the number of peers in it
+		Topics map[string]int `json:"topics"`
+	} `json:"pubsub"`
+	PeerExchange struct {
+		Enabled bool `json:"enabled"`
+	} `json:"peer_exchange"`
+}
+
+// AdminHandler returns an http.Handler serving the node's admin API. Besides
+// inspecting topics, providers, peers and backends, it can register and
+// unregister topics, so it should only be reachable by operators. With
+// Config.AdminToken set, every request must present it as a bearer token.
+// POST requests take a JSON body and are refused without an
+// application/json Content-Type, which a browser cannot send to another
+// origin without the preflight the API never answers.
+func (n *ServiceNode) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /services", n.adminListServices)
+	mux.HandleFunc("POST /services", n.adminRegisterService)
+	mux.HandleFunc("DELETE /services", n.adminUnregisterService)
+	mux.HandleFunc("GET /providers", n.adminProviders)
+	mux.HandleFunc("GET /peers", n.adminPeers)
+	mux.HandleFunc("GET /handlers", n.adminHandlers)
+	mux.HandleFunc("GET /backends", n.adminBackends)
+	mux.HandleFunc("POST /refresh", n.adminRefresh)
+	mux.HandleFunc("GET /bans", n.adminBans)
+	mux.HandleFunc("POST /bans", n.adminBan)
+	mux.HandleFunc("DELETE /bans", n.adminUnban)
+	return n.adminAuth(mux)
+}
+
+// adminAuth refuses requests without the admin token, if there is one
+func (n *ServiceNode) adminAuth(next http.Handler) http.Handler {
+	if n.adminToken == "" {
+		return next
+	}
+	want := []byte("Bearer " + n.adminToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid admin token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readJSON decodes the JSON body of r into v. It writes the error response
+// and returns false when the body is not JSON.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("request body must be application/json"))
+		return false
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return false
+	}
+	return true
+}
+
+// ServeAdmin serves the admin API on addr until ctx is cancelled
+func (n *ServiceNode) ServeAdmin(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return n.serveAdmin(ctx, ln)
+}
+
+func (n *ServiceNode) serveAdmin(ctx context.Context, ln net.Listener) error {
+	srv := &http.Server{
+		Handler:           n.AdminHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (n *ServiceNode) adminListServices(w http.ResponseWriter, r *http.Request) {
+	counts := n.countProviders()
+	services := make([]adminService, 0, len(counts))
+	for topic, live := range counts {
+		services = append(services, adminService{
+			Topic:      topic,
+			Advertised: n.IsAdvertised(topic),
+			Providers:  live,
+		})
+	}
+	slices.SortFunc(services, func(a, b adminService) int {
+		return strings.Compare(a.Topic, b.Topic)
+	})
+	writeJSON(w, http.StatusOK, services)
+}
+
+func (n *ServiceNode) adminRegisterService(w http.ResponseWriter, r *http.Request) {
+	var req adminTopicRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Topic == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing topic"))
+		return
+	}
+	if err := n.RegisterService(req.Topic); err != nil {
+		if errors.Is(err, ErrServiceRegistered) {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, adminService{Topic: req.Topic, Advertised: true})
+}
+
+func (n *ServiceNode) adminUnregisterService(w http.ResponseWriter, r *http.Request) {
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing topic"))
+		return
+	}
+	if err := n.UnregisterService(topic); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminProviders lists every known provider, including expired ones, of one
+// topic or of all topics
+func (n *ServiceNode) adminProviders(w http.ResponseWriter, r *http.Request) {
+	topic := r.URL.Query().Get("topic")
+
+	n.mu.RLock()
+	if _, ok := n.services[topic]; topic != "" && !ok {
+		n.mu.RUnlock()
+		writeError(w, http.StatusNotFound, errors.New("service not found: "+topic))
+		return
+	}
+	providers := []adminProvider{}
+	now := time.Now()
+	for t, service := range n.services {
+		if topic != "" && t != topic {
+			continue
+		}
+		for p, data := range service.Peers {
+			addrs := slices.Clone(data.Addrs)
+			for _, addr := range n.host.Peerstore().Addrs(p) {
+				if !slices.Contains(addrs, addr.String()) {
+					addrs = append(addrs, addr.String())
+				}
+			}
+			health := healthLive
+			if !n.live(t, data, now) {
+				health = healthExpired
+			}
+			provider := adminProvider{
+				Topic:     t,
+				ID:        p.String(),
+				Addrs:     addrs,
+				Sources:   slices.Clone(data.Sources),
+				LastSeen:  data.LastSeen,
+				Health:    health,
+				Connected: n.host.Network().Connectedness(p) == network.Connected,
+				Verified:  data.Verified,
+			}
+			if data.Attestation != "" {
+				expires := data.AttestationExpires
+				provider.AttestedUntil = &expires
+			}
+			providers = append(providers, provider)
+		}
+	}
+	n.mu.RUnlock()
+
+	slices.SortFunc(providers, func(a, b adminProvider) int {
+		if c := strings.Compare(a.Topic, b.Topic); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	writeJSON(w, http.StatusOK, providers)
+}
+
+func (n *ServiceNode) adminPeers(w http.ResponseWriter, r *http.Request) {
+	peers := []adminPeer{}
+	for _, p := range n.host.Network().Peers() {
+		ap := adminPeer{ID: p.String(), Conns: []adminConn{}}
+		for _, c := range n.host.Network().ConnsToPeer(p) {
+			stat := c.Stat()
+			ap.Conns = append(ap.Conns, adminConn{
+				Addr:      c.RemoteMultiaddr().String(),
+				Direction: stat.Direction.String(),
+				Opened:    stat.Opened,
+			})
+		}
+		peers = append(peers, ap)
+	}
+	slices.SortFunc(peers, func(a, b adminPeer) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	writeJSON(w, http.StatusOK, peers)
+}
+
+func (n *ServiceNode) adminHandlers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, adminHandlers{
+		Handlers: n.serviceRegistry.HandlerProtocols(),
+		Clients:  n.serviceRegistry.ClientProtocols(),
+	})
+}
+
+func (n *ServiceNode) adminBackends(w http.ResponseWriter, r *http.Request) {
+	var b adminBackends
+	if n.dht != nil {
+		b.DHT.Enabled = true
+		b.DHT.RoutingTableSize = n.dht.RoutingTable().Size()
+	}
+
+	b.PubSub.Topics = map[string]int{}
+	if n.pubsub != nil {
+		b.PubSub.Enabled = true
+		n.mu.RLock()
+		for topic, state := range n.topics {
+			if state.topic != nil {
+				b.PubSub.Topics[topic] = len(state.topic.ListPeers())
+			}
+		}
+		n.mu.RUnlock()
+	}
+
+	b.PeerExchange.Enabled = n.peerExchange
+	writeJSON(w, http.StatusOK, b)
+}
+
+// adminRefresh refreshes the topic of the body, or every topic when it is
+// empty
+func (n *ServiceNode) adminRefresh(w http.ResponseWriter, r *http.Request) {
+	var req adminTopicRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if err := n.Refresh(req.Topic); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (n *ServiceNode) adminBans(w http.ResponseWriter, r *http.Request) {
+	bans, err := n.Bans()
+	if err != nil {
+		writeError(w, http.StatusNotImplemented, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, bans)
+}
+
+// adminBan bans the peer of the body for its duration, or without expiry
+// when it is missing
+func (n *ServiceNode) adminBan(w http.ResponseWriter, r *http.Request) {
+	var req adminBanRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	p, err := peer.Decode(req.Peer)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid peer: %w", err))
+		return
+	}
+	var d time.Duration
+	if s := req.Duration; s != "" {
+		if d, err = time.ParseDuration(s); err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid duration %q", s))
+			return
+		}
+	}
+	if err := n.Ban(p, d); err != nil {
+		if errors.Is(err, errNoGater) {
+			writeError(w, http.StatusNotImplemented, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	ban := Ban{Peer: p}
+	if d > 0 {
+		expires := time.Now().Add(d)
+		ban.Expires = &expires
+	}
+	writeJSON(w, http.StatusCreated, ban)
+}
+
+func (n *ServiceNode) adminUnban(w http.ResponseWriter, r *http.Request) {
+	p, err := peer.Decode(r.URL.Query().Get("peer"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid peer: %w", err))
+		return
+	}
+	if err := n.Unban(p); err != nil {
+		if errors.Is(err, errNoGater) {
+			writeError(w, http.StatusNotImplemented, err)
+			return
+		}
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,126 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	"github.com/jibuji/p2p-service-discover/pkg/types"
+)
+
+var errNoAttestation = errors.New("provider has no attestation")
+
+// ownAttestation is an attestation of this node, announced with the topics
+// it covers
+type ownAttestation struct {
+	raw string
+	att *service.Attestation
+}
+
+// attestation is a verified attestation of a provider
+type attestation struct {
+	raw     string
+	expires time.Time
+}
+
+// validateAttestations checks the provider authorities and the node's own
+// attestations
+func (c *Config) validateAttestations() error {
+	for topic, authorities := range c.ProviderAuthorities {
+		if len(authorities) == 0 {
+			return fmt.Errorf("no provider authorities for topic %s", topic)
+		}
+		for _, a := range authorities {
+			if _, err := a.ExtractPublicKey(); err != nil {
+				return fmt.Errorf("provider authority %s for topic %s has no embedded key: %w", a, topic, err)
+			}
+		}
+	}
+	_, err := parseAttestations(c.Attestations)
+	return err
+}
+
+func parseAttestations(raw []string) ([]ownAttestation, error) {
+	atts := make([]ownAttestation, len(raw))
+	for i, s := range raw {
+		att, err := service.ParseAttestation(s)
+		if err != nil {
+			return nil, err
+		}
+		atts[i] = ownAttestation{raw: s, att: att}
+	}
+	return atts, nil
+}
+
+// attestationFor returns the node's attestation for topic that expires
+// last, or "" if it has none
+func (n *ServiceNode) attestationFor(topic string) string {
+	var best *ownAttestation
+	now := time.Now()
+	for i, a := range n.attestations {
+		if a.att.Subject != n.host.ID() || !a.att.Covers(topic) || !now.Before(a.att.Expires) {
+			continue
+		}
+		if best == nil || a.att.Expires.After(best.att.Expires) {
+			best = &n.attestations[i]
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.raw
+}
+
+// verifyProvider checks the attestation announced by p for topic. For
+// topics with provider authorities it must be valid and issued by one of
+// them. For other topics a valid attestation is kept, so peer exchange
+// passes it on, and anything else is ignored.
+func (n *ServiceNode) verifyProvider(topic string, p peer.ID, raw string) (*attestation, error) {
+	authorities, required := n.providerAuthorities[topic]
+	if raw == "" {
+		if required {
+			return nil, errNoAttestation
+		}
+		return nil, nil
+	}
+	var att *service.Attestation
+	var err error
+	if required {
+		att, err = service.VerifyAttestation(raw, p, topic, authorities)
+	} else {
+		att, err = service.VerifyAttestationSignature(raw, p, topic)
+	}
+	if err != nil {
+		if required {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return &attestation{raw: raw, expires: att.Expires}, nil
+}
+
+// requiresAttestation reports whether providers of topic need an attestation
+func (n *ServiceNode) requiresAttestation(topic string) bool {
+	_, ok := n.providerAuthorities[topic]
+	return ok
+}
+
+// attested reports whether att, as returned by verifyProvider, proves its
+// subject provides topic: only when it was issued by one of the topic's
+// provider authorities, since on other topics anyone may sign one
+func (n *ServiceNode) attested(topic string, att *attestation) bool {
+	return att != nil && n.requiresAttestation(topic)
+}
+
+// admitted reports whether a recorded provider of topic may be returned:
+// always, unless the topic requires an attestation and the provider's has
+// expired
+func (n *ServiceNode) admitted(topic string, data types.PeerData) bool {
+	if !n.requiresAttestation(topic) {
+		return true
+	}
+	return data.Attestation != "" && time.Now().Before(data.AttestationExpires)
+}
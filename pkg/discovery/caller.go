@@ -0,0 +1,22 @@
+package discovery
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+)
+
+// CallerFromContext returns the peer, address, protocol and connection
+// direction of the call a service handler is running. It reports false
+// outside of calls dispatched to handlers embedding service.BaseService.
+func CallerFromContext(ctx context.Context) (*service.Caller, bool) {
+	return service.CallerFromContext(ctx)
+}
+
+// PeerFromContext returns the ID of the peer making the call a service
+// handler is running
+func PeerFromContext(ctx context.Context) (peer.ID, bool) {
+	return service.PeerFromContext(ctx)
+}
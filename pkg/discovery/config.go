@@ -1,7 +1,19 @@
 package discovery
 
 import (
+	"fmt"
+	"log/slog"
 	"time"
+
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	"github.com/jibuji/p2p-service-discover/pkg/types"
 )
 
 // Option is a function type that modifies Config
@@ -9,22 +21,188 @@ type Option func(*Config)
 
 // Config holds the configuration for the service discovery node
 type Config struct {
-	EnableDHT          bool
+	EnableDHT bool
+	// DHTMode selects whether the DHT acts as a client or a server. The
+	// default, dht.ModeAuto, becomes a server once the node is publicly
+	// reachable; bootstrap nodes should use dht.ModeServer.
+	DHTMode            dht.ModeOpt
 	EnablePubSub       bool
 	EnablePeerExchange bool
-	PeerTTL            time.Duration
-	Options            []Option
+	// EnableReflection serves the reflection protocol, which lists the
+	// node's services to other peers, and the descriptor protocol, which
+	// returns the protobuf files published for them. They share the peer
+	// exchange ACL, rate limits and timeouts, and leave out the services
+	// whose ACL rejects the caller. Off by default.
+	EnableReflection bool
+	PeerTTL          time.Duration
+	// DiscoveryInterval is the time between DHT provider lookups
+	DiscoveryInterval time.Duration
+	// AnnounceInterval is the time between pubsub announcements. It must be
+	// shorter than PeerTTL, or providers expire between announcements.
+	AnnounceInterval time.Duration
+	// MetricsRegisterer receives the node's Prometheus collectors.
+	// Metrics are disabled when it is nil.
+	MetricsRegisterer prometheus.Registerer
+	// Logger receives the node's structured logs. slog.Default() is used
+	// when it is nil.
+	Logger *slog.Logger
+	// TracerProvider creates the tracers for discovery operations and
+	// service calls. The global provider is used when it is nil.
+	TracerProvider trace.TracerProvider
+	// ServerInterceptors run around every call dispatched to the node's
+	// service handlers, which must embed service.BaseService with a service
+	// implementing service.ServerProvider, ClientInterceptors around every
+	// call made by its service clients
+	ServerInterceptors []service.UnaryServerInterceptor
+	ClientInterceptors []service.UnaryClientInterceptor
+	// AdminAddr is the address the admin HTTP API listens on. The API is
+	// not served when it is empty.
+	AdminAddr string
+	// AdminToken, when set, must be presented by every admin API request
+	// in an "Authorization: Bearer" header
+	AdminToken string
+	// AllowLimitedConns lets service streams use relayed connections, which
+	// the relay limits in duration and data. Otherwise a stream to a peer
+	// reachable only through a relay waits for hole punching to connect
+	// the peers directly.
+	AllowLimitedConns bool
+	// PeerExchangeACL filters the peers allowed to query the peer exchange
+	// service. Every peer is allowed when it is nil.
+	PeerExchangeACL *service.ACL
+	// PeerExchangeACLFile is loaded with service.LoadACL instead of
+	// PeerExchangeACL, and reloaded when it changes
+	PeerExchangeACLFile string
+	// PeerExchangeRateLimits bound the peer exchange streams and calls
+	// accepted from each peer and from all peers together
+	PeerExchangeRateLimits service.RateLimits
+	// PeerExchangeTimeouts bound the peer exchange calls and close streams
+	// left idle
+	PeerExchangeTimeouts service.Timeouts
+	// PeerExchangeLimits bound the size of peer exchange responses, and
+	// may keep private addresses out of them
+	PeerExchangeLimits types.PeerExchangeLimits
+	// PeerVerification controls how providers learned through peer
+	// exchange are verified
+	PeerVerification types.PeerVerification
+	// Gater is used by Ban and Unban, and closes the connections of banned
+	// peers. NewNode sets it to the gater of the host it creates; a host
+	// created elsewhere needs libp2p.ConnectionGater with the same gater.
+	Gater *Gater
+	// ProviderAuthorities maps topics to the authorities whose attestations
+	// admit providers. Providers of these topics without a valid attestation
+	// are dropped; other topics accept every provider.
+	ProviderAuthorities map[string][]peer.ID
+	// Attestations are the node's own encoded attestations. Each is
+	// announced with the topics it covers.
+	Attestations []string
+	// Host describes the host created by NewNode
+	Host    HostConfig
+	Options []Option
 }
 
-// DefaultConfig returns a Config with default values
-func DefaultConfig() *Config {
-	return &Config{
+// Default values of Config
+const (
+	DefaultPeerTTL           = 3 * time.Hour
+	DefaultDiscoveryInterval = time.Minute
+	DefaultAnnounceInterval  = time.Minute
+)
+
+// DefaultPeerExchangeRateLimits allow each peer bursts of peer exchange
+// queries, but not a steady flood
+var DefaultPeerExchangeRateLimits = service.RateLimits{
+	PeerStreams: service.RateLimit{Rate: 2, Burst: 20},
+	PeerCalls:   service.RateLimit{Rate: 10, Burst: 50},
+}
+
+// DefaultPeerExchangeTimeouts close peer exchange streams that are left open
+// without queries
+var DefaultPeerExchangeTimeouts = service.Timeouts{
+	Call: 10 * time.Second,
+	Idle: time.Minute,
+}
+
+// DefaultPeerExchangeLimits keep a small query from returning a large part
+// of the network at once
+var DefaultPeerExchangeLimits = types.PeerExchangeLimits{
+	MaxPeers:         200,
+	MaxResponseBytes: 64 << 10,
+}
+
+// DefaultPeerVerification verifies providers sent by three peers or
+// answering a probe, and keeps unverified ones in FindPeers after the
+// verified ones
+var DefaultPeerVerification = types.PeerVerification{
+	Reporters: 3,
+	Probe:     true,
+}
+
+// DefaultConfig returns a Config with default values, modified by opts
+func DefaultConfig(opts ...Option) *Config {
+	c := &Config{
 		EnableDHT:          true,
 		EnablePubSub:       true,
 		EnablePeerExchange: true,
-		PeerTTL:            3 * time.Hour,
-		Options:            []Option{},
+		PeerTTL:            DefaultPeerTTL,
+		DiscoveryInterval:  DefaultDiscoveryInterval,
+		AnnounceInterval:   DefaultAnnounceInterval,
+
+		PeerExchangeRateLimits: DefaultPeerExchangeRateLimits,
+		PeerExchangeTimeouts:   DefaultPeerExchangeTimeouts,
+		PeerExchangeLimits:     DefaultPeerExchangeLimits,
+		PeerVerification:       DefaultPeerVerification,
+		Host: HostConfig{
+			ConnLow:   DefaultConnLow,
+			ConnHigh:  DefaultConnHigh,
+			ConnGrace: DefaultConnGrace,
+		},
+		Options: []Option{},
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Validate reports the first setting that is out of range or inconsistent
+// with another
+func (c *Config) Validate() error {
+	if c.PeerTTL <= 0 {
+		return fmt.Errorf("peer TTL must be positive, got %s", c.PeerTTL)
+	}
+	if c.DiscoveryInterval <= 0 {
+		return fmt.Errorf("discovery interval must be positive, got %s", c.DiscoveryInterval)
+	}
+	if c.AnnounceInterval <= 0 {
+		return fmt.Errorf("announce interval must be positive, got %s", c.AnnounceInterval)
+	}
+	if c.EnableDHT && c.DiscoveryInterval >= c.PeerTTL {
+		return fmt.Errorf("discovery interval (%s) must be shorter than peer TTL (%s)", c.DiscoveryInterval, c.PeerTTL)
+	}
+	if c.EnablePubSub && c.AnnounceInterval >= c.PeerTTL {
+		return fmt.Errorf("announce interval (%s) must be shorter than peer TTL (%s)", c.AnnounceInterval, c.PeerTTL)
+	}
+	if c.PeerExchangeACL != nil && c.PeerExchangeACLFile != "" {
+		return fmt.Errorf("peer exchange ACL and ACL file are mutually exclusive")
+	}
+	if err := c.PeerExchangeRateLimits.Validate(); err != nil {
+		return fmt.Errorf("invalid peer exchange rate limits: %w", err)
+	}
+	if err := c.PeerExchangeTimeouts.Validate(); err != nil {
+		return fmt.Errorf("invalid peer exchange timeouts: %w", err)
+	}
+	if err := c.PeerExchangeLimits.Validate(); err != nil {
+		return fmt.Errorf("invalid peer exchange limits: %w", err)
+	}
+	if err := c.PeerVerification.Validate(); err != nil {
+		return fmt.Errorf("invalid peer verification: %w", err)
+	}
+	if _, ok := dhtModeNames[c.DHTMode]; !ok {
+		return fmt.Errorf("unknown DHT mode %d", c.DHTMode)
+	}
+	if err := c.validateAttestations(); err != nil {
+		return err
+	}
+	return c.Host.validate()
 }
 
 // WithDHT enables or disables DHT
@@ -34,6 +212,13 @@ func WithDHT(enable bool) Option {
 	}
 }
 
+// WithDHTMode sets the DHT mode
+func WithDHTMode(mode dht.ModeOpt) Option {
+	return func(c *Config) {
+		c.DHTMode = mode
+	}
+}
+
 // WithPubSub enables or disables PubSub
 func WithPubSub(enable bool) Option {
 	return func(c *Config) {
@@ -48,9 +233,321 @@ func WithPeerTTL(ttl time.Duration) Option {
 	}
 }
 
+// WithDiscoveryInterval sets the time between DHT provider lookups
+func WithDiscoveryInterval(interval time.Duration) Option {
+	return func(c *Config) {
+		c.DiscoveryInterval = interval
+	}
+}
+
+// WithAnnounceInterval sets the time between pubsub announcements
+func WithAnnounceInterval(interval time.Duration) Option {
+	return func(c *Config) {
+		c.AnnounceInterval = interval
+	}
+}
+
 // WithPeerExchange enables or disables peer exchange service
 func WithPeerExchange(enable bool) Option {
 	return func(c *Config) {
 		c.EnablePeerExchange = enable
 	}
 }
+
+// WithReflection enables or disables the reflection and descriptor services
+func WithReflection(enable bool) Option {
+	return func(c *Config) {
+		c.EnableReflection = enable
+	}
+}
+
+// WithPeerExchangeACL filters the peers allowed to query peer exchange
+func WithPeerExchangeACL(acl *service.ACL) Option {
+	return func(c *Config) {
+		c.PeerExchangeACL = acl
+	}
+}
+
+// WithPeerExchangeACLFile loads the peer exchange ACL from path and reloads
+// it when the file changes
+func WithPeerExchangeACLFile(path string) Option {
+	return func(c *Config) {
+		c.PeerExchangeACLFile = path
+	}
+}
+
+// WithPeerExchangeRateLimits replaces the peer exchange rate limits. The
+// zero RateLimits removes them.
+func WithPeerExchangeRateLimits(l service.RateLimits) Option {
+	return func(c *Config) {
+		c.PeerExchangeRateLimits = l
+	}
+}
+
+// WithPeerExchangeTimeouts replaces the peer exchange timeouts. The zero
+// Timeouts removes them.
+func WithPeerExchangeTimeouts(t service.Timeouts) Option {
+	return func(c *Config) {
+		c.PeerExchangeTimeouts = t
+	}
+}
+
+// WithPeerExchangeLimits replaces the peer exchange response limits. The
+// zero PeerExchangeLimits removes them.
+func WithPeerExchangeLimits(l types.PeerExchangeLimits) Option {
+	return func(c *Config) {
+		c.PeerExchangeLimits = l
+	}
+}
+
+// WithPeerVerification replaces how providers learned through peer exchange
+// are verified
+func WithPeerVerification(v types.PeerVerification) Option {
+	return func(c *Config) {
+		c.PeerVerification = v
+	}
+}
+
+// WithProviderAuthorities admits only providers of topic holding an
+// attestation issued by one of authorities
+func WithProviderAuthorities(topic string, authorities ...peer.ID) Option {
+	return func(c *Config) {
+		if c.ProviderAuthorities == nil {
+			c.ProviderAuthorities = make(map[string][]peer.ID)
+		}
+		c.ProviderAuthorities[topic] = authorities
+	}
+}
+
+// WithAttestations adds encoded attestations of the node, announced with the
+// topics they cover
+func WithAttestations(attestations ...string) Option {
+	return func(c *Config) {
+		c.Attestations = append(c.Attestations, attestations...)
+	}
+}
+
+// WithGater sets the connection gater managed by Ban and Unban
+func WithGater(g *Gater) Option {
+	return func(c *Config) {
+		c.Gater = g
+	}
+}
+
+// WithBlockedPeers refuses connections with the given peer IDs
+func WithBlockedPeers(ids ...string) Option {
+	return func(c *Config) {
+		c.Host.Gater.BlockedPeers = ids
+	}
+}
+
+// WithAllowedCIDRs limits connections to addresses in the given ranges
+func WithAllowedCIDRs(cidrs ...string) Option {
+	return func(c *Config) {
+		c.Host.Gater.AllowedCIDRs = cidrs
+	}
+}
+
+// WithBlockedCIDRs refuses connections with addresses in the given ranges
+func WithBlockedCIDRs(cidrs ...string) Option {
+	return func(c *Config) {
+		c.Host.Gater.BlockedCIDRs = cidrs
+	}
+}
+
+// WithBanFile saves runtime bans to path, so they survive restarts
+func WithBanFile(path string) Option {
+	return func(c *Config) {
+		c.Host.Gater.BanFile = path
+	}
+}
+
+// WithPSK joins the private network of psk
+func WithPSK(psk pnet.PSK) Option {
+	return func(c *Config) {
+		c.Host.PSK = psk
+	}
+}
+
+// WithPSKFile joins the private network whose key is saved at path, in the
+// swarm.key format
+func WithPSKFile(path string) Option {
+	return func(c *Config) {
+		c.Host.PSKFile = path
+	}
+}
+
+// WithPSKEnv joins the private network whose key is in the environment
+// variable name
+func WithPSKEnv(name string) Option {
+	return func(c *Config) {
+		c.Host.PSKEnv = name
+	}
+}
+
+// WithRequirePSK refuses to start the node without a private network key
+func WithRequirePSK() Option {
+	return func(c *Config) {
+		c.Host.RequirePSK = true
+	}
+}
+
+// WithMetrics registers the node's Prometheus collectors with reg
+func WithMetrics(reg prometheus.Registerer) Option {
+	return func(c *Config) {
+		c.MetricsRegisterer = reg
+	}
+}
+
+// WithLogger sets the structured logger used by the node and its services
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Config) {
+		c.Logger = logger
+	}
+}
+
+// WithTracerProvider sets the OpenTelemetry tracer provider
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *Config) {
+		c.TracerProvider = tp
+	}
+}
+
+// WithServerInterceptors adds interceptors run around every call the
+// node's service handlers dispatch. Handlers whose service does not
+// implement service.ServerProvider cannot then be registered.
+func WithServerInterceptors(interceptors ...service.UnaryServerInterceptor) Option {
+	return func(c *Config) {
+		c.ServerInterceptors = append(c.ServerInterceptors, interceptors...)
+	}
+}
+
+// WithClientInterceptors adds interceptors run around every call made by
+// the node's service clients
+func WithClientInterceptors(interceptors ...service.UnaryClientInterceptor) Option {
+	return func(c *Config) {
+		c.ClientInterceptors = append(c.ClientInterceptors, interceptors...)
+	}
+}
+
+// WithAdmin serves the admin HTTP API on addr
+func WithAdmin(addr string) Option {
+	return func(c *Config) {
+		c.AdminAddr = addr
+	}
+}
+
+// WithAdminToken requires admin API requests to present token as a bearer
+// token
+func WithAdminToken(token string) Option {
+	return func(c *Config) {
+		c.AdminToken = token
+	}
+}
+
+// WithIdentityFile loads the host identity from path, creating it if needed
+func WithIdentityFile(path string) Option {
+	return func(c *Config) {
+		c.Host.IdentityKeyFile = path
+	}
+}
+
+// WithListenAddrs sets the multiaddrs the host listens on
+func WithListenAddrs(addrs ...string) Option {
+	return func(c *Config) {
+		c.Host.ListenAddrs = addrs
+	}
+}
+
+// WithTransports enables only the given transports
+func WithTransports(transports ...string) Option {
+	return func(c *Config) {
+		c.Host.Transports = transports
+	}
+}
+
+// WithSecurity enables only the given security protocols, in order of
+// preference
+func WithSecurity(protocols ...string) Option {
+	return func(c *Config) {
+		c.Host.Security = protocols
+	}
+}
+
+// WithConnLimits sets the connection manager's watermarks and grace period
+func WithConnLimits(low, high int, grace time.Duration) Option {
+	return func(c *Config) {
+		c.Host.ConnLow = low
+		c.Host.ConnHigh = high
+		c.Host.ConnGrace = grace
+	}
+}
+
+// WithLibp2pOptions adds options to the ones NewNode builds the host with
+func WithLibp2pOptions(opts ...libp2p.Option) Option {
+	return func(c *Config) {
+		c.Host.Libp2pOptions = append(c.Host.Libp2pOptions, opts...)
+	}
+}
+
+// WithNATPortMap asks the router to forward a port with UPnP or NAT-PMP
+func WithNATPortMap() Option {
+	return func(c *Config) {
+		c.Host.NATPortMap = true
+	}
+}
+
+// WithAutoNATService answers other peers' AutoNAT reachability checks
+func WithAutoNATService() Option {
+	return func(c *Config) {
+		c.Host.AutoNATService = true
+	}
+}
+
+// WithReachability overrides the reachability AutoNAT detects with
+// ReachabilityPublic or ReachabilityPrivate
+func WithReachability(reachability string) Option {
+	return func(c *Config) {
+		c.Host.Reachability = reachability
+	}
+}
+
+// WithRelayService offers circuit relay v2 to other peers
+func WithRelayService() Option {
+	return func(c *Config) {
+		c.Host.RelayService = true
+	}
+}
+
+// WithStaticRelays reserves slots on the given relays while the host is not
+// publicly reachable
+func WithStaticRelays(addrs ...string) Option {
+	return func(c *Config) {
+		c.Host.StaticRelays = addrs
+	}
+}
+
+// WithHolePunching upgrades relayed connections to direct ones
+func WithHolePunching() Option {
+	return func(c *Config) {
+		c.Host.HolePunching = true
+	}
+}
+
+// WithServiceLimits bounds the streams and memory of a service protocol in
+// the host's resource manager
+func WithServiceLimits(protocol string, l ServiceLimit) Option {
+	return func(c *Config) {
+		if c.Host.ServiceLimits == nil {
+			c.Host.ServiceLimits = make(map[string]ServiceLimit)
+		}
+		c.Host.ServiceLimits[protocol] = l
+	}
+}
+
+// WithLimitedConns lets service streams use relayed connections
+func WithLimitedConns(allow bool) Option {
+	return func(c *Config) {
+		c.AllowLimitedConns = allow
+	}
+}
@@ -1,20 +1,44 @@
 package discovery
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
 	"time"
 
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/p2p/discovery/routing"
 	"github.com/multiformats/go-multiaddr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/jibuji/p2p-service-discover/internal/logging"
+	"github.com/jibuji/p2p-service-discover/pkg/discovery/service"
 	"github.com/jibuji/p2p-service-discover/pkg/types"
 )
 
+// Discovery backends, used in logs
+const (
+	backendDHT          = "dht"
+	backendPubSub       = "pubsub"
+	backendPeerExchange = "peer-exchange"
+)
+
 type announcement struct {
 	PeerID    string    `json:"peer_id"`
 	Timestamp time.Time `json:"timestamp"`
+	// Addrs are the announcer's addresses, including relay addresses when
+	// it is reachable only through a relay
+	Addrs []string `json:"addrs,omitempty"`
+	// Attestation admits the announcer as a provider of the topic
+	Attestation string `json:"attestation,omitempty"`
+	// Protocols are the versions the announcer provides, on the topic of a
+	// protocol family
+	Protocols []string `json:"protocols,omitempty"`
 }
 
 func convertAddrs(addrs []multiaddr.Multiaddr) []string {
@@ -25,103 +49,307 @@ func convertAddrs(addrs []multiaddr.Multiaddr) []string {
 	return result
 }
 
-func (n *ServiceNode) dhtDiscoveryLoop(serviceTopic string) {
-	ticker := time.NewTicker(time.Minute)
+func (n *ServiceNode) dhtDiscoveryLoop(ctx context.Context, serviceTopic string, refresh <-chan struct{}) {
+	ticker := time.NewTicker(n.lookupInterval)
 	defer ticker.Stop()
 
 	routingDiscovery := routing.NewRoutingDiscovery(n.dht)
+	log := n.logger.With(logging.KeyTopic, serviceTopic, logging.KeyBackend, backendDHT)
 
 	for {
 		select {
-		case <-n.ctx.Done():
+		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			peers, err := routingDiscovery.FindPeers(n.ctx, serviceTopic)
-			if err != nil {
-				continue
-			}
+		case <-refresh:
+		}
+		n.dhtLookup(ctx, routingDiscovery, serviceTopic, log)
+	}
+}
 
-			n.mu.Lock()
-			service := n.services[serviceTopic]
-			now := time.Now()
-			for p := range peers {
-				if p.ID != n.host.ID() { // Don't add self
-					service.Peers[p.ID] = types.PeerData{
-						LastSeen: now,
-						Addrs:    convertAddrs(p.Addrs),
-					}
-				}
-			}
-			n.mu.Unlock()
+// dhtLookup queries the DHT once for providers of serviceTopic
+func (n *ServiceNode) dhtLookup(ctx context.Context, routingDiscovery *routing.RoutingDiscovery, serviceTopic string, log *slog.Logger) {
+	ctx, span := n.tracer.Start(ctx, "dht.FindPeers",
+		trace.WithAttributes(attribute.String("p2p.topic", serviceTopic)))
+	start := time.Now()
+	peers, err := routingDiscovery.FindPeers(ctx, serviceTopic)
+	if err != nil {
+		n.metrics.ObserveDHTLookup(serviceTopic, time.Since(start), 0, err)
+		endSpan(span, err)
+		n.logLimiter.Log(log, slog.LevelWarn, "dht-find:"+serviceTopic,
+			"DHT provider lookup failed", "error", err)
+		return
+	}
+
+	var found []peer.AddrInfo
+	for p := range peers {
+		if p.ID != n.host.ID() { // Don't add self
+			found = append(found, p)
+		}
+	}
+	n.metrics.ObserveDHTLookup(serviceTopic, time.Since(start), len(found), nil)
+	span.SetAttributes(attribute.Int("p2p.providers_found", len(found)))
+	span.End()
+	log.Debug("DHT provider lookup finished",
+		"found", len(found), "duration", time.Since(start))
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	service, ok := n.services[serviceTopic]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	for _, p := range found {
+		// DHT records carry no attestation, so they only refresh providers
+		// that announced one
+		if _, known := service.Peers[p.ID]; !known && n.requiresAttestation(serviceTopic) {
+			continue
 		}
+		n.recordProvider(log, service, p.ID, backendDHT, now, convertAddrs(p.Addrs), nil, true)
 	}
 }
 
-func (n *ServiceNode) announceLoop(serviceTopic string, topic *pubsub.Topic) {
-	ticker := time.NewTicker(time.Minute)
+// announceLoop publishes the node's announcements on topic. On family
+// topics they list the versions the node provides, and are skipped while it
+// provides none.
+func (n *ServiceNode) announceLoop(ctx context.Context, serviceTopic string, topic *pubsub.Topic, family bool, refresh <-chan struct{}) {
+	ticker := time.NewTicker(n.announceInterval)
 	defer ticker.Stop()
 
+	log := n.logger.With(logging.KeyTopic, serviceTopic, logging.KeyBackend, backendPubSub)
+
 	for {
 		select {
-		case <-n.ctx.Done():
+		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			ann := announcement{
-				PeerID:    n.host.ID().String(),
-				Timestamp: time.Now(),
-			}
+		case <-refresh:
+		}
 
-			data, err := json.Marshal(ann)
-			if err != nil {
+		ann := announcement{
+			PeerID:      n.host.ID().String(),
+			Timestamp:   time.Now(),
+			Addrs:       convertAddrs(n.host.Addrs()),
+			Attestation: n.attestationFor(serviceTopic),
+		}
+		if family {
+			n.mu.RLock()
+			ann.Protocols = n.familyVersions(serviceTopic)
+			n.mu.RUnlock()
+			if len(ann.Protocols) == 0 {
 				continue
 			}
+		}
 
-			if err := topic.Publish(n.ctx, data); err != nil {
-				continue
-			}
+		data, err := json.Marshal(ann)
+		if err != nil {
+			n.logLimiter.Log(log, slog.LevelError, "announce-encode:"+serviceTopic,
+				"Failed to encode announcement", "error", err)
+			continue
+		}
+
+		err = topic.Publish(ctx, data)
+		n.metrics.AnnouncementPublished(serviceTopic, err)
+		if err != nil && ctx.Err() == nil {
+			n.logLimiter.Log(log, slog.LevelWarn, "announce-publish:"+serviceTopic,
+				"Failed to publish announcement", "error", err)
 		}
 	}
 }
 
-func (n *ServiceNode) pubsubDiscoveryLoop(serviceTopic string, topic *pubsub.Topic) {
-	sub, err := topic.Subscribe()
-	if err != nil {
-		return
-	}
+func (n *ServiceNode) pubsubDiscoveryLoop(ctx context.Context, serviceTopic string, sub *pubsub.Subscription) {
+	log := n.logger.With(logging.KeyTopic, serviceTopic, logging.KeyBackend, backendPubSub)
 	defer sub.Cancel()
 
 	for {
-		select {
-		case <-n.ctx.Done():
-			return
-		default:
-			msg, err := sub.Next(n.ctx)
-			if err != nil {
-				continue
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, pubsub.ErrSubscriptionCancelled) {
+				return
 			}
+			n.logLimiter.Log(log, slog.LevelWarn, "pubsub-next:"+serviceTopic,
+				"Failed to read announcement", "error", err)
+			continue
+		}
 
-			// Skip messages from self
-			if msg.ReceivedFrom == n.host.ID() {
-				continue
-			}
+		// Skip messages from self
+		if msg.ReceivedFrom == n.host.ID() {
+			continue
+		}
 
-			var ann announcement
-			if err := json.Unmarshal(msg.Data, &ann); err != nil {
-				continue
-			}
+		var ann announcement
+		if err := json.Unmarshal(msg.Data, &ann); err != nil {
+			n.metrics.AnnouncementRejected(serviceTopic)
+			n.logLimiter.Log(log, slog.LevelDebug, "announce-decode:"+serviceTopic,
+				"Rejected malformed announcement",
+				logging.KeyPeer, msg.ReceivedFrom, "error", err)
+			continue
+		}
 
-			peerID, err := peer.Decode(ann.PeerID)
-			if err != nil {
-				continue
-			}
+		peerID, err := peer.Decode(ann.PeerID)
+		if err != nil {
+			n.metrics.AnnouncementRejected(serviceTopic)
+			n.logLimiter.Log(log, slog.LevelDebug, "announce-peer:"+serviceTopic,
+				"Rejected announcement with invalid peer ID",
+				logging.KeyPeer, msg.ReceivedFrom, "error", err)
+			continue
+		}
+		att, err := n.verifyProvider(serviceTopic, peerID, ann.Attestation)
+		if err != nil {
+			n.metrics.AnnouncementRejected(serviceTopic)
+			n.logLimiter.Log(log, slog.LevelDebug, "announce-attestation:"+serviceTopic,
+				"Rejected announcement without a valid attestation",
+				logging.KeyPeer, peerID, "error", err)
+			continue
+		}
+		n.metrics.AnnouncementReceived(serviceTopic)
 
-			n.mu.Lock()
-			service := n.services[serviceTopic]
-			service.Peers[peerID] = types.PeerData{
-				LastSeen: ann.Timestamp,
-				Addrs:    []string{}, // Will be updated by DHT discovery
-			}
-			n.mu.Unlock()
+		// Only the signed author's own announcement verifies it, and only
+		// its addresses are trusted; otherwise they are filled in by DHT
+		// discovery
+		var addrs []string
+		selfSigned := msg.GetFrom() == peerID
+		if selfSigned {
+			addrs = n.addAnnouncedAddrs(peerID, ann.Addrs)
+		}
+		verified := selfSigned || n.attested(serviceTopic, att)
+
+		n.mu.Lock()
+		if service, ok := n.services[serviceTopic]; ok {
+			n.recordProvider(log, service, peerID, backendPubSub, notAfterNow(ann.Timestamp), addrs, att, verified)
+			n.recordProtocols(service, peerID, ann.Protocols)
 		}
+		n.mu.Unlock()
+	}
+}
+
+// addAnnouncedAddrs adds the valid addresses announced by p to the
+// peerstore, so p can be dialed through its relays, and returns them
+func (n *ServiceNode) addAnnouncedAddrs(p peer.ID, addrs []string) []string {
+	valid := parseAddrs(addrs)
+	n.host.Peerstore().AddAddrs(p, valid, n.peerTTL)
+	return convertAddrs(valid)
+}
+
+// parseAddrs returns the valid multiaddrs in addrs
+func parseAddrs(addrs []string) []multiaddr.Multiaddr {
+	var valid []multiaddr.Multiaddr
+	for _, s := range addrs {
+		if addr, err := multiaddr.NewMultiaddr(s); err == nil {
+			valid = append(valid, addr)
+		}
+	}
+	return valid
+}
+
+// notAfterNow returns t, or the current time when a remote peer reported a
+// sighting in the future, which would keep the provider live past its TTL
+func notAfterNow(t time.Time) time.Time {
+	if now := time.Now(); t.After(now) {
+		return now
+	}
+	return t
+}
+
+// endSpan ends span, marking it failed when err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// recordProvider records that source saw p providing the service at seen.
+// Known addresses and attestation are kept when addrs is empty or att is
+// nil. The entry is verified when verified is set. It reports whether the
+// entry was added or changed. Must be called with n.mu held.
+func (n *ServiceNode) recordProvider(log *slog.Logger, service *types.ServiceInfo, p peer.ID, source string, seen time.Time, addrs []string, att *attestation, verified bool) bool {
+	data, ok := service.Peers[p]
+	if !ok {
+		log.Debug("Discovered provider", logging.KeyPeer, p)
+	}
+	updated := !ok
+	if seen.After(data.LastSeen) {
+		data.LastSeen = seen
+		data.Departed = time.Time{}
+		updated = true
+	}
+	if len(addrs) > 0 && !slices.Equal(data.Addrs, addrs) {
+		data.Addrs = addrs
+		updated = true
+	}
+	if att != nil && (att.raw != data.Attestation || !att.expires.Equal(data.AttestationExpires)) {
+		data.Attestation = att.raw
+		data.AttestationExpires = att.expires
+		updated = true
+	}
+	if !slices.Contains(data.Sources, source) {
+		data.Sources = append(data.Sources, source)
+	}
+	if !data.Verified && verified {
+		data.Verified = true
+		data.Reporters = nil
+		updated = true
+	}
+	if updated {
+		data.Updated = time.Now()
+	}
+	service.Peers[p] = data
+	return updated
+}
+
+// recordDeparture removes p as a provider of the service on a peer exchange
+// tombstone for its sighting at lastSeen. Any sync peer can send one, so it
+// only removes an unverified entry learned from peer exchange alone whose
+// sighting is exactly lastSeen. It reports whether p was a live provider.
+// Must be called with n.mu held.
+func (n *ServiceNode) recordDeparture(log *slog.Logger, service *types.ServiceInfo, p peer.ID, lastSeen time.Time) bool {
+	data, ok := service.Peers[p]
+	if !ok || !data.Departed.IsZero() || data.Verified || !data.LastSeen.Equal(lastSeen) ||
+		!slices.Equal(data.Sources, []string{backendPeerExchange}) {
+		return false
+	}
+	now := time.Now()
+	wasLive := n.live(service.Topic, data, now)
+	data.Departed = now
+	data.Updated = now
+	service.Peers[p] = data
+	log.Debug("Provider departed", logging.KeyPeer, p)
+	return wasLive
+}
+
+// live reports whether a recorded provider of topic is current at now: seen
+// within the peer TTL, admitted and not removed by a tombstone
+func (n *ServiceNode) live(topic string, data types.PeerData, now time.Time) bool {
+	return data.Departed.IsZero() && now.Sub(data.LastSeen) < n.peerTTL && n.admitted(topic, data)
+}
+
+// departure returns when a recorded provider of topic that is no longer
+// live left: on a tombstone, or when its sighting or attestation expired
+func (n *ServiceNode) departure(topic string, data types.PeerData) time.Time {
+	if !data.Departed.IsZero() {
+		return data.Departed
+	}
+	left := data.LastSeen.Add(n.peerTTL)
+	if n.requiresAttestation(topic) && data.AttestationExpires.Before(left) {
+		left = data.AttestationExpires
+	}
+	return left
+}
+
+// recordProtocols records the versions p announced on a protocol family
+// topic, ignoring those outside the family. Must be called with n.mu held.
+func (n *ServiceNode) recordProtocols(info *types.ServiceInfo, p peer.ID, protocols []string) {
+	family, err := service.ParseProtocolRange(info.Topic)
+	if err != nil || len(protocols) == 0 {
+		return
+	}
+	data, ok := info.Peers[p]
+	if !ok {
+		return
 	}
+	data.Protocols = family.Select(protocols)
+	info.Peers[p] = data
 }
@@ -0,0 +1,327 @@
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+
+	"github.com/jibuji/p2p-service-discover/internal/logging"
+)
+
+var errNoGater = errors.New("node has no connection gater")
+
+// GaterConfig describes the connections refused by a Gater
+type GaterConfig struct {
+	// BlockedPeers are peer IDs that are never connected
+	BlockedPeers []string
+	// AllowedCIDRs limit connections to addresses in these ranges. Every
+	// address is allowed when it is empty.
+	AllowedCIDRs []string
+	// BlockedCIDRs are refused, even inside an allowed range
+	BlockedCIDRs []string
+	// BanFile keeps the bans made at runtime, so they survive restarts
+	BanFile string
+}
+
+// Ban is a peer banned at runtime
+type Ban struct {
+	Peer peer.ID `json:"peer"`
+	// Expires is nil for bans without expiry
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Gater is a libp2p connection gater refusing blocked peers and addresses
+// before any resources are spent on them. Peers can also be banned and
+// unbanned at runtime; bans are saved to GaterConfig.BanFile.
+type Gater struct {
+	blockedPeers map[peer.ID]struct{}
+	allowed      []*net.IPNet
+	blocked      []*net.IPNet
+	banFile      string
+
+	mu      sync.RWMutex
+	bans    map[peer.ID]time.Time // the zero time never expires
+	network network.Network
+}
+
+var _ connmgr.ConnectionGater = (*Gater)(nil)
+
+// NewGater creates a Gater, loading the bans saved in gc.BanFile
+func NewGater(gc GaterConfig) (*Gater, error) {
+	g := &Gater{
+		blockedPeers: make(map[peer.ID]struct{}, len(gc.BlockedPeers)),
+		banFile:      gc.BanFile,
+		bans:         make(map[peer.ID]time.Time),
+	}
+	for _, s := range gc.BlockedPeers {
+		p, err := peer.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blocked peer %q: %w", s, err)
+		}
+		g.blockedPeers[p] = struct{}{}
+	}
+	var err error
+	if g.allowed, err = parseCIDRs(gc.AllowedCIDRs); err != nil {
+		return nil, err
+	}
+	if g.blocked, err = parseCIDRs(gc.BlockedCIDRs); err != nil {
+		return nil, err
+	}
+	if err := g.load(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (gc *GaterConfig) validate() error {
+	for _, s := range gc.BlockedPeers {
+		if _, err := peer.Decode(s); err != nil {
+			return fmt.Errorf("invalid blocked peer %q: %w", s, err)
+		}
+	}
+	if _, err := parseCIDRs(gc.AllowedCIDRs); err != nil {
+		return err
+	}
+	_, err := parseCIDRs(gc.BlockedCIDRs)
+	return err
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, s := range cidrs {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", s, err)
+		}
+		nets[i] = ipnet
+	}
+	return nets, nil
+}
+
+// attach lets the gater close the connections of peers it bans
+func (g *Gater) attach(n network.Network) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.network = n
+}
+
+// Ban refuses connections with p for d, or until Unban when d is zero, and
+// closes the current ones
+func (g *Gater) Ban(p peer.ID, d time.Duration) error {
+	var expires time.Time
+	if d > 0 {
+		expires = time.Now().Add(d)
+	}
+
+	g.mu.Lock()
+	g.bans[p] = expires
+	err := g.save()
+	n := g.network
+	g.mu.Unlock()
+
+	if n != nil {
+		n.ClosePeer(p)
+	}
+	return err
+}
+
+// Unban lifts the ban on p. Peers in GaterConfig.BlockedPeers stay blocked.
+func (g *Gater) Unban(p peer.ID) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.bans[p]; !ok {
+		return fmt.Errorf("peer %s is not banned", p)
+	}
+	delete(g.bans, p)
+	return g.save()
+}
+
+// Bans returns the bans in effect, ordered by peer ID
+func (g *Gater) Bans() []Ban {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	now := time.Now()
+	bans := make([]Ban, 0, len(g.bans))
+	for p, expires := range g.bans {
+		if expires.IsZero() {
+			bans = append(bans, Ban{Peer: p})
+		} else if expires.After(now) {
+			bans = append(bans, Ban{Peer: p, Expires: &expires})
+		}
+	}
+	slices.SortFunc(bans, func(a, b Ban) int { return strings.Compare(string(a.Peer), string(b.Peer)) })
+	return bans
+}
+
+// Blocked reports whether connections with p are refused
+func (g *Gater) Blocked(p peer.ID) bool {
+	if _, ok := g.blockedPeers[p]; ok {
+		return true
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	expires, ok := g.bans[p]
+	return ok && (expires.IsZero() || time.Now().Before(expires))
+}
+
+// allowedAddr checks the IP of addr against the CIDR ranges. Addresses
+// without an IP, such as DNS addresses, are allowed.
+func (g *Gater) allowedAddr(addr multiaddr.Multiaddr) bool {
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return true
+	}
+	for _, ipnet := range g.blocked {
+		if ipnet.Contains(ip) {
+			return false
+		}
+	}
+	if len(g.allowed) == 0 {
+		return true
+	}
+	for _, ipnet := range g.allowed {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// InterceptPeerDial implements connmgr.ConnectionGater
+func (g *Gater) InterceptPeerDial(p peer.ID) bool {
+	return !g.Blocked(p)
+}
+
+// InterceptAddrDial implements connmgr.ConnectionGater
+func (g *Gater) InterceptAddrDial(_ peer.ID, addr multiaddr.Multiaddr) bool {
+	return g.allowedAddr(addr)
+}
+
+// InterceptAccept implements connmgr.ConnectionGater
+func (g *Gater) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	return g.allowedAddr(addrs.RemoteMultiaddr())
+}
+
+// InterceptSecured implements connmgr.ConnectionGater
+func (g *Gater) InterceptSecured(_ network.Direction, p peer.ID, addrs network.ConnMultiaddrs) bool {
+	return !g.Blocked(p) && g.allowedAddr(addrs.RemoteMultiaddr())
+}
+
+// InterceptUpgraded implements connmgr.ConnectionGater
+func (g *Gater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+// load reads the ban file, dropping expired bans
+func (g *Gater) load() error {
+	if g.banFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(g.banFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var bans []Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return fmt.Errorf("invalid ban file %s: %w", g.banFile, err)
+	}
+	now := time.Now()
+	for _, b := range bans {
+		switch {
+		case b.Expires == nil:
+			g.bans[b.Peer] = time.Time{}
+		case b.Expires.After(now):
+			g.bans[b.Peer] = *b.Expires
+		}
+	}
+	return nil
+}
+
+// save writes the bans in effect to the ban file. Must be called with g.mu
+// held.
+func (g *Gater) save() error {
+	if g.banFile == "" {
+		return nil
+	}
+	now := time.Now()
+	for p, expires := range g.bans {
+		if !expires.IsZero() && !expires.After(now) {
+			delete(g.bans, p)
+		}
+	}
+
+	bans := make([]Ban, 0, len(g.bans))
+	for p, expires := range g.bans {
+		b := Ban{Peer: p}
+		if !expires.IsZero() {
+			b.Expires = &expires
+		}
+		bans = append(bans, b)
+	}
+	slices.SortFunc(bans, func(a, b Ban) int { return strings.Compare(string(a.Peer), string(b.Peer)) })
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write a new file and rename it, so a crash never leaves a partial one
+	if err := os.MkdirAll(filepath.Dir(g.banFile), 0o700); err != nil {
+		return err
+	}
+	tmp := g.banFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to save bans: %w", err)
+	}
+	return os.Rename(tmp, g.banFile)
+}
+
+// Ban refuses connections with p for d, or until Unban when d is zero, and
+// closes the current ones
+func (n *ServiceNode) Ban(p peer.ID, d time.Duration) error {
+	if n.gater == nil {
+		return errNoGater
+	}
+	if err := n.gater.Ban(p, d); err != nil {
+		return err
+	}
+	n.logger.Info("Banned peer", logging.KeyPeer, p, "duration", d)
+	return nil
+}
+
+// Unban lifts a ban made with Ban
+func (n *ServiceNode) Unban(p peer.ID) error {
+	if n.gater == nil {
+		return errNoGater
+	}
+	if err := n.gater.Unban(p); err != nil {
+		return err
+	}
+	n.logger.Info("Unbanned peer", logging.KeyPeer, p)
+	return nil
+}
+
+// Bans returns the bans in effect
+func (n *ServiceNode) Bans() ([]Ban, error) {
+	if n.gater == nil {
+		return nil, errNoGater
+	}
+	return n.gater.Bans(), nil
+}
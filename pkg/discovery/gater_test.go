@@ -0,0 +1,155 @@
+package discovery
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+func TestGaterAddrs(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		blocked []string
+		addr    string
+		want    bool
+	}{
+		{name: "no ranges", addr: "/ip4/203.0.113.1/tcp/4001", want: true},
+		{name: "blocked", blocked: []string{"203.0.113.0/24"}, addr: "/ip4/203.0.113.1/tcp/4001", want: false},
+		{name: "not blocked", blocked: []string{"203.0.113.0/24"}, addr: "/ip4/198.51.100.1/tcp/4001", want: true},
+		{name: "allowed", allowed: []string{"203.0.113.0/24"}, addr: "/ip4/203.0.113.1/tcp/4001", want: true},
+		{name: "not allowed", allowed: []string{"203.0.113.0/24"}, addr: "/ip4/198.51.100.1/tcp/4001", want: false},
+		{
+			name:    "blocked inside allowed",
+			allowed: []string{"203.0.113.0/24"},
+			blocked: []string{"203.0.113.128/25"},
+			addr:    "/ip4/203.0.113.200/udp/4001/quic-v1",
+			want:    false,
+		},
+		{name: "blocked IPv6", blocked: []string{"2001:db8::/32"}, addr: "/ip6/2001:db8::1/tcp/4001", want: false},
+		{name: "DNS", allowed: []string{"203.0.113.0/24"}, addr: "/dns4/example.com/tcp/4001", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := NewGater(GaterConfig{AllowedCIDRs: tt.allowed, BlockedCIDRs: tt.blocked})
+			if err != nil {
+				t.Fatalf("NewGater: %v", err)
+			}
+			if got := g.InterceptAddrDial(randomPeer(t), multiaddr.StringCast(tt.addr)); got != tt.want {
+				t.Errorf("InterceptAddrDial(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGaterConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		gc   GaterConfig
+	}{
+		{name: "blocked peer", gc: GaterConfig{BlockedPeers: []string{"not-a-peer-id"}}},
+		{name: "allowed CIDR", gc: GaterConfig{AllowedCIDRs: []string{"203.0.113.1"}}},
+		{name: "blocked CIDR", gc: GaterConfig{BlockedCIDRs: []string{"203.0.113.0/33"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.gc.validate(); err == nil {
+				t.Error("validate succeeded")
+			}
+			if _, err := NewGater(tt.gc); err == nil {
+				t.Error("NewGater succeeded")
+			}
+		})
+	}
+}
+
+func TestGaterBlockedPeers(t *testing.T) {
+	blocked := randomPeer(t)
+	g, err := NewGater(GaterConfig{BlockedPeers: []string{blocked.String()}})
+	if err != nil {
+		t.Fatalf("NewGater: %v", err)
+	}
+	if g.InterceptPeerDial(blocked) {
+		t.Error("dial to a blocked peer allowed")
+	}
+	if !g.InterceptPeerDial(randomPeer(t)) {
+		t.Error("dial to another peer refused")
+	}
+	// Unban does not lift the configured block
+	if err := g.Unban(blocked); err == nil {
+		t.Error("Unban of a peer that is not banned succeeded")
+	}
+	if !g.Blocked(blocked) {
+		t.Error("blocked peer no longer blocked")
+	}
+}
+
+func TestGaterBans(t *testing.T) {
+	g, err := NewGater(GaterConfig{})
+	if err != nil {
+		t.Fatalf("NewGater: %v", err)
+	}
+	banned, expired := randomPeer(t), randomPeer(t)
+	if err := g.Ban(banned, 0); err != nil {
+		t.Fatalf("Ban: %v", err)
+	}
+	if err := g.Ban(expired, time.Nanosecond); err != nil {
+		t.Fatalf("Ban: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+
+	if g.InterceptPeerDial(banned) {
+		t.Error("dial to a banned peer allowed")
+	}
+	if !g.InterceptPeerDial(expired) {
+		t.Error("dial to a peer whose ban expired refused")
+	}
+	if bans := g.Bans(); len(bans) != 1 || bans[0].Peer != banned || bans[0].Expires != nil {
+		t.Errorf("Bans() = %v, want %s without expiry", bans, banned)
+	}
+
+	if err := g.Unban(banned); err != nil {
+		t.Fatalf("Unban: %v", err)
+	}
+	if g.Blocked(banned) {
+		t.Error("unbanned peer still blocked")
+	}
+}
+
+func TestGaterBanFile(t *testing.T) {
+	gc := GaterConfig{BanFile: filepath.Join(t.TempDir(), "bans", "bans.json")}
+	g, err := NewGater(gc)
+	if err != nil {
+		t.Fatalf("NewGater: %v", err)
+	}
+	forever, hour, unbanned := randomPeer(t), randomPeer(t), randomPeer(t)
+	for _, b := range []struct {
+		p peer.ID
+		d time.Duration
+	}{{forever, 0}, {hour, time.Hour}, {unbanned, 0}} {
+		if err := g.Ban(b.p, b.d); err != nil {
+			t.Fatalf("Ban: %v", err)
+		}
+	}
+	if err := g.Unban(unbanned); err != nil {
+		t.Fatalf("Unban: %v", err)
+	}
+
+	// A restarted gater keeps the bans in effect
+	g, err = NewGater(gc)
+	if err != nil {
+		t.Fatalf("NewGater with the ban file: %v", err)
+	}
+	if !g.Blocked(forever) || !g.Blocked(hour) {
+		t.Error("bans lost on restart")
+	}
+	if g.Blocked(unbanned) {
+		t.Error("lifted ban restored on restart")
+	}
+	if bans := g.Bans(); len(bans) != 2 {
+		t.Errorf("Bans() = %v, want 2 bans", bans)
+	}
+}
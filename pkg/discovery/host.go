@@ -0,0 +1,364 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+	"github.com/libp2p/go-libp2p/p2p/security/noise"
+	libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
+	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
+)
+
+// Transports and security protocols supported by HostConfig
+const (
+	TransportTCP       = "tcp"
+	TransportQUIC      = "quic"
+	TransportWebSocket = "websocket"
+
+	SecurityNoise = "noise"
+	SecurityTLS   = "tls"
+)
+
+// Default connection manager limits
+const (
+	DefaultConnLow   = 100
+	DefaultConnHigh  = 400
+	DefaultConnGrace = time.Minute
+)
+
+var transportOptions = map[string]libp2p.Option{
+	TransportTCP:       libp2p.Transport(tcp.NewTCPTransport),
+	TransportQUIC:      libp2p.Transport(quic.NewTransport),
+	TransportWebSocket: libp2p.Transport(websocket.New),
+}
+
+// transportListenAddrs are listened on when a transport is enabled and no
+// listen addresses are given
+var transportListenAddrs = map[string][]string{
+	TransportTCP:       {"/ip4/0.0.0.0/tcp/0", "/ip6/::/tcp/0"},
+	TransportQUIC:      {"/ip4/0.0.0.0/udp/0/quic-v1", "/ip6/::/udp/0/quic-v1"},
+	TransportWebSocket: {"/ip4/0.0.0.0/tcp/0/ws", "/ip6/::/tcp/0/ws"},
+}
+
+var securityOptions = map[string]libp2p.Option{
+	SecurityNoise: libp2p.Security(noise.ID, noise.New),
+	SecurityTLS:   libp2p.Security(libp2ptls.ID, libp2ptls.New),
+}
+
+// HostConfig describes the libp2p host created by NewNode and NewHost.
+// NewServiceNode, which is given a host, ignores it.
+type HostConfig struct {
+	// IdentityKeyFile holds the host's private key, so the peer ID survives
+	// restarts. A new key is generated and saved when the file does not exist;
+	// without a file the host gets a new peer ID every time.
+	IdentityKeyFile string
+	// ListenAddrs are the multiaddrs to listen on. By default the host listens
+	// on a random port of every enabled transport.
+	ListenAddrs []string
+	// Transports lists the enabled transports: tcp, quic and websocket.
+	// The libp2p defaults are used when it is empty.
+	Transports []string
+	// Security lists the security protocols in order of preference: noise
+	// and tls. The libp2p defaults are used when it is empty.
+	Security []string
+	// ConnLow and ConnHigh are the connection manager's watermarks: above
+	// ConnHigh connections, it trims down to ConnLow. Connections younger
+	// than ConnGrace are kept.
+	ConnLow   int
+	ConnHigh  int
+	ConnGrace time.Duration
+
+	// NATPortMap asks the router to forward a port with UPnP or NAT-PMP
+	NATPortMap bool
+	// AutoNATService answers other peers' AutoNAT reachability checks
+	AutoNATService bool
+	// Reachability overrides the reachability AutoNAT detects: public or
+	// private. Hosts forced private reserve relay slots right away.
+	Reachability string
+	// RelayService offers circuit relay v2 to other peers
+	RelayService bool
+	// StaticRelays are the relays, as multiaddrs including /p2p/, that the
+	// host reserves a slot on while it is not publicly reachable. Peers
+	// then reach it through /p2p-circuit addresses.
+	StaticRelays []string
+	// HolePunching upgrades relayed connections to direct ones
+	HolePunching bool
+
+	// ServiceLimits bound the streams and memory of service protocols in
+	// the resource manager, by protocol ID. The libp2p default resource
+	// manager is used when it is empty; a resource manager given in
+	// Libp2pOptions cannot be combined with it.
+	ServiceLimits map[string]ServiceLimit
+
+	// Gater configures the connection gater of the host
+	Gater GaterConfig
+
+	// PSK, PSKFile or PSKEnv, the name of an environment variable, give the
+	// pre-shared key of a private network. Peers without the same key
+	// cannot complete a handshake. Private networks do not support QUIC, so
+	// the libp2p defaults become TCP and WebSocket.
+	PSK     pnet.PSK
+	PSKFile string
+	PSKEnv  string
+	// RequirePSK refuses to create the host without a key
+	RequirePSK bool
+
+	// Libp2pOptions are appended to the options built from the fields above
+	Libp2pOptions []libp2p.Option
+}
+
+// Values of HostConfig.Reachability
+const (
+	ReachabilityPublic  = "public"
+	ReachabilityPrivate = "private"
+)
+
+func (hc *HostConfig) validate() error {
+	for _, t := range hc.Transports {
+		if _, ok := transportOptions[t]; !ok {
+			return fmt.Errorf("unknown transport %q", t)
+		}
+	}
+	for _, s := range hc.Security {
+		if _, ok := securityOptions[s]; !ok {
+			return fmt.Errorf("unknown security protocol %q", s)
+		}
+	}
+	if hc.ConnLow < 0 || hc.ConnHigh < hc.ConnLow {
+		return fmt.Errorf("connection limits must satisfy 0 <= low <= high, got low %d, high %d", hc.ConnLow, hc.ConnHigh)
+	}
+	if hc.ConnGrace < 0 {
+		return fmt.Errorf("connection grace period must not be negative, got %s", hc.ConnGrace)
+	}
+	switch hc.Reachability {
+	case "", ReachabilityPublic, ReachabilityPrivate:
+	default:
+		return fmt.Errorf("reachability must be public or private, got %q", hc.Reachability)
+	}
+	if _, err := hc.staticRelays(); err != nil {
+		return err
+	}
+	for protocol, l := range hc.ServiceLimits {
+		if err := l.validate(protocol); err != nil {
+			return err
+		}
+	}
+	keys := 0
+	for _, set := range []bool{len(hc.PSK) > 0, hc.PSKFile != "", hc.PSKEnv != ""} {
+		if set {
+			keys++
+		}
+	}
+	if keys > 1 {
+		return errors.New("only one of the private network key, key file and key variable may be set")
+	}
+	if hc.RequirePSK && keys == 0 {
+		return errors.New("a private network key is required but none is configured")
+	}
+	if hc.privateNetwork() {
+		if slices.Contains(hc.Transports, TransportQUIC) {
+			return errors.New("QUIC cannot be used in a private network")
+		}
+		for _, addr := range hc.ListenAddrs {
+			if strings.Contains(addr, "/quic") {
+				return fmt.Errorf("QUIC listen address %s cannot be used in a private network", addr)
+			}
+		}
+	}
+	return hc.Gater.validate()
+}
+
+func (hc *HostConfig) staticRelays() ([]peer.AddrInfo, error) {
+	relays := make([]peer.AddrInfo, 0, len(hc.StaticRelays))
+	for _, s := range hc.StaticRelays {
+		info, err := peer.AddrInfoFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid static relay %s: %w", s, err)
+		}
+		relays = append(relays, *info)
+	}
+	return relays, nil
+}
+
+// natOptions returns the libp2p options for NAT traversal and relaying
+func (hc *HostConfig) natOptions() []libp2p.Option {
+	var opts []libp2p.Option
+	if hc.NATPortMap {
+		opts = append(opts, libp2p.NATPortMap())
+	}
+	if hc.AutoNATService {
+		opts = append(opts, libp2p.EnableNATService(), libp2p.EnableAutoNATv2())
+	}
+	switch hc.Reachability {
+	case ReachabilityPublic:
+		opts = append(opts, libp2p.ForceReachabilityPublic())
+	case ReachabilityPrivate:
+		opts = append(opts, libp2p.ForceReachabilityPrivate())
+	}
+	if hc.RelayService {
+		opts = append(opts, libp2p.EnableRelayService())
+	}
+	if relays, _ := hc.staticRelays(); len(relays) > 0 {
+		// Reservations need the relay transport, which libp2p enables only
+		// after checking autorelay's options
+		opts = append(opts, libp2p.EnableRelay(), libp2p.EnableAutoRelayWithStaticRelays(relays))
+	}
+	if hc.HolePunching {
+		opts = append(opts, libp2p.EnableHolePunching())
+	}
+	return opts
+}
+
+// NewNode creates a libp2p host from the host settings in the configuration
+// and starts a ServiceNode on it. Closing the node closes the host.
+func NewNode(ctx context.Context, opts ...Option) (*ServiceNode, error) {
+	return NewNodeFromConfig(ctx, DefaultConfig(opts...))
+}
+
+// NewNodeFromConfig is NewNode for a configuration built beforehand, such as
+// one read by LoadConfig. cfg is not modified.
+func NewNodeFromConfig(ctx context.Context, cfg *Config) (*ServiceNode, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	h, gater, err := newHost(cfg.Host)
+	if err != nil {
+		return nil, err
+	}
+	nodeCfg := *cfg
+	if nodeCfg.Gater == nil {
+		nodeCfg.Gater = gater
+	}
+
+	node, err := NewServiceNode(ctx, h, nodeCfg)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	return node, nil
+}
+
+// NewHost creates a libp2p host as described by hc. Its connection gater
+// refuses the peers and addresses blocked in hc.Gater; NewNode also hands it
+// to the node for Ban and Unban.
+func NewHost(hc HostConfig) (host.Host, error) {
+	h, _, err := newHost(hc)
+	return h, err
+}
+
+func newHost(hc HostConfig) (host.Host, *Gater, error) {
+	if err := hc.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	priv, err := LoadIdentity(hc.IdentityKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gater, err := NewGater(hc.Gater)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	psk, err := hc.loadPSK()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cm, err := connmgr.NewConnManager(hc.ConnLow, hc.ConnHigh, connmgr.WithGracePeriod(hc.ConnGrace))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create connection manager: %w", err)
+	}
+
+	opts := []libp2p.Option{
+		libp2p.Identity(priv),
+		libp2p.ConnectionManager(cm),
+		libp2p.ConnectionGater(gater),
+	}
+	if psk != nil {
+		opts = append(opts, libp2p.PrivateNetwork(psk))
+	}
+	if len(hc.ServiceLimits) > 0 {
+		mgr, err := hc.resourceManager()
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, libp2p.ResourceManager(mgr))
+	}
+
+	listenAddrs := hc.ListenAddrs
+	for _, t := range hc.Transports {
+		opts = append(opts, transportOptions[t])
+		if len(hc.ListenAddrs) == 0 {
+			listenAddrs = append(listenAddrs, transportListenAddrs[t]...)
+		}
+	}
+	if len(listenAddrs) > 0 {
+		opts = append(opts, libp2p.ListenAddrStrings(listenAddrs...))
+	}
+	for _, s := range hc.Security {
+		opts = append(opts, securityOptions[s])
+	}
+	opts = append(opts, hc.natOptions()...)
+	opts = append(opts, hc.Libp2pOptions...)
+
+	h, err := libp2p.New(opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create libp2p host: %w", err)
+	}
+	return h, gater, nil
+}
+
+// LoadIdentity reads the private key at path, generating and saving a new
+// Ed25519 key if the file does not exist. An empty path yields a new key
+// that is not saved.
+func LoadIdentity(path string) (crypto.PrivKey, error) {
+	if path == "" {
+		priv, _, err := crypto.GenerateEd25519Key(nil)
+		return priv, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		priv, err := crypto.UnmarshalPrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity key %s: %w", path, err)
+		}
+		return priv, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		return nil, err
+	}
+	data, err = crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to save identity key: %w", err)
+	}
+	return priv, nil
+}
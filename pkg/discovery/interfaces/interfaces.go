@@ -2,10 +2,13 @@ package discovery
 
 import (
 	"context"
+	"time"
 
 	pb "github.com/jibuji/p2p-service-discover/internal/protocol/proto"
 	"github.com/jibuji/p2p-service-discover/pkg/types"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
 )
 
 // ServiceDiscovery defines the core functionality for service discovery
@@ -18,10 +21,42 @@ type ServiceDiscovery interface {
 
 	// CheckServiceProvider verifies if a peer provides a specific service
 	CheckServiceProvider(ctx context.Context, peerID peer.ID, serviceTopic string) (bool, error)
+
+	// PeersChangedSince returns the providers of a service added or updated
+	// after since, and those that departed after since
+	PeersChangedSince(serviceTopic string, since time.Time) (updated, departed []types.PeerInfo, err error)
 }
 
 // PeerExchange defines the peer exchange protocol functionality
 type PeerExchange interface {
 	// FetchPeerList retrieves a paginated list of peers for a service from a remote peer
 	FetchPeerList(ctx context.Context, remotePeer peer.ID, serviceTopic string, page, pageSize int32) ([]*pb.PeerInfo, error)
+
+	// CheckService asks a remote peer whether it knows providers of a service
+	CheckService(ctx context.Context, remotePeer peer.ID, serviceTopic string) (bool, error)
+
+	// SyncPeerList merges the changes to a remote peer's providers of a
+	// service since the previous sync into the node's own
+	SyncPeerList(ctx context.Context, remotePeer peer.ID, serviceTopic string) (updated, removed int, err error)
+}
+
+// ServiceReflection defines the reflection protocol functionality
+type ServiceReflection interface {
+	// Services describes the protocols the node serves or advertises
+	Services() []types.ServiceDescription
+
+	// FetchServices asks a remote peer which protocols it serves or advertises
+	FetchServices(ctx context.Context, remotePeer peer.ID) ([]types.ServiceDescription, error)
+
+	// Descriptors returns the protobuf files published for a protocol, each
+	// after the files it imports
+	Descriptors(protocolID string) []protoreflect.FileDescriptor
+
+	// ServiceAllowed reports whether the ACL of the handler serving a
+	// protocol accepts p; protocols without a handler accept every peer
+	ServiceAllowed(protocolID string, p peer.ID) bool
+
+	// FetchDescriptors asks a remote peer for the protobuf files it
+	// published for a protocol
+	FetchDescriptors(ctx context.Context, remotePeer peer.ID, protocolID string) (*protoregistry.Files, error)
 }
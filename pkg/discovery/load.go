@@ -0,0 +1,440 @@
+package discovery
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"gopkg.in/yaml.v3"
+
+	"github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	"github.com/jibuji/p2p-service-discover/pkg/types"
+)
+
+// EnvPrefix starts the names of the environment variables read by LoadConfig
+const EnvPrefix = "P2PDISCOVER_"
+
+var dhtModeNames = map[dht.ModeOpt]string{
+	dht.ModeAuto:       "auto",
+	dht.ModeClient:     "client",
+	dht.ModeServer:     "server",
+	dht.ModeAutoServer: "auto-server",
+}
+
+// fileConfig is the file representation of the settings in Config that are
+// not Go values
+type fileConfig struct {
+	EnableDHT           bool          `yaml:"enable_dht"`
+	DHTMode             string        `yaml:"dht_mode"`
+	EnablePubSub        bool          `yaml:"enable_pubsub"`
+	EnablePeerExchange  bool          `yaml:"enable_peer_exchange"`
+	EnableReflection    bool          `yaml:"enable_reflection"`
+	PeerTTL             time.Duration `yaml:"peer_ttl"`
+	DiscoveryInterval   time.Duration `yaml:"discovery_interval"`
+	AnnounceInterval    time.Duration `yaml:"announce_interval"`
+	AdminAddr           string        `yaml:"admin_addr"`
+	AdminToken          string        `yaml:"admin_token"`
+	AllowLimitedConns   bool          `yaml:"allow_limited_conns"`
+	PeerExchangeACLFile string        `yaml:"peer_exchange_acl_file"`
+	// PeerExchangeRateLimits has rate and burst keys under streams,
+	// peer_streams, calls and peer_calls
+	PeerExchangeRateLimits service.RateLimits `yaml:"peer_exchange_rate_limits"`
+	// PeerExchangeTimeouts has call, methods and idle keys
+	PeerExchangeTimeouts service.Timeouts `yaml:"peer_exchange_timeouts"`
+	// PeerExchangeLimits has max_peers, max_response_bytes and
+	// redact_private_addrs keys
+	PeerExchangeLimits types.PeerExchangeLimits `yaml:"peer_exchange_limits"`
+	// PeerVerification has reporters, probe and exclude_unverified keys
+	PeerVerification types.PeerVerification `yaml:"peer_verification"`
+	// ProviderAuthorities maps topics to authority peer IDs
+	ProviderAuthorities map[string][]string `yaml:"provider_authorities"`
+	Attestations        []string            `yaml:"attestations"`
+	Host                fileHostConfig      `yaml:"host"`
+}
+
+type fileHostConfig struct {
+	IdentityKeyFile string                  `yaml:"identity_key_file"`
+	ListenAddrs     []string                `yaml:"listen_addrs"`
+	Transports      []string                `yaml:"transports"`
+	Security        []string                `yaml:"security"`
+	ConnLow         int                     `yaml:"conn_low"`
+	ConnHigh        int                     `yaml:"conn_high"`
+	ConnGrace       time.Duration           `yaml:"conn_grace"`
+	NATPortMap      bool                    `yaml:"nat_port_map"`
+	AutoNATService  bool                    `yaml:"autonat_service"`
+	Reachability    string                  `yaml:"reachability"`
+	RelayService    bool                    `yaml:"relay_service"`
+	StaticRelays    []string                `yaml:"static_relays"`
+	HolePunching    bool                    `yaml:"hole_punching"`
+	BlockedPeers    []string                `yaml:"blocked_peers"`
+	AllowedCIDRs    []string                `yaml:"allowed_cidrs"`
+	BlockedCIDRs    []string                `yaml:"blocked_cidrs"`
+	BanFile         string                  `yaml:"ban_file"`
+	PSKFile         string                  `yaml:"psk_file"`
+	PSKEnv          string                  `yaml:"psk_env"`
+	RequirePSK      bool                    `yaml:"require_psk"`
+	ServiceLimits   map[string]ServiceLimit `yaml:"service_limits"`
+}
+
+// envSetters apply the environment variable named EnvPrefix plus the key
+var envSetters = map[string]func(fc *fileConfig, value string) error{
+	"ENABLE_DHT":             boolSetter(func(fc *fileConfig) *bool { return &fc.EnableDHT }),
+	"DHT_MODE":               stringSetter(func(fc *fileConfig) *string { return &fc.DHTMode }),
+	"ENABLE_PUBSUB":          boolSetter(func(fc *fileConfig) *bool { return &fc.EnablePubSub }),
+	"ENABLE_PEER_EXCHANGE":   boolSetter(func(fc *fileConfig) *bool { return &fc.EnablePeerExchange }),
+	"ENABLE_REFLECTION":      boolSetter(func(fc *fileConfig) *bool { return &fc.EnableReflection }),
+	"PEER_TTL":               durationSetter(func(fc *fileConfig) *time.Duration { return &fc.PeerTTL }),
+	"DISCOVERY_INTERVAL":     durationSetter(func(fc *fileConfig) *time.Duration { return &fc.DiscoveryInterval }),
+	"ANNOUNCE_INTERVAL":      durationSetter(func(fc *fileConfig) *time.Duration { return &fc.AnnounceInterval }),
+	"ADMIN_ADDR":             stringSetter(func(fc *fileConfig) *string { return &fc.AdminAddr }),
+	"ADMIN_TOKEN":            stringSetter(func(fc *fileConfig) *string { return &fc.AdminToken }),
+	"ALLOW_LIMITED_CONNS":    boolSetter(func(fc *fileConfig) *bool { return &fc.AllowLimitedConns }),
+	"PEER_EXCHANGE_ACL_FILE": stringSetter(func(fc *fileConfig) *string { return &fc.PeerExchangeACLFile }),
+	"ATTESTATIONS":           listSetter(func(fc *fileConfig) *[]string { return &fc.Attestations }),
+
+	"HOST_IDENTITY_KEY_FILE": stringSetter(func(fc *fileConfig) *string { return &fc.Host.IdentityKeyFile }),
+	"HOST_LISTEN_ADDRS":      listSetter(func(fc *fileConfig) *[]string { return &fc.Host.ListenAddrs }),
+	"HOST_TRANSPORTS":        listSetter(func(fc *fileConfig) *[]string { return &fc.Host.Transports }),
+	"HOST_SECURITY":          listSetter(func(fc *fileConfig) *[]string { return &fc.Host.Security }),
+	"HOST_CONN_LOW":          intSetter(func(fc *fileConfig) *int { return &fc.Host.ConnLow }),
+	"HOST_CONN_HIGH":         intSetter(func(fc *fileConfig) *int { return &fc.Host.ConnHigh }),
+	"HOST_CONN_GRACE":        durationSetter(func(fc *fileConfig) *time.Duration { return &fc.Host.ConnGrace }),
+	"HOST_NAT_PORT_MAP":      boolSetter(func(fc *fileConfig) *bool { return &fc.Host.NATPortMap }),
+	"HOST_AUTONAT_SERVICE":   boolSetter(func(fc *fileConfig) *bool { return &fc.Host.AutoNATService }),
+	"HOST_REACHABILITY":      stringSetter(func(fc *fileConfig) *string { return &fc.Host.Reachability }),
+	"HOST_RELAY_SERVICE":     boolSetter(func(fc *fileConfig) *bool { return &fc.Host.RelayService }),
+	"HOST_STATIC_RELAYS":     listSetter(func(fc *fileConfig) *[]string { return &fc.Host.StaticRelays }),
+	"HOST_HOLE_PUNCHING":     boolSetter(func(fc *fileConfig) *bool { return &fc.Host.HolePunching }),
+	"HOST_BLOCKED_PEERS":     listSetter(func(fc *fileConfig) *[]string { return &fc.Host.BlockedPeers }),
+	"HOST_ALLOWED_CIDRS":     listSetter(func(fc *fileConfig) *[]string { return &fc.Host.AllowedCIDRs }),
+	"HOST_BLOCKED_CIDRS":     listSetter(func(fc *fileConfig) *[]string { return &fc.Host.BlockedCIDRs }),
+	"HOST_BAN_FILE":          stringSetter(func(fc *fileConfig) *string { return &fc.Host.BanFile }),
+	"HOST_PSK_FILE":          stringSetter(func(fc *fileConfig) *string { return &fc.Host.PSKFile }),
+	"HOST_PSK_ENV":           stringSetter(func(fc *fileConfig) *string { return &fc.Host.PSKEnv }),
+	"HOST_REQUIRE_PSK":       boolSetter(func(fc *fileConfig) *bool { return &fc.Host.RequirePSK }),
+}
+
+// LoadConfig reads a Config from a YAML (.yaml, .yml) or JSON (.json) file.
+// Keys are the snake_case names of the Config fields, with the HostConfig
+// fields under "host". Durations are strings such as "90s" or "3h", and the
+// DHT mode is one of auto, client, server or auto-server. Missing keys keep
+// their default value.
+//
+// Environment variables named EnvPrefix plus the upper-case key, such as
+// P2PDISCOVER_PEER_TTL or P2PDISCOVER_HOST_LISTEN_ADDRS, override the file;
+// lists are comma-separated. opts are applied last. Unknown
+// keys and variables are errors, and the result is checked with Validate.
+func LoadConfig(path string, opts ...Option) (*Config, error) {
+	return LoadAppConfig(path, nil, opts...)
+}
+
+// LoadAppConfig is LoadConfig for programs that keep settings of their own
+// in the same file. app points to a struct whose fields, named by their yaml
+// tags, are read from the top-level keys of the file next to those of the
+// Config; its defaults are kept for missing keys. Keys known to neither are
+// errors.
+func LoadAppConfig(path string, app interface{}, opts ...Option) (*Config, error) {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml", ".json":
+	default:
+		return nil, fmt.Errorf("config %s: unsupported file extension %q", path, ext)
+	}
+	if app != nil {
+		if t := reflect.TypeOf(app); t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.Struct {
+			return nil, fmt.Errorf("config %s: app settings must be a pointer to a struct, got %T", path, app)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fc := toFileConfig(DefaultConfig())
+
+	// YAML is a superset of JSON, so one decoder reads both
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(withApp(fc, app)); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("config %s: %w", path, describeDecodeError(err))
+	}
+
+	if err := applyEnv(fc, os.Environ()); err != nil {
+		return nil, err
+	}
+
+	cfg, err := fc.config()
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// withApp returns the value to decode a file into: fc, or a struct inlining
+// both fc and the app settings, so that unknown keys are still found
+func withApp(fc *fileConfig, app interface{}) interface{} {
+	if app == nil {
+		return fc
+	}
+	v := reflect.New(reflect.StructOf([]reflect.StructField{
+		{Name: "Config", Type: reflect.TypeOf(fc), Tag: `yaml:",inline"`},
+		{Name: "App", Type: reflect.TypeOf(app), Tag: `yaml:",inline"`},
+	}))
+	v.Elem().Field(0).Set(reflect.ValueOf(fc))
+	v.Elem().Field(1).Set(reflect.ValueOf(app))
+	return v.Interface()
+}
+
+// describeDecodeError rewrites yaml's messages about unknown fields, which
+// name the internal type, in terms of config keys
+func describeDecodeError(err error) error {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return err
+	}
+	msgs := make([]string, len(typeErr.Errors))
+	for i, msg := range typeErr.Errors {
+		if before, _, ok := strings.Cut(msg, " not found in type "); ok {
+			line, field, _ := strings.Cut(before, ": field ")
+			msg = fmt.Sprintf("%s: unknown key %q", line, field)
+		}
+		msgs[i] = msg
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+func toFileConfig(c *Config) *fileConfig {
+	return &fileConfig{
+		EnableDHT:              c.EnableDHT,
+		DHTMode:                dhtModeNames[c.DHTMode],
+		EnablePubSub:           c.EnablePubSub,
+		EnablePeerExchange:     c.EnablePeerExchange,
+		EnableReflection:       c.EnableReflection,
+		PeerTTL:                c.PeerTTL,
+		DiscoveryInterval:      c.DiscoveryInterval,
+		AnnounceInterval:       c.AnnounceInterval,
+		AdminAddr:              c.AdminAddr,
+		AdminToken:             c.AdminToken,
+		AllowLimitedConns:      c.AllowLimitedConns,
+		PeerExchangeACLFile:    c.PeerExchangeACLFile,
+		PeerExchangeRateLimits: c.PeerExchangeRateLimits,
+		PeerExchangeTimeouts:   c.PeerExchangeTimeouts,
+		PeerExchangeLimits:     c.PeerExchangeLimits,
+		PeerVerification:       c.PeerVerification,
+		ProviderAuthorities:    encodeAuthorities(c.ProviderAuthorities),
+		Attestations:           c.Attestations,
+		Host: fileHostConfig{
+			IdentityKeyFile: c.Host.IdentityKeyFile,
+			ListenAddrs:     c.Host.ListenAddrs,
+			Transports:      c.Host.Transports,
+			Security:        c.Host.Security,
+			ConnLow:         c.Host.ConnLow,
+			ConnHigh:        c.Host.ConnHigh,
+			ConnGrace:       c.Host.ConnGrace,
+			NATPortMap:      c.Host.NATPortMap,
+			AutoNATService:  c.Host.AutoNATService,
+			Reachability:    c.Host.Reachability,
+			RelayService:    c.Host.RelayService,
+			StaticRelays:    c.Host.StaticRelays,
+			HolePunching:    c.Host.HolePunching,
+			BlockedPeers:    c.Host.Gater.BlockedPeers,
+			AllowedCIDRs:    c.Host.Gater.AllowedCIDRs,
+			BlockedCIDRs:    c.Host.Gater.BlockedCIDRs,
+			BanFile:         c.Host.Gater.BanFile,
+			PSKFile:         c.Host.PSKFile,
+			PSKEnv:          c.Host.PSKEnv,
+			RequirePSK:      c.Host.RequirePSK,
+			ServiceLimits:   c.Host.ServiceLimits,
+		},
+	}
+}
+
+func (fc *fileConfig) config() (*Config, error) {
+	mode, ok := parseDHTMode(fc.DHTMode)
+	if !ok {
+		return nil, fmt.Errorf("dht_mode must be auto, client, server or auto-server, got %q", fc.DHTMode)
+	}
+
+	c := DefaultConfig()
+	c.EnableDHT = fc.EnableDHT
+	c.DHTMode = mode
+	c.EnablePubSub = fc.EnablePubSub
+	c.EnablePeerExchange = fc.EnablePeerExchange
+	c.EnableReflection = fc.EnableReflection
+	c.PeerTTL = fc.PeerTTL
+	c.DiscoveryInterval = fc.DiscoveryInterval
+	c.AnnounceInterval = fc.AnnounceInterval
+	c.AdminAddr = fc.AdminAddr
+	c.AdminToken = fc.AdminToken
+	c.AllowLimitedConns = fc.AllowLimitedConns
+	c.PeerExchangeACLFile = fc.PeerExchangeACLFile
+	c.PeerExchangeRateLimits = fc.PeerExchangeRateLimits
+	c.PeerExchangeTimeouts = fc.PeerExchangeTimeouts
+	c.PeerExchangeLimits = fc.PeerExchangeLimits
+	c.PeerVerification = fc.PeerVerification
+	authorities, err := decodeAuthorities(fc.ProviderAuthorities)
+	if err != nil {
+		return nil, err
+	}
+	c.ProviderAuthorities = authorities
+	c.Attestations = fc.Attestations
+	c.Host.IdentityKeyFile = fc.Host.IdentityKeyFile
+	c.Host.ListenAddrs = fc.Host.ListenAddrs
+	c.Host.Transports = fc.Host.Transports
+	c.Host.Security = fc.Host.Security
+	c.Host.ConnLow = fc.Host.ConnLow
+	c.Host.ConnHigh = fc.Host.ConnHigh
+	c.Host.ConnGrace = fc.Host.ConnGrace
+	c.Host.NATPortMap = fc.Host.NATPortMap
+	c.Host.AutoNATService = fc.Host.AutoNATService
+	c.Host.Reachability = fc.Host.Reachability
+	c.Host.RelayService = fc.Host.RelayService
+	c.Host.StaticRelays = fc.Host.StaticRelays
+	c.Host.HolePunching = fc.Host.HolePunching
+	c.Host.Gater = GaterConfig{
+		BlockedPeers: fc.Host.BlockedPeers,
+		AllowedCIDRs: fc.Host.AllowedCIDRs,
+		BlockedCIDRs: fc.Host.BlockedCIDRs,
+		BanFile:      fc.Host.BanFile,
+	}
+	c.Host.PSKFile = fc.Host.PSKFile
+	c.Host.PSKEnv = fc.Host.PSKEnv
+	c.Host.RequirePSK = fc.Host.RequirePSK
+	c.Host.ServiceLimits = fc.Host.ServiceLimits
+	return c, nil
+}
+
+func encodeAuthorities(authorities map[string][]peer.ID) map[string][]string {
+	if authorities == nil {
+		return nil
+	}
+	encoded := make(map[string][]string, len(authorities))
+	for topic, ids := range authorities {
+		for _, id := range ids {
+			encoded[topic] = append(encoded[topic], id.String())
+		}
+	}
+	return encoded
+}
+
+func decodeAuthorities(encoded map[string][]string) (map[string][]peer.ID, error) {
+	if encoded == nil {
+		return nil, nil
+	}
+	authorities := make(map[string][]peer.ID, len(encoded))
+	for topic, ids := range encoded {
+		authorities[topic] = make([]peer.ID, 0, len(ids))
+		for _, s := range ids {
+			id, err := peer.Decode(s)
+			if err != nil {
+				return nil, fmt.Errorf("provider_authorities: invalid peer ID %q for topic %s: %w", s, topic, err)
+			}
+			authorities[topic] = append(authorities[topic], id)
+		}
+	}
+	return authorities, nil
+}
+
+func parseDHTMode(name string) (dht.ModeOpt, bool) {
+	for mode, n := range dhtModeNames {
+		if n == name {
+			return mode, true
+		}
+	}
+	return 0, false
+}
+
+// applyEnv applies the EnvPrefix variables found in environ
+func applyEnv(fc *fileConfig, environ []string) error {
+	var unknown []string
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		key, ok := strings.CutPrefix(name, EnvPrefix)
+		if !ok {
+			continue
+		}
+		set, ok := envSetters[key]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		if err := set(fc, value); err != nil {
+			return fmt.Errorf("environment variable %s: %w", name, err)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown environment variables: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+func boolSetter(field func(*fileConfig) *bool) func(*fileConfig, string) error {
+	return func(fc *fileConfig, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		*field(fc) = b
+		return nil
+	}
+}
+
+func stringSetter(field func(*fileConfig) *string) func(*fileConfig, string) error {
+	return func(fc *fileConfig, value string) error {
+		*field(fc) = value
+		return nil
+	}
+}
+
+func durationSetter(field func(*fileConfig) *time.Duration) func(*fileConfig, string) error {
+	return func(fc *fileConfig, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		*field(fc) = d
+		return nil
+	}
+}
+
+func intSetter(field func(*fileConfig) *int) func(*fileConfig, string) error {
+	return func(fc *fileConfig, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		*field(fc) = n
+		return nil
+	}
+}
+
+// listSetter reads a comma-separated list
+func listSetter(field func(*fileConfig) *[]string) func(*fileConfig, string) error {
+	return func(fc *fileConfig, value string) error {
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*field(fc) = list
+		return nil
+	}
+}
@@ -2,7 +2,11 @@ package discovery
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
+	"slices"
 	"sync"
 	"time"
 
@@ -11,30 +15,105 @@ import (
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 
 	srpc "github.com/jibuji/go-stream-rpc"
+	"github.com/jibuji/p2p-service-discover/internal/logging"
 	"github.com/jibuji/p2p-service-discover/internal/protocol/proto"
 	"github.com/jibuji/p2p-service-discover/internal/protocol/proto/service/peerexchange"
+	"github.com/jibuji/p2p-service-discover/internal/protocol/proto/service/reflection"
 	"github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	"github.com/jibuji/p2p-service-discover/pkg/metrics"
 	"github.com/jibuji/p2p-service-discover/pkg/types"
 )
 
+// ErrServiceRegistered is returned when registering a topic the node
+// already provides or watches
+var ErrServiceRegistered = errors.New("service already registered")
+
 type ServiceNode struct {
-	host            host.Host
-	dht             *dht.IpfsDHT
-	pubsub          *pubsub.PubSub
-	ctx             context.Context
-	cancel          context.CancelFunc
-	services        map[string]*types.ServiceInfo
-	mu              sync.RWMutex
-	peerTTL         time.Duration
-	serviceRegistry service.ServiceRegistry
+	host             host.Host
+	dht              *dht.IpfsDHT
+	pubsub           *pubsub.PubSub
+	ctx              context.Context
+	cancel           context.CancelFunc
+	services         map[string]*types.ServiceInfo
+	topics           map[string]*topicState
+	mu               sync.RWMutex
+	peerTTL          time.Duration
+	lookupInterval   time.Duration
+	announceInterval time.Duration
+	serviceRegistry  service.ServiceRegistry
+	metrics          *metrics.Metrics
+	logger           *slog.Logger
+	logLimiter       *logging.Limiter
+	tracer           trace.Tracer
+	peerExchange     bool
+	gater            *Gater
+	// adminToken is the bearer token admin API requests must present
+	adminToken string
+	// Topics whose providers need an attestation, and the node's own
+	providerAuthorities map[string][]peer.ID
+	attestations        []ownAttestation
+	verification        types.PeerVerification
+	// probes queues unverified providers to connect to, with the addresses
+	// peer exchange sent for them
+	probes chan peer.AddrInfo
+}
+
+// topicState holds the discovery routines running for a registered topic
+type topicState struct {
+	// advertise is false for topics that are only watched
+	advertise bool
+	// family is set for topics such as /calculator/1.x, shared by the
+	// versions of a protocol with the same major version. The node announces
+	// there the versions it provides; watched is set when WatchService asked
+	// for the family.
+	family   bool
+	watched  bool
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	topic    *pubsub.Topic
+	dht      chan struct{}
+	announce chan struct{}
+	// syncs holds where peer exchange syncs left off, by remote peer.
+	// Guarded by the node's mu.
+	syncs map[peer.ID]peerSync
 }
 
+// stop ends the discovery routines and leaves the pubsub topic
+func (t *topicState) stop() {
+	t.cancel()
+	t.wg.Wait()
+	if t.topic != nil {
+		t.topic.Close()
+	}
+}
+
+// refresh asks the routines to look up providers and announce now
+func (t *topicState) refresh() {
+	for _, ch := range []chan struct{}{t.dht, t.announce} {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+const tracerName = "github.com/jibuji/p2p-service-discover/pkg/discovery"
+
+// logInterval bounds how often a repeating discovery failure is logged
+const logInterval = 5 * time.Minute
+
+// aclReloadInterval is how often Config.PeerExchangeACLFile is checked for
+// changes
+const aclReloadInterval = 10 * time.Second
+
 func (n *ServiceNode) initProtocols(cfg Config) error {
 	// Initialize DHT if enabled
 	if cfg.EnableDHT {
-		kdht, err := dht.New(n.ctx, n.host)
+		kdht, err := dht.New(n.ctx, n.host, dht.Mode(cfg.DHTMode))
 		if err != nil {
 			return err
 		}
@@ -49,18 +128,65 @@ func (n *ServiceNode) initProtocols(cfg Config) error {
 		}
 		n.pubsub = ps
 	}
+	n.peerExchange = cfg.EnablePeerExchange
+	if !cfg.EnablePeerExchange && !cfg.EnableReflection {
+		return nil
+	}
+
+	// Peer exchange and reflection share the ACL, rate limits and timeouts
+	acl := cfg.PeerExchangeACL
+	if cfg.PeerExchangeACLFile != "" {
+		var err error
+		if acl, err = service.LoadACL(cfg.PeerExchangeACLFile); err != nil {
+			return err
+		}
+		go acl.Watch(n.ctx, aclReloadInterval, n.logger)
+	}
+	handlerOpts := []service.HandlerOption{
+		service.WithACL(acl),
+		service.WithRateLimits(cfg.PeerExchangeRateLimits),
+		service.WithTimeouts(cfg.PeerExchangeTimeouts),
+	}
 
 	// Initialize peer exchange if enabled
 	if cfg.EnablePeerExchange {
-		handler := peerexchange.NewHandler(n)
-		if err := n.RegisterServiceHandler(handler); err != nil {
+		handler := peerexchange.NewHandler(n, cfg.PeerExchangeLimits, n.metrics, n.logger)
+		opts := append(slices.Clip(handlerOpts), service.WithDescriptors(proto.File_internal_protocol_proto_peerlist_proto))
+		if err := n.RegisterServiceHandler(handler, opts...); err != nil {
 			return err
 		}
 
+		for _, id := range handler.Protocols() {
+			n.Registry().RegisterClientConstructor(
+				id,
+				func(peer *srpc.RpcPeer) interface{} {
+					return proto.NewServicePeerClient(peer)
+				},
+			)
+		}
+	}
+
+	// Initialize reflection and descriptors if enabled. They are served
+	// without being advertised: every node that enables them answers.
+	if cfg.EnableReflection {
+		opts := append(slices.Clip(handlerOpts), service.WithDescriptors(proto.File_internal_protocol_proto_reflection_proto))
+		if err := n.serviceRegistry.RegisterService(reflection.NewHandler(n), opts...); err != nil {
+			return err
+		}
+		opts = append(slices.Clip(handlerOpts), service.WithDescriptors(proto.File_internal_protocol_proto_descriptor_proto))
+		if err := n.serviceRegistry.RegisterService(reflection.NewDescriptorHandler(n), opts...); err != nil {
+			return err
+		}
 		n.Registry().RegisterClientConstructor(
-			peerexchange.PeerExchangeProtocolID,
+			reflection.ReflectionProtocolID,
 			func(peer *srpc.RpcPeer) interface{} {
-				return proto.NewServicePeerClient(peer)
+				return proto.NewReflectionClient(peer)
+			},
+		)
+		n.Registry().RegisterClientConstructor(
+			reflection.DescriptorProtocolID,
+			func(peer *srpc.RpcPeer) interface{} {
+				return proto.NewDescriptorClient(peer)
 			},
 		)
 	}
@@ -68,69 +194,380 @@ func (n *ServiceNode) initProtocols(cfg Config) error {
 	return nil
 }
 
-// NewServiceNode creates a new service discovery node
+// NewServiceNode creates a new service discovery node. cfg.Options are
+// applied to cfg first, and the result is checked with Validate.
 func NewServiceNode(ctx context.Context, h host.Host, cfg Config) (*ServiceNode, error) {
+	for _, opt := range cfg.Options {
+		opt(&cfg)
+	}
+	if cfg.DiscoveryInterval <= 0 {
+		cfg.DiscoveryInterval = DefaultDiscoveryInterval
+	}
+	if cfg.AnnounceInterval <= 0 {
+		cfg.AnnounceInterval = DefaultAnnounceInterval
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	attestations, err := parseAttestations(cfg.Attestations)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
 	node := &ServiceNode{
-		host:     h,
-		ctx:      ctx,
-		cancel:   cancel,
-		services: make(map[string]*types.ServiceInfo),
-		peerTTL:  cfg.PeerTTL,
+		host:             h,
+		ctx:              ctx,
+		cancel:           cancel,
+		services:         make(map[string]*types.ServiceInfo),
+		topics:           make(map[string]*topicState),
+		peerTTL:          cfg.PeerTTL,
+		lookupInterval:   cfg.DiscoveryInterval,
+		announceInterval: cfg.AnnounceInterval,
+		gater:            cfg.Gater,
+		adminToken:       cfg.AdminToken,
+		logger:           logger.With("node", h.ID()),
+		logLimiter:       logging.NewLimiter(logInterval),
+
+		providerAuthorities: cfg.ProviderAuthorities,
+		attestations:        attestations,
+		verification:        cfg.PeerVerification,
+		probes:              make(chan peer.AddrInfo, probeQueue),
+	}
+	if cfg.Gater != nil {
+		cfg.Gater.attach(h.Network())
+	}
+
+	if cfg.MetricsRegisterer != nil {
+		m, err := metrics.New(cfg.MetricsRegisterer)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("failed to register metrics: %w", err)
+		}
+		if err := m.WatchProviders(node.countProviders); err != nil {
+			m.Unregister()
+			cancel()
+			return nil, fmt.Errorf("failed to register metrics: %w", err)
+		}
+		node.metrics = m
 	}
 
-	node.serviceRegistry = service.NewRegistry(h)
+	tp := cfg.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	node.tracer = tp.Tracer(tracerName)
+
+	node.serviceRegistry = service.NewRegistry(h,
+		service.WithMetrics(node.metrics),
+		service.WithLogger(node.logger),
+		service.WithTracerProvider(tp),
+		service.WithLimitedConns(cfg.AllowLimitedConns),
+		service.WithServerInterceptors(cfg.ServerInterceptors...),
+		service.WithClientInterceptors(cfg.ClientInterceptors...),
+	)
+
+	if err := node.startVerification(); err != nil {
+		node.metrics.Unregister()
+		cancel()
+		return nil, err
+	}
 
 	// Initialize DHT and PubSub if enabled
 	if err := node.initProtocols(cfg); err != nil {
+		node.metrics.Unregister()
 		cancel()
 		return nil, err
 	}
 
+	if cfg.AdminAddr != "" {
+		ln, err := net.Listen("tcp", cfg.AdminAddr)
+		if err != nil {
+			node.metrics.Unregister()
+			cancel()
+			return nil, fmt.Errorf("failed to listen for admin API: %w", err)
+		}
+		go func() {
+			if err := node.serveAdmin(ctx, ln); err != nil {
+				node.logger.Error("Admin API stopped", "error", err)
+			}
+		}()
+		node.logger.Info("Admin API listening", "addr", ln.Addr())
+	}
+
+	node.logger.Info("Service node started",
+		"dht", cfg.EnableDHT, "pubsub", cfg.EnablePubSub, "peer_exchange", cfg.EnablePeerExchange,
+		"reflection", cfg.EnableReflection)
 	return node, nil
 }
 
-// RegisterService registers a new service with the given topic
+// RegisterService registers a new service with the given topic. The node
+// advertises itself as a provider and discovers other providers. For
+// protocol IDs ending with a version, such as /calculator/1.2.0, the node
+// also announces the version on the topic of its protocol family,
+// /calculator/1.x, where FindCompatiblePeers looks for it. Registering a
+// topic twice fails with ErrServiceRegistered.
 func (n *ServiceNode) RegisterService(serviceTopic string) error {
+	if service.IsProtocolRange(serviceTopic) {
+		return fmt.Errorf("cannot provide a range of versions: %s", serviceTopic)
+	}
+	if err := n.registerTopic(serviceTopic, true); err != nil {
+		return err
+	}
+	family, ok := service.FamilyTopic(serviceTopic)
+	if !ok {
+		return nil
+	}
+	if err := n.joinFamily(family, false); err != nil {
+		n.stopTopic(serviceTopic)
+		return err
+	}
+	n.advertiseFamily(family)
+	return nil
+}
+
+// WatchService discovers providers of the given topic without advertising
+// the node as one. The topic may be a range of versions such as
+// /calculator/^1.0, whose providers are returned by FindCompatiblePeers.
+func (n *ServiceNode) WatchService(serviceTopic string) error {
+	if service.IsProtocolRange(serviceTopic) {
+		pr, err := service.ParseProtocolRange(serviceTopic)
+		if err != nil {
+			return err
+		}
+		return n.joinFamily(pr.Family(), true)
+	}
+	return n.registerTopic(serviceTopic, false)
+}
+
+func (n *ServiceNode) registerTopic(serviceTopic string, advertise bool) error {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
 	if _, exists := n.services[serviceTopic]; exists {
-		return fmt.Errorf("service %s already registered", serviceTopic)
+		return fmt.Errorf("%w: %s", ErrServiceRegistered, serviceTopic)
 	}
+	return n.startTopic(serviceTopic, &topicState{advertise: advertise})
+}
+
+// joinFamily registers a protocol family topic unless it already is. watch
+// marks it as asked for by WatchService, which keeps it registered when the
+// node stops providing versions of the protocol.
+func (n *ServiceNode) joinFamily(family string, watch bool) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 
+	if state, exists := n.topics[family]; exists {
+		state.watched = state.watched || watch
+		return nil
+	}
+	return n.startTopic(family, &topicState{family: true, watched: watch})
+}
+
+// startTopic starts discovering serviceTopic, and advertising it unless it
+// is only watched. Must be called with n.mu held.
+func (n *ServiceNode) startTopic(serviceTopic string, state *topicState) error {
 	service := &types.ServiceInfo{
-		Topic: serviceTopic,
-		Peers: make(map[peer.ID]types.PeerData),
+		Topic:      serviceTopic,
+		Peers:      make(map[peer.ID]types.PeerData),
+		Registered: time.Now(),
 	}
 
-	// Setup DHT advertising if enabled
-	if n.dht != nil {
-		routingDiscovery := routing.NewRoutingDiscovery(n.dht)
-		routingDiscovery.Advertise(n.ctx, serviceTopic)
+	log := n.logger.With(logging.KeyTopic, serviceTopic)
 
-		// Start DHT discovery loop
-		go n.dhtDiscoveryLoop(serviceTopic)
-	}
+	ctx, cancel := context.WithCancel(n.ctx)
+	state.cancel = cancel
+	state.dht = make(chan struct{}, 1)
+	state.announce = make(chan struct{}, 1)
+	advertise := state.advertise
 
-	// Setup PubSub if enabled
+	// Join the pubsub topic first, so a failure leaves nothing running
+	var sub *pubsub.Subscription
 	if n.pubsub != nil {
 		topic, err := n.pubsub.Join(serviceTopic)
 		if err != nil {
+			cancel()
 			return fmt.Errorf("failed to join topic: %w", err)
 		}
+		sub, err = topic.Subscribe()
+		if err != nil {
+			topic.Close()
+			cancel()
+			return fmt.Errorf("failed to subscribe to topic: %w", err)
+		}
+		state.topic = topic
+	}
 
-		// Start pubsub announcement and discovery routines
-		go n.announceLoop(serviceTopic, topic)
-		go n.pubsubDiscoveryLoop(serviceTopic, topic)
+	// Setup DHT advertising if enabled
+	if n.dht != nil {
+		if advertise {
+			routingDiscovery := routing.NewRoutingDiscovery(n.dht)
+			if _, err := routingDiscovery.Advertise(ctx, serviceTopic); err != nil {
+				log.Warn("Failed to advertise service", logging.KeyBackend, backendDHT, "error", err)
+			}
+		}
+
+		// Start DHT discovery loop
+		state.wg.Add(1)
+		go func() {
+			defer state.wg.Done()
+			n.dhtDiscoveryLoop(ctx, serviceTopic, state.dht)
+		}()
+	}
+
+	// Start pubsub announcement and discovery routines. Family topics are
+	// announced on while the node provides a version in the family.
+	if state.topic != nil {
+		if advertise || state.family {
+			state.wg.Add(1)
+			go func() {
+				defer state.wg.Done()
+				n.announceLoop(ctx, serviceTopic, state.topic, state.family, state.announce)
+			}()
+		}
+		state.wg.Add(1)
+		go func() {
+			defer state.wg.Done()
+			n.pubsubDiscoveryLoop(ctx, serviceTopic, sub)
+		}()
 	}
 
 	n.services[serviceTopic] = service
+	n.topics[serviceTopic] = state
+	log.Info("Service registered", "advertise", advertise, "family", state.family)
 	return nil
 }
 
-// FindPeers returns a list of peers that provide the specified service
+// advertiseFamily advertises the node in the DHT as a provider of a
+// protocol family and announces its versions right away
+func (n *ServiceNode) advertiseFamily(family string) {
+	if n.dht != nil {
+		routingDiscovery := routing.NewRoutingDiscovery(n.dht)
+		if _, err := routingDiscovery.Advertise(n.ctx, family); err != nil {
+			n.logger.Warn("Failed to advertise service", logging.KeyTopic, family,
+				logging.KeyBackend, backendDHT, "error", err)
+		}
+	}
+	n.Refresh(family)
+}
+
+// familyVersions returns the protocol IDs in family that the node provides,
+// highest first. Must be called with n.mu held.
+func (n *ServiceNode) familyVersions(family string) []string {
+	var versions []string
+	for topic, state := range n.topics {
+		if f, ok := service.FamilyTopic(topic); ok && f == family && state.advertise {
+			versions = append(versions, topic)
+		}
+	}
+	pr, err := service.ParseProtocolRange(family)
+	if err != nil {
+		return nil
+	}
+	return pr.Select(versions)
+}
+
+// UnregisterService stops discovering and announcing the given topic, which
+// may be registered or watched, and
+// forgets its providers. A handler registered for the topic keeps serving.
+// For a range, the node stops watching its protocol family, which stays
+// registered while the node provides versions in it.
+func (n *ServiceNode) UnregisterService(serviceTopic string) error {
+	if service.IsProtocolRange(serviceTopic) {
+		pr, err := service.ParseProtocolRange(serviceTopic)
+		if err != nil {
+			return err
+		}
+		n.mu.Lock()
+		state, ok := n.topics[pr.Family()]
+		if ok {
+			state.watched = false
+		}
+		n.mu.Unlock()
+		if !ok {
+			return fmt.Errorf("service not found: %s", serviceTopic)
+		}
+		n.leaveFamily(pr.Family())
+		return nil
+	}
+
+	if err := n.stopTopic(serviceTopic); err != nil {
+		return err
+	}
+	if family, ok := service.FamilyTopic(serviceTopic); ok {
+		n.leaveFamily(family)
+	}
+	return nil
+}
+
+// leaveFamily unregisters a protocol family topic once it is neither
+// watched nor home to a version the node provides
+func (n *ServiceNode) leaveFamily(family string) {
+	n.mu.RLock()
+	state, ok := n.topics[family]
+	unused := ok && state.family && !state.watched && len(n.familyVersions(family)) == 0
+	n.mu.RUnlock()
+	if unused {
+		n.stopTopic(family)
+	}
+}
+
+func (n *ServiceNode) stopTopic(serviceTopic string) error {
+	n.mu.Lock()
+	state, ok := n.topics[serviceTopic]
+	delete(n.topics, serviceTopic)
+	n.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("service not found: %s", serviceTopic)
+	}
+
+	state.stop()
+
+	n.mu.Lock()
+	delete(n.services, serviceTopic)
+	n.mu.Unlock()
+
+	n.logger.Info("Service unregistered", logging.KeyTopic, serviceTopic)
+	return nil
+}
+
+// Refresh triggers an immediate DHT lookup and pubsub announcement for the
+// given topic, or for every registered topic when serviceTopic is empty. A
+// range refreshes its protocol family.
+func (n *ServiceNode) Refresh(serviceTopic string) error {
+	if service.IsProtocolRange(serviceTopic) {
+		pr, _ := service.ParseProtocolRange(serviceTopic)
+		serviceTopic = pr.Family()
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if serviceTopic == "" {
+		for _, state := range n.topics {
+			state.refresh()
+		}
+		return nil
+	}
+
+	state, ok := n.topics[serviceTopic]
+	if !ok {
+		return fmt.Errorf("service not found: %s", serviceTopic)
+	}
+	state.refresh()
+	return nil
+}
+
+// FindPeers returns a list of peers that provide the specified service,
+// verified ones first. Unverified providers, learned only through peer
+// exchange, are left out with PeerVerification.ExcludeUnverified.
 func (n *ServiceNode) FindPeers(serviceTopic string) ([]types.PeerInfo, error) {
 	n.mu.RLock()
 	defer n.mu.RUnlock()
@@ -143,24 +580,147 @@ func (n *ServiceNode) FindPeers(serviceTopic string) ([]types.PeerInfo, error) {
 	var peers []types.PeerInfo
 	now := time.Now()
 	for p, data := range service.Peers {
-		if now.Sub(data.LastSeen) < n.peerTTL {
-			// Get peer's multiaddresses
-			peerAddrs := n.host.Peerstore().Addrs(p)
-			addrStrings := make([]string, len(peerAddrs))
-			for i, addr := range peerAddrs {
-				addrStrings[i] = addr.String()
-			}
+		if n.live(serviceTopic, data, now) && n.listed(data) {
+			peers = append(peers, n.peerInfo(p, data))
+		}
+	}
+	slices.SortStableFunc(peers, compareVerified)
+	return peers, nil
+}
 
-			peers = append(peers, types.PeerInfo{
-				ID:       p,
-				Addrs:    addrStrings,
-				LastSeen: data.LastSeen,
-			})
+// peerInfo describes a recorded provider
+func (n *ServiceNode) peerInfo(p peer.ID, data types.PeerData) types.PeerInfo {
+	// Merge the peerstore's addresses with the discovered ones, which
+	// include the relay addresses of providers behind NAT
+	addrStrings := convertAddrs(n.host.Peerstore().Addrs(p))
+	for _, addr := range data.Addrs {
+		if !slices.Contains(addrStrings, addr) {
+			addrStrings = append(addrStrings, addr)
 		}
 	}
+
+	return types.PeerInfo{
+		ID:          p,
+		Addrs:       addrStrings,
+		LastSeen:    data.LastSeen,
+		Attestation: data.Attestation,
+		Protocols:   data.Protocols,
+		Verified:    data.Verified,
+	}
+}
+
+// FindCompatiblePeers returns the providers of a version in a range such as
+// /calculator/^1.0, with the versions in the range each one provides,
+// highest first. Providers come from the protocol family topic, registered
+// with WatchService(serviceRange) or when the node provides a version in
+// the family, and from the registered topics of versions in the range. The
+// versions of a provider found only in the DHT are taken from identify once
+// the node has connected to it; until then it is left out. Peers are
+// ordered by their highest version, verified ones first.
+func (n *ServiceNode) FindCompatiblePeers(serviceRange string) ([]types.PeerInfo, error) {
+	pr, err := service.ParseProtocolRange(serviceRange)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.RLock()
+	var topics []string
+	for topic := range n.services {
+		if topic == pr.Family() || pr.Contains(topic) {
+			topics = append(topics, topic)
+		}
+	}
+	n.mu.RUnlock()
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("service not found: %s", serviceRange)
+	}
+
+	byPeer := make(map[peer.ID]*types.PeerInfo)
+	var order []peer.ID
+	for _, topic := range topics {
+		peers, err := n.FindPeers(topic)
+		if err != nil {
+			continue
+		}
+		for _, info := range peers {
+			protocols := info.Protocols
+			switch {
+			case topic != pr.Family():
+				protocols = []string{topic}
+			case len(protocols) == 0:
+				protocols = n.identifiedProtocols(info.ID)
+			}
+			protocols = pr.Select(protocols)
+			if len(protocols) == 0 {
+				continue
+			}
+			found, ok := byPeer[info.ID]
+			if !ok {
+				info.Protocols = nil
+				found = &info
+				byPeer[info.ID] = found
+				order = append(order, info.ID)
+			}
+			if info.LastSeen.After(found.LastSeen) {
+				found.LastSeen = info.LastSeen
+			}
+			found.Verified = found.Verified || info.Verified
+			found.Protocols = pr.Select(append(found.Protocols, protocols...))
+		}
+	}
+
+	peers := make([]types.PeerInfo, 0, len(order))
+	for _, p := range order {
+		peers = append(peers, *byPeer[p])
+	}
+	slices.SortStableFunc(peers, func(a, b types.PeerInfo) int {
+		if c := compareHighest(a.Protocols, b.Protocols); c != 0 {
+			return -c
+		}
+		return compareVerified(a, b)
+	})
 	return peers, nil
 }
 
+// identifiedProtocols returns the protocols identify reported for p
+func (n *ServiceNode) identifiedProtocols(p peer.ID) []string {
+	supported, err := n.host.Peerstore().GetProtocols(p)
+	if err != nil {
+		return nil
+	}
+	ids := make([]string, len(supported))
+	for i, id := range supported {
+		ids[i] = string(id)
+	}
+	return ids
+}
+
+// compareHighest compares the first, highest, versions of two sorted lists
+func compareHighest(a, b []string) int {
+	_, va, _ := service.SplitProtocolID(a[0])
+	_, vb, _ := service.SplitProtocolID(b[0])
+	return va.Compare(vb)
+}
+
+// countProviders returns the number of live providers per registered topic
+func (n *ServiceNode) countProviders() map[string]int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	counts := make(map[string]int, len(n.services))
+	now := time.Now()
+	for topic, service := range n.services {
+		live := 0
+		for _, data := range service.Peers {
+			if n.live(topic, data, now) {
+				live++
+			}
+		}
+		counts[topic] = live
+	}
+	return counts
+}
+
 // CheckServiceProvider verifies if a peer provides a specific service
 func (n *ServiceNode) CheckServiceProvider(ctx context.Context, peerID peer.ID, serviceTopic string) (bool, error) {
 	n.mu.RLock()
@@ -171,12 +731,14 @@ func (n *ServiceNode) CheckServiceProvider(ctx context.Context, peerID peer.ID,
 		return false, fmt.Errorf("service not found: %s", serviceTopic)
 	}
 
+	n.mu.RLock()
 	data, exists := service.Peers[peerID]
+	n.mu.RUnlock()
 	if !exists {
 		return false, nil
 	}
 
-	return time.Since(data.LastSeen) < n.peerTTL, nil
+	return n.live(serviceTopic, data, time.Now()) && n.listed(data), nil
 }
 
 // Host returns the libp2p host
@@ -187,6 +749,8 @@ func (n *ServiceNode) Host() host.Host {
 // Close shuts down the node and all its services
 func (n *ServiceNode) Close() error {
 	n.cancel()
+	n.metrics.Unregister()
+	n.logger.Info("Service node closing")
 	if n.dht != nil {
 		if err := n.dht.Close(); err != nil {
 			return err
@@ -195,6 +759,15 @@ func (n *ServiceNode) Close() error {
 	return n.host.Close()
 }
 
+// IsAdvertised reports whether the node advertises itself as a provider of
+// the given topic, rather than only watching it
+func (n *ServiceNode) IsAdvertised(serviceTopic string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	state, ok := n.topics[serviceTopic]
+	return ok && (state.advertise || state.family && len(n.familyVersions(serviceTopic)) > 0)
+}
+
 // ListServices returns a list of all registered service topics
 func (n *ServiceNode) ListServices() []string {
 	n.mu.RLock()
@@ -212,15 +785,30 @@ func (n *ServiceNode) ListPeers(serviceTopic string) ([]types.PeerInfo, error) {
 	return n.FindPeers(serviceTopic)
 }
 
-// RegisterServiceHandler registers a service handler and automatically registers it for discovery
-func (n *ServiceNode) RegisterServiceHandler(handler service.ServiceHandler) error {
-	// Register the service for discovery
-	if err := n.RegisterService(handler.Protocol()); err != nil {
+// RegisterServiceHandler registers a service handler and automatically registers it for discovery.
+// opts apply to this handler only, such as service.WithACL. A handler serving
+// several protocol IDs, such as versions added with BaseService.AddProtocols,
+// is registered for discovery under each of them.
+func (n *ServiceNode) RegisterServiceHandler(handler service.ServiceHandler, opts ...service.HandlerOption) error {
+	// Register the service handler first, so that invalid options leave
+	// nothing advertised
+	if err := n.serviceRegistry.RegisterService(handler, opts...); err != nil {
 		return err
 	}
 
-	// Register the service handler
-	return n.serviceRegistry.RegisterService(handler)
+	// Register the service for discovery. If a topic fails, nothing is
+	// left advertised or served.
+	protocols := service.ServedProtocols(handler)
+	for i, protocolID := range protocols {
+		if err := n.RegisterService(protocolID); err != nil {
+			for _, registered := range protocols[:i] {
+				n.UnregisterService(registered)
+			}
+			n.serviceRegistry.UnregisterService(handler)
+			return err
+		}
+	}
+	return nil
 }
 
 // NewServiceClient creates a client for a remote service
@@ -2,12 +2,47 @@ package discovery
 
 import (
 	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"time"
 
+	"github.com/jibuji/p2p-service-discover/internal/bloom"
+	"github.com/jibuji/p2p-service-discover/internal/logging"
 	"github.com/jibuji/p2p-service-discover/internal/protocol/proto"
+	"github.com/jibuji/p2p-service-discover/pkg/types"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	protobuf "google.golang.org/protobuf/proto"
 )
 
-const PeerExchangeProtocolID = "/peer-exchange/1.0.1"
+const (
+	PeerExchangeProtocolID = "/peer-exchange/1.0.1"
+	// PeerExchangeSyncProtocolID adds delta syncs to peer exchange
+	PeerExchangeSyncProtocolID = "/peer-exchange/1.1.0"
+)
+
+// fullSyncEvery makes every nth sync with a peer a full one, resending the
+// providers that false positives of the Bloom filter left out
+const fullSyncEvery = 10
+
+// maxLegacyPages bounds the pages fetched from a peer serving peer exchange
+// without sync
+const maxLegacyPages = 50
+
+// maxSyncRounds bounds the requests of one sync with a peer whose responses
+// stay truncated
+const maxSyncRounds = 50
+
+// peerSync is where the peer exchange syncs with a remote peer left off
+type peerSync struct {
+	// since is the server time of the last response
+	since int64
+	count int
+}
 
 // NewPeerExchangeClient creates a client for peer exchange
 func NewPeerExchangeClient(node *ServiceNode, ctx context.Context, targetPeer peer.ID) (*proto.ServicePeerClient, error) {
@@ -17,3 +52,308 @@ func NewPeerExchangeClient(node *ServiceNode, ctx context.Context, targetPeer pe
 	}
 	return client.(*proto.ServicePeerClient), nil
 }
+
+// FetchPeerList retrieves a page of providers for a service from a remote
+// peer. For topics with provider authorities, providers without a valid
+// attestation are dropped.
+func (n *ServiceNode) FetchPeerList(ctx context.Context, remotePeer peer.ID, serviceTopic string, page, pageSize int32) ([]*proto.PeerInfo, error) {
+	ctx, span := n.tracer.Start(ctx, "peer-exchange.FetchPeerList", trace.WithAttributes(
+		attribute.String("p2p.topic", serviceTopic),
+		attribute.String("p2p.peer_id", remotePeer.String()),
+	))
+	peers, _, err := n.fetchPeerList(ctx, remotePeer, serviceTopic, page, pageSize)
+	n.metrics.PeerExchangeMade("FetchPeerList", err)
+	span.SetAttributes(attribute.Int("p2p.peers", len(peers)))
+	endSpan(span, err)
+	return peers, err
+}
+
+// fetchPeerList returns a page of providers and the number of pages
+func (n *ServiceNode) fetchPeerList(ctx context.Context, remotePeer peer.ID, serviceTopic string, page, pageSize int32) ([]*proto.PeerInfo, int32, error) {
+	resp := &proto.PeerListResponse{}
+	err := n.callPeerExchange(ctx, PeerExchangeProtocolID, remotePeer, "FetchPeerList", &proto.PeerListRequest{
+		ServiceTopic: serviceTopic,
+		Page:         page,
+		PageSize:     pageSize,
+	}, resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !n.requiresAttestation(serviceTopic) {
+		return resp.Peers, resp.TotalPages, nil
+	}
+
+	peers := make([]*proto.PeerInfo, 0, len(resp.Peers))
+	for _, info := range resp.Peers {
+		id, err := peer.IDFromBytes(info.PeerId)
+		if err != nil {
+			continue
+		}
+		if _, err := n.verifyProvider(serviceTopic, id, info.Attestation); err != nil {
+			n.logger.Debug("Dropped provider without a valid attestation",
+				logging.KeyTopic, serviceTopic, logging.KeyPeer, id, logging.KeyBackend, backendPeerExchange, "error", err)
+			continue
+		}
+		peers = append(peers, info)
+	}
+	return peers, resp.TotalPages, nil
+}
+
+// fetchAllPeers fetches every page of providers from a peer serving peer
+// exchange without sync, up to maxLegacyPages
+func (n *ServiceNode) fetchAllPeers(ctx context.Context, remotePeer peer.ID, serviceTopic string) ([]*proto.PeerInfo, error) {
+	var all []*proto.PeerInfo
+	for page, pages := int32(0), int32(1); page < pages && page < maxLegacyPages; page++ {
+		peers, total, err := n.fetchPeerList(ctx, remotePeer, serviceTopic, page, 0)
+		n.metrics.PeerExchangeMade("FetchPeerList", err)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, peers...)
+		pages = total
+	}
+	return all, nil
+}
+
+// callPeerExchange calls a ServicePeer method of remotePeer on protocolID.
+// Unlike the generated client, it keeps the error the remote handler
+// answered with.
+func (n *ServiceNode) callPeerExchange(ctx context.Context, protocolID string, remotePeer peer.ID, method string, req, resp protobuf.Message) error {
+	err := n.serviceRegistry.Invoke(ctx, protocolID, remotePeer, "ServicePeer."+method, req, resp)
+	if err != nil {
+		return fmt.Errorf("peer exchange with %s failed: %w", remotePeer, err)
+	}
+	return nil
+}
+
+// CheckService asks a remote peer whether it knows providers of a service
+func (n *ServiceNode) CheckService(ctx context.Context, remotePeer peer.ID, serviceTopic string) (bool, error) {
+	ctx, span := n.tracer.Start(ctx, "peer-exchange.CheckService", trace.WithAttributes(
+		attribute.String("p2p.topic", serviceTopic),
+		attribute.String("p2p.peer_id", remotePeer.String()),
+	))
+	provides, err := n.checkService(ctx, remotePeer, serviceTopic)
+	n.metrics.PeerExchangeMade("CheckService", err)
+	endSpan(span, err)
+	return provides, err
+}
+
+func (n *ServiceNode) checkService(ctx context.Context, remotePeer peer.ID, serviceTopic string) (bool, error) {
+	resp := &proto.ServiceCheckResponse{}
+	err := n.callPeerExchange(ctx, PeerExchangeProtocolID, remotePeer, "CheckService", &proto.ServiceCheckRequest{
+		ServiceTopic: serviceTopic,
+	}, resp)
+	if err != nil {
+		return false, err
+	}
+	return resp.ProvidesService, nil
+}
+
+// PeersChangedSince returns the live providers of a service added or updated
+// after since, and the providers that departed after since, with the
+// sighting that departed as LastSeen: expired, no longer admitted or removed
+// by a tombstone. It serves peer exchange syncs.
+func (n *ServiceNode) PeersChangedSince(serviceTopic string, since time.Time) (updated, departed []types.PeerInfo, err error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	service, ok := n.services[serviceTopic]
+	if !ok {
+		return nil, nil, fmt.Errorf("service not found: %s", serviceTopic)
+	}
+
+	now := time.Now()
+	for p, data := range service.Peers {
+		switch {
+		case n.live(serviceTopic, data, now):
+			if data.Updated.After(since) {
+				updated = append(updated, n.peerInfo(p, data))
+			}
+		case n.departure(serviceTopic, data).After(since):
+			departed = append(departed, types.PeerInfo{ID: p, LastSeen: data.LastSeen})
+		}
+	}
+	return updated, departed, nil
+}
+
+// SyncPeerList merges the providers of a registered service that a remote
+// peer knows into the node's own, and returns how many were added, updated
+// or verified and how many removed. The node sends a Bloom filter of the
+// providers it knows, and the remote peer answers with the others that were
+// added or updated since the previous sync, and with tombstones for those
+// that departed since. Truncated answers are followed up, for a bounded
+// number of requests and while they bring new providers. Peers serving only
+// PeerExchangeProtocolID send their whole list instead. For topics with
+// provider authorities, providers without a valid attestation are dropped.
+// The others stay unverified until confirmed as Config.PeerVerification
+// describes.
+func (n *ServiceNode) SyncPeerList(ctx context.Context, remotePeer peer.ID, serviceTopic string) (updated, removed int, err error) {
+	ctx, span := n.tracer.Start(ctx, "peer-exchange.SyncPeerList", trace.WithAttributes(
+		attribute.String("p2p.topic", serviceTopic),
+		attribute.String("p2p.peer_id", remotePeer.String()),
+	))
+	updated, removed, err = n.syncPeerList(ctx, remotePeer, serviceTopic)
+	span.SetAttributes(
+		attribute.Int("p2p.peers_updated", updated),
+		attribute.Int("p2p.peers_removed", removed),
+	)
+	endSpan(span, err)
+	return updated, removed, err
+}
+
+func (n *ServiceNode) syncPeerList(ctx context.Context, remotePeer peer.ID, serviceTopic string) (int, int, error) {
+	log := n.logger.With(logging.KeyTopic, serviceTopic, logging.KeyBackend, backendPeerExchange)
+	// Truncated responses are continued with the providers received so far
+	// in the filter, as long as they bring new ones
+	var updated, removed int
+	for round := 0; round < maxSyncRounds; round++ {
+		first := round == 0
+		req, ok := n.syncRequest(serviceTopic, remotePeer)
+		if !ok {
+			return updated, removed, fmt.Errorf("service not found: %s", serviceTopic)
+		}
+		resp := &proto.PeerSyncResponse{}
+		err := n.callPeerExchange(ctx, PeerExchangeSyncProtocolID, remotePeer, "SyncPeers", req, resp)
+		if err != nil && first && n.legacyPeerExchange(remotePeer) {
+			log.Debug("Peer does not sync, fetching its whole peer list", logging.KeyPeer, remotePeer)
+			infos, err := n.fetchAllPeers(ctx, remotePeer, serviceTopic)
+			if err != nil {
+				return 0, 0, err
+			}
+			return n.mergePeers(log, serviceTopic, remotePeer, infos), 0, nil
+		}
+		n.metrics.PeerExchangeMade("SyncPeers", err)
+		if err != nil {
+			return updated, removed, err
+		}
+
+		merged := n.mergePeers(log, serviceTopic, remotePeer, resp.Peers)
+		updated += merged
+		removed += n.mergeSync(log, serviceTopic, remotePeer, resp)
+		if !resp.Truncated || merged == 0 {
+			return updated, removed, nil
+		}
+	}
+	log.Debug("Peer still truncates its responses, stopping sync",
+		logging.KeyPeer, remotePeer, "rounds", maxSyncRounds)
+	return updated, removed, nil
+}
+
+// legacyPeerExchange reports whether identify found p serving peer exchange
+// without sync
+func (n *ServiceNode) legacyPeerExchange(p peer.ID) bool {
+	supported, err := n.host.Peerstore().SupportsProtocols(p, PeerExchangeSyncProtocolID, PeerExchangeProtocolID)
+	return err == nil && slices.Equal(supported, []protocol.ID{PeerExchangeProtocolID})
+}
+
+// syncRequest returns the next sync request for the providers of a
+// registered service to remotePeer, with a Bloom filter of the live ones.
+// Unverified providers are left out of the filter unless remotePeer already
+// sent them, so that other peers send them again as confirmation.
+func (n *ServiceNode) syncRequest(serviceTopic string, remotePeer peer.ID) (*proto.PeerSyncRequest, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	service, ok := n.services[serviceTopic]
+	state, registered := n.topics[serviceTopic]
+	if !ok || !registered {
+		return nil, false
+	}
+
+	now := time.Now()
+	filter := bloom.New(len(service.Peers), rand.Uint64())
+	for p, data := range service.Peers {
+		if n.live(serviceTopic, data, now) && (data.Verified || slices.Contains(data.Reporters, remotePeer)) {
+			filter.Add(bloom.PeerKey([]byte(p), data.LastSeen.UnixNano()))
+		}
+	}
+	req := &proto.PeerSyncRequest{
+		ServiceTopic: serviceTopic,
+		Filter:       filter.Bits(),
+		FilterHashes: filter.NumHashes(),
+		FilterSeed:   filter.Seed(),
+	}
+	if last := state.syncs[remotePeer]; last.count%fullSyncEvery != 0 {
+		req.Since = last.since
+	}
+	return req, true
+}
+
+// mergePeers records providers of a service that remotePeer sent through
+// peer exchange and returns how many were added, updated or verified. New
+// providers left unverified are probed. The addresses sent for a provider
+// reach the peerstore only once it is verified, and never replace those of a
+// provider verified already.
+func (n *ServiceNode) mergePeers(log *slog.Logger, serviceTopic string, remotePeer peer.ID, infos []*proto.PeerInfo) int {
+	updated := 0
+	for _, info := range infos {
+		id, err := peer.IDFromBytes(info.PeerId)
+		if err != nil || id == n.host.ID() {
+			continue
+		}
+		att, err := n.verifyProvider(serviceTopic, id, info.Attestation)
+		if err != nil {
+			log.Debug("Dropped provider without a valid attestation", logging.KeyPeer, id, "error", err)
+			continue
+		}
+		valid := parseAddrs(info.Addresses)
+
+		n.mu.Lock()
+		unverified, confirmed := false, false
+		if service, ok := n.services[serviceTopic]; ok {
+			data, known := service.Peers[id]
+			addrs := convertAddrs(valid)
+			if data.Verified {
+				addrs = nil
+			}
+			changed := n.recordProvider(log, service, id, backendPeerExchange, notAfterNow(time.Unix(0, info.LastSeen)), addrs, att, n.attested(serviceTopic, att))
+			if n.recordReport(service, id, remotePeer) || changed {
+				updated++
+			}
+			unverified = !known && !service.Peers[id].Verified
+			confirmed = !data.Verified && service.Peers[id].Verified
+		}
+		n.mu.Unlock()
+		switch {
+		case unverified:
+			n.probe(peer.AddrInfo{ID: id, Addrs: valid})
+		case confirmed:
+			n.host.Peerstore().AddAddrs(id, valid, n.peerTTL)
+		}
+	}
+	return updated
+}
+
+// mergeSync applies the tombstones of a sync response from remotePeer,
+// returning how many providers they removed, and records where a complete
+// sync left off
+func (n *ServiceNode) mergeSync(log *slog.Logger, serviceTopic string, remotePeer peer.ID, resp *proto.PeerSyncResponse) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	service, ok := n.services[serviceTopic]
+	if !ok {
+		return 0
+	}
+	removed := 0
+	for _, t := range resp.Tombstones {
+		id, err := peer.IDFromBytes(t.PeerId)
+		if err != nil {
+			continue
+		}
+		if n.recordDeparture(log, service, id, time.Unix(0, t.LastSeen)) {
+			removed++
+		}
+	}
+
+	if state, ok := n.topics[serviceTopic]; ok && !resp.Truncated {
+		if state.syncs == nil {
+			state.syncs = make(map[peer.ID]peerSync)
+		}
+		state.syncs[remotePeer] = peerSync{
+			since: resp.SyncTime,
+			count: state.syncs[remotePeer].count + 1,
+		}
+	}
+	return removed
+}
@@ -0,0 +1,243 @@
+package discovery
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/jibuji/p2p-service-discover/internal/bloom"
+	"github.com/jibuji/p2p-service-discover/internal/logging"
+	"github.com/jibuji/p2p-service-discover/internal/protocol/proto"
+	"github.com/jibuji/p2p-service-discover/pkg/types"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const syncTopic = "/sync-test/1.0.0"
+
+// newTestNode returns a node with topics registered but no discovery
+// routines running, for checking how it records providers
+func newTestNode(t *testing.T, verification types.PeerVerification, topics ...string) *ServiceNode {
+	t.Helper()
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatalf("GenPeer: %v", err)
+	}
+	n := &ServiceNode{
+		host:         h,
+		services:     make(map[string]*types.ServiceInfo),
+		topics:       make(map[string]*topicState),
+		peerTTL:      time.Hour,
+		logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		logLimiter:   logging.NewLimiter(time.Minute),
+		tracer:       noop.NewTracerProvider().Tracer(tracerName),
+		verification: verification,
+		probes:       make(chan peer.AddrInfo, 16),
+	}
+	for _, topic := range topics {
+		n.services[topic] = &types.ServiceInfo{Topic: topic, Peers: make(map[peer.ID]types.PeerData)}
+		n.topics[topic] = &topicState{advertise: true}
+	}
+	return n
+}
+
+func randomPeer(t *testing.T) peer.ID {
+	t.Helper()
+	_, pub, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatalf("GenerateEd25519Key: %v", err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatalf("IDFromPublicKey: %v", err)
+	}
+	return id
+}
+
+func TestSyncRequestFilter(t *testing.T) {
+	n := newTestNode(t, types.PeerVerification{}, syncTopic)
+	remote := randomPeer(t)
+	verified, reported, unverified, expired := randomPeer(t), randomPeer(t), randomPeer(t), randomPeer(t)
+	now := time.Now()
+	peers := n.services[syncTopic].Peers
+	peers[verified] = types.PeerData{LastSeen: now, Verified: true}
+	peers[reported] = types.PeerData{LastSeen: now, Reporters: []peer.ID{remote}}
+	peers[unverified] = types.PeerData{LastSeen: now, Reporters: []peer.ID{randomPeer(t)}}
+	peers[expired] = types.PeerData{LastSeen: now.Add(-2 * time.Hour), Verified: true}
+
+	req, ok := n.syncRequest(syncTopic, remote)
+	if !ok {
+		t.Fatal("syncRequest found no service")
+	}
+	filter, err := bloom.Decode(req.Filter, req.FilterHashes, req.FilterSeed)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	tests := []struct {
+		name string
+		id   peer.ID
+		want bool
+	}{
+		{name: "verified", id: verified, want: true},
+		{name: "sent by the remote peer", id: reported, want: true},
+		{name: "unverified", id: unverified, want: false},
+		{name: "expired", id: expired, want: false},
+	}
+	for _, tt := range tests {
+		key := bloom.PeerKey([]byte(tt.id), peers[tt.id].LastSeen.UnixNano())
+		if got := filter.Has(key); got != tt.want {
+			t.Errorf("%s provider in filter = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if req.Since != 0 {
+		t.Errorf("first sync has Since %d, want a full sync", req.Since)
+	}
+
+	if _, ok := n.syncRequest("/unregistered/1.0.0", remote); ok {
+		t.Error("syncRequest for an unregistered topic succeeded")
+	}
+}
+
+func TestSyncSince(t *testing.T) {
+	n := newTestNode(t, types.PeerVerification{}, syncTopic)
+	remote := randomPeer(t)
+
+	// Every complete sync records where the next one starts, and every
+	// fullSyncEvery-th one starts over
+	for i := 0; i < 2*fullSyncEvery; i++ {
+		req, _ := n.syncRequest(syncTopic, remote)
+		wantFull := i%fullSyncEvery == 0
+		if full := req.Since == 0; full != wantFull {
+			t.Fatalf("sync %d: Since = %d, want full sync %v", i, req.Since, wantFull)
+		}
+		if !wantFull && req.Since != int64(i) {
+			t.Fatalf("sync %d: Since = %d, want %d", i, req.Since, i)
+		}
+		n.mergeSync(n.logger, syncTopic, remote, &proto.PeerSyncResponse{SyncTime: int64(i + 1)})
+	}
+
+	// Syncs are tracked per remote peer
+	if req, _ := n.syncRequest(syncTopic, randomPeer(t)); req.Since != 0 {
+		t.Errorf("first sync with another peer has Since %d", req.Since)
+	}
+}
+
+func TestTruncatedSyncKeepsSince(t *testing.T) {
+	n := newTestNode(t, types.PeerVerification{}, syncTopic)
+	remote := randomPeer(t)
+
+	n.mergeSync(n.logger, syncTopic, remote, &proto.PeerSyncResponse{SyncTime: 100})
+	n.mergeSync(n.logger, syncTopic, remote, &proto.PeerSyncResponse{SyncTime: 100, Truncated: true})
+	n.mergeSync(n.logger, syncTopic, remote, &proto.PeerSyncResponse{SyncTime: 200, Truncated: true})
+
+	req, _ := n.syncRequest(syncTopic, remote)
+	if req.Since != 100 {
+		t.Errorf("Since = %d after truncated syncs, want 100", req.Since)
+	}
+	if got := n.topics[syncTopic].syncs[remote].count; got != 1 {
+		t.Errorf("%d complete syncs recorded, want 1", got)
+	}
+}
+
+func TestMergeSyncTombstones(t *testing.T) {
+	seen := time.Unix(0, time.Now().Add(-time.Minute).UnixNano())
+	tests := []struct {
+		name     string
+		data     types.PeerData
+		lastSeen time.Time
+		removed  bool
+	}{
+		{
+			name:     "unverified from peer exchange",
+			data:     types.PeerData{LastSeen: seen, Sources: []string{backendPeerExchange}},
+			lastSeen: seen,
+			removed:  true,
+		},
+		{
+			name:     "seen since",
+			data:     types.PeerData{LastSeen: seen.Add(time.Second), Sources: []string{backendPeerExchange}},
+			lastSeen: seen,
+		},
+		{
+			name:     "earlier sighting",
+			data:     types.PeerData{LastSeen: seen, Sources: []string{backendPeerExchange}},
+			lastSeen: seen.Add(time.Second),
+		},
+		{
+			name:     "verified",
+			data:     types.PeerData{LastSeen: seen, Sources: []string{backendPeerExchange}, Verified: true},
+			lastSeen: seen,
+		},
+		{
+			name:     "also from another backend",
+			data:     types.PeerData{LastSeen: seen, Sources: []string{backendPeerExchange, backendDHT}},
+			lastSeen: seen,
+		},
+		{
+			name:     "from pubsub",
+			data:     types.PeerData{LastSeen: seen, Sources: []string{backendPubSub}},
+			lastSeen: seen,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newTestNode(t, types.PeerVerification{}, syncTopic)
+			p := randomPeer(t)
+			n.services[syncTopic].Peers[p] = tt.data
+
+			removed := n.mergeSync(n.logger, syncTopic, randomPeer(t), &proto.PeerSyncResponse{
+				Tombstones: []*proto.PeerTombstone{{PeerId: []byte(p), LastSeen: tt.lastSeen.UnixNano()}},
+			})
+			if (removed == 1) != tt.removed {
+				t.Errorf("mergeSync removed %d providers, want removed %v", removed, tt.removed)
+			}
+			peers, err := n.FindPeers(syncTopic)
+			if err != nil {
+				t.Fatalf("FindPeers: %v", err)
+			}
+			if listed := len(peers) == 1; listed == tt.removed {
+				t.Errorf("provider listed = %v after the tombstone", listed)
+			}
+		})
+	}
+}
+
+func TestTombstoneDeparture(t *testing.T) {
+	n := newTestNode(t, types.PeerVerification{}, syncTopic)
+	p := randomPeer(t)
+	seen := time.Unix(0, time.Now().Add(-time.Minute).UnixNano())
+	n.services[syncTopic].Peers[p] = types.PeerData{LastSeen: seen, Sources: []string{backendPeerExchange}, Updated: seen}
+
+	since := time.Now()
+	resp := &proto.PeerSyncResponse{
+		Tombstones: []*proto.PeerTombstone{{PeerId: []byte(p), LastSeen: seen.UnixNano()}},
+	}
+	if removed := n.mergeSync(n.logger, syncTopic, randomPeer(t), resp); removed != 1 {
+		t.Fatalf("mergeSync removed %d providers, want 1", removed)
+	}
+	// The departed provider is passed on as a tombstone, but not counted
+	// as removed again
+	_, departed, err := n.PeersChangedSince(syncTopic, since)
+	if err != nil {
+		t.Fatalf("PeersChangedSince: %v", err)
+	}
+	if len(departed) != 1 || departed[0].ID != p || !departed[0].LastSeen.Equal(seen) {
+		t.Errorf("departed = %v, want %s seen at %s", departed, p, seen)
+	}
+	if removed := n.mergeSync(n.logger, syncTopic, randomPeer(t), resp); removed != 0 {
+		t.Errorf("second tombstone removed %d providers", removed)
+	}
+
+	// A new sighting brings it back
+	n.mu.Lock()
+	n.recordProvider(n.logger, n.services[syncTopic], p, backendPeerExchange, time.Now(), nil, nil, false)
+	n.mu.Unlock()
+	if peers, _ := n.FindPeers(syncTopic); len(peers) != 1 {
+		t.Errorf("provider seen again is not listed")
+	}
+}
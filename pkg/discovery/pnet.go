@@ -0,0 +1,104 @@
+package discovery
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/pnet"
+)
+
+// pskHeader starts keys in the swarm.key format read by DecodePSK
+const pskHeader = "/key/swarm/psk/1.0.0/"
+
+// GeneratePSK returns a new random pre-shared key for a private network
+func GeneratePSK() (pnet.PSK, error) {
+	psk := make(pnet.PSK, 32)
+	if _, err := rand.Read(psk); err != nil {
+		return nil, err
+	}
+	return psk, nil
+}
+
+// EncodePSK encodes psk in the swarm.key format used by other libp2p
+// implementations
+func EncodePSK(psk pnet.PSK) []byte {
+	return []byte(pskHeader + "\n/base16/\n" + hex.EncodeToString(psk) + "\n")
+}
+
+// DecodePSK reads a key in the swarm.key format, or as 64 hexadecimal
+// characters, which fit in an environment variable
+func DecodePSK(data []byte) (pnet.PSK, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(pskHeader)) {
+		return pnet.DecodeV1PSK(bytes.NewReader(data))
+	}
+	psk, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(psk) != 32 {
+		return nil, errors.New("private network key must be 64 hexadecimal characters or in swarm.key format")
+	}
+	return psk, nil
+}
+
+// SavePSK writes psk to path in the swarm.key format, readable only by the
+// owner. An existing file is not overwritten.
+func SavePSK(path string, psk pnet.PSK) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(EncodePSK(psk)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadPSK reads a key saved with SavePSK or by another libp2p implementation
+func LoadPSK(path string) (pnet.PSK, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	psk, err := DecodePSK(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private network key %s: %w", path, err)
+	}
+	return psk, nil
+}
+
+// privateNetwork reports whether hc configures a pre-shared key
+func (hc *HostConfig) privateNetwork() bool {
+	return len(hc.PSK) > 0 || hc.PSKFile != "" || hc.PSKEnv != ""
+}
+
+// loadPSK returns the key configured in hc, or nil for a public network
+func (hc *HostConfig) loadPSK() (pnet.PSK, error) {
+	switch {
+	case len(hc.PSK) > 0:
+		return hc.PSK, nil
+	case hc.PSKFile != "":
+		return LoadPSK(hc.PSKFile)
+	case hc.PSKEnv != "":
+		value := os.Getenv(hc.PSKEnv)
+		if value == "" {
+			return nil, fmt.Errorf("private network key variable %s is not set", hc.PSKEnv)
+		}
+		psk, err := DecodePSK([]byte(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid private network key in %s: %w", hc.PSKEnv, err)
+		}
+		return psk, nil
+	}
+	if hc.RequirePSK {
+		return nil, errors.New("a private network key is required but none is configured")
+	}
+	return nil, nil
+}
@@ -0,0 +1,106 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+)
+
+const pnetTopic = "/pnet-test/1.0.0"
+
+func newPSKNode(t *testing.T, psk pnet.PSK) *ServiceNode {
+	t.Helper()
+	n, err := NewNode(context.Background(),
+		WithDHT(false),
+		WithAnnounceInterval(200*time.Millisecond),
+		WithListenAddrs("/ip4/127.0.0.1/tcp/0"),
+		WithPSK(psk),
+		WithRequirePSK(),
+	)
+	if err != nil {
+		t.Fatalf("NewNode: %v", err)
+	}
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+func generatePSK(t *testing.T) pnet.PSK {
+	t.Helper()
+	psk, err := GeneratePSK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return psk
+}
+
+// TestPrivateNetwork checks that only nodes sharing the provider's key can
+// connect to it and discover it
+func TestPrivateNetwork(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	psk := generatePSK(t)
+	provider := newPSKNode(t, psk)
+	if err := provider.RegisterService(pnetTopic); err != nil {
+		t.Fatal(err)
+	}
+	providerInfo := peer.AddrInfo{ID: provider.Host().ID(), Addrs: provider.Host().Addrs()}
+
+	member := newPSKNode(t, psk)
+	outsider := newPSKNode(t, generatePSK(t))
+
+	connectCtx, cancelConnect := context.WithTimeout(ctx, 2*time.Second)
+	err := outsider.Host().Connect(connectCtx, providerInfo)
+	cancelConnect()
+	if err == nil {
+		t.Fatal("node with another key connected to the provider")
+	}
+	if err := member.Host().Connect(ctx, providerInfo); err != nil {
+		t.Fatalf("node with the same key cannot connect to the provider: %v", err)
+	}
+
+	for _, n := range []*ServiceNode{member, outsider} {
+		if err := n.WatchService(pnetTopic); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !waitForProvider(ctx, member, provider.Host().ID()) {
+		t.Fatal("node with the same key did not discover the provider")
+	}
+	// Give the provider's announcements a few more intervals
+	time.Sleep(time.Second)
+	peers, err := outsider.FindPeers(pnetTopic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) > 0 {
+		t.Fatalf("node with another key discovered %v", peers)
+	}
+	if len(outsider.Host().Network().ConnsToPeer(provider.Host().ID())) > 0 {
+		t.Fatal("node with another key is connected to the provider")
+	}
+}
+
+func waitForProvider(ctx context.Context, n *ServiceNode, id peer.ID) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		peers, err := n.FindPeers(pnetTopic)
+		if err == nil {
+			for _, p := range peers {
+				if p.ID == id {
+					return true
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
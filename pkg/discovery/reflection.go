@@ -0,0 +1,204 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"github.com/jibuji/p2p-service-discover/internal/protocol/proto"
+	"github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+	"github.com/jibuji/p2p-service-discover/pkg/types"
+)
+
+const (
+	ReflectionProtocolID = "/reflection/1.0.0"
+	DescriptorProtocolID = "/descriptor/1.0.0"
+)
+
+// Services describes the protocols the node serves with a stream handler or
+// advertises as a provider, ordered by protocol ID. Topics that are only
+// watched are left out.
+func (n *ServiceNode) Services() []types.ServiceDescription {
+	byProtocol := make(map[string]*types.ServiceDescription)
+	for _, h := range n.serviceRegistry.Handlers() {
+		byProtocol[h.Protocol] = &types.ServiceDescription{
+			Protocol:   h.Protocol,
+			Metadata:   h.Metadata,
+			Registered: h.Registered,
+			Handler:    true,
+		}
+	}
+
+	n.mu.RLock()
+	for topic, state := range n.topics {
+		if !state.advertise {
+			continue
+		}
+		registered := n.services[topic].Registered
+		desc, ok := byProtocol[topic]
+		if !ok {
+			desc = &types.ServiceDescription{Protocol: topic, Registered: registered}
+			byProtocol[topic] = desc
+		}
+		desc.Advertised = true
+		if registered.Before(desc.Registered) {
+			desc.Registered = registered
+		}
+	}
+	n.mu.RUnlock()
+
+	services := make([]types.ServiceDescription, 0, len(byProtocol))
+	for protocolID, desc := range byProtocol {
+		if _, v, ok := service.SplitProtocolID(protocolID); ok {
+			desc.Version = v.String()
+		}
+		services = append(services, *desc)
+	}
+	sortServices(services)
+	return services
+}
+
+// FetchServices asks a remote peer which protocols it serves or advertises,
+// through the reflection protocol
+func (n *ServiceNode) FetchServices(ctx context.Context, remotePeer peer.ID) ([]types.ServiceDescription, error) {
+	ctx, span := n.tracer.Start(ctx, "reflection.FetchServices", trace.WithAttributes(
+		attribute.String("p2p.peer_id", remotePeer.String()),
+	))
+	services, err := n.fetchServices(ctx, remotePeer)
+	span.SetAttributes(attribute.Int("p2p.services", len(services)))
+	endSpan(span, err)
+	return services, err
+}
+
+func (n *ServiceNode) fetchServices(ctx context.Context, remotePeer peer.ID) ([]types.ServiceDescription, error) {
+	rpcPeer, err := n.serviceRegistry.OpenPeer(ctx, ReflectionProtocolID, remotePeer)
+	if err != nil {
+		return nil, err
+	}
+	defer rpcPeer.Close()
+
+	resp := proto.NewReflectionClient(rpcPeer).ListServices(&proto.ListServicesRequest{})
+	if resp == nil {
+		return nil, fmt.Errorf("reflection with %s failed", remotePeer)
+	}
+
+	services := make([]types.ServiceDescription, len(resp.Services))
+	for i, entry := range resp.Services {
+		services[i] = types.ServiceDescription{
+			Protocol:   entry.ProtocolId,
+			Version:    entry.Version,
+			Metadata:   entry.Metadata,
+			Registered: time.Unix(0, entry.RegisteredAt),
+			Handler:    entry.Handler,
+			Advertised: entry.Advertised,
+		}
+	}
+	sortServices(services)
+	return services, nil
+}
+
+// Descriptors returns the protobuf files published for a protocol with
+// service.WithDescriptors, each after the files it imports
+func (n *ServiceNode) Descriptors(protocolID string) []protoreflect.FileDescriptor {
+	for _, h := range n.serviceRegistry.Handlers() {
+		if h.Protocol == protocolID {
+			return withImports(h.Descriptors)
+		}
+	}
+	return nil
+}
+
+// ServiceAllowed reports whether the ACL of the handler serving protocolID
+// accepts p. Reflection only describes the services a caller may use.
+func (n *ServiceNode) ServiceAllowed(protocolID string, p peer.ID) bool {
+	for _, h := range n.serviceRegistry.Handlers() {
+		if h.Protocol == protocolID {
+			return h.ACL.Allowed(p)
+		}
+	}
+	return true
+}
+
+// withImports adds the files imported by files, each before the files
+// importing it
+func withImports(files []protoreflect.FileDescriptor) []protoreflect.FileDescriptor {
+	var ordered []protoreflect.FileDescriptor
+	seen := make(map[string]bool)
+	var visit func(fd protoreflect.FileDescriptor)
+	visit = func(fd protoreflect.FileDescriptor) {
+		if seen[fd.Path()] || fd.IsPlaceholder() {
+			return
+		}
+		seen[fd.Path()] = true
+		imports := fd.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			visit(imports.Get(i).FileDescriptor)
+		}
+		ordered = append(ordered, fd)
+	}
+	for _, fd := range files {
+		visit(fd)
+	}
+	return ordered
+}
+
+// FetchDescriptors asks a remote peer for the protobuf files it published
+// for a protocol, through the descriptor protocol
+func (n *ServiceNode) FetchDescriptors(ctx context.Context, remotePeer peer.ID, protocolID string) (*protoregistry.Files, error) {
+	ctx, span := n.tracer.Start(ctx, "reflection.FetchDescriptors", trace.WithAttributes(
+		attribute.String("p2p.peer_id", remotePeer.String()),
+		attribute.String("p2p.protocol", protocolID),
+	))
+	files, err := n.fetchDescriptors(ctx, remotePeer, protocolID)
+	endSpan(span, err)
+	return files, err
+}
+
+func (n *ServiceNode) fetchDescriptors(ctx context.Context, remotePeer peer.ID, protocolID string) (*protoregistry.Files, error) {
+	rpcPeer, err := n.serviceRegistry.OpenPeer(ctx, DescriptorProtocolID, remotePeer)
+	if err != nil {
+		return nil, err
+	}
+	defer rpcPeer.Close()
+
+	resp := proto.NewDescriptorClient(rpcPeer).FileDescriptors(&proto.FileDescriptorsRequest{
+		ProtocolId: protocolID,
+	})
+	if resp == nil {
+		return nil, fmt.Errorf("descriptor request to %s failed", remotePeer)
+	}
+	if len(resp.FileDescriptors) == 0 {
+		return nil, fmt.Errorf("%s publishes no descriptors for %s", remotePeer, protocolID)
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, b := range resp.FileDescriptors {
+		fd := &descriptorpb.FileDescriptorProto{}
+		if err := protobuf.Unmarshal(b, fd); err != nil {
+			return nil, fmt.Errorf("invalid descriptor from %s: %w", remotePeer, err)
+		}
+		set.File = append(set.File, fd)
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptors from %s: %w", remotePeer, err)
+	}
+	return files, nil
+}
+
+func sortServices(services []types.ServiceDescription) {
+	slices.SortFunc(services, func(a, b types.ServiceDescription) int {
+		return strings.Compare(a.Protocol, b.Protocol)
+	})
+}
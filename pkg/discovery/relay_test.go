@@ -0,0 +1,100 @@
+package discovery
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const echoProtocol = "/test/echo/1.0.0"
+
+func newTestHost(t *testing.T, hc HostConfig) host.Host {
+	t.Helper()
+	h, err := NewHost(hc)
+	if err != nil {
+		t.Fatalf("NewHost: %v", err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// TestRelayReservation checks that a peer without listen addresses, which
+// reserves a slot on a static relay, is reachable through the relay
+func TestRelayReservation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	relay := newTestHost(t, HostConfig{
+		ListenAddrs:  []string{"/ip4/127.0.0.1/tcp/0"},
+		Reachability: ReachabilityPublic,
+		RelayService: true,
+	})
+	relayInfo := peer.AddrInfo{ID: relay.ID(), Addrs: relay.Addrs()}
+	relayAddrs, err := peer.AddrInfoToP2pAddrs(&relayInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	private := newTestHost(t, HostConfig{
+		Reachability:  ReachabilityPrivate,
+		StaticRelays:  []string{relayAddrs[0].String()},
+		Libp2pOptions: []libp2p.Option{libp2p.NoListenAddrs},
+	})
+	private.SetStreamHandler(echoProtocol, func(s network.Stream) {
+		defer s.Close()
+		io.Copy(s, s)
+	})
+	if err := private.Connect(ctx, relayInfo); err != nil {
+		t.Fatalf("connecting to the relay: %v", err)
+	}
+
+	client := newTestHost(t, HostConfig{ListenAddrs: []string{"/ip4/127.0.0.1/tcp/0"}})
+	circuit := relayAddrs[0].Encapsulate(multiaddr.StringCast("/p2p-circuit"))
+	target := peer.AddrInfo{ID: private.ID(), Addrs: []multiaddr.Multiaddr{circuit}}
+
+	// The reservation is made in the background once the private host
+	// learns it cannot be reached directly
+	for {
+		err := client.Connect(ctx, target)
+		if err == nil {
+			break
+		}
+		// Failed dials are backed off, which would fail the next try at once
+		client.Network().(*swarm.Swarm).Backoff().Clear(private.ID())
+		select {
+		case <-ctx.Done():
+			t.Fatalf("peer not reachable through the relay: %v", err)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+
+	conns := client.Network().ConnsToPeer(private.ID())
+	if len(conns) == 0 || !conns[0].Stat().Limited {
+		t.Fatalf("expected a limited relayed connection, got %v", conns)
+	}
+
+	s, err := client.NewStream(network.WithAllowLimitedConn(ctx, "relay test"), private.ID(), echoProtocol)
+	if err != nil {
+		t.Fatalf("opening a stream through the relay: %v", err)
+	}
+	defer s.Close()
+	if _, err := s.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	s.CloseWrite()
+	reply, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "ping" {
+		t.Fatalf("got %q through the relay, want %q", reply, "ping")
+	}
+}
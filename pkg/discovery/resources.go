@@ -0,0 +1,59 @@
+package discovery
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+)
+
+// ServiceLimit bounds the resources used by the streams of one service
+// protocol in the host's resource manager. The registry attaches every
+// stream to the scope of its protocol's service. Zero fields keep the
+// libp2p defaults.
+type ServiceLimit struct {
+	Streams         int `yaml:"streams"`
+	StreamsInbound  int `yaml:"streams_inbound"`
+	StreamsOutbound int `yaml:"streams_outbound"`
+	// PeerStreams bounds the streams of the service with each peer
+	PeerStreams int `yaml:"peer_streams"`
+	// Memory bounds the bytes reserved for the requests being served
+	Memory int64 `yaml:"memory"`
+}
+
+func (l ServiceLimit) validate(protocol string) error {
+	if l.Streams < 0 || l.StreamsInbound < 0 || l.StreamsOutbound < 0 || l.PeerStreams < 0 || l.Memory < 0 {
+		return fmt.Errorf("service limits of %s must not be negative", protocol)
+	}
+	return nil
+}
+
+// resourceManager returns a resource manager with the libp2p default limits
+// and hc.ServiceLimits
+func (hc *HostConfig) resourceManager() (network.ResourceManager, error) {
+	defaults := rcmgr.DefaultLimits
+	libp2p.SetDefaultServiceLimits(&defaults)
+
+	partial := rcmgr.PartialLimitConfig{
+		Service:     make(map[string]rcmgr.ResourceLimits, len(hc.ServiceLimits)),
+		ServicePeer: make(map[string]rcmgr.ResourceLimits),
+	}
+	for protocol, l := range hc.ServiceLimits {
+		partial.Service[protocol] = rcmgr.ResourceLimits{
+			Streams:         rcmgr.LimitVal(l.Streams),
+			StreamsInbound:  rcmgr.LimitVal(l.StreamsInbound),
+			StreamsOutbound: rcmgr.LimitVal(l.StreamsOutbound),
+			Memory:          rcmgr.LimitVal64(l.Memory),
+		}
+		if l.PeerStreams > 0 {
+			partial.ServicePeer[protocol] = rcmgr.ResourceLimits{Streams: rcmgr.LimitVal(l.PeerStreams)}
+		}
+	}
+
+	mgr, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(partial.Build(defaults.AutoScale())))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resource manager: %w", err)
+	}
+	return mgr, nil
+}
@@ -0,0 +1,56 @@
+package discovery
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+const limitedProtocol = "/limited-test/1.0.0"
+
+func TestServiceLimits(t *testing.T) {
+	hc := HostConfig{ServiceLimits: map[string]ServiceLimit{
+		limitedProtocol: {Streams: 1, Memory: 1 << 20},
+	}}
+	mgr, err := hc.resourceManager()
+	if err != nil {
+		t.Fatalf("resourceManager: %v", err)
+	}
+	defer mgr.Close()
+
+	open := func() network.StreamManagementScope {
+		t.Helper()
+		s, err := mgr.OpenStream(randomPeer(t), network.DirInbound)
+		if err != nil {
+			t.Fatalf("OpenStream: %v", err)
+		}
+		t.Cleanup(s.Done)
+		if err := s.SetProtocol(limitedProtocol); err != nil {
+			t.Fatalf("SetProtocol: %v", err)
+		}
+		return s
+	}
+	first := open()
+	if err := first.SetService(limitedProtocol); err != nil {
+		t.Fatalf("SetService of the first stream: %v", err)
+	}
+	if err := open().SetService(limitedProtocol); err == nil {
+		t.Error("second stream attached to a service limited to one")
+	}
+	if err := open().SetService("/unlimited-test/1.0.0"); err != nil {
+		t.Errorf("SetService of another service: %v", err)
+	}
+
+	if err := first.ReserveMemory(2<<20, network.ReservationPriorityAlways); err == nil {
+		t.Error("reserved more memory than the service limit")
+	}
+	if err := first.ReserveMemory(1<<10, network.ReservationPriorityAlways); err != nil {
+		t.Errorf("ReserveMemory within the service limit: %v", err)
+	}
+}
+
+func TestServiceLimitValidate(t *testing.T) {
+	if err := (ServiceLimit{Memory: -1}).validate(limitedProtocol); err == nil {
+		t.Error("validate accepted a negative limit")
+	}
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"gopkg.in/yaml.v3"
+
+	"github.com/jibuji/p2p-service-discover/internal/logging"
+)
+
+// Reasons a stream is rejected by an ACL, used in logs and metrics
+const (
+	rejectDenied     = "denied"
+	rejectNotAllowed = "not_allowed"
+)
+
+// ACL decides which peers may open streams to a service. Denied peers are
+// always rejected; when the allow-list is not empty, only the peers on it
+// are accepted. The lists can be replaced while streams are being served.
+// A nil ACL accepts every peer.
+type ACL struct {
+	path string
+
+	mu    sync.RWMutex
+	allow map[peer.ID]struct{}
+	deny  map[peer.ID]struct{}
+	// loaded is the version of the file last loaded
+	loaded fileVersion
+}
+
+// NewACL creates an ACL from allow and deny lists
+func NewACL(allow, deny []peer.ID) *ACL {
+	a := &ACL{}
+	a.Set(allow, deny)
+	return a
+}
+
+// aclFile is the file representation of an ACL: lists of peer IDs
+type aclFile struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// LoadACL reads an ACL from a YAML or JSON file with "allow" and "deny"
+// lists of peer IDs. Reload and Watch read the file again.
+func LoadACL(path string) (*ACL, error) {
+	a := &ACL{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Set replaces the allow and deny lists
+func (a *ACL) Set(allow, deny []peer.ID) {
+	allowSet := make(map[peer.ID]struct{}, len(allow))
+	for _, p := range allow {
+		allowSet[p] = struct{}{}
+	}
+	denySet := make(map[peer.ID]struct{}, len(deny))
+	for _, p := range deny {
+		denySet[p] = struct{}{}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.allow = allowSet
+	a.deny = denySet
+}
+
+// Allowed reports whether p may open streams
+func (a *ACL) Allowed(p peer.ID) bool {
+	return a.check(p) == ""
+}
+
+// check returns the reason p is rejected, or "" if it is accepted
+func (a *ACL) check(p peer.ID) string {
+	if a == nil {
+		return ""
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if _, ok := a.deny[p]; ok {
+		return rejectDenied
+	}
+	if _, ok := a.allow[p]; len(a.allow) > 0 && !ok {
+		return rejectNotAllowed
+	}
+	return ""
+}
+
+// Reload reads the ACL's file again. The lists are kept when the file is
+// invalid.
+func (a *ACL) Reload() error {
+	if a.path == "" {
+		return errors.New("ACL was not loaded from a file")
+	}
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+
+	var f aclFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("ACL %s: %w", a.path, err)
+	}
+	allow, err := decodePeerIDs(f.Allow)
+	if err != nil {
+		return fmt.Errorf("ACL %s: allow: %w", a.path, err)
+	}
+	deny, err := decodePeerIDs(f.Deny)
+	if err != nil {
+		return fmt.Errorf("ACL %s: deny: %w", a.path, err)
+	}
+
+	a.Set(allow, deny)
+	a.mu.Lock()
+	a.loaded = versionOf(info)
+	a.mu.Unlock()
+	return nil
+}
+
+func decodePeerIDs(ids []string) ([]peer.ID, error) {
+	peers := make([]peer.ID, len(ids))
+	for i, s := range ids {
+		p, err := peer.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer ID %q: %w", s, err)
+		}
+		peers[i] = p
+	}
+	return peers, nil
+}
+
+// Watch reloads the ACL's file whenever it changes, checking every interval,
+// until ctx is done. Failed reloads are logged and keep the previous lists.
+// It returns at once for an ACL created with NewACL.
+func (a *ACL) Watch(ctx context.Context, interval time.Duration, logger *slog.Logger) {
+	if a.path == "" {
+		return
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	watchFile(ctx, a.path, interval, logger.With("acl", a.path), func() fileVersion {
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+		return a.loaded
+	}, a.Reload)
+}
+
+// admit checks the remote peer of an inbound stream against the ACL.
+// Rejected streams are reset, logged and counted.
+func (o *streamOptions) admit(s network.Stream, protocolID string) bool {
+	p := s.Conn().RemotePeer()
+	reason := o.acl.check(p)
+	if reason == "" {
+		return true
+	}
+	s.Reset()
+	o.metrics.StreamRejected(protocolID, reason)
+	o.logLimiter.Log(o.logger, slog.LevelInfo, "acl:"+protocolID+":"+p.String(), "Rejected stream",
+		logging.KeyProtocol, protocolID, logging.KeyPeer, p, "reason", reason)
+	return false
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestACLCheck(t *testing.T) {
+	a, b, c := peer.ID("a"), peer.ID("b"), peer.ID("c")
+	tests := []struct {
+		name  string
+		acl   *ACL
+		p     peer.ID
+		wants string
+	}{
+		{name: "nil ACL", acl: nil, p: a},
+		{name: "empty lists", acl: NewACL(nil, nil), p: a},
+		{name: "denied", acl: NewACL(nil, []peer.ID{a}), p: a, wants: rejectDenied},
+		{name: "not denied", acl: NewACL(nil, []peer.ID{a}), p: b},
+		{name: "allowed", acl: NewACL([]peer.ID{a, b}, nil), p: b},
+		{name: "not allowed", acl: NewACL([]peer.ID{a, b}, nil), p: c, wants: rejectNotAllowed},
+		{name: "allowed and denied", acl: NewACL([]peer.ID{a}, []peer.ID{a}), p: a, wants: rejectDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.acl.check(tt.p); got != tt.wants {
+				t.Errorf("check(%s) = %q, want %q", tt.p, got, tt.wants)
+			}
+			if got := tt.acl.Allowed(tt.p); got != (tt.wants == "") {
+				t.Errorf("Allowed(%s) = %v", tt.p, got)
+			}
+		})
+	}
+}
+
+func TestACLRejectsStreams(t *testing.T) {
+	tests := []struct {
+		name   string
+		deny   bool
+		reason string
+	}{
+		{name: "denied", deny: true, reason: rejectDenied},
+		{name: "not allowed", reason: rejectNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl := NewACL(nil, nil)
+			tp := newTestPair(t, WithACL(acl))
+			if tt.deny {
+				acl.Set(nil, []peer.ID{tp.client.ID()})
+			} else {
+				acl.Set([]peer.ID{tp.server.ID()}, nil)
+			}
+
+			_, err := tp.call("Echo", "hello")
+			checkRejected(t, err)
+			tp.waitForCounter(t, "streams_rejected_total", map[string]string{"protocol": echoProtocol, "reason": tt.reason}, 1)
+		})
+	}
+}
+
+func TestACLSetApplies(t *testing.T) {
+	acl := NewACL(nil, nil)
+	tp := newTestPair(t, WithACL(acl))
+	if _, err := tp.call("Echo", "hello"); err != nil {
+		t.Fatalf("Echo before the peer is denied: %v", err)
+	}
+
+	acl.Set(nil, []peer.ID{tp.client.ID()})
+	_, err := tp.call("Echo", "hello")
+	checkRejected(t, err)
+
+	acl.Set(nil, nil)
+	if _, err := tp.call("Echo", "hello"); err != nil {
+		t.Errorf("Echo once the peer is no longer denied: %v", err)
+	}
+}
+
+func TestLoadACL(t *testing.T) {
+	a := peer.ID("\x00\x04test")
+	path := filepath.Join(t.TempDir(), "acl.yaml")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("deny: [" + a.String() + "]\n")
+	acl, err := LoadACL(path)
+	if err != nil {
+		t.Fatalf("LoadACL: %v", err)
+	}
+	if acl.Allowed(a) {
+		t.Errorf("peer denied by the file is allowed")
+	}
+
+	// An invalid file keeps the lists
+	for _, data := range []string{"deny: [not-a-peer-id]\n", "unknown: []\n"} {
+		write(data)
+		if err := acl.Reload(); err == nil {
+			t.Errorf("Reload of %q succeeded", data)
+		}
+		if acl.Allowed(a) {
+			t.Errorf("failed Reload of %q dropped the deny list", data)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// attestationDomain is prepended to the payload before signing, so tokens
+// and attestations cannot be swapped
+const attestationDomain = "p2p-service-discover/attestation:"
+
+// Attestation states that an authority admits a peer as a provider of
+// service topics. Providers carry it in their announcements, and nodes
+// trusting the authority for a topic drop providers without one.
+type Attestation struct {
+	ID       string    `json:"id"`
+	Issuer   peer.ID   `json:"iss"`
+	Subject  peer.ID   `json:"sub"`
+	Topics   []string  `json:"topics"`
+	IssuedAt time.Time `json:"iat"`
+	Expires  time.Time `json:"exp"`
+}
+
+// Covers reports whether the attestation admits its subject for topic
+func (a *Attestation) Covers(topic string) bool {
+	return slices.Contains(a.Topics, topic)
+}
+
+// Attest signs att and returns the encoded attestation. The issuer and issue
+// time are set by the authority, and a random ID is chosen when att has none.
+func (a *Authority) Attest(att Attestation) (string, error) {
+	if att.Subject == "" {
+		return "", errors.New("attestation has no subject")
+	}
+	if att.Expires.IsZero() {
+		return "", errors.New("attestation has no expiry")
+	}
+	if len(att.Topics) == 0 {
+		return "", errors.New("attestation has no topics")
+	}
+	if att.ID == "" {
+		id, err := randomID()
+		if err != nil {
+			return "", err
+		}
+		att.ID = id
+	}
+	att.Issuer = a.id
+	att.IssuedAt = time.Now().UTC().Truncate(time.Second)
+	return a.sign(attestationDomain, att)
+}
+
+// ParseAttestation decodes an encoded attestation and checks that it is
+// signed by its issuer. Whether the issuer is trusted is up to the caller.
+func ParseAttestation(s string) (*Attestation, error) {
+	var att Attestation
+	if err := parseSigned(attestationDomain, s, &att, func() peer.ID { return att.Issuer }); err != nil {
+		return nil, fmt.Errorf("invalid attestation: %w", err)
+	}
+	return &att, nil
+}
+
+// VerifyAttestation checks that s was issued by one of authorities, admits
+// subject as a provider of topic and has not expired. It returns an error
+// when authorities is empty, since anyone can then sign one.
+func VerifyAttestation(s string, subject peer.ID, topic string, authorities []peer.ID) (*Attestation, error) {
+	if len(authorities) == 0 {
+		return nil, fmt.Errorf("no authorities to verify the attestation for %s", topic)
+	}
+	att, err := ParseAttestation(s)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(authorities, att.Issuer) {
+		return nil, fmt.Errorf("attestation issuer %s is not trusted for %s", att.Issuer, topic)
+	}
+	if err := checkAttestation(att, subject, topic); err != nil {
+		return nil, err
+	}
+	return att, nil
+}
+
+// VerifyAttestationSignature checks that s is signed by its issuer, admits
+// subject as a provider of topic and has not expired. Its issuer is not
+// checked, so it proves nothing about subject on its own.
+func VerifyAttestationSignature(s string, subject peer.ID, topic string) (*Attestation, error) {
+	att, err := ParseAttestation(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAttestation(att, subject, topic); err != nil {
+		return nil, err
+	}
+	return att, nil
+}
+
+// checkAttestation checks the subject, topics and expiry of att
+func checkAttestation(att *Attestation, subject peer.ID, topic string) error {
+	if att.Subject != subject {
+		return fmt.Errorf("attestation was issued to %s", att.Subject)
+	}
+	if !att.Covers(topic) {
+		return fmt.Errorf("attestation does not cover %s", topic)
+	}
+	if !time.Now().Before(att.Expires) {
+		return fmt.Errorf("attestation expired at %s", att.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// signed is the encoded form of tokens and attestations: a JSON payload and
+// the issuer's signature over it
+type signed struct {
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"sig"`
+}
+
+// Authority issues capability tokens and provider attestations signed with
+// its key
+type Authority struct {
+	key crypto.PrivKey
+	id  peer.ID
+}
+
+// NewAuthority creates an Authority signing with key. Verifiers trust it by
+// its peer ID, so the key type must be one whose public key is embedded in
+// the peer ID, such as Ed25519.
+func NewAuthority(key crypto.PrivKey) (*Authority, error) {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := id.ExtractPublicKey(); err != nil {
+		return nil, fmt.Errorf("authority key must be embedded in its peer ID: %w", err)
+	}
+	return &Authority{key: key, id: id}, nil
+}
+
+// ID returns the peer ID verifiers trust the authority by
+func (a *Authority) ID() peer.ID {
+	return a.id
+}
+
+// sign encodes v with the authority's signature over it in domain
+func (a *Authority) sign(domain string, v interface{}) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sig, err := a.key.Sign(append([]byte(domain), payload...))
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(signed{Payload: payload, Signature: sig})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func randomID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// parseSigned decodes s into v and checks the signature of the issuer that
+// issuer returns once v is decoded
+func parseSigned(domain, s string, v interface{}, issuer func() peer.ID) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return err
+	}
+	var sd signed
+	if err := json.Unmarshal(data, &sd); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(sd.Payload, v); err != nil {
+		return err
+	}
+
+	pub, err := issuer().ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("issuer %s has no embedded key: %w", issuer(), err)
+	}
+	ok, err := pub.Verify(append([]byte(domain), sd.Payload...), sd.Signature)
+	if err != nil || !ok {
+		return errors.New("bad signature")
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Caller identifies the remote end of the stream a call arrived on
+type Caller struct {
+	Peer     peer.ID
+	Addr     ma.Multiaddr
+	Protocol string
+	// Direction is the direction of the connection the stream uses:
+	// network.DirInbound when the caller dialed this node
+	Direction network.Direction
+}
+
+type callerKey struct{}
+
+// withCaller returns ctx carrying the caller of the calls on s
+func withCaller(ctx context.Context, s network.Stream) context.Context {
+	return context.WithValue(ctx, callerKey{}, &Caller{
+		Peer:      s.Conn().RemotePeer(),
+		Addr:      s.Conn().RemoteMultiaddr(),
+		Protocol:  string(s.Protocol()),
+		Direction: s.Conn().Stat().Direction,
+	})
+}
+
+// CallerFromContext returns the caller of the call handled with ctx. Only
+// calls dispatched by BaseService carry one, so the service must implement
+// ServerProvider: the RPC peer dispatches the calls of other services with
+// context.Background(), and RegisterService warns about them. It reports
+// false for those calls.
+func CallerFromContext(ctx context.Context) (*Caller, bool) {
+	c, ok := ctx.Value(callerKey{}).(*Caller)
+	return c, ok
+}
+
+// PeerFromContext returns the ID of the peer making the call handled with
+// ctx
+func PeerFromContext(ctx context.Context) (peer.ID, bool) {
+	c, ok := CallerFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	return c.Peer, true
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	srpc "github.com/jibuji/go-stream-rpc"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/jibuji/p2p-service-discover/internal/logging"
+)
+
+// ErrorCodeOverloaded is returned for calls made while the service is at
+// its limit of calls in flight, or out of the memory the resource manager
+// grants it. The call was not dispatched and may be retried later.
+const ErrorCodeOverloaded srpc.ErrorCode = 0x102
+
+// Reasons a stream or call is rejected for lack of capacity, used in logs and
+// metrics
+const (
+	rejectTooManyStreams = "too_many_streams"
+	rejectTooManyCalls   = "too_many_calls"
+	rejectResourceLimit  = "resource_limit"
+)
+
+// ConcurrencyLimits bounds the streams a service serves and the calls it
+// runs at once. Streams and calls over a limit wait in a queue of up to
+// Queue entries each for at most QueueTimeout; when the queue is full or the
+// wait times out, streams are reset and calls fail with ErrorCodeOverloaded.
+// A zero limit means no limit.
+type ConcurrencyLimits struct {
+	// Streams is the number of streams served at once
+	Streams int `yaml:"streams"`
+	// Calls is the number of calls in flight at once, over all streams
+	Calls        int           `yaml:"calls"`
+	Queue        int           `yaml:"queue"`
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+}
+
+// Validate reports the first limit out of range
+func (l ConcurrencyLimits) Validate() error {
+	if l.Streams < 0 || l.Calls < 0 || l.Queue < 0 {
+		return fmt.Errorf("concurrency limits must not be negative, got streams %d, calls %d, queue %d", l.Streams, l.Calls, l.Queue)
+	}
+	if l.Queue > 0 && l.QueueTimeout <= 0 {
+		return errors.New("a concurrency queue needs a positive timeout")
+	}
+	return nil
+}
+
+// slots is a semaphore with a bounded number of waiters. A nil *slots has no
+// limit.
+type slots struct {
+	sem     chan struct{}
+	queue   int32
+	timeout time.Duration
+	waiting atomic.Int32
+}
+
+// newSlots returns nil when n is not a limit
+func newSlots(n int, l ConcurrencyLimits) *slots {
+	if n <= 0 {
+		return nil
+	}
+	return &slots{sem: make(chan struct{}, n), queue: int32(l.Queue), timeout: l.QueueTimeout}
+}
+
+// acquire takes a slot, waiting in the queue when there is room in it. It
+// reports false when no slot was taken.
+func (s *slots) acquire(ctx context.Context) bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	default:
+	}
+	if s.waiting.Add(1) > s.queue {
+		s.waiting.Add(-1)
+		return false
+	}
+	defer s.waiting.Add(-1)
+
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *slots) release() {
+	if s != nil {
+		<-s.sem
+	}
+}
+
+// concurrency enforces the ConcurrencyLimits of one registered handler
+type concurrency struct {
+	streams *slots
+	calls   *slots
+}
+
+// newConcurrency returns nil when l has no limits
+func newConcurrency(l ConcurrencyLimits) *concurrency {
+	if l.Streams <= 0 && l.Calls <= 0 {
+		return nil
+	}
+	return &concurrency{streams: newSlots(l.Streams, l), calls: newSlots(l.Calls, l)}
+}
+
+// acquireStream takes a stream slot for s and attaches s to the resource
+// manager's scope for the service. It reports false after resetting, logging
+// and counting a stream that cannot be served; otherwise the caller must call
+// the returned release when it is done with the stream.
+func (o *streamOptions) acquireStream(s network.Stream, protocolID string) (func(), bool) {
+	if err := s.Scope().SetService(protocolID); err != nil {
+		return nil, o.rejectStream(s, protocolID, rejectResourceLimit, err)
+	}
+	var streams *slots
+	if o.concurrency != nil {
+		streams = o.concurrency.streams
+	}
+	if !streams.acquire(context.Background()) {
+		return nil, o.rejectStream(s, protocolID, rejectTooManyStreams, nil)
+	}
+	return streams.release, true
+}
+
+func (o *streamOptions) rejectStream(s network.Stream, protocolID, reason string, err error) bool {
+	p := s.Conn().RemotePeer()
+	s.Reset()
+	o.metrics.StreamRejected(protocolID, reason)
+	args := []any{logging.KeyProtocol, protocolID, logging.KeyPeer, p, "reason", reason}
+	if err != nil {
+		args = append(args, "error", err)
+	}
+	o.logLimiter.Log(o.logger, slog.LevelWarn, reason+":"+protocolID, "Rejected stream", args...)
+	return false
+}
+
+// acquireCall takes a slot for a call to method and reserves memory for its
+// payload in the stream's resource scope. On success the caller must call
+// the returned release once the call is answered.
+func (o *streamOptions) acquireCall(ctx context.Context, s network.Stream, protocolID, method string, size int) (func(), error) {
+	p := s.Conn().RemotePeer()
+	if err := s.Scope().ReserveMemory(size, network.ReservationPriorityMedium); err != nil {
+		return nil, o.rejectCall(p, protocolID, method, rejectResourceLimit, "not enough memory for %s", method)
+	}
+	var calls *slots
+	if o.concurrency != nil {
+		calls = o.concurrency.calls
+	}
+	if !calls.acquire(ctx) {
+		s.Scope().ReleaseMemory(size)
+		return nil, o.rejectCall(p, protocolID, method, rejectTooManyCalls, "too many calls in flight for %s", protocolID)
+	}
+	return func() {
+		calls.release()
+		s.Scope().ReleaseMemory(size)
+	}, nil
+}
+
+func (o *streamOptions) rejectCall(p peer.ID, protocolID, method, reason, format string, args ...interface{}) error {
+	o.metrics.CallRejected(protocolID, method, reason)
+	o.logLimiter.Log(o.logger, slog.LevelWarn, reason+"-call:"+protocolID, "Rejected call",
+		logging.KeyProtocol, protocolID, logging.KeyPeer, p, "method", method, "reason", reason)
+	return rpcErrorf(ErrorCodeOverloaded, format, args...)
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestConcurrencyLimitsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  ConcurrencyLimits
+		wantErr bool
+	}{
+		{name: "no limits"},
+		{name: "limits", limits: ConcurrencyLimits{Streams: 10, Calls: 100, Queue: 10, QueueTimeout: time.Second}},
+		{name: "negative", limits: ConcurrencyLimits{Calls: -1}, wantErr: true},
+		{name: "queue without timeout", limits: ConcurrencyLimits{Calls: 1, Queue: 1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.limits.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSlots(t *testing.T) {
+	ctx := context.Background()
+	var unlimited *slots
+	if !unlimited.acquire(ctx) {
+		t.Error("nil slots refused a slot")
+	}
+
+	s := newSlots(1, ConcurrencyLimits{})
+	if !s.acquire(ctx) {
+		t.Fatal("first slot refused")
+	}
+	if s.acquire(ctx) {
+		t.Error("slot taken over the limit without a queue")
+	}
+
+	// A queued waiter times out, or gets the slot once it is released
+	s = newSlots(1, ConcurrencyLimits{Queue: 1, QueueTimeout: 10 * time.Millisecond})
+	s.acquire(ctx)
+	if s.acquire(ctx) {
+		t.Error("queued waiter took a slot that was never released")
+	}
+	s.timeout = time.Minute
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.release()
+	}()
+	if !s.acquire(ctx) {
+		t.Error("queued waiter did not get the released slot")
+	}
+}
+
+func TestConcurrencyRejectsCalls(t *testing.T) {
+	tp := newTestPair(t, WithConcurrencyLimits(ConcurrencyLimits{Calls: 1}))
+	waited := make(chan error, 1)
+	go func() {
+		_, err := tp.call("Wait", "hello")
+		waited <- err
+	}()
+
+	// Calls fail once Wait holds the only slot
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := tp.call("Echo", "hello")
+		if err != nil {
+			checkRPCError(t, err, ErrorCodeOverloaded)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Echo never rejected while Wait is in flight")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	labels := map[string]string{"protocol": echoProtocol, "method": "Echo.Echo", "reason": rejectTooManyCalls}
+	tp.waitForCounter(t, "rpc_calls_rejected_total", labels, 1)
+
+	close(tp.service.server.release)
+	if err := <-waited; err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	if _, err := tp.call("Echo", "hello"); err != nil {
+		t.Errorf("Echo once the slot is released: %v", err)
+	}
+}
+
+func TestConcurrencyRejectsStreams(t *testing.T) {
+	tp := newTestPair(t, WithConcurrencyLimits(ConcurrencyLimits{Streams: 1}))
+
+	// An answered call shows the open stream holds the only slot
+	c, err := tp.clientReg.(*registry).openConn(context.Background(), tp.server.ID(), echoProtocol, []string{echoProtocol})
+	if err != nil {
+		t.Fatalf("openConn: %v", err)
+	}
+	req, _ := proto.Marshal(wrapperspb.String("hello"))
+	if _, err := c.roundTrip(context.Background(), 1, "Echo.Echo", req); err != nil {
+		t.Fatalf("Echo on the first stream: %v", err)
+	}
+
+	_, err = tp.call("Echo", "hello")
+	checkRejected(t, err)
+	tp.waitForCounter(t, "streams_rejected_total", map[string]string{"protocol": echoProtocol, "reason": rejectTooManyStreams}, 1)
+
+	c.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := tp.call("Echo", "hello"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream slot not released when the first stream closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
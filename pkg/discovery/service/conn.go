@@ -0,0 +1,549 @@
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	srpc "github.com/jibuji/go-stream-rpc"
+	"github.com/libp2p/go-libp2p/core/network"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/jibuji/p2p-service-discover/internal/logging"
+)
+
+const (
+	sideClient = "client"
+	sideServer = "server"
+)
+
+// undecodable replaces the payload of error frames handed to the RpcPeer.
+// RpcPeer looks up responses by id with the error bit still set, so an error
+// frame never reaches the waiting call, which then blocks until its 30 second
+// timeout. A response it cannot unmarshal fails the call right away.
+var undecodable = []byte{0xff}
+
+// maxPendingMetadata bounds the metadata kept for calls not yet dispatched
+const maxPendingMetadata = 256
+
+type pendingCall struct {
+	method string
+	start  time.Time
+	span   trace.Span
+	// done receives the outcome of calls made by client interceptors, whose
+	// responses are not handed to the RpcPeer
+	done chan<- callResult
+}
+
+// conn sits between a libp2p stream and the srpc.RpcPeer using it. Outgoing
+// frames are written whole, so calls made by the RpcPeer and responses
+// written by the conn never interleave, and every call is observed on its
+// way out and back.
+//
+// srpc.RpcPeer dispatches incoming calls itself, always with
+// context.Background(), and the conn only observes them. When services is
+// set, from a ServerProvider, the conn dispatches request frames instead;
+// all other frames are passed through to the RpcPeer.
+//
+// Calls made through the conn are traced as children of ctx, and the trace
+// context is sent ahead of each request in a metadata frame when the remote
+// handler advertises the extension protocol.
+type conn struct {
+	ctx      context.Context
+	stream   network.Stream
+	protocol string
+	opts     *streamOptions
+	// server is set on the streams a service accepts, which read metadata
+	// and token frames
+	server bool
+	// extended is set on outbound streams when the remote handler reads
+	// metadata frames
+	extended bool
+
+	services map[string]interface{}
+	callMeta map[uint32]metadata
+	// interceptors run around each dispatched call
+	interceptors []UnaryServerInterceptor
+	// token is the capability the remote peer presented, checked before
+	// each dispatched call
+	token *Token
+
+	pr *io.PipeReader
+	pw *io.PipeWriter
+
+	bufMu sync.Mutex
+	wbuf  []byte
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint32]pendingCall
+	// serving holds the calls dispatched by the RpcPeer until it answers
+	serving map[uint32]pendingCall
+	// ended is closed when run stops reading, after which no response
+	// arrives
+	ended   chan struct{}
+	endOnce sync.Once
+
+	// calls tracks the dispatched calls; active counts them for the idle
+	// timeout
+	calls  sync.WaitGroup
+	idleMu sync.Mutex
+	active int
+}
+
+func newConn(ctx context.Context, s network.Stream, opts *streamOptions) *conn {
+	pr, pw := io.Pipe()
+	return &conn{
+		ctx:      context.WithoutCancel(ctx),
+		stream:   s,
+		protocol: string(s.Protocol()),
+		opts:     opts,
+		pr:       pr,
+		pw:       pw,
+		callMeta: make(map[uint32]metadata),
+		pending:  make(map[uint32]pendingCall),
+		serving:  make(map[uint32]pendingCall),
+		ended:    make(chan struct{}),
+	}
+}
+
+// Read implements srpc.Stream
+func (c *conn) Read(p []byte) (int, error) {
+	return c.pr.Read(p)
+}
+
+// Write implements srpc.Stream. RpcPeer writes a frame in several pieces, so
+// bytes are buffered until a whole frame is available.
+func (c *conn) Write(p []byte) (int, error) {
+	c.bufMu.Lock()
+	defer c.bufMu.Unlock()
+
+	c.wbuf = append(c.wbuf, p...)
+	for {
+		n := peerFrameLength(c.wbuf)
+		if n == 0 || len(c.wbuf) < n {
+			return len(p), nil
+		}
+		raw := append([]byte(nil), c.wbuf[:n]...)
+		c.wbuf = c.wbuf[n:]
+		binary.BigEndian.PutUint32(raw[:4], uint32(n-4))
+		if err := c.send(raw); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Close closes the underlying stream
+func (c *conn) Close() error {
+	c.pr.Close()
+	return c.stream.Close()
+}
+
+func (c *conn) send(raw []byte) error {
+	f, err := parseFrame(raw)
+	if err != nil {
+		return err
+	}
+	if f.isResponse() {
+		c.answered(f)
+		return c.writeFrame(raw)
+	}
+	if len(c.opts.clientInterceptors) > 0 {
+		select {
+		case <-c.ended:
+			return io.ErrClosedPipe
+		default:
+		}
+		go c.intercept(f)
+		return nil
+	}
+	if err := c.startCall(c.ctx, f, nil); err != nil {
+		return err
+	}
+	return c.writeFrame(raw)
+}
+
+// startCall traces an outgoing request, sends its metadata and records it
+// as pending until the response arrives
+func (c *conn) startCall(ctx context.Context, f *frame, done chan<- callResult) error {
+	ctx, span := c.opts.tracer.Start(ctx, f.method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		rpcAttributes(c.protocol, f.method, c.stream.Conn().RemotePeer()),
+	)
+
+	md := metadata{}
+	if c.extended {
+		propagator.Inject(ctx, md)
+	}
+	if len(md) > 0 {
+		meta, err := encodeMetadata(f.callID(), md)
+		if err == nil {
+			err = c.writeFrame(meta)
+		}
+		if err != nil {
+			endSpan(span, err)
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.ended:
+		endSpan(span, io.ErrClosedPipe)
+		return io.ErrClosedPipe
+	default:
+	}
+	c.pending[f.callID()] = pendingCall{method: f.method, start: time.Now(), span: span, done: done}
+	return nil
+}
+
+func (c *conn) writeFrame(raw []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.stream.Write(raw)
+	return err
+}
+
+// run reads frames until the stream fails. Requests are dispatched when the
+// conn has services; everything else is handed to the RpcPeer. The context
+// of dispatched calls is cancelled when the stream is reset; when the remote
+// closes it, run waits for the calls to be answered.
+//
+// With an idle timeout, run returns errIdle once no call was in flight for
+// that long.
+func (c *conn) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer c.end()
+
+	if c.services != nil && c.opts.timeouts.Idle > 0 {
+		c.stream.SetReadDeadline(time.Now().Add(c.opts.timeouts.Idle))
+	}
+	for {
+		f, raw, err := readFrame(c.stream)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				cancel()
+			}
+			c.calls.Wait()
+			c.end()
+			c.failPending(err)
+			c.pw.CloseWithError(err)
+			if c.services != nil && c.opts.timeouts.Idle > 0 && isTimeout(err) {
+				return errIdle
+			}
+			return err
+		}
+
+		switch {
+		case f.isResponse():
+			if raw = c.complete(f, raw); raw == nil {
+				continue
+			}
+		case c.server && isMetadataFrame(f):
+			c.storeMetadata(f.payload)
+			continue
+		case c.server && isTokenFrame(f):
+			// only the first frame of a stream can present a token
+			continue
+		case c.services != nil:
+			c.callStarted()
+			go c.dispatch(ctx, f)
+			continue
+		case c.server:
+			c.serve(f)
+		}
+
+		if _, err := c.pw.Write(raw); err != nil {
+			return err
+		}
+	}
+}
+
+// end marks the stream as no longer read. Calls started after it fail at
+// once.
+func (c *conn) end() {
+	c.endOnce.Do(func() {
+		c.mu.Lock()
+		close(c.ended)
+		c.mu.Unlock()
+	})
+}
+
+// complete records the outcome of an outgoing call and returns the frame to
+// hand to the RpcPeer, or nil when a client interceptor waits for it
+func (c *conn) complete(f *frame, raw []byte) []byte {
+	c.mu.Lock()
+	call, ok := c.pending[f.callID()]
+	delete(c.pending, f.callID())
+	c.mu.Unlock()
+
+	var err error
+	if f.isError() {
+		err = f.rpcError()
+		raw = encodeResponse(f.id, undecodable)
+	}
+	if ok {
+		c.opts.metrics.ObserveRPC(sideClient, c.protocol, call.method, time.Since(call.start), err)
+		endSpan(call.span, err)
+	}
+	if ok && call.done != nil {
+		call.done <- callResult{payload: f.payload, err: err}
+		return nil
+	}
+	return raw
+}
+
+// abandon ends an outgoing call that will not wait for its response
+func (c *conn) abandon(id uint32, err error) {
+	c.mu.Lock()
+	call, ok := c.pending[id]
+	delete(c.pending, id)
+	c.mu.Unlock()
+
+	if ok {
+		c.opts.metrics.ObserveRPC(sideClient, c.protocol, call.method, time.Since(call.start), err)
+		endSpan(call.span, err)
+	}
+}
+
+// serve records a request the RpcPeer dispatches until it answers
+func (c *conn) serve(f *frame) {
+	ctx := propagator.Extract(c.ctx, c.takeMetadata(f.callID()))
+	_, span := c.opts.tracer.Start(ctx, f.method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		rpcAttributes(c.protocol, f.method, c.stream.Conn().RemotePeer()),
+	)
+	c.mu.Lock()
+	c.serving[f.callID()] = pendingCall{method: f.method, start: time.Now(), span: span}
+	c.mu.Unlock()
+}
+
+// answered records the outcome of a call the RpcPeer dispatched
+func (c *conn) answered(f *frame) {
+	c.mu.Lock()
+	call, ok := c.serving[f.callID()]
+	delete(c.serving, f.callID())
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	// The RpcPeer answers calls to methods it does not register with
+	// ErrorCodeMethodNotFound
+	method := call.method
+	var err error
+	if f.isError() {
+		rpcErr := f.rpcError()
+		if rpcErr.Code == srpc.ErrorCodeMethodNotFound {
+			method = unknownMethod
+		}
+		err = rpcErr
+	}
+	c.opts.metrics.ObserveRPC(sideServer, c.protocol, method, time.Since(call.start), err)
+	endSpan(call.span, err)
+}
+
+// failPending fails the outgoing calls still waiting for a response when
+// the stream ends, such as when the remote peer rejects it, instead of
+// leaving them to RpcPeer's timeout. Calls the RpcPeer has not answered yet
+// fail too, since their responses can no longer be sent.
+func (c *conn) failPending(err error) {
+	c.mu.Lock()
+	pending, serving := c.pending, c.serving
+	c.pending = make(map[uint32]pendingCall)
+	c.serving = make(map[uint32]pendingCall)
+	c.mu.Unlock()
+
+	// The RpcPeer never answered these, so whether it registers their
+	// methods is not known
+	for _, call := range serving {
+		c.opts.metrics.ObserveRPC(sideServer, c.protocol, unknownMethod, time.Since(call.start), err)
+		endSpan(call.span, err)
+	}
+
+	for id, call := range pending {
+		c.opts.metrics.ObserveRPC(sideClient, c.protocol, call.method, time.Since(call.start), err)
+		endSpan(call.span, err)
+		if call.done != nil {
+			call.done <- callResult{err: err}
+			continue
+		}
+		if _, err := c.pw.Write(encodeResponse(id, undecodable)); err != nil {
+			return
+		}
+	}
+}
+
+// storeMetadata keeps the values of a metadata frame until the request they
+// belong to is dispatched
+func (c *conn) storeMetadata(payload []byte) {
+	var mf metadataFrame
+	if err := json.Unmarshal(payload, &mf); err != nil {
+		c.opts.logger.Debug("Ignoring malformed call metadata",
+			logging.KeyProtocol, c.protocol,
+			logging.KeyPeer, c.stream.Conn().RemotePeer(),
+			"error", err)
+		return
+	}
+	c.mu.Lock()
+	if len(c.callMeta) < maxPendingMetadata {
+		c.callMeta[mf.Call] = mf.Values
+	}
+	c.mu.Unlock()
+}
+
+func (c *conn) takeMetadata(call uint32) metadata {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	md, ok := c.callMeta[call]
+	if !ok {
+		return metadata{}
+	}
+	delete(c.callMeta, call)
+	return md
+}
+
+func (c *conn) dispatch(ctx context.Context, f *frame) {
+	defer c.callDone()
+	ctx = propagator.Extract(ctx, c.takeMetadata(f.callID()))
+	ctx, span := c.opts.tracer.Start(ctx, f.method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		rpcAttributes(c.protocol, f.method, c.stream.Conn().RemotePeer()),
+	)
+
+	start := time.Now()
+	method := c.methodLabel(f.method)
+	var payload []byte
+	err := c.opts.allowCall(c.stream.Conn().RemotePeer(), c.protocol, method)
+	if err == nil {
+		err = c.authorize(f.method)
+	}
+	if err == nil {
+		var release func()
+		if release, err = c.opts.acquireCall(ctx, c.stream, c.protocol, method, len(f.payload)); err == nil {
+			payload, err = c.call(ctx, f.method, f.payload, release)
+		}
+	}
+	c.opts.metrics.ObserveRPC(sideServer, c.protocol, method, time.Since(start), err)
+	endSpan(span, err)
+
+	if err != nil {
+		var rpcErr *srpc.RPCError
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &srpc.RPCError{Code: srpc.ErrorCodeInternalError, Message: err.Error()}
+		}
+		c.reply(f, encodeError(f.id, rpcErr.Code, rpcErr.Message))
+		return
+	}
+	c.reply(f, encodeResponse(f.id, payload))
+}
+
+func (c *conn) reply(f *frame, raw []byte) {
+	if err := c.writeFrame(raw); err != nil && !isStreamEnd(err) {
+		c.opts.logger.Debug("Failed to write RPC response",
+			logging.KeyProtocol, c.protocol,
+			logging.KeyPeer, c.stream.Conn().RemotePeer(),
+			"method", f.method, "error", err)
+	}
+}
+
+// isStreamEnd reports whether err only signals that the stream went away
+func isStreamEnd(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, network.ErrReset)
+}
+
+// authorize checks a call against the stream's token, if it has one
+func (c *conn) authorize(method string) error {
+	if c.token == nil {
+		return nil
+	}
+	return c.opts.tokens.authorize(c.token, c.protocol, method)
+}
+
+// unknownMethod is the metric label of calls to methods the service does
+// not register, which remote peers could otherwise pick without bound
+const unknownMethod = "unknown"
+
+// methodLabel returns fullMethod ("Service.Method") when it is a method of
+// the conn's services, or else unknownMethod
+func (c *conn) methodLabel(fullMethod string) string {
+	serviceName, methodName, ok := strings.Cut(fullMethod, ".")
+	if svc, found := c.services[serviceName]; ok && found && reflect.ValueOf(svc).MethodByName(methodName).IsValid() {
+		return fullMethod
+	}
+	return unknownMethod
+}
+
+// invoke calls fullMethod ("Service.Method") the same way RpcPeer does, but
+// with ctx and through the conn's interceptors
+func (c *conn) invoke(ctx context.Context, fullMethod string, payload []byte) ([]byte, error) {
+	serviceName, methodName, ok := strings.Cut(fullMethod, ".")
+	if !ok || strings.Contains(methodName, ".") {
+		return nil, rpcErrorf(srpc.ErrorCodeInvalidRequest, "invalid method name format")
+	}
+
+	svc, ok := c.services[serviceName]
+	if !ok {
+		return nil, rpcErrorf(srpc.ErrorCodeMethodNotFound, "service %s not found", serviceName)
+	}
+
+	method := reflect.ValueOf(svc).MethodByName(methodName)
+	if !method.IsValid() {
+		return nil, rpcErrorf(srpc.ErrorCodeMethodNotFound, "method %s not found", methodName)
+	}
+
+	methodType := method.Type()
+	if methodType.NumIn() != 2 || methodType.NumOut() != 1 || methodType.In(1).Kind() != reflect.Ptr {
+		return nil, rpcErrorf(srpc.ErrorCodeInvalidRequest, "invalid method signature")
+	}
+
+	req, ok := reflect.New(methodType.In(1).Elem()).Interface().(proto.Message)
+	if !ok {
+		return nil, rpcErrorf(srpc.ErrorCodeInvalidRequest, "invalid method signature")
+	}
+	if err := proto.Unmarshal(payload, req); err != nil {
+		return nil, rpcErrorf(srpc.ErrorCodeInternalError, "failed to unmarshal request: %v", err)
+	}
+
+	handler := func(ctx context.Context, req proto.Message) (proto.Message, error) {
+		f := &failure{}
+		results := method.Call([]reflect.Value{reflect.ValueOf(withFailure(ctx, f)), reflect.ValueOf(req)})
+		if err := f.get(); err != nil {
+			return nil, err
+		}
+		resp, ok := results[0].Interface().(proto.Message)
+		if !ok {
+			return nil, rpcErrorf(srpc.ErrorCodeInternalError, "invalid method return value")
+		}
+		return resp, nil
+	}
+	if len(c.interceptors) > 0 {
+		info := &CallInfo{Protocol: c.protocol, Method: fullMethod, Peer: c.stream.Conn().RemotePeer()}
+		handler = chainServer(c.interceptors, info, handler)
+	}
+	resp, err := handler(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := proto.Marshal(resp)
+	if err != nil {
+		return nil, rpcErrorf(srpc.ErrorCodeInternalError, "failed to marshal response: %v", err)
+	}
+	return out, nil
+}
+
+func rpcErrorf(code srpc.ErrorCode, format string, args ...interface{}) *srpc.RPCError {
+	return &srpc.RPCError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"sync"
+
+	srpc "github.com/jibuji/go-stream-rpc"
+)
+
+// ErrorCodeNotFound is returned by handlers for requests about something the
+// node does not have, such as a topic it has not registered
+const ErrorCodeNotFound srpc.ErrorCode = 0x104
+
+// Errorf returns an error answered to the caller with code and the formatted
+// message. Handlers fail calls with it through Fail; codes of go-stream-rpc
+// such as srpc.ErrorCodeMalformedRequest may be used as well.
+func Errorf(code srpc.ErrorCode, format string, args ...interface{}) error {
+	return rpcErrorf(code, format, args...)
+}
+
+type failureKey struct{}
+
+// failure holds the error a handler failed its call with. Handlers may
+// call Fail from other goroutines, so it is guarded by mu.
+type failure struct {
+	mu  sync.Mutex
+	err error
+}
+
+// set records err unless an error was recorded already
+func (f *failure) set(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+// get returns the recorded error
+func (f *failure) get() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// withFailure returns ctx in which Fail records the call's error in f
+func withFailure(ctx context.Context, f *failure) context.Context {
+	return context.WithValue(ctx, failureKey{}, f)
+}
+
+// Fail makes the call handled with ctx fail with err, answered to the
+// caller instead of the response the handler returns. Errors that do not
+// come from Errorf are answered with srpc.ErrorCodeInternalError. Only the
+// first error counts, and only when Fail is called before the handler
+// returns; it has no effect outside of calls dispatched by BaseService,
+// whose service implements ServerProvider.
+func Fail(ctx context.Context, err error) {
+	if f, ok := ctx.Value(failureKey{}).(*failure); ok {
+		f.set(err)
+	}
+}
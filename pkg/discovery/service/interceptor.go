@@ -0,0 +1,120 @@
+package service
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/proto"
+)
+
+// CallInfo describes the call an interceptor runs around
+type CallInfo struct {
+	Protocol string
+	// Method is the full method name, such as "Calculator.Add"
+	Method string
+	// Peer is the remote peer: the caller on the server, the callee on the
+	// client
+	Peer peer.ID
+}
+
+// UnaryHandler runs a call on the server and returns its response
+type UnaryHandler func(ctx context.Context, req proto.Message) (proto.Message, error)
+
+// UnaryServerInterceptor runs around a call dispatched to a service. It may
+// inspect or replace the request and response, or answer without calling
+// handler. An error of type *srpc.RPCError is sent with its code; any other
+// error is sent as an internal error.
+type UnaryServerInterceptor func(ctx context.Context, req proto.Message, info *CallInfo, handler UnaryHandler) (proto.Message, error)
+
+// UnaryInvoker sends an encoded request and waits for the encoded response
+type UnaryInvoker func(ctx context.Context, req []byte) ([]byte, error)
+
+// UnaryClientInterceptor runs around a call made by a client. Generated
+// clients marshal their messages before they reach the registry, so the
+// request and response are protobuf encoded. It may answer without calling
+// invoker; the client sees any error as a failed call.
+type UnaryClientInterceptor func(ctx context.Context, req []byte, info *CallInfo, invoker UnaryInvoker) ([]byte, error)
+
+// WithServerInterceptors runs interceptors around every call dispatched to
+// the handlers of the registry, which must embed BaseService with a service
+// implementing ServerProvider; RegisterService rejects other handlers. The
+// first one is the outermost; they run outside those added with
+// BaseService.UseInterceptors.
+func WithServerInterceptors(interceptors ...UnaryServerInterceptor) RegistryOption {
+	return func(r *registry) {
+		r.serverInterceptors = append(r.serverInterceptors, interceptors...)
+	}
+}
+
+// WithClientInterceptors runs interceptors around every call made on the
+// streams the registry opens, including the clients of NewClient. The first
+// one is the outermost.
+func WithClientInterceptors(interceptors ...UnaryClientInterceptor) RegistryOption {
+	return func(r *registry) {
+		r.clientInterceptors = append(r.clientInterceptors, interceptors...)
+	}
+}
+
+// chainServer wraps handler in interceptors, the first one outermost
+func chainServer(interceptors []UnaryServerInterceptor, info *CallInfo, handler UnaryHandler) UnaryHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, req proto.Message) (proto.Message, error) {
+			return interceptor(ctx, req, info, next)
+		}
+	}
+	return handler
+}
+
+// chainClient wraps invoker in interceptors, the first one outermost
+func chainClient(interceptors []UnaryClientInterceptor, info *CallInfo, invoker UnaryInvoker) UnaryInvoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, req []byte) ([]byte, error) {
+			return interceptor(ctx, req, info, next)
+		}
+	}
+	return invoker
+}
+
+// intercept runs an outgoing request through the client interceptors and
+// hands their response to the RpcPeer, which waits for it as usual
+func (c *conn) intercept(f *frame) {
+	info := &CallInfo{Protocol: c.protocol, Method: f.method, Peer: c.stream.Conn().RemotePeer()}
+	invoker := func(ctx context.Context, req []byte) ([]byte, error) {
+		return c.roundTrip(ctx, f.callID(), f.method, req)
+	}
+	resp, err := chainClient(c.opts.clientInterceptors, info, invoker)(c.ctx, f.payload)
+	if err != nil {
+		resp = undecodable
+	}
+	c.pw.Write(encodeResponse(f.id, resp))
+}
+
+type callResult struct {
+	payload []byte
+	err     error
+}
+
+// roundTrip sends a request and waits for its response, the stream's end or
+// ctx, whichever comes first
+func (c *conn) roundTrip(ctx context.Context, id uint32, method string, req []byte) ([]byte, error) {
+	done := make(chan callResult, 1)
+	raw := encodeRequest(id, method, req)
+	err := c.startCall(ctx, &frame{id: id, method: method, payload: req}, done)
+	if err == nil {
+		err = c.writeFrame(raw)
+	}
+	if err != nil {
+		c.abandon(id, err)
+		return nil, err
+	}
+
+	select {
+	case r := <-done:
+		return r.payload, r.err
+	case <-ctx.Done():
+		c.abandon(id, ctx.Err())
+		return nil, ctx.Err()
+	}
+}
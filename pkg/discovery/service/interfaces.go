@@ -2,12 +2,18 @@ package service
 
 import (
 	"context"
-	"log"
+	"errors"
+	"io"
+	"slices"
+	"time"
 
 	srpc "github.com/jibuji/go-stream-rpc"
-	stream "github.com/jibuji/go-stream-rpc/stream/libp2p"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/jibuji/p2p-service-discover/internal/logging"
 )
 
 // ServiceHandler represents a service implementation
@@ -25,22 +31,80 @@ type RPCService interface {
 	RegisterWithPeer(peer *srpc.RpcPeer)
 }
 
+// ServerProvider is implemented by RPC services that hand their servers to
+// BaseService. BaseService then dispatches their calls itself, with a context
+// that carries the caller and is cancelled on timeouts, and checks each call
+// against the handler's token, limits and interceptors. The calls of other
+// services are dispatched by the RPC peer with context.Background(), and only
+// observed on their way in and out.
+type ServerProvider interface {
+	// Servers returns the servers RegisterWithPeer registers, keyed by the
+	// service name their clients call, such as "Calculator". It is called for
+	// every stream.
+	Servers() map[string]interface{}
+}
+
+// HandlerInfo describes a protocol served by a registered handler
+type HandlerInfo struct {
+	Protocol string
+	Metadata map[string]string
+	// Descriptors are the protobuf files defining the handler's services
+	Descriptors []protoreflect.FileDescriptor
+	Registered  time.Time
+	// ACL is the handler's WithACL option; nil accepts every peer
+	ACL *ACL
+}
+
 // ServiceRegistry manages service registration and client creation
 type ServiceRegistry interface {
 	// RegisterService registers a service handler
-	RegisterService(handler ServiceHandler) error
+	RegisterService(handler ServiceHandler, opts ...HandlerOption) error
+
+	// UnregisterService removes the stream handlers of the protocols handler
+	// serves. Streams already open are not closed.
+	UnregisterService(handler ServiceHandler)
 
-	// NewClient creates a client for the given service and peer
+	// NewClient creates a client for the given service and peer. protocol
+	// may be a range such as /calculator/^1.0, in which case the highest
+	// version in it that the peer supports and that has a client constructor
+	// is negotiated; a constructor registered for the range serves any of its
+	// versions.
 	NewClient(ctx context.Context, protocol string, peer peer.ID) (interface{}, error)
 
+	// OpenPeer opens a stream to the given peer and returns an RPC peer on it.
+	// protocol may be a range, as for NewClient. The caller owns the peer and
+	// must Close it.
+	OpenPeer(ctx context.Context, protocol string, peer peer.ID) (*srpc.RpcPeer, error)
+
+	// Invoke calls method, such as "Calculator.Add", on a stream of its own
+	// to the given peer. Unlike calls made through an RPC peer, it returns
+	// the error the remote handler answered with as an *srpc.RPCError.
+	Invoke(ctx context.Context, protocol string, peer peer.ID, method string, req, resp proto.Message) error
+
 	// RegisterClientConstructor registers a constructor function for creating service clients
 	RegisterClientConstructor(protocol string, constructor func(*srpc.RpcPeer) interface{})
+
+	// RegisterClientToken sets the capability token presented on the streams
+	// opened for protocol. An empty token removes it.
+	RegisterClientToken(protocol string, token string)
+
+	// HandlerProtocols returns the protocol IDs served by registered handlers
+	HandlerProtocols() []string
+
+	// Handlers describes the protocols served by registered handlers
+	Handlers() []HandlerInfo
+
+	// ClientProtocols returns the protocol IDs with a client constructor
+	ClientProtocols() []string
 }
 
 // BaseService provides common stream handling functionality
 type BaseService struct {
-	protocolID string
-	service    RPCService
+	protocolID   string
+	service      RPCService
+	interceptors []UnaryServerInterceptor
+	// aliases are the other protocol IDs the service is served on
+	aliases []string
 }
 
 // NewBaseService creates a new base service
@@ -55,20 +119,120 @@ func (b *BaseService) Protocol() string {
 	return b.protocolID
 }
 
+// AddProtocols serves the service on ids too, such as older versions it is
+// compatible with. It must be called before the service is registered.
+func (b *BaseService) AddProtocols(ids ...string) {
+	for _, id := range ids {
+		if id != b.protocolID && !slices.Contains(b.aliases, id) {
+			b.aliases = append(b.aliases, id)
+		}
+	}
+}
+
+// Protocols returns the protocol ID of the service followed by those added
+// with AddProtocols
+func (b *BaseService) Protocols() []string {
+	return append([]string{b.protocolID}, b.aliases...)
+}
+
+// ServedProtocols returns the protocol IDs a handler is registered for: the
+// result of its Protocols method when it has one, such as handlers embedding
+// BaseService, or else its Protocol
+func ServedProtocols(h ServiceHandler) []string {
+	if m, ok := h.(interface{ Protocols() []string }); ok {
+		return m.Protocols()
+	}
+	return []string{h.Protocol()}
+}
+
+// UseInterceptors runs interceptors around every call the service handles,
+// inside those of the registry. The first one is the outermost. It must be
+// called before the service is registered, and the service must implement
+// ServerProvider.
+func (b *BaseService) UseInterceptors(interceptors ...UnaryServerInterceptor) {
+	b.interceptors = append(b.interceptors, interceptors...)
+}
+
+// streamServer is implemented by handlers embedding BaseService. The registry
+// serves their streams with its own settings instead of binding the handler,
+// which may be registered on several nodes, to a single registry.
+type streamServer interface {
+	serveStream(s network.Stream, opts *streamOptions)
+	dispatches() bool
+	intercepts() bool
+}
+
 // HandleStream implements the common stream handling pattern
 func (b *BaseService) HandleStream(s network.Stream) {
-	peer := srpc.NewRpcPeer(stream.NewLibP2PStream(s))
-	defer peer.Close()
+	opts := defaultStreamOptions()
+	b.serveStream(s, &opts)
+}
 
-	b.service.RegisterWithPeer(peer)
+// dispatches reports whether the service's calls are dispatched by
+// BaseService rather than by the RPC peer
+func (b *BaseService) dispatches() bool {
+	_, ok := b.service.(ServerProvider)
+	return ok
+}
 
-	// Handle stream closure
-	done := make(chan struct{})
-	peer.OnStreamClose(func(err error) {
-		if err != nil {
-			log.Printf("Stream error: %v\n", err)
+// intercepts reports whether interceptors were added with UseInterceptors
+func (b *BaseService) intercepts() bool {
+	return len(b.interceptors) > 0
+}
+
+func (b *BaseService) serveStream(s network.Stream, opts *streamOptions) {
+	// The stream's protocol is the version the client negotiated
+	protocolID := string(s.Protocol())
+	if protocolID == "" {
+		protocolID = b.protocolID
+	}
+	log := opts.logger.With(
+		logging.KeyProtocol, protocolID,
+		logging.KeyPeer, s.Conn().RemotePeer(),
+	)
+	log.Debug("Stream opened")
+
+	if !opts.admit(s, protocolID) || !opts.allowStream(s, protocolID) {
+		return
+	}
+	release, ok := opts.acquireStream(s, protocolID)
+	if !ok {
+		return
+	}
+	defer release()
+	var token *Token
+	if opts.tokens != nil {
+		if token, ok = opts.verifyToken(s, protocolID); !ok {
+			return
 		}
-		close(done)
-	})
-	<-done
+	}
+
+	c := newConn(context.Background(), s, opts)
+	c.server = true
+	c.token = token
+	c.interceptors = append(slices.Clip(opts.serverInterceptors), b.interceptors...)
+	if sp, ok := b.service.(ServerProvider); ok {
+		c.services = sp.Servers()
+	} else if token != nil || opts.checksCalls() || len(c.interceptors) > 0 {
+		// RpcPeer would dispatch the calls without checking their scope,
+		// rate or timeout, or running the interceptors
+		log.Error("RPC service does not implement ServerProvider, closing stream that requires call checks")
+		s.Reset()
+		return
+	}
+	peer := srpc.NewRpcPeer(c)
+	defer peer.Close()
+	b.service.RegisterWithPeer(peer)
+
+	err := c.run(withCaller(context.Background(), s))
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+		log.Debug("Stream closed")
+	case errors.Is(err, errIdle):
+		log.Debug("Closing idle stream", "timeout", opts.timeouts.Idle)
+	case errors.Is(err, network.ErrReset):
+		log.Debug("Stream reset by remote peer")
+	default:
+		log.Warn("Stream error", "error", err)
+	}
 }
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	srpc "github.com/jibuji/go-stream-rpc"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/time/rate"
+
+	"github.com/jibuji/p2p-service-discover/internal/logging"
+)
+
+// ErrorCodeRateLimited is returned for calls over a rate limit of the
+// service. The call was not dispatched and may be retried later.
+const ErrorCodeRateLimited srpc.ErrorCode = 0x101
+
+// rejectRateLimited is the reason for streams and calls over a rate limit,
+// used in logs and metrics
+const rejectRateLimited = "rate_limited"
+
+// maxLimitedPeers is the number of peers whose buckets are kept before idle
+// ones are dropped
+const maxLimitedPeers = 4096
+
+// RateLimit is a token bucket holding up to Burst events and refilled at
+// Rate events per second. The zero value means no limit.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0
+}
+
+func (l RateLimit) validate(name string) error {
+	if l.Rate < 0 {
+		return fmt.Errorf("%s rate must not be negative, got %g", name, l.Rate)
+	}
+	if l.Rate > 0 && l.Burst < 1 {
+		return fmt.Errorf("%s burst must be at least 1, got %d", name, l.Burst)
+	}
+	return nil
+}
+
+func (l RateLimit) limiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(l.Rate), l.Burst)
+}
+
+// RateLimits bounds the streams and calls a service accepts. Streams and
+// Calls apply to all peers together, PeerStreams and PeerCalls to each peer.
+// Streams over a limit are reset, and calls over a limit are answered with
+// ErrorCodeRateLimited.
+type RateLimits struct {
+	Streams     RateLimit `yaml:"streams"`
+	PeerStreams RateLimit `yaml:"peer_streams"`
+	Calls       RateLimit `yaml:"calls"`
+	PeerCalls   RateLimit `yaml:"peer_calls"`
+}
+
+// Validate reports the first limit with a negative rate or without a burst
+func (l RateLimits) Validate() error {
+	for _, err := range []error{
+		l.Streams.validate("streams"),
+		l.PeerStreams.validate("peer streams"),
+		l.Calls.validate("calls"),
+		l.PeerCalls.validate("peer calls"),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limitsCalls reports whether calls are limited, which only BaseService
+// handlers can enforce
+func (l RateLimits) limitsCalls() bool {
+	return l.Calls.enabled() || l.PeerCalls.enabled()
+}
+
+// rateLimiter enforces the RateLimits of one registered handler
+type rateLimiter struct {
+	// streams and calls are nil when not limited
+	streams     *rate.Limiter
+	calls       *rate.Limiter
+	peerStreams *peerLimiters
+	peerCalls   *peerLimiters
+}
+
+func newRateLimiter(l RateLimits) *rateLimiter {
+	r := &rateLimiter{
+		peerStreams: newPeerLimiters(l.PeerStreams),
+		peerCalls:   newPeerLimiters(l.PeerCalls),
+	}
+	if l.Streams.enabled() {
+		r.streams = l.Streams.limiter()
+	}
+	if l.Calls.enabled() {
+		r.calls = l.Calls.limiter()
+	}
+	return r
+}
+
+// allowStream reports whether p may open another stream. A nil limiter
+// allows everything.
+func (r *rateLimiter) allowStream(p peer.ID) bool {
+	if r == nil {
+		return true
+	}
+	return allow(r.peerStreams, r.streams, p)
+}
+
+// allowCall reports whether p may make another call
+func (r *rateLimiter) allowCall(p peer.ID) bool {
+	if r == nil {
+		return true
+	}
+	return allow(r.peerCalls, r.calls, p)
+}
+
+// allow checks the peer's bucket first, so a peer over its own limit does
+// not use up the tokens shared by all peers
+func allow(perPeer *peerLimiters, global *rate.Limiter, p peer.ID) bool {
+	if !perPeer.allow(p) {
+		return false
+	}
+	return global == nil || global.Allow()
+}
+
+// peerLimiters holds a bucket per peer
+type peerLimiters struct {
+	limit RateLimit
+
+	mu    sync.Mutex
+	peers map[peer.ID]*rate.Limiter
+}
+
+// newPeerLimiters returns nil when l is not a limit
+func newPeerLimiters(l RateLimit) *peerLimiters {
+	if !l.enabled() {
+		return nil
+	}
+	return &peerLimiters{limit: l, peers: make(map[peer.ID]*rate.Limiter)}
+}
+
+func (pl *peerLimiters) allow(p peer.ID) bool {
+	if pl == nil {
+		return true
+	}
+	now := time.Now()
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	l, ok := pl.peers[p]
+	if !ok {
+		if len(pl.peers) >= maxLimitedPeers {
+			pl.prune(now)
+		}
+		l = pl.limit.limiter()
+		pl.peers[p] = l
+	}
+	return l.AllowN(now, 1)
+}
+
+// prune drops the buckets that are full again, which behave like new ones.
+// Must be called with pl.mu held.
+func (pl *peerLimiters) prune(now time.Time) {
+	for p, l := range pl.peers {
+		if l.TokensAt(now) >= float64(pl.limit.Burst) {
+			delete(pl.peers, p)
+		}
+	}
+}
+
+// allowStream checks the stream rate limits. Streams over a limit are
+// reset, logged and counted.
+func (o *streamOptions) allowStream(s network.Stream, protocolID string) bool {
+	p := s.Conn().RemotePeer()
+	if o.limiter.allowStream(p) {
+		return true
+	}
+	s.Reset()
+	o.metrics.StreamRejected(protocolID, rejectRateLimited)
+	o.logLimiter.Log(o.logger, slog.LevelInfo, "ratelimit:"+protocolID+":"+p.String(), "Rejected stream",
+		logging.KeyProtocol, protocolID, logging.KeyPeer, p, "reason", rejectRateLimited)
+	return false
+}
+
+// allowCall checks the call rate limits before method is dispatched
+func (o *streamOptions) allowCall(p peer.ID, protocolID, method string) error {
+	if o.limiter.allowCall(p) {
+		return nil
+	}
+	o.metrics.CallRejected(protocolID, method, rejectRateLimited)
+	o.logLimiter.Log(o.logger, slog.LevelDebug, "ratelimit-call:"+protocolID+":"+p.String(), "Rejected call",
+		logging.KeyProtocol, protocolID, logging.KeyPeer, p, "method", method, "reason", rejectRateLimited)
+	return rpcErrorf(ErrorCodeRateLimited, "rate limit exceeded for %s", protocolID)
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// slow refills too slowly for a test to notice
+func slow(burst int) RateLimit {
+	return RateLimit{Rate: 0.001, Burst: burst}
+}
+
+func TestRateLimitsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  RateLimits
+		wantErr bool
+	}{
+		{name: "no limits"},
+		{name: "limits", limits: RateLimits{Streams: slow(1), PeerCalls: RateLimit{Rate: 10, Burst: 20}}},
+		{name: "negative rate", limits: RateLimits{Calls: RateLimit{Rate: -1}}, wantErr: true},
+		{name: "no burst", limits: RateLimits{PeerStreams: RateLimit{Rate: 1}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.limits.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	a, b := peer.ID("a"), peer.ID("b")
+	tests := []struct {
+		name   string
+		limits RateLimits
+		calls  []peer.ID
+		want   []bool
+	}{
+		{name: "no limits", calls: []peer.ID{a, a, a}, want: []bool{true, true, true}},
+		{name: "per peer", limits: RateLimits{PeerCalls: slow(2)}, calls: []peer.ID{a, a, a, b}, want: []bool{true, true, false, true}},
+		{name: "global", limits: RateLimits{Calls: slow(2)}, calls: []peer.ID{a, b, b}, want: []bool{true, true, false}},
+		{
+			// a over its own limit does not use up b's share
+			name:   "per peer first",
+			limits: RateLimits{Calls: slow(2), PeerCalls: slow(1)},
+			calls:  []peer.ID{a, a, a, b, b},
+			want:   []bool{true, false, false, true, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRateLimiter(tt.limits)
+			for i, p := range tt.calls {
+				if got := r.allowCall(p); got != tt.want[i] {
+					t.Errorf("call %d by %s allowed = %v, want %v", i, p, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitsRejectStreams(t *testing.T) {
+	tp := newTestPair(t, WithRateLimits(RateLimits{PeerStreams: slow(1)}))
+	if _, err := tp.call("Echo", "hello"); err != nil {
+		t.Fatalf("first Echo: %v", err)
+	}
+	_, err := tp.call("Echo", "hello")
+	checkRejected(t, err)
+	tp.waitForCounter(t, "streams_rejected_total", map[string]string{"protocol": echoProtocol, "reason": rejectRateLimited}, 1)
+}
+
+func TestRateLimitsRejectCalls(t *testing.T) {
+	tp := newTestPair(t, WithRateLimits(RateLimits{Calls: slow(1)}))
+	if _, err := tp.call("Echo", "hello"); err != nil {
+		t.Fatalf("first Echo: %v", err)
+	}
+	_, err := tp.call("Echo", "hello")
+	checkRPCError(t, err, ErrorCodeRateLimited)
+	labels := map[string]string{"protocol": echoProtocol, "method": "Echo.Echo", "reason": rejectRateLimited}
+	tp.waitForCounter(t, "rpc_calls_rejected_total", labels, 1)
+}
@@ -2,49 +2,353 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
 	"sync"
+	"time"
 
 	srpc "github.com/jibuji/go-stream-rpc"
-	stream "github.com/jibuji/go-stream-rpc/stream/libp2p"
+	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/jibuji/p2p-service-discover/internal/logging"
+	"github.com/jibuji/p2p-service-discover/pkg/metrics"
 )
 
+// RegistryOption configures a registry created by NewRegistry
+type RegistryOption func(*registry)
+
+// WithMetrics records stream and RPC call metrics in m
+func WithMetrics(m *metrics.Metrics) RegistryOption {
+	return func(r *registry) {
+		r.metrics = m
+	}
+}
+
+// WithLogger sets the logger used for stream and call failures
+func WithLogger(logger *slog.Logger) RegistryOption {
+	return func(r *registry) {
+		r.logger = logger
+	}
+}
+
+// WithTracerProvider sets the provider of the tracer used for client and
+// server call spans. The global provider is used by default.
+func WithTracerProvider(tp trace.TracerProvider) RegistryOption {
+	return func(r *registry) {
+		r.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// WithLimitedConns lets OpenPeer and NewClient open streams over relayed
+// connections. By default they wait for a direct connection.
+func WithLimitedConns(allow bool) RegistryOption {
+	return func(r *registry) {
+		r.allowLimited = allow
+	}
+}
+
+// HandlerOption configures a single handler registered with RegisterService
+type HandlerOption func(*streamOptions)
+
+// errNotDispatched is returned for handler options that check every call of
+// a handler whose calls are dispatched by the RPC peer
+var errNotDispatched = errors.New("it does not embed BaseService with a ServerProvider service")
+
+// WithACL accepts only the streams of peers allowed by acl. The ACL is
+// checked when a stream is opened, before the RPC peer is created.
+func WithACL(acl *ACL) HandlerOption {
+	return func(o *streamOptions) {
+		o.acl = acl
+	}
+}
+
+// WithTokens accepts only the streams presenting a capability token that v
+// verifies. Every call on the stream is checked against the token's scope,
+// expiry and revocation before it is dispatched. Only handlers embedding
+// BaseService whose service implements ServerProvider can check tokens.
+func WithTokens(v *TokenVerifier) HandlerOption {
+	return func(o *streamOptions) {
+		o.tokens = v
+	}
+}
+
+// WithRateLimits bounds the streams and calls the handler accepts. Call
+// limits are only enforced by handlers embedding BaseService whose service
+// implements ServerProvider.
+func WithRateLimits(l RateLimits) HandlerOption {
+	return func(o *streamOptions) {
+		o.rateLimits = l
+	}
+}
+
+// WithConcurrencyLimits bounds the streams the handler serves and the calls
+// it runs at once. Call limits are only enforced by handlers embedding
+// BaseService whose service implements ServerProvider.
+func WithConcurrencyLimits(l ConcurrencyLimits) HandlerOption {
+	return func(o *streamOptions) {
+		o.concurrencyLimits = l
+	}
+}
+
+// WithTimeouts sets the call and idle timeouts of the handler. Only
+// handlers embedding BaseService whose service implements ServerProvider
+// enforce them, and RegisterService returns an error for others.
+func WithTimeouts(t Timeouts) HandlerOption {
+	return func(o *streamOptions) {
+		o.timeouts = t
+	}
+}
+
+// WithMetadata describes the handler with key-value pairs, such as an
+// owner or a description, returned with its protocols by Handlers and by
+// the reflection protocol
+func WithMetadata(md map[string]string) HandlerOption {
+	return func(o *streamOptions) {
+		o.metadata = md
+	}
+}
+
+// WithDescriptors publishes the protobuf files defining the handler's
+// services through the descriptor protocol, which lets tools such as
+// p2pdisc call them without generated code. Pass the File_* variables of
+// the generated packages; the files they import are published with them.
+func WithDescriptors(files ...protoreflect.FileDescriptor) HandlerOption {
+	return func(o *streamOptions) {
+		o.descriptors = files
+	}
+}
+
+// streamOptions are the settings applied to every stream a registry opens or
+// accepts
+type streamOptions struct {
+	metrics    *metrics.Metrics
+	logger     *slog.Logger
+	logLimiter *logging.Limiter
+	tracer     trace.Tracer
+	// acl filters the peers of inbound streams; it is set per handler
+	acl *ACL
+	// tokens verifies the tokens of inbound streams; it is set per handler
+	tokens *TokenVerifier
+	// rateLimits are set per handler, and enforced by limiter
+	rateLimits RateLimits
+	limiter    *rateLimiter
+	// concurrencyLimits are set per handler, and enforced by concurrency
+	concurrencyLimits ConcurrencyLimits
+	concurrency       *concurrency
+	// timeouts are set per handler
+	timeouts Timeouts
+	// interceptors are set on the registry
+	serverInterceptors []UnaryServerInterceptor
+	clientInterceptors []UnaryClientInterceptor
+	// metadata and descriptors are set per handler, and only reported by
+	// Handlers
+	metadata    map[string]string
+	descriptors []protoreflect.FileDescriptor
+}
+
+// checksCalls reports whether calls are checked or bounded, which needs the
+// conn to dispatch them
+func (o *streamOptions) checksCalls() bool {
+	return o.rateLimits.limitsCalls() || o.concurrencyLimits.Calls > 0 ||
+		o.timeouts.limitsCalls() || o.timeouts.Idle > 0
+}
+
+func defaultStreamOptions() streamOptions {
+	return streamOptions{
+		logger:     slog.Default(),
+		logLimiter: logging.NewLimiter(time.Minute),
+		tracer:     defaultTracer(),
+	}
+}
+
 type registry struct {
+	streamOptions
 	host host.Host
 	mu   sync.RWMutex
+	// Whether outbound streams may use relayed connections
+	allowLimited bool
+	// Protocol IDs with a registered handler
+	handlers map[string]HandlerInfo
 	// Map protocol ID to client constructor function
 	clientConstructors map[string]func(*srpc.RpcPeer) interface{}
+	// Map protocol ID to the token presented on outbound streams
+	clientTokens map[string]string
 }
 
-func NewRegistry(h host.Host) ServiceRegistry {
-	return &registry{
+func NewRegistry(h host.Host, opts ...RegistryOption) ServiceRegistry {
+	r := &registry{
+		streamOptions:      defaultStreamOptions(),
 		host:               h,
+		handlers:           make(map[string]HandlerInfo),
 		clientConstructors: make(map[string]func(*srpc.RpcPeer) interface{}),
+		clientTokens:       make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.logger == nil {
+		r.logger = slog.Default()
 	}
+	return r
 }
 
-func (r *registry) RegisterService(handler ServiceHandler) error {
+func (r *registry) RegisterService(handler ServiceHandler, opts ...HandlerOption) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	protocolID := handler.Protocol()
+	so := r.streamOptions
+	for _, opt := range opts {
+		opt(&so)
+	}
+	// Only calls dispatched by BaseService can be checked
+	ss, ok := handler.(streamServer)
+	dispatched := ok && ss.dispatches()
+	if ok && !dispatched {
+		r.logger.Warn("Service does not implement ServerProvider, its calls get no caller and cannot be checked",
+			logging.KeyProtocol, protocolID)
+	}
+	if !dispatched && so.tokens != nil {
+		return fmt.Errorf("handler for %s cannot check tokens: %w", protocolID, errNotDispatched)
+	}
+	if err := so.rateLimits.Validate(); err != nil {
+		return fmt.Errorf("invalid rate limits for %s: %w", protocolID, err)
+	}
+	if !dispatched && so.rateLimits.limitsCalls() {
+		return fmt.Errorf("handler for %s cannot limit calls: %w", protocolID, errNotDispatched)
+	}
+	so.limiter = newRateLimiter(so.rateLimits)
+	if err := so.concurrencyLimits.Validate(); err != nil {
+		return fmt.Errorf("invalid concurrency limits for %s: %w", protocolID, err)
+	}
+	if !dispatched && so.concurrencyLimits.Calls > 0 {
+		return fmt.Errorf("handler for %s cannot limit calls in flight: %w", protocolID, errNotDispatched)
+	}
+	so.concurrency = newConcurrency(so.concurrencyLimits)
+	if err := so.timeouts.Validate(); err != nil {
+		return fmt.Errorf("invalid timeouts for %s: %w", protocolID, err)
+	}
+	if !dispatched && (so.timeouts.limitsCalls() || so.timeouts.Idle > 0) {
+		return fmt.Errorf("handler for %s cannot enforce timeouts: %w", protocolID, errNotDispatched)
+	}
+	if !dispatched && (len(so.serverInterceptors) > 0 || ok && ss.intercepts()) {
+		return fmt.Errorf("handler for %s cannot run server interceptors: %w", protocolID, errNotDispatched)
+	}
 
-	// Set the stream handler
-	r.host.SetStreamHandler(protocol.ID(protocolID), handler.HandleStream)
+	// Set the stream handler for every protocol ID the handler serves, and
+	// advertise the extension protocols of those BaseService serves
+	registered := time.Now()
+	for _, protocolID := range ServedProtocols(handler) {
+		r.logger.Debug("Registered stream handler", logging.KeyProtocol, protocolID)
+		r.host.SetStreamHandler(protocol.ID(protocolID), func(s network.Stream) {
+			r.metrics.StreamOpened(protocolID, "inbound")
+			if ss, ok := handler.(streamServer); ok {
+				ss.serveStream(s, &so)
+				return
+			}
+			if !so.admit(s, protocolID) || !so.allowStream(s, protocolID) {
+				return
+			}
+			release, ok := so.acquireStream(s, protocolID)
+			if !ok {
+				return
+			}
+			defer release()
+			handler.HandleStream(s)
+		})
+		if _, ok := handler.(streamServer); ok {
+			r.host.SetStreamHandler(extensionProtocol(protocolID), func(s network.Stream) {
+				s.Reset()
+			})
+		}
+		r.handlers[protocolID] = HandlerInfo{
+			Protocol:    protocolID,
+			Metadata:    maps.Clone(so.metadata),
+			Descriptors: slices.Clone(so.descriptors),
+			Registered:  registered,
+			ACL:         so.acl,
+		}
+	}
 
 	return nil
 }
 
+func (r *registry) UnregisterService(handler ServiceHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, protocolID := range ServedProtocols(handler) {
+		r.host.RemoveStreamHandler(protocol.ID(protocolID))
+		r.host.RemoveStreamHandler(extensionProtocol(protocolID))
+		delete(r.handlers, protocolID)
+		r.logger.Debug("Removed stream handler", logging.KeyProtocol, protocolID)
+	}
+}
+
 func (r *registry) RegisterClientConstructor(protocol string, constructor func(*srpc.RpcPeer) interface{}) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.clientConstructors[protocol] = constructor
 }
 
+func (r *registry) RegisterClientToken(protocol string, token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if token == "" {
+		delete(r.clientTokens, protocol)
+		return
+	}
+	r.clientTokens[protocol] = token
+}
+
+func (r *registry) HandlerProtocols() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return sortedKeys(r.handlers)
+}
+
+func (r *registry) Handlers() []HandlerInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	handlers := make([]HandlerInfo, 0, len(r.handlers))
+	for _, protocolID := range sortedKeys(r.handlers) {
+		info := r.handlers[protocolID]
+		info.Metadata = maps.Clone(info.Metadata)
+		handlers = append(handlers, info)
+	}
+	return handlers
+}
+
+func (r *registry) ClientProtocols() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return sortedKeys(r.clientConstructors)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
 func (r *registry) NewClient(ctx context.Context, ptcID string, targetPeer peer.ID) (interface{}, error) {
+	if IsProtocolRange(ptcID) {
+		return r.newRangeClient(ctx, ptcID, targetPeer)
+	}
+
 	r.mu.RLock()
 	constructor, ok := r.clientConstructors[ptcID]
 	r.mu.RUnlock()
@@ -53,11 +357,207 @@ func (r *registry) NewClient(ctx context.Context, ptcID string, targetPeer peer.
 		return nil, fmt.Errorf("no client constructor registered for protocol: %s", ptcID)
 	}
 
-	s, err := r.host.NewStream(ctx, targetPeer, protocol.ID(ptcID))
+	rpcPeer, err := r.OpenPeer(ctx, ptcID, targetPeer)
 	if err != nil {
 		return nil, err
 	}
-
-	rpcPeer := srpc.NewRpcPeer(stream.NewLibP2PStream(s))
 	return constructor(rpcPeer), nil
 }
+
+// newRangeClient creates a client for the highest version in the range that
+// the remote peer supports and that has a constructor, either for the version
+// itself or for the range
+func (r *registry) newRangeClient(ctx context.Context, rangeID string, targetPeer peer.ID) (interface{}, error) {
+	pr, err := ParseProtocolRange(rangeID)
+	if err != nil {
+		return nil, err
+	}
+	supported, err := r.supportedVersions(ctx, pr, targetPeer)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	constructors := make(map[string]func(*srpc.RpcPeer) interface{})
+	for _, id := range supported {
+		if constructor, ok := r.clientConstructors[id]; ok {
+			constructors[id] = constructor
+		} else if constructor, ok := r.clientConstructors[rangeID]; ok {
+			constructors[id] = constructor
+		}
+	}
+	r.mu.RUnlock()
+
+	var candidates []string
+	for _, id := range supported {
+		if _, ok := constructors[id]; ok {
+			candidates = append(candidates, id)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no client constructor registered for the versions of %s supported by %s: %v", rangeID, targetPeer, supported)
+	}
+
+	rpcPeer, selected, err := r.openPeer(ctx, targetPeer, rangeID, candidates)
+	if err != nil {
+		return nil, err
+	}
+	return constructors[selected](rpcPeer), nil
+}
+
+func (r *registry) OpenPeer(ctx context.Context, ptcID string, targetPeer peer.ID) (*srpc.RpcPeer, error) {
+	candidates := []string{ptcID}
+	if IsProtocolRange(ptcID) {
+		pr, err := ParseProtocolRange(ptcID)
+		if err != nil {
+			return nil, err
+		}
+		if candidates, err = r.supportedVersions(ctx, pr, targetPeer); err != nil {
+			return nil, err
+		}
+	}
+	rpcPeer, _, err := r.openPeer(ctx, targetPeer, ptcID, candidates)
+	return rpcPeer, err
+}
+
+func (r *registry) Invoke(ctx context.Context, ptcID string, targetPeer peer.ID, method string, req, resp proto.Message) error {
+	candidates := []string{ptcID}
+	if IsProtocolRange(ptcID) {
+		pr, err := ParseProtocolRange(ptcID)
+		if err != nil {
+			return err
+		}
+		if candidates, err = r.supportedVersions(ctx, pr, targetPeer); err != nil {
+			return err
+		}
+	}
+	payload, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	c, err := r.openConn(ctx, targetPeer, ptcID, candidates)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// The stream carries this call only, so any request ID will do
+	info := &CallInfo{Protocol: c.protocol, Method: method, Peer: targetPeer}
+	invoker := func(ctx context.Context, req []byte) ([]byte, error) {
+		return c.roundTrip(ctx, 1, method, req)
+	}
+	out, err := chainClient(c.opts.clientInterceptors, info, invoker)(ctx, payload)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(out, resp)
+}
+
+// openPeer opens a stream negotiating the first of protocols the remote peer
+// supports, and returns an RPC peer on it with the protocol selected.
+// requested is the protocol ID or range asked for, whose client token is
+// presented when the selected protocol has none.
+func (r *registry) openPeer(ctx context.Context, targetPeer peer.ID, requested string, protocols []string) (*srpc.RpcPeer, string, error) {
+	c, err := r.openConn(ctx, targetPeer, requested, protocols)
+	if err != nil {
+		return nil, "", err
+	}
+	return srpc.NewRpcPeer(c), c.protocol, nil
+}
+
+// openConn opens a stream as openPeer does and returns the conn reading it
+func (r *registry) openConn(ctx context.Context, targetPeer peer.ID, requested string, protocols []string) (*conn, error) {
+	streamCtx := ctx
+	if r.allowLimited {
+		streamCtx = network.WithAllowLimitedConn(ctx, "service-rpc")
+	}
+	pids := make([]protocol.ID, len(protocols))
+	for i, id := range protocols {
+		pids[i] = protocol.ID(id)
+	}
+	s, err := r.host.NewStream(streamCtx, targetPeer, pids...)
+	if err != nil {
+		return nil, err
+	}
+	ptcID := string(s.Protocol())
+	r.metrics.StreamOpened(ptcID, "outbound")
+	if err := s.Scope().SetService(ptcID); err != nil {
+		s.Reset()
+		return nil, fmt.Errorf("resource limit of %s reached: %w", ptcID, err)
+	}
+	if ptcID != requested {
+		r.logger.Debug("Negotiated protocol version",
+			logging.KeyProtocol, ptcID, logging.KeyPeer, targetPeer, "requested", requested)
+	}
+
+	c := newConn(ctx, s, &r.streamOptions)
+	c.extended = supportsExtension(r.host, targetPeer, ptcID)
+	r.mu.RLock()
+	token, ok := r.clientTokens[ptcID]
+	if !ok {
+		token = r.clientTokens[requested]
+	}
+	r.mu.RUnlock()
+	// Servers that check tokens advertise the extension protocol; others
+	// would take the frame for a call
+	if token != "" && !c.extended {
+		r.logger.Debug("Peer does not take tokens, not presenting one",
+			logging.KeyProtocol, ptcID, logging.KeyPeer, targetPeer)
+	} else if token != "" {
+		if err := c.writeFrame(encodeToken(token)); err != nil {
+			s.Reset()
+			return nil, fmt.Errorf("failed to present token: %w", err)
+		}
+	}
+	go func() {
+		if err := c.run(context.Background()); err != nil && !isStreamEnd(err) {
+			r.logger.Debug("Client stream failed",
+				logging.KeyProtocol, ptcID, logging.KeyPeer, targetPeer, "error", err)
+		}
+	}()
+	return c, nil
+}
+
+// supportedVersions connects to p and returns the versions in pr it
+// supports according to identify, highest first
+func (r *registry) supportedVersions(ctx context.Context, pr ProtocolRange, p peer.ID) ([]string, error) {
+	sub, err := r.host.EventBus().Subscribe([]interface{}{
+		new(event.EvtPeerIdentificationCompleted),
+		new(event.EvtPeerIdentificationFailed),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Close()
+	if err := r.host.Connect(ctx, peer.AddrInfo{ID: p}); err != nil {
+		return nil, err
+	}
+
+	for identified := false; ; {
+		supported, err := r.host.Peerstore().GetProtocols(p)
+		if err != nil {
+			return nil, err
+		}
+		if len(supported) > 0 || identified {
+			ids := make([]string, len(supported))
+			for i, id := range supported {
+				ids[i] = string(id)
+			}
+			if versions := pr.Select(ids); len(versions) > 0 {
+				return versions, nil
+			}
+			return nil, fmt.Errorf("%s supports no version in %s", p, pr)
+		}
+		select {
+		case e := <-sub.Out():
+			switch e := e.(type) {
+			case event.EvtPeerIdentificationCompleted:
+				identified = e.Peer == p
+			case event.EvtPeerIdentificationFailed:
+				identified = e.Peer == p
+			}
+		case <-ctx.Done():
+			return nil, fmt.Errorf("identify of %s did not complete: %w", p, ctx.Err())
+		}
+	}
+}
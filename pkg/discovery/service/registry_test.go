@@ -0,0 +1,218 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	srpc "github.com/jibuji/go-stream-rpc"
+	"github.com/jibuji/p2p-service-discover/pkg/metrics"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const echoProtocol = "/echo-test/1.0.0"
+
+// echoServer answers Echo with its request. Wait answers once the call's
+// context is done or release is closed.
+type echoServer struct {
+	release chan struct{}
+}
+
+func (e *echoServer) Echo(ctx context.Context, req *wrapperspb.StringValue) *wrapperspb.StringValue {
+	return req
+}
+
+func (e *echoServer) Wait(ctx context.Context, req *wrapperspb.StringValue) *wrapperspb.StringValue {
+	select {
+	case <-ctx.Done():
+	case <-e.release:
+	}
+	return req
+}
+
+type echoService struct {
+	*BaseService
+	server *echoServer
+}
+
+func newEchoService() *echoService {
+	s := &echoService{server: &echoServer{release: make(chan struct{})}}
+	s.BaseService = NewBaseService(echoProtocol, s)
+	return s
+}
+
+func (s *echoService) RegisterWithPeer(p *srpc.RpcPeer) {
+	p.RegisterService("Echo", s.server)
+}
+
+func (s *echoService) Servers() map[string]interface{} {
+	return map[string]interface{}{"Echo": s.server}
+}
+
+// testPair is a server registry serving the echo service and a client
+// registry calling it, on hosts of a mock network
+type testPair struct {
+	server, client       host.Host
+	serverReg, clientReg ServiceRegistry
+	service              *echoService
+	metrics              *prometheus.Registry
+}
+
+// newTestPair registers the echo service with opts on a new server
+func newTestPair(t *testing.T, opts ...HandlerOption) *testPair {
+	t.Helper()
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+	server, err := mn.GenPeer()
+	if err != nil {
+		t.Fatalf("GenPeer: %v", err)
+	}
+	client, err := mn.GenPeer()
+	if err != nil {
+		t.Fatalf("GenPeer: %v", err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatalf("LinkAll: %v", err)
+	}
+	return newTestPairOn(t, server, client, opts...)
+}
+
+// newTCPTestPair is newTestPair on hosts connected over loopback TCP, whose
+// streams support deadlines unlike those of a mock network
+func newTCPTestPair(t *testing.T, opts ...HandlerOption) *testPair {
+	t.Helper()
+	var hosts [2]host.Host
+	for i := range hosts {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		if err != nil {
+			t.Fatalf("libp2p.New: %v", err)
+		}
+		t.Cleanup(func() { h.Close() })
+		hosts[i] = h
+	}
+	server, client := hosts[0], hosts[1]
+	client.Peerstore().AddAddrs(server.ID(), server.Addrs(), peerstore.PermanentAddrTTL)
+	return newTestPairOn(t, server, client, opts...)
+}
+
+func newTestPairOn(t *testing.T, server, client host.Host, opts ...HandlerOption) *testPair {
+	t.Helper()
+	// Identify would report the extension protocol
+	client.Peerstore().AddProtocols(server.ID(), echoProtocol, extensionProtocol(echoProtocol))
+
+	reg := prometheus.NewRegistry()
+	m, err := metrics.New(reg)
+	if err != nil {
+		t.Fatalf("metrics.New: %v", err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tp := &testPair{
+		server:    server,
+		client:    client,
+		serverReg: NewRegistry(server, WithLogger(logger), WithMetrics(m)),
+		clientReg: NewRegistry(client, WithLogger(logger)),
+		service:   newEchoService(),
+		metrics:   reg,
+	}
+	if err := tp.serverReg.RegisterService(tp.service, opts...); err != nil {
+		t.Fatalf("RegisterService: %v", err)
+	}
+	return tp
+}
+
+// call calls an echo method on a new stream
+func (tp *testPair) call(method, msg string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp := &wrapperspb.StringValue{}
+	err := tp.clientReg.Invoke(ctx, echoProtocol, tp.server.ID(), "Echo."+method, wrapperspb.String(msg), resp)
+	return resp.GetValue(), err
+}
+
+// open opens a stream to the echo service and returns the RPC peer on it
+func (tp *testPair) open(t *testing.T) *srpc.RpcPeer {
+	t.Helper()
+	p, err := tp.clientReg.OpenPeer(context.Background(), echoProtocol, tp.server.ID())
+	if err != nil {
+		t.Fatalf("OpenPeer: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+// counter returns the value of a counter of the server's metrics
+func (tp *testPair) counter(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := tp.metrics.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	for _, f := range families {
+		if f.GetName() != "p2pdiscover_"+name {
+			continue
+		}
+	metrics:
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if v, ok := labels[l.GetName()]; ok && v != l.GetValue() {
+					continue metrics
+				}
+			}
+			return m.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+// waitForCounter waits until a counter of the server's metrics reaches want.
+// Rejected streams are reset before they are counted.
+func (tp *testPair) waitForCounter(t *testing.T, name string, labels map[string]string, want float64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for tp.counter(t, name, labels) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s%v = %g, want %g", name, labels, tp.counter(t, name, labels), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// checkRPCError fails the test unless err was answered with code
+func checkRPCError(t *testing.T, err error, code srpc.ErrorCode) *srpc.RPCError {
+	t.Helper()
+	var rpcErr *srpc.RPCError
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("error = %v, want RPC error %d", err, code)
+	}
+	if rpcErr.Code != code {
+		t.Errorf("error = %d %q, want code %d", rpcErr.Code, rpcErr.Message, code)
+	}
+	return rpcErr
+}
+
+// checkRejected fails the test unless err is a stream reset instead of an
+// answer
+func checkRejected(t *testing.T, err error) {
+	t.Helper()
+	var rpcErr *srpc.RPCError
+	if err == nil || errors.As(err, &rpcErr) {
+		t.Fatalf("error = %v, want the stream to be reset", err)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	tp := newTestPair(t)
+	got, err := tp.call("Echo", "hello")
+	if err != nil || got != "hello" {
+		t.Fatalf("Echo = %q, %v", got, err)
+	}
+	tp.waitForCounter(t, "streams_opened_total", map[string]string{"protocol": echoProtocol, "direction": "inbound"}, 1)
+}
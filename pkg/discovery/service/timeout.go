@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	srpc "github.com/jibuji/go-stream-rpc"
+)
+
+// ErrorCodeDeadlineExceeded is returned for calls that did not complete
+// within their timeout. The handler's context is cancelled, but the handler
+// may still be running.
+const ErrorCodeDeadlineExceeded srpc.ErrorCode = 0x103
+
+// errIdle ends a stream that had no call in flight for the idle timeout
+var errIdle = errors.New("stream idle")
+
+// Timeouts bound how long a service runs a call and keeps a stream without
+// calls open. Zero durations mean no timeout. Only handlers embedding
+// BaseService whose service implements ServerProvider can enforce them;
+// RegisterService rejects others with timeouts set.
+type Timeouts struct {
+	// Call bounds every call; the handler's context is cancelled when it
+	// expires. Methods overrides it for full method names such as
+	// "Calculator.Add".
+	Call    time.Duration            `yaml:"call"`
+	Methods map[string]time.Duration `yaml:"methods"`
+	// Idle closes streams that had no call in flight for this long
+	Idle time.Duration `yaml:"idle"`
+}
+
+// Validate reports the first negative timeout
+func (t Timeouts) Validate() error {
+	if t.Call < 0 {
+		return fmt.Errorf("call timeout must not be negative, got %s", t.Call)
+	}
+	for method, d := range t.Methods {
+		if d < 0 {
+			return fmt.Errorf("timeout of %s must not be negative, got %s", method, d)
+		}
+	}
+	if t.Idle < 0 {
+		return fmt.Errorf("idle timeout must not be negative, got %s", t.Idle)
+	}
+	return nil
+}
+
+// limitsCalls reports whether any call has a timeout
+func (t Timeouts) limitsCalls() bool {
+	if t.Call > 0 {
+		return true
+	}
+	for _, d := range t.Methods {
+		if d > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// forMethod returns the timeout of calls to method, or 0 for none
+func (t Timeouts) forMethod(method string) time.Duration {
+	if d, ok := t.Methods[method]; ok {
+		return d
+	}
+	return t.Call
+}
+
+// isTimeout reports whether err is a stream deadline expiring
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// callStarted stops the idle timeout while a call is in flight
+func (c *conn) callStarted() {
+	c.calls.Add(1)
+	if c.opts.timeouts.Idle <= 0 {
+		return
+	}
+	c.idleMu.Lock()
+	defer c.idleMu.Unlock()
+	c.active++
+	if c.active == 1 {
+		c.stream.SetReadDeadline(time.Time{})
+	}
+}
+
+// callDone restarts the idle timeout once no call is in flight
+func (c *conn) callDone() {
+	defer c.calls.Done()
+	if c.opts.timeouts.Idle <= 0 {
+		return
+	}
+	c.idleMu.Lock()
+	defer c.idleMu.Unlock()
+	c.active--
+	if c.active == 0 {
+		c.stream.SetReadDeadline(time.Now().Add(c.opts.timeouts.Idle))
+	}
+}
+
+// call runs method with the timeout configured for it. When the timeout
+// expires first, the call fails with ErrorCodeDeadlineExceeded while the
+// handler, whose context is cancelled, finishes in the background.
+func (c *conn) call(ctx context.Context, method string, payload []byte, release func()) ([]byte, error) {
+	timeout := c.opts.timeouts.forMethod(method)
+	if timeout <= 0 {
+		defer release()
+		return c.invoke(ctx, method, payload)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	type result struct {
+		payload []byte
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer release()
+		out, err := c.invoke(ctx, method, payload)
+		done <- result{out, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.payload, r.err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, rpcErrorf(ErrorCodeDeadlineExceeded, "%s did not complete within %s", method, timeout)
+		}
+		return nil, ctx.Err()
+	}
+}
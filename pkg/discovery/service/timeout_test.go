@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	srpc "github.com/jibuji/go-stream-rpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// passthroughService serves the echo server without ServerProvider, so its
+// calls are dispatched by the RPC peer
+type passthroughService struct {
+	*BaseService
+}
+
+func (s *passthroughService) RegisterWithPeer(p *srpc.RpcPeer) {
+	p.RegisterService("Echo", &echoServer{})
+}
+
+func TestTimeoutsValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts Timeouts
+		wantErr  bool
+	}{
+		{name: "no timeouts"},
+		{name: "timeouts", timeouts: Timeouts{Call: time.Second, Methods: map[string]time.Duration{"Echo.Wait": 0}, Idle: time.Minute}},
+		{name: "negative call", timeouts: Timeouts{Call: -1}, wantErr: true},
+		{name: "negative method", timeouts: Timeouts{Methods: map[string]time.Duration{"Echo.Wait": -1}}, wantErr: true},
+		{name: "negative idle", timeouts: Timeouts{Idle: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.timeouts.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTimeoutsForMethod(t *testing.T) {
+	timeouts := Timeouts{Call: time.Second, Methods: map[string]time.Duration{"Echo.Wait": time.Minute, "Echo.Stream": 0}}
+	for method, want := range map[string]time.Duration{"Echo.Echo": time.Second, "Echo.Wait": time.Minute, "Echo.Stream": 0} {
+		if got := timeouts.forMethod(method); got != want {
+			t.Errorf("forMethod(%s) = %s, want %s", method, got, want)
+		}
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts Timeouts
+	}{
+		{name: "every call", timeouts: Timeouts{Call: 50 * time.Millisecond}},
+		{name: "method", timeouts: Timeouts{Methods: map[string]time.Duration{"Echo.Wait": 50 * time.Millisecond}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := newTestPair(t, WithTimeouts(tt.timeouts))
+			_, err := tp.call("Wait", "hello")
+			checkRPCError(t, err, ErrorCodeDeadlineExceeded)
+			if got, err := tp.call("Echo", "hello"); err != nil || got != "hello" {
+				t.Errorf("Echo = %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	tp := newTCPTestPair(t, WithTimeouts(Timeouts{Idle: 50 * time.Millisecond}))
+	c, err := tp.clientReg.(*registry).openConn(context.Background(), tp.server.ID(), echoProtocol, []string{echoProtocol})
+	if err != nil {
+		t.Fatalf("openConn: %v", err)
+	}
+	defer c.Close()
+	req, _ := proto.Marshal(wrapperspb.String("hello"))
+	if _, err := c.roundTrip(context.Background(), 1, "Echo.Echo", req); err != nil {
+		t.Fatalf("Echo: %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.roundTrip(ctx, 2, "Echo.Echo", req); err == nil {
+		t.Error("call on an idle stream answered")
+	}
+}
+
+func TestTimeoutsNotDispatched(t *testing.T) {
+	tp := newTestPair(t)
+	s := &passthroughService{}
+	s.BaseService = NewBaseService("/passthrough-test/1.0.0", s)
+	for _, timeouts := range []Timeouts{{Call: time.Second}, {Idle: time.Second}} {
+		if err := tp.serverReg.RegisterService(s, WithTimeouts(timeouts)); !errors.Is(err, errNotDispatched) {
+			t.Errorf("RegisterService with %+v = %v, want %v", timeouts, err, errNotDispatched)
+		}
+	}
+}
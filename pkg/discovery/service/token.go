@@ -0,0 +1,326 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	srpc "github.com/jibuji/go-stream-rpc"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"gopkg.in/yaml.v3"
+
+	"github.com/jibuji/p2p-service-discover/internal/logging"
+)
+
+// tokenMethod names the frame a client sends first on a stream to present
+// its capability token. Like metadata frames it is a request with id 0, sent
+// only to peers advertising the extension protocol; a server that does not
+// check tokens ignores it.
+const tokenMethod = "@token"
+
+// tokenDomain is prepended to the payload before signing, so a signature
+// made for something else is never accepted as a token
+const tokenDomain = "p2p-service-discover/token:"
+
+// tokenTimeout bounds how long a server waits for the token of a new stream
+const tokenTimeout = 10 * time.Second
+
+// ErrorCodePermissionDenied is returned for calls outside the scope of the
+// stream's token, or made after the token expired or was revoked. It is
+// above the codes used by go-stream-rpc.
+const ErrorCodePermissionDenied srpc.ErrorCode = 0x100
+
+// Reasons a stream is rejected by a TokenVerifier, used in logs and metrics
+const (
+	rejectTokenMissing = "token_missing"
+	rejectTokenInvalid = "token_invalid"
+)
+
+// Scope grants access to methods of a service protocol
+type Scope struct {
+	Protocol string `json:"protocol"`
+	// Methods are full method names such as "Calculator.Add". Every method
+	// is granted when it is empty.
+	Methods []string `json:"methods,omitempty"`
+}
+
+// Token is a capability granted by an authority to a peer. It is signed by
+// the authority's key, whose peer ID is the issuer.
+type Token struct {
+	// ID identifies the token in revocation lists
+	ID      string  `json:"id"`
+	Issuer  peer.ID `json:"iss"`
+	Subject peer.ID `json:"sub"`
+	// Audience lists the providers that accept the token; any provider
+	// trusting the issuer accepts it when it is empty
+	Audience []peer.ID `json:"aud,omitempty"`
+	Scopes   []Scope   `json:"scopes"`
+	IssuedAt time.Time `json:"iat"`
+	Expires  time.Time `json:"exp"`
+}
+
+// Allows reports whether the token grants calls to method of protocol. An
+// empty method checks the protocol only.
+func (t *Token) Allows(protocol, method string) bool {
+	for _, s := range t.Scopes {
+		if s.Protocol != protocol {
+			continue
+		}
+		if method == "" || len(s.Methods) == 0 || slices.Contains(s.Methods, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Issue signs t and returns the encoded token. The issuer and issue time
+// are set by the authority, and a random ID is chosen when t has none.
+func (a *Authority) Issue(t Token) (string, error) {
+	if t.Subject == "" {
+		return "", errors.New("token has no subject")
+	}
+	if t.Expires.IsZero() {
+		return "", errors.New("token has no expiry")
+	}
+	if len(t.Scopes) == 0 {
+		return "", errors.New("token has no scopes")
+	}
+	if t.ID == "" {
+		id, err := randomID()
+		if err != nil {
+			return "", err
+		}
+		t.ID = id
+	}
+	t.Issuer = a.id
+	t.IssuedAt = time.Now().UTC().Truncate(time.Second)
+	return a.sign(tokenDomain, t)
+}
+
+// ParseToken decodes an encoded token and checks that it is signed by its
+// issuer. Whether the issuer is trusted is up to the caller.
+func ParseToken(s string) (*Token, error) {
+	var t Token
+	if err := parseSigned(tokenDomain, s, &t, func() peer.ID { return t.Issuer }); err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	return &t, nil
+}
+
+// TokenVerifier accepts tokens issued by trusted authorities that have not
+// expired or been revoked. Revoked token IDs are added with Revoke or read
+// from a file with LoadRevocations.
+type TokenVerifier struct {
+	authorities map[peer.ID]struct{}
+
+	mu sync.RWMutex
+	// revoked holds IDs revoked with Revoke, fileRevoked those read from path
+	revoked     map[string]struct{}
+	fileRevoked map[string]struct{}
+	path        string
+	// loaded is the version of the file last loaded
+	loaded fileVersion
+}
+
+// NewTokenVerifier creates a TokenVerifier trusting the given authorities
+func NewTokenVerifier(authorities ...peer.ID) (*TokenVerifier, error) {
+	if len(authorities) == 0 {
+		return nil, errors.New("token verifier needs at least one authority")
+	}
+	v := &TokenVerifier{
+		authorities: make(map[peer.ID]struct{}, len(authorities)),
+		revoked:     make(map[string]struct{}),
+		fileRevoked: make(map[string]struct{}),
+	}
+	for _, a := range authorities {
+		if _, err := a.ExtractPublicKey(); err != nil {
+			return nil, fmt.Errorf("authority %s has no embedded key: %w", a, err)
+		}
+		v.authorities[a] = struct{}{}
+	}
+	return v, nil
+}
+
+// Revoke rejects the tokens with the given IDs from now on, including on
+// streams already open
+func (v *TokenVerifier) Revoke(ids ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, id := range ids {
+		v.revoked[id] = struct{}{}
+	}
+}
+
+// Revoked reports whether the token with the given ID is revoked
+func (v *TokenVerifier) Revoked(id string) bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	_, ok := v.revoked[id]
+	if !ok {
+		_, ok = v.fileRevoked[id]
+	}
+	return ok
+}
+
+// revocationFile is the file representation of a revocation list
+type revocationFile struct {
+	Revoked []string `yaml:"revoked"`
+}
+
+// LoadRevocations reads a YAML or JSON file with a "revoked" list of token
+// IDs. Reload and Watch read it again; IDs revoked with Revoke are kept.
+func (v *TokenVerifier) LoadRevocations(path string) error {
+	v.mu.Lock()
+	v.path = path
+	v.mu.Unlock()
+	return v.Reload()
+}
+
+// Reload reads the revocation file again. The list is kept when the file is
+// invalid.
+func (v *TokenVerifier) Reload() error {
+	v.mu.RLock()
+	path := v.path
+	v.mu.RUnlock()
+	if path == "" {
+		return errors.New("no revocation file was loaded")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var f revocationFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("revocation list %s: %w", path, err)
+	}
+	revoked := make(map[string]struct{}, len(f.Revoked))
+	for _, id := range f.Revoked {
+		revoked[id] = struct{}{}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.fileRevoked = revoked
+	v.loaded = versionOf(info)
+	return nil
+}
+
+// Watch reloads the revocation file whenever it changes, checking every
+// interval, until ctx is done. Failed reloads are logged and keep the
+// previous list. It returns at once when no file was loaded.
+func (v *TokenVerifier) Watch(ctx context.Context, interval time.Duration, logger *slog.Logger) {
+	v.mu.RLock()
+	path := v.path
+	v.mu.RUnlock()
+	if path == "" {
+		return
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	watchFile(ctx, path, interval, logger.With("revocations", path), func() fileVersion {
+		v.mu.RLock()
+		defer v.mu.RUnlock()
+		return v.loaded
+	}, v.Reload)
+}
+
+// Verify checks an encoded token presented by subject to the provider
+// audience for protocol: its signature and issuer, subject, audience,
+// expiry, revocation and scope
+func (v *TokenVerifier) Verify(token string, subject, audience peer.ID, protocol string) (*Token, error) {
+	t, err := ParseToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := v.authorities[t.Issuer]; !ok {
+		return nil, fmt.Errorf("token issuer %s is not trusted", t.Issuer)
+	}
+	if t.Subject != subject {
+		return nil, fmt.Errorf("token was issued to %s", t.Subject)
+	}
+	if len(t.Audience) > 0 && !slices.Contains(t.Audience, audience) {
+		return nil, errors.New("token is not meant for this provider")
+	}
+	if err := v.check(t); err != nil {
+		return nil, err
+	}
+	if !t.Allows(protocol, "") {
+		return nil, fmt.Errorf("token does not grant %s", protocol)
+	}
+	return t, nil
+}
+
+// check returns why a verified token is no longer valid, if it is not
+func (v *TokenVerifier) check(t *Token) error {
+	if !time.Now().Before(t.Expires) {
+		return fmt.Errorf("token expired at %s", t.Expires.Format(time.RFC3339))
+	}
+	if v.Revoked(t.ID) {
+		return fmt.Errorf("token %s is revoked", t.ID)
+	}
+	return nil
+}
+
+// authorize checks a call to method on a stream admitted with t
+func (v *TokenVerifier) authorize(t *Token, protocol, method string) error {
+	if err := v.check(t); err != nil {
+		return rpcErrorf(ErrorCodePermissionDenied, "%v", err)
+	}
+	if !t.Allows(protocol, method) {
+		return rpcErrorf(ErrorCodePermissionDenied, "token does not grant %s", method)
+	}
+	return nil
+}
+
+// encodeToken returns the frame presenting token
+func encodeToken(token string) []byte {
+	return encodeRequest(0, tokenMethod, []byte(token))
+}
+
+func isTokenFrame(f *frame) bool {
+	return !f.isResponse() && f.id == 0 && f.method == tokenMethod
+}
+
+// verifyToken reads the token frame that starts an inbound stream and
+// verifies it. Streams without a valid token are reset, logged and counted.
+func (o *streamOptions) verifyToken(s network.Stream, protocolID string) (*Token, bool) {
+	p := s.Conn().RemotePeer()
+	reject := func(reason string, err error) (*Token, bool) {
+		s.Reset()
+		o.metrics.StreamRejected(protocolID, reason)
+		o.logLimiter.Log(o.logger, slog.LevelInfo, "token:"+protocolID+":"+p.String(), "Rejected stream",
+			logging.KeyProtocol, protocolID, logging.KeyPeer, p, "reason", reason, "error", err)
+		return nil, false
+	}
+
+	s.SetReadDeadline(time.Now().Add(tokenTimeout))
+	f, _, err := readFrame(s)
+	s.SetReadDeadline(time.Time{})
+	if err != nil {
+		return reject(rejectTokenMissing, err)
+	}
+	if !isTokenFrame(f) {
+		return reject(rejectTokenMissing, errors.New("stream did not start with a token"))
+	}
+	t, err := o.tokens.Verify(string(f.payload), p, s.Conn().LocalPeer(), protocolID)
+	if err != nil {
+		return reject(rejectTokenInvalid, err)
+	}
+	return t, true
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func newTestAuthority(t *testing.T) *Authority {
+	t.Helper()
+	key, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatalf("GenerateEd25519Key: %v", err)
+	}
+	a, err := NewAuthority(key)
+	if err != nil {
+		t.Fatalf("NewAuthority: %v", err)
+	}
+	return a
+}
+
+func issue(t *testing.T, a *Authority, tok Token) string {
+	t.Helper()
+	s, err := a.Issue(tok)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	return s
+}
+
+func TestTokenVerify(t *testing.T) {
+	a, untrusted := newTestAuthority(t), newTestAuthority(t)
+	v, err := NewTokenVerifier(a.ID())
+	if err != nil {
+		t.Fatalf("NewTokenVerifier: %v", err)
+	}
+	subject, provider, other := newTestAuthority(t).ID(), newTestAuthority(t).ID(), newTestAuthority(t).ID()
+	valid := Token{
+		ID:      "valid",
+		Subject: subject,
+		Scopes:  []Scope{{Protocol: echoProtocol}},
+		Expires: time.Now().Add(time.Hour),
+	}
+	v.Revoke("revoked")
+
+	tests := []struct {
+		name    string
+		issuer  *Authority
+		change  func(*Token)
+		subject peer.ID
+		wantErr string
+	}{
+		{name: "valid", change: func(*Token) {}},
+		{name: "audience", change: func(tok *Token) { tok.Audience = []peer.ID{provider} }},
+		{name: "untrusted issuer", issuer: untrusted, change: func(*Token) {}, wantErr: "is not trusted"},
+		{name: "other subject", change: func(*Token) {}, subject: other, wantErr: "was issued to"},
+		{name: "other audience", change: func(tok *Token) { tok.Audience = []peer.ID{other} }, wantErr: "not meant for this provider"},
+		{name: "expired", change: func(tok *Token) { tok.Expires = time.Now().Add(-time.Minute) }, wantErr: "token expired"},
+		{name: "revoked", change: func(tok *Token) { tok.ID = "revoked" }, wantErr: "is revoked"},
+		{name: "other protocol", change: func(tok *Token) { tok.Scopes = []Scope{{Protocol: "/other/1.0.0"}} }, wantErr: "does not grant"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer, tok, subj := a, valid, subject
+			if tt.issuer != nil {
+				issuer = tt.issuer
+			}
+			if tt.subject != "" {
+				subj = tt.subject
+			}
+			tt.change(&tok)
+			_, err := v.Verify(issue(t, issuer, tok), subj, provider, echoProtocol)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Verify: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Verify error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := v.Verify("garbage", subject, provider, echoProtocol); err == nil {
+		t.Error("Verify of an invalid encoding succeeded")
+	}
+}
+
+// newTokenPair returns a test pair whose server checks tokens issued by a
+func newTokenPair(t *testing.T, a *Authority) (*testPair, *TokenVerifier) {
+	t.Helper()
+	v, err := NewTokenVerifier(a.ID())
+	if err != nil {
+		t.Fatalf("NewTokenVerifier: %v", err)
+	}
+	return newTestPair(t, WithTokens(v)), v
+}
+
+func TestTokenRejectsStreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		expires time.Duration
+		present bool
+		reason  string
+	}{
+		{name: "missing", reason: rejectTokenMissing},
+		{name: "expired", expires: -time.Minute, present: true, reason: rejectTokenInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAuthority(t)
+			tp, _ := newTokenPair(t, a)
+			if tt.present {
+				tp.clientReg.RegisterClientToken(echoProtocol, issue(t, a, Token{
+					Subject: tp.client.ID(),
+					Scopes:  []Scope{{Protocol: echoProtocol}},
+					Expires: time.Now().Add(tt.expires),
+				}))
+			}
+
+			_, err := tp.call("Echo", "hello")
+			checkRejected(t, err)
+			tp.waitForCounter(t, "streams_rejected_total", map[string]string{"protocol": echoProtocol, "reason": tt.reason}, 1)
+		})
+	}
+}
+
+func TestTokenMethodScope(t *testing.T) {
+	a := newTestAuthority(t)
+	tp, _ := newTokenPair(t, a)
+	tp.clientReg.RegisterClientToken(echoProtocol, issue(t, a, Token{
+		Subject: tp.client.ID(),
+		Scopes:  []Scope{{Protocol: echoProtocol, Methods: []string{"Echo.Echo"}}},
+		Expires: time.Now().Add(time.Hour),
+	}))
+
+	if got, err := tp.call("Echo", "hello"); err != nil || got != "hello" {
+		t.Fatalf("Echo = %q, %v", got, err)
+	}
+	close(tp.service.server.release)
+	_, err := tp.call("Wait", "hello")
+	checkRPCError(t, err, ErrorCodePermissionDenied)
+}
+
+func TestTokenRevokedOnOpenStream(t *testing.T) {
+	a := newTestAuthority(t)
+	tp, v := newTokenPair(t, a)
+	tp.clientReg.RegisterClientToken(echoProtocol, issue(t, a, Token{
+		ID:      "revoked",
+		Subject: tp.client.ID(),
+		Scopes:  []Scope{{Protocol: echoProtocol}},
+		Expires: time.Now().Add(time.Hour),
+	}))
+
+	// Both calls go on the same stream
+	c, err := tp.clientReg.(*registry).openConn(context.Background(), tp.server.ID(), echoProtocol, []string{echoProtocol})
+	if err != nil {
+		t.Fatalf("openConn: %v", err)
+	}
+	defer c.Close()
+	req, _ := proto.Marshal(wrapperspb.String("hello"))
+	if _, err := c.roundTrip(context.Background(), 1, "Echo.Echo", req); err != nil {
+		t.Fatalf("Echo before revocation: %v", err)
+	}
+	v.Revoke("revoked")
+	_, err = c.roundTrip(context.Background(), 2, "Echo.Echo", req)
+	if rpcErr := checkRPCError(t, err, ErrorCodePermissionDenied); !strings.Contains(rpcErr.Message, "revoked") {
+		t.Errorf("error message = %q, want the token revoked", rpcErr.Message)
+	}
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/jibuji/p2p-service-discover/pkg/discovery/service"
+
+// metadataMethod names the frames that carry call metadata. They are sent as
+// requests with id 0, which go-stream-rpc never uses, and only to peers that
+// advertise the extension protocol of the stream's protocol.
+const metadataMethod = "@metadata"
+
+// propagator moves trace context and baggage between client and server
+var propagator = propagation.NewCompositeTextMapPropagator(
+	propagation.TraceContext{},
+	propagation.Baggage{},
+)
+
+// metadata holds key/value pairs sent ahead of a call
+type metadata map[string]string
+
+func (m metadata) Get(key string) string {
+	return m[key]
+}
+
+func (m metadata) Set(key, value string) {
+	m[key] = value
+}
+
+func (m metadata) Keys() []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// metadataFrame is the payload of a metadata frame. Call is the id of the
+// request the values belong to.
+type metadataFrame struct {
+	Call   uint32   `json:"call"`
+	Values metadata `json:"values"`
+}
+
+func encodeMetadata(call uint32, md metadata) ([]byte, error) {
+	payload, err := json.Marshal(metadataFrame{Call: call, Values: md})
+	if err != nil {
+		return nil, err
+	}
+	return encodeRequest(0, metadataMethod, payload), nil
+}
+
+func isMetadataFrame(f *frame) bool {
+	return !f.isResponse() && f.id == 0 && f.method == metadataMethod
+}
+
+func defaultTracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
+
+// rpcAttributes describes a call on a span
+func rpcAttributes(protocol, method string, remote peer.ID) trace.SpanStartOption {
+	service, name, _ := strings.Cut(method, ".")
+	return trace.WithAttributes(
+		attribute.String("rpc.system", "stream-rpc"),
+		attribute.String("rpc.service", service),
+		attribute.String("rpc.method", name),
+		attribute.String("p2p.protocol", protocol),
+		attribute.String("p2p.peer_id", remote.String()),
+	)
+}
+
+// endSpan ends span, marking it failed when err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
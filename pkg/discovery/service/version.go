@@ -0,0 +1,189 @@
+package service
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version MAJOR.MINOR.PATCH, the last element of
+// protocol IDs such as /calculator/1.2.0. Pre-release and build suffixes are
+// not supported.
+type Version struct {
+	Major, Minor, Patch int
+}
+
+// ParseVersion parses a version such as 1.2.0
+func ParseVersion(s string) (Version, error) {
+	nums, n, wildcard, err := parseVersionParts(s)
+	if err != nil {
+		return Version{}, err
+	}
+	if n != 3 || wildcard {
+		return Version{}, fmt.Errorf("invalid version %q: want MAJOR.MINOR.PATCH", s)
+	}
+	return Version{nums[0], nums[1], nums[2]}, nil
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Compare returns -1, 0 or 1 as v is lower than, equal to or higher than o
+func (v Version) Compare(o Version) int {
+	if c := cmp.Compare(v.Major, o.Major); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(v.Minor, o.Minor); c != 0 {
+		return c
+	}
+	return cmp.Compare(v.Patch, o.Patch)
+}
+
+// SplitProtocolID splits a protocol ID such as /calculator/1.2.0 into its
+// name, /calculator, and its version. It reports false when the ID does not
+// end with a version.
+func SplitProtocolID(id string) (string, Version, bool) {
+	i := strings.LastIndex(id, "/")
+	if i <= 0 {
+		return "", Version{}, false
+	}
+	v, err := ParseVersion(id[i+1:])
+	if err != nil {
+		return "", Version{}, false
+	}
+	return id[:i], v, true
+}
+
+// FamilyTopic returns the discovery topic shared by the versions of a
+// protocol with the same major version, such as /calculator/1.x for
+// /calculator/1.2.0. It reports false when id does not end with a version.
+func FamilyTopic(id string) (string, bool) {
+	name, v, ok := SplitProtocolID(id)
+	if !ok {
+		return "", false
+	}
+	return familyTopic(name, v.Major), true
+}
+
+func familyTopic(name string, major int) string {
+	return name + "/" + strconv.Itoa(major) + ".x"
+}
+
+// ProtocolRange matches the versions of a protocol within one major version.
+// It is written as the protocol name followed by:
+//
+//	^1.2  1.2.0 up to, but not including, 2.0.0 (^0.2 stops before 0.3.0)
+//	~1.2  1.2.0 up to, but not including, 1.3.0
+//	1.x   every 1.y.z version; 1.2.x and 1 work the same way
+//	1.2.3 only 1.2.3
+type ProtocolRange struct {
+	Name string
+	// Min is the lowest version in the range, Max the lowest one above it
+	Min, Max Version
+	spec     string
+}
+
+// ParseProtocolRange parses a range such as /calculator/^1.0
+func ParseProtocolRange(s string) (ProtocolRange, error) {
+	i := strings.LastIndex(s, "/")
+	if i <= 0 || i == len(s)-1 {
+		return ProtocolRange{}, fmt.Errorf("invalid protocol range %q: want /name/range", s)
+	}
+	r := ProtocolRange{Name: s[:i], spec: s[i+1:]}
+
+	spec, op := r.spec, byte(0)
+	if spec[0] == '^' || spec[0] == '~' {
+		spec, op = spec[1:], spec[0]
+	}
+	nums, n, wildcard, err := parseVersionParts(spec)
+	if err != nil {
+		return ProtocolRange{}, fmt.Errorf("invalid protocol range %q: %w", s, err)
+	}
+	r.Min = Version{nums[0], nums[1], nums[2]}
+	switch {
+	case op == '^' && (r.Min.Major > 0 || n == 1):
+		r.Max = Version{Major: r.Min.Major + 1}
+	case op == '^' && (r.Min.Minor > 0 || n == 2):
+		r.Max = Version{Minor: r.Min.Minor + 1}
+	case op == '^':
+		r.Max = Version{Patch: r.Min.Patch + 1}
+	case n == 1:
+		r.Max = Version{Major: r.Min.Major + 1}
+	case op == '~' || n == 2:
+		r.Max = Version{Major: r.Min.Major, Minor: r.Min.Minor + 1}
+	case wildcard:
+		return ProtocolRange{}, fmt.Errorf("invalid protocol range %q: wildcard after a patch version", s)
+	default:
+		r.Max = Version{r.Min.Major, r.Min.Minor, r.Min.Patch + 1}
+	}
+	return r, nil
+}
+
+// IsProtocolRange reports whether s is a range rather than a single version
+// or a protocol ID without a version
+func IsProtocolRange(s string) bool {
+	if _, _, ok := SplitProtocolID(s); ok {
+		return false
+	}
+	_, err := ParseProtocolRange(s)
+	return err == nil
+}
+
+func (r ProtocolRange) String() string {
+	return r.Name + "/" + r.spec
+}
+
+// Family returns the discovery topic of the range's major version
+func (r ProtocolRange) Family() string {
+	return familyTopic(r.Name, r.Min.Major)
+}
+
+// Contains reports whether id is a version of the protocol in the range
+func (r ProtocolRange) Contains(id string) bool {
+	name, v, ok := SplitProtocolID(id)
+	return ok && name == r.Name && v.Compare(r.Min) >= 0 && v.Compare(r.Max) < 0
+}
+
+// Select returns the IDs in ids that the range contains, highest version
+// first and without duplicates
+func (r ProtocolRange) Select(ids []string) []string {
+	var out []string
+	for _, id := range ids {
+		if r.Contains(id) && !slices.Contains(out, id) {
+			out = append(out, id)
+		}
+	}
+	slices.SortFunc(out, compareProtocolIDs)
+	return out
+}
+
+// compareProtocolIDs orders versions of one protocol from the highest
+func compareProtocolIDs(a, b string) int {
+	_, va, _ := SplitProtocolID(a)
+	_, vb, _ := SplitProtocolID(b)
+	return vb.Compare(va)
+}
+
+// parseVersionParts parses up to three dot separated numbers, optionally
+// ending with a wildcard x or *. n counts the numbers; missing ones are 0.
+func parseVersionParts(s string) (nums [3]int, n int, wildcard bool, err error) {
+	parts := strings.Split(s, ".")
+	if last := parts[len(parts)-1]; len(parts) > 1 && (last == "x" || last == "X" || last == "*") {
+		parts, wildcard = parts[:len(parts)-1], true
+	}
+	if len(parts) > 3 {
+		return nums, 0, false, fmt.Errorf("too many elements in %q", s)
+	}
+	for i, p := range parts {
+		if p == "" || strings.Trim(p, "0123456789") != "" || (len(p) > 1 && p[0] == '0') {
+			return nums, 0, false, fmt.Errorf("invalid number %q in %q", p, s)
+		}
+		if nums[i], err = strconv.Atoi(p); err != nil {
+			return nums, 0, false, fmt.Errorf("invalid number %q in %q", p, s)
+		}
+	}
+	return nums, len(parts), wildcard, nil
+}
@@ -0,0 +1,267 @@
+package service
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Version
+		wantErr bool
+	}{
+		{in: "1.2.3", want: Version{1, 2, 3}},
+		{in: "0.0.0", want: Version{0, 0, 0}},
+		{in: "10.20.30", want: Version{10, 20, 30}},
+		{in: "1.2", wantErr: true},
+		{in: "1.2.3.4", wantErr: true},
+		{in: "1.2.x", wantErr: true},
+		{in: "01.2.3", wantErr: true},
+		{in: "1.2.3-beta", wantErr: true},
+		{in: "1.2.3+build", wantErr: true},
+		{in: "-1.2.3", wantErr: true},
+		{in: "1..3", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseVersion(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseVersion(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseVersion(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSplitProtocolID(t *testing.T) {
+	tests := []struct {
+		id       string
+		wantName string
+		want     Version
+		wantOK   bool
+	}{
+		{id: "/calculator/1.2.0", wantName: "/calculator", want: Version{1, 2, 0}, wantOK: true},
+		{id: "/a/b/0.1.0", wantName: "/a/b", want: Version{0, 1, 0}, wantOK: true},
+		{id: "/calculator/1.x"},
+		{id: "/calculator/1.2.0-rc.1"},
+		{id: "/calculator"},
+		{id: "1.2.0"},
+	}
+	for _, tt := range tests {
+		name, v, ok := SplitProtocolID(tt.id)
+		if ok != tt.wantOK || name != tt.wantName || v != tt.want {
+			t.Errorf("SplitProtocolID(%q) = %q, %v, %v, want %q, %v, %v",
+				tt.id, name, v, ok, tt.wantName, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestFamilyTopic(t *testing.T) {
+	tests := []struct {
+		id     string
+		want   string
+		wantOK bool
+	}{
+		{id: "/calculator/1.2.0", want: "/calculator/1.x", wantOK: true},
+		{id: "/calculator/0.3.1", want: "/calculator/0.x", wantOK: true},
+		{id: "/calculator/1.x"},
+		{id: "/calculator"},
+	}
+	for _, tt := range tests {
+		got, ok := FamilyTopic(tt.id)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("FamilyTopic(%q) = %q, %v, want %q, %v", tt.id, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestParseProtocolRange(t *testing.T) {
+	tests := []struct {
+		in       string
+		min, max Version
+		wantErr  bool
+	}{
+		{in: "/calc/^1.2", min: Version{1, 2, 0}, max: Version{2, 0, 0}},
+		{in: "/calc/^1", min: Version{1, 0, 0}, max: Version{2, 0, 0}},
+		{in: "/calc/^0.2", min: Version{0, 2, 0}, max: Version{0, 3, 0}},
+		{in: "/calc/^0.0.3", min: Version{0, 0, 3}, max: Version{0, 0, 4}},
+		{in: "/calc/^0.0", min: Version{0, 0, 0}, max: Version{0, 1, 0}},
+		{in: "/calc/^0", min: Version{0, 0, 0}, max: Version{1, 0, 0}},
+		{in: "/calc/~1.2", min: Version{1, 2, 0}, max: Version{1, 3, 0}},
+		{in: "/calc/~1.2.5", min: Version{1, 2, 5}, max: Version{1, 3, 0}},
+		{in: "/calc/1.x", min: Version{1, 0, 0}, max: Version{2, 0, 0}},
+		{in: "/calc/1.*", min: Version{1, 0, 0}, max: Version{2, 0, 0}},
+		{in: "/calc/1", min: Version{1, 0, 0}, max: Version{2, 0, 0}},
+		{in: "/calc/1.2.x", min: Version{1, 2, 0}, max: Version{1, 3, 0}},
+		{in: "/calc/1.2", min: Version{1, 2, 0}, max: Version{1, 3, 0}},
+		{in: "/calc/1.2.3", min: Version{1, 2, 3}, max: Version{1, 2, 4}},
+		{in: "/a/b/^2.1", min: Version{2, 1, 0}, max: Version{3, 0, 0}},
+		{in: "/calc/1.2.3.x", wantErr: true},
+		{in: "/calc/1.2.3.4", wantErr: true},
+		{in: "/calc/x", wantErr: true},
+		{in: "/calc/^", wantErr: true},
+		{in: "/calc/^x", wantErr: true},
+		{in: "/calc/>=1.0", wantErr: true},
+		{in: "/calc/1.02", wantErr: true},
+		{in: "/calc/1.2.3-beta", wantErr: true},
+		{in: "/calc/", wantErr: true},
+		{in: "calc", wantErr: true},
+		{in: "/1.0.0", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		r, err := ParseProtocolRange(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseProtocolRange(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if r.Min != tt.min || r.Max != tt.max {
+			t.Errorf("ParseProtocolRange(%q) = [%v, %v), want [%v, %v)", tt.in, r.Min, r.Max, tt.min, tt.max)
+		}
+		if r.String() != tt.in {
+			t.Errorf("ParseProtocolRange(%q).String() = %q", tt.in, r.String())
+		}
+	}
+}
+
+func TestProtocolRangeFamily(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "/calc/^1.2", want: "/calc/1.x"},
+		{in: "/calc/~0.3", want: "/calc/0.x"},
+		{in: "/calc/2.x", want: "/calc/2.x"},
+		{in: "/calc/1.2.3", want: "/calc/1.x"},
+	}
+	for _, tt := range tests {
+		r, err := ParseProtocolRange(tt.in)
+		if err != nil {
+			t.Fatalf("ParseProtocolRange(%q): %v", tt.in, err)
+		}
+		if got := r.Family(); got != tt.want {
+			t.Errorf("ParseProtocolRange(%q).Family() = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestIsProtocolRange(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{in: "/calc/^1.0", want: true},
+		{in: "/calc/1.x", want: true},
+		{in: "/calc/1.2", want: true},
+		{in: "/calc/1.2.3", want: false},
+		{in: "/calc", want: false},
+		{in: "/calc/latest", want: false},
+	}
+	for _, tt := range tests {
+		if got := IsProtocolRange(tt.in); got != tt.want {
+			t.Errorf("IsProtocolRange(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestProtocolRangeContains(t *testing.T) {
+	tests := []struct {
+		r    string
+		id   string
+		want bool
+	}{
+		// Boundaries: Min is in the range, Max is not
+		{r: "/calc/^1.2", id: "/calc/1.2.0", want: true},
+		{r: "/calc/^1.2", id: "/calc/1.1.9", want: false},
+		{r: "/calc/^1.2", id: "/calc/1.99.99", want: true},
+		{r: "/calc/^1.2", id: "/calc/2.0.0", want: false},
+		{r: "/calc/^0.2", id: "/calc/0.2.9", want: true},
+		{r: "/calc/^0.2", id: "/calc/0.3.0", want: false},
+		{r: "/calc/^0.0.3", id: "/calc/0.0.3", want: true},
+		{r: "/calc/^0.0.3", id: "/calc/0.0.4", want: false},
+		{r: "/calc/~1.2", id: "/calc/1.2.7", want: true},
+		{r: "/calc/~1.2", id: "/calc/1.3.0", want: false},
+		{r: "/calc/1.x", id: "/calc/1.0.0", want: true},
+		{r: "/calc/1.x", id: "/calc/0.9.9", want: false},
+		{r: "/calc/1.x", id: "/calc/2.0.0", want: false},
+		{r: "/calc/1.2.3", id: "/calc/1.2.3", want: true},
+		{r: "/calc/1.2.3", id: "/calc/1.2.4", want: false},
+		// Other protocols, pre-releases and IDs without a version
+		{r: "/calc/^1.0", id: "/other/1.0.0", want: false},
+		{r: "/calc/^1.0", id: "/calc/sub/1.0.0", want: false},
+		{r: "/calc/^1.0", id: "/calc/1.2.0-beta", want: false},
+		{r: "/calc/^1.0", id: "/calc/1.x", want: false},
+		{r: "/calc/^1.0", id: "/calc", want: false},
+	}
+	for _, tt := range tests {
+		r, err := ParseProtocolRange(tt.r)
+		if err != nil {
+			t.Fatalf("ParseProtocolRange(%q): %v", tt.r, err)
+		}
+		if got := r.Contains(tt.id); got != tt.want {
+			t.Errorf("%s.Contains(%q) = %v, want %v", tt.r, tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestProtocolRangeSelect(t *testing.T) {
+	tests := []struct {
+		r    string
+		ids  []string
+		want []string
+	}{
+		{
+			r:    "/calc/^1.0",
+			ids:  []string{"/calc/1.0.0", "/calc/1.10.0", "/calc/1.2.0", "/calc/2.0.0", "/calc/0.9.0"},
+			want: []string{"/calc/1.10.0", "/calc/1.2.0", "/calc/1.0.0"},
+		},
+		{
+			r:    "/calc/~1.2",
+			ids:  []string{"/calc/1.2.1", "/calc/1.2.1", "/calc/1.2.0", "/calc/1.3.0", "/other/1.2.5"},
+			want: []string{"/calc/1.2.1", "/calc/1.2.0"},
+		},
+		{
+			r:    "/calc/^1.0",
+			ids:  []string{"/calc/1.0.0-beta", "/calc/2.0.0"},
+			want: nil,
+		},
+		{
+			r:    "/calc/1.x",
+			ids:  nil,
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		r, err := ParseProtocolRange(tt.r)
+		if err != nil {
+			t.Fatalf("ParseProtocolRange(%q): %v", tt.r, err)
+		}
+		if got := r.Select(tt.ids); !slices.Equal(got, tt.want) {
+			t.Errorf("%s.Select(%q) = %q, want %q", tt.r, tt.ids, got, tt.want)
+		}
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	tests := []struct {
+		a, b Version
+		want int
+	}{
+		{a: Version{1, 2, 3}, b: Version{1, 2, 3}, want: 0},
+		{a: Version{1, 2, 3}, b: Version{1, 2, 4}, want: -1},
+		{a: Version{1, 3, 0}, b: Version{1, 2, 9}, want: 1},
+		{a: Version{2, 0, 0}, b: Version{1, 99, 99}, want: 1},
+		{a: Version{0, 10, 0}, b: Version{0, 9, 0}, want: 1},
+	}
+	for _, tt := range tests {
+		if got := tt.a.Compare(tt.b); got != tt.want {
+			t.Errorf("%v.Compare(%v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
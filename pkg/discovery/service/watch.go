@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// fileVersion tells the contents of a watched file apart by modification
+// time and size
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func versionOf(info os.FileInfo) fileVersion {
+	return fileVersion{modTime: info.ModTime(), size: info.Size()}
+}
+
+func (v fileVersion) equal(o fileVersion) bool {
+	return v.modTime.Equal(o.modTime) && v.size == o.size
+}
+
+// watchFile calls reload whenever the file at path differs from the version
+// loaded returns, checking every interval, until ctx is done. A file that
+// failed to reload is not tried again until it changes.
+func watchFile(ctx context.Context, path string, interval time.Duration, log *slog.Logger, loaded func() fileVersion, reload func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var failed fileVersion
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Warn("Cannot check file", "error", err)
+			continue
+		}
+		current := versionOf(info)
+		if current.equal(loaded()) || current.equal(failed) {
+			continue
+		}
+
+		if err := reload(); err != nil {
+			log.Warn("Failed to reload file, keeping the previous contents", "error", err)
+			failed = current
+			continue
+		}
+		log.Info("Reloaded file")
+	}
+}
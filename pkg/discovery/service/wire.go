@@ -0,0 +1,172 @@
+package service
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	srpc "github.com/jibuji/go-stream-rpc"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Frame layout used by go-stream-rpc:
+//
+//	request:  length(4) | id(4) | method length(1) | method | payload
+//	response: length(4) | id|responseFlag(4) | payload
+//	error:    length(4) | id|responseFlag|errorFlag(4) | code(4) | message
+//
+// length counts every byte after itself.
+const (
+	responseFlag = srpc.RequestIDMSB
+	errorFlag    = uint32(0x40000000)
+	callIDMask   = uint32(0x3fffffff)
+)
+
+// extensionSuffix is appended to the protocol IDs served by BaseService to
+// form the extension protocols advertised through identify. They tell clients
+// that the handler reads the frames go-stream-rpc does not know, such as
+// metadata frames. A plain go-stream-rpc peer answers those with an error
+// frame whose length leaves out its error code, after which the stream can no
+// longer be read, so they are only sent to peers advertising the extension.
+const extensionSuffix = "/srpc-ext"
+
+// extensionProtocol returns the extension protocol of the protocol id. No
+// streams are opened for it.
+func extensionProtocol(id string) protocol.ID {
+	return protocol.ID(id + extensionSuffix)
+}
+
+// supportsExtension reports whether p advertises the extension protocol of
+// id. Opening a stream waits for identify, so the answer is known once a
+// stream to p is open.
+func supportsExtension(h host.Host, p peer.ID, id string) bool {
+	supported, err := h.Peerstore().SupportsProtocols(p, extensionProtocol(id))
+	return err == nil && len(supported) > 0
+}
+
+type frame struct {
+	id      uint32
+	method  string
+	payload []byte
+}
+
+func (f *frame) isResponse() bool {
+	return f.id&responseFlag != 0
+}
+
+func (f *frame) isError() bool {
+	return f.isResponse() && f.id&errorFlag != 0
+}
+
+// callID returns the id of the call a frame belongs to, without flags
+func (f *frame) callID() uint32 {
+	return f.id & callIDMask
+}
+
+// rpcError decodes the payload of an error frame
+func (f *frame) rpcError() *srpc.RPCError {
+	if len(f.payload) < 4 {
+		return &srpc.RPCError{Code: srpc.ErrorCodeUnknown, Message: "error payload too short"}
+	}
+	return &srpc.RPCError{
+		Code:    srpc.ErrorCode(binary.BigEndian.Uint32(f.payload[:4])),
+		Message: string(f.payload[4:]),
+	}
+}
+
+// readFrame reads one frame and also returns its raw bytes, so it can be
+// forwarded unchanged
+func readFrame(r io.Reader) (*frame, []byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 4 || length > srpc.MaxMessageSize {
+		return nil, nil, fmt.Errorf("invalid message length: %d bytes", length)
+	}
+
+	raw := make([]byte, 4+length)
+	copy(raw, header[:])
+	if _, err := io.ReadFull(r, raw[8:]); err != nil {
+		return nil, nil, err
+	}
+
+	f, err := parseFrame(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, raw, nil
+}
+
+// parseFrame decodes a complete frame, including its length prefix
+func parseFrame(raw []byte) (*frame, error) {
+	f := &frame{id: binary.BigEndian.Uint32(raw[4:8])}
+	body := raw[8:]
+
+	if f.isResponse() {
+		f.payload = body
+		return f, nil
+	}
+
+	if len(body) < 1 || len(body) < 1+int(body[0]) {
+		return nil, fmt.Errorf("truncated request frame")
+	}
+	nameLen := int(body[0])
+	f.method = string(body[1 : 1+nameLen])
+	f.payload = body[1+nameLen:]
+	return f, nil
+}
+
+// frameLength reports the size of the first frame in buf, or 0 if buf does
+// not yet hold its length prefix
+func frameLength(buf []byte) int {
+	if len(buf) < 4 {
+		return 0
+	}
+	return 4 + int(binary.BigEndian.Uint32(buf[:4]))
+}
+
+// peerFrameLength is frameLength for the frames an RpcPeer writes, whose
+// error responses hold 4 bytes more than their length counts: it leaves out
+// the error code. It returns 0 until the id is buffered.
+func peerFrameLength(buf []byte) int {
+	if len(buf) < 8 {
+		return 0
+	}
+	n := frameLength(buf)
+	if id := binary.BigEndian.Uint32(buf[4:8]); id&responseFlag != 0 && id&errorFlag != 0 {
+		n += 4
+	}
+	return n
+}
+
+func encodeRequest(id uint32, method string, payload []byte) []byte {
+	buf := make([]byte, 9+len(method)+len(payload))
+	binary.BigEndian.PutUint32(buf[:4], uint32(5+len(method)+len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], id)
+	buf[8] = byte(len(method))
+	copy(buf[9:], method)
+	copy(buf[9+len(method):], payload)
+	return buf
+}
+
+func encodeResponse(id uint32, payload []byte) []byte {
+	buf := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(buf[:4], uint32(4+len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], id&callIDMask|responseFlag)
+	copy(buf[8:], payload)
+	return buf
+}
+
+func encodeError(id uint32, code srpc.ErrorCode, message string) []byte {
+	buf := make([]byte, 12+len(message))
+	binary.BigEndian.PutUint32(buf[:4], uint32(8+len(message)))
+	binary.BigEndian.PutUint32(buf[4:8], id&callIDMask|responseFlag|errorFlag)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(code))
+	copy(buf[12:], message)
+	return buf
+}
@@ -0,0 +1,177 @@
+package discovery
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+
+	"github.com/jibuji/p2p-service-discover/internal/logging"
+	"github.com/jibuji/p2p-service-discover/pkg/types"
+)
+
+// How providers learned through peer exchange were verified, used in logs
+const (
+	verifiedContact   = "contact"
+	verifiedReporters = "reporters"
+)
+
+const (
+	// probeQueue bounds the providers waiting for a probe; new unverified
+	// providers past it are not probed
+	probeQueue = 64
+	// probeWorkers is how many probes run at once
+	probeWorkers = 4
+	// probeTimeout bounds the connection attempt of a probe
+	probeTimeout = 10 * time.Second
+)
+
+// startVerification verifies the providers the node identifies, and starts
+// the probes when they are enabled
+func (n *ServiceNode) startVerification() error {
+	sub, err := n.host.EventBus().Subscribe(new(event.EvtPeerIdentificationCompleted))
+	if err != nil {
+		return err
+	}
+	go n.identifyLoop(n.ctx, sub)
+	if n.verification.Probe {
+		for i := 0; i < probeWorkers; i++ {
+			go n.probeLoop(n.ctx)
+		}
+	}
+	return nil
+}
+
+// identifyLoop verifies the providers identify completes with
+func (n *ServiceNode) identifyLoop(ctx context.Context, sub event.Subscription) {
+	defer sub.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-sub.Out():
+			if !ok {
+				return
+			}
+			n.verifyContact(e.(event.EvtPeerIdentificationCompleted).Peer)
+		}
+	}
+}
+
+// probeLoop connects to the queued providers; identify verifies those it
+// reaches
+func (n *ServiceNode) probeLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case info := <-n.probes:
+			n.probeProvider(ctx, info)
+		}
+	}
+}
+
+// probeProvider connects to an unverified provider, at the addresses in
+// the peerstore and those in info. The host keeps the addresses it dials
+// for a short while only; those the provider does not answer on are removed
+// at once. Identify records the addresses of a provider it reaches.
+func (n *ServiceNode) probeProvider(ctx context.Context, info peer.AddrInfo) {
+	ps := n.host.Peerstore()
+	known := ps.Addrs(info.ID)
+	unknown := slices.DeleteFunc(slices.Clone(info.Addrs), func(addr multiaddr.Multiaddr) bool {
+		return slices.ContainsFunc(known, addr.Equal)
+	})
+
+	probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+	err := n.host.Connect(probeCtx, info)
+	cancel()
+	if err == nil {
+		return
+	}
+	ps.SetAddrs(info.ID, unknown, 0)
+	if ctx.Err() == nil {
+		n.logger.Debug("Failed to probe provider", logging.KeyPeer, info.ID, "error", err)
+	}
+}
+
+// probe queues a provider for a probe, unless probes are disabled or the
+// queue is full
+func (n *ServiceNode) probe(info peer.AddrInfo) {
+	if !n.verification.Probe {
+		return
+	}
+	select {
+	case n.probes <- info:
+	default:
+	}
+}
+
+// verifyContact verifies p as a provider of every topic, once the node was
+// in direct contact with it
+func (n *ServiceNode) verifyContact(p peer.ID) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, service := range n.services {
+		if data, ok := service.Peers[p]; ok && !data.Verified {
+			n.verify(service, p, verifiedContact)
+		}
+	}
+}
+
+// recordReport records that reporter sent p through peer exchange as a
+// provider of the service. p is verified when the node is connected to it
+// or enough peers sent it. It reports whether p was verified. Must be called
+// with n.mu held.
+func (n *ServiceNode) recordReport(service *types.ServiceInfo, p, reporter peer.ID) bool {
+	data, ok := service.Peers[p]
+	if !ok || data.Verified {
+		return false
+	}
+	if n.host.Network().Connectedness(p) == network.Connected {
+		n.verify(service, p, verifiedContact)
+		return true
+	}
+	if !slices.Contains(data.Reporters, reporter) {
+		data.Reporters = append(data.Reporters, reporter)
+		service.Peers[p] = data
+	}
+	if n.verification.Reporters > 0 && len(data.Reporters) >= n.verification.Reporters {
+		n.verify(service, p, verifiedReporters)
+		return true
+	}
+	return false
+}
+
+// verify marks p as a verified provider of the service. The entry counts as
+// updated, so peer exchange syncs relay it from then on. Must be called with
+// n.mu held.
+func (n *ServiceNode) verify(service *types.ServiceInfo, p peer.ID, how string) {
+	data := service.Peers[p]
+	data.Verified = true
+	data.Reporters = nil
+	data.Updated = time.Now()
+	service.Peers[p] = data
+	n.logger.Debug("Verified provider",
+		logging.KeyTopic, service.Topic, logging.KeyPeer, p, "by", how)
+}
+
+// listed reports whether FindPeers returns a live provider
+func (n *ServiceNode) listed(data types.PeerData) bool {
+	return data.Verified || !n.verification.ExcludeUnverified
+}
+
+// compareVerified orders verified providers first
+func compareVerified(a, b types.PeerInfo) int {
+	switch {
+	case a.Verified == b.Verified:
+		return 0
+	case a.Verified:
+		return -1
+	default:
+		return 1
+	}
+}
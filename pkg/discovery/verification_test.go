@@ -0,0 +1,155 @@
+package discovery
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jibuji/p2p-service-discover/internal/protocol/proto"
+	"github.com/jibuji/p2p-service-discover/pkg/types"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const verifyTopic = "/verify-test/1.0.0"
+
+// report merges p, sent by reporter through peer exchange with addr
+func report(n *ServiceNode, reporter, p peer.ID, addr string, lastSeen time.Time) int {
+	return n.mergePeers(n.logger, verifyTopic, reporter, []*proto.PeerInfo{{
+		PeerId:    []byte(p),
+		LastSeen:  lastSeen.UnixNano(),
+		Addresses: []string{addr},
+	}})
+}
+
+// findPeer reports whether FindPeers returns p, and whether as verified
+func findPeer(t *testing.T, n *ServiceNode, p peer.ID) (listed, verified bool) {
+	t.Helper()
+	peers, err := n.FindPeers(verifyTopic)
+	if err != nil {
+		t.Fatalf("FindPeers: %v", err)
+	}
+	for _, info := range peers {
+		if info.ID == p {
+			return true, info.Verified
+		}
+	}
+	return false, false
+}
+
+func TestUnverifiedProviderNotListed(t *testing.T) {
+	tests := []struct {
+		name         string
+		verification types.PeerVerification
+		listed       bool
+	}{
+		{name: "included", verification: types.PeerVerification{Reporters: 2}, listed: true},
+		{name: "excluded", verification: types.PeerVerification{Reporters: 2, ExcludeUnverified: true}, listed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newTestNode(t, tt.verification, verifyTopic)
+			p := randomPeer(t)
+			if updated := report(n, randomPeer(t), p, "/ip4/203.0.113.1/tcp/4001", time.Now()); updated != 1 {
+				t.Fatalf("mergePeers updated %d providers, want 1", updated)
+			}
+			listed, verified := findPeer(t, n, p)
+			if listed != tt.listed || verified {
+				t.Errorf("listed %v, verified %v, want listed %v and unverified", listed, verified, tt.listed)
+			}
+		})
+	}
+}
+
+func TestVerifiedByReporters(t *testing.T) {
+	n := newTestNode(t, types.PeerVerification{Reporters: 3, ExcludeUnverified: true}, verifyTopic)
+	p := randomPeer(t)
+	const addr = "/ip4/203.0.113.1/tcp/4001"
+	reporters := []peer.ID{randomPeer(t), randomPeer(t), randomPeer(t)}
+
+	// A peer reporting the provider again does not count twice
+	for i := 0; i < 2; i++ {
+		report(n, reporters[0], p, addr, time.Now())
+		report(n, reporters[1], p, addr, time.Now())
+	}
+	if listed, _ := findPeer(t, n, p); listed {
+		t.Fatal("provider listed with 2 of 3 reporters")
+	}
+	if got := n.services[verifyTopic].Peers[p].Reporters; !slices.Equal(got, reporters[:2]) {
+		t.Errorf("reporters = %v, want %v", got, reporters[:2])
+	}
+
+	report(n, reporters[2], p, addr, time.Now())
+	if listed, verified := findPeer(t, n, p); !listed || !verified {
+		t.Fatalf("listed %v, verified %v after 3 reporters", listed, verified)
+	}
+	if got := n.services[verifyTopic].Peers[p].Reporters; got != nil {
+		t.Errorf("reporters kept after verification: %v", got)
+	}
+}
+
+func TestAddrsAddedOnceVerified(t *testing.T) {
+	n := newTestNode(t, types.PeerVerification{Reporters: 2}, verifyTopic)
+	p := randomPeer(t)
+	addr := multiaddr.StringCast("/ip4/203.0.113.1/tcp/4001")
+
+	report(n, randomPeer(t), p, addr.String(), time.Now())
+	if addrs := n.host.Peerstore().Addrs(p); len(addrs) != 0 {
+		t.Fatalf("unverified provider's addresses in the peerstore: %v", addrs)
+	}
+
+	report(n, randomPeer(t), p, addr.String(), time.Now())
+	if _, verified := findPeer(t, n, p); !verified {
+		t.Fatal("provider not verified by 2 reporters")
+	}
+	if addrs := n.host.Peerstore().Addrs(p); !slices.ContainsFunc(addrs, addr.Equal) {
+		t.Errorf("peerstore addresses = %v, want %s", addrs, addr)
+	}
+
+	// Once verified, peer exchange no longer replaces its addresses
+	other := multiaddr.StringCast("/ip4/198.51.100.1/tcp/4001")
+	report(n, randomPeer(t), p, other.String(), time.Now())
+	if addrs := n.host.Peerstore().Addrs(p); slices.ContainsFunc(addrs, other.Equal) {
+		t.Errorf("peer exchange added %s to a verified provider", other)
+	}
+	if got := n.services[verifyTopic].Peers[p].Addrs; !slices.Equal(got, []string{addr.String()}) {
+		t.Errorf("recorded addresses = %v, want %s", got, addr)
+	}
+}
+
+func TestProbeUnverified(t *testing.T) {
+	n := newTestNode(t, types.PeerVerification{Probe: true}, verifyTopic)
+	p := randomPeer(t)
+	const addr = "/ip4/203.0.113.1/tcp/4001"
+
+	report(n, randomPeer(t), p, addr, time.Now())
+	select {
+	case info := <-n.probes:
+		if info.ID != p || len(info.Addrs) != 1 || info.Addrs[0].String() != addr {
+			t.Errorf("probed %v, want %s at %s", info, p, addr)
+		}
+	default:
+		t.Fatal("new unverified provider was not probed")
+	}
+	if addrs := n.host.Peerstore().Addrs(p); len(addrs) != 0 {
+		t.Errorf("probed provider's addresses in the peerstore: %v", addrs)
+	}
+
+	// Only new providers are probed
+	report(n, randomPeer(t), p, addr, time.Now())
+	select {
+	case info := <-n.probes:
+		t.Errorf("known provider probed again: %v", info)
+	default:
+	}
+}
+
+func TestFutureSightingClamped(t *testing.T) {
+	n := newTestNode(t, types.PeerVerification{}, verifyTopic)
+	p := randomPeer(t)
+
+	report(n, randomPeer(t), p, "/ip4/203.0.113.1/tcp/4001", time.Now().Add(24*time.Hour))
+	if seen := n.services[verifyTopic].Peers[p].LastSeen; seen.After(time.Now()) {
+		t.Errorf("recorded sighting %s is in the future", seen)
+	}
+}
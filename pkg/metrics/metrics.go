@@ -0,0 +1,242 @@
+// Package metrics defines the Prometheus collectors exported by the service
+// discovery node and the service registry.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "p2pdiscover"
+
+// Metrics holds the collectors shared by a ServiceNode and its registry.
+// A nil *Metrics is valid and records nothing, so callers never need to
+// check whether metrics are enabled.
+type Metrics struct {
+	registerer prometheus.Registerer
+	collectors []prometheus.Collector
+
+	announcements     *prometheus.CounterVec
+	dhtLookupDuration *prometheus.HistogramVec
+	dhtLookupPeers    *prometheus.HistogramVec
+	peerExchange      *prometheus.CounterVec
+	streams           *prometheus.CounterVec
+	streamsRejected   *prometheus.CounterVec
+	callsRejected     *prometheus.CounterVec
+	rpcDuration       *prometheus.HistogramVec
+}
+
+// New creates the collectors and registers them with reg
+func New(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		registerer: reg,
+		announcements: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "announcements_total",
+			Help:      "PubSub announcements by topic and result (published, publish_failed, received, rejected).",
+		}, []string{"topic", "result"}),
+		dhtLookupDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "dht_lookup_duration_seconds",
+			Help:      "Duration of DHT provider lookups by topic and result.",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+		}, []string{"topic", "result"}),
+		dhtLookupPeers: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "dht_lookup_peers",
+			Help:      "Number of providers returned by a DHT lookup.",
+			Buckets:   []float64{0, 1, 2, 5, 10, 20, 50, 100},
+		}, []string{"topic"}),
+		peerExchange: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "peer_exchange_requests_total",
+			Help:      "Peer exchange requests served and made, by method and result.",
+		}, []string{"direction", "method", "result"}),
+		streams: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "streams_opened_total",
+			Help:      "Streams opened per service protocol and direction.",
+		}, []string{"protocol", "direction"}),
+		streamsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "streams_rejected_total",
+			Help:      "Inbound streams rejected by protocol and reason (denied, not_allowed, token_missing, token_invalid, rate_limited, too_many_streams, resource_limit).",
+		}, []string{"protocol", "reason"}),
+		callsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rpc_calls_rejected_total",
+			Help:      "Inbound RPC calls rejected before dispatch, by protocol, method and reason (rate_limited, too_many_calls, resource_limit).",
+		}, []string{"protocol", "method", "reason"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "rpc_call_duration_seconds",
+			Help:      "Latency of RPC calls by side (client or server), protocol, method and result.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"side", "protocol", "method", "result"}),
+	}
+
+	for _, c := range []prometheus.Collector{
+		m.announcements,
+		m.dhtLookupDuration,
+		m.dhtLookupPeers,
+		m.peerExchange,
+		m.streams,
+		m.streamsRejected,
+		m.callsRejected,
+		m.rpcDuration,
+	} {
+		if err := m.register(c); err != nil {
+			m.Unregister()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *Metrics) register(c prometheus.Collector) error {
+	if err := m.registerer.Register(c); err != nil {
+		return err
+	}
+	m.collectors = append(m.collectors, c)
+	return nil
+}
+
+// WatchProviders registers a gauge reporting the number of live providers
+// per topic. fn is called on every scrape.
+func (m *Metrics) WatchProviders(fn func() map[string]int) error {
+	if m == nil {
+		return nil
+	}
+	return m.register(&providersCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "providers"),
+			"Live providers per service topic.",
+			[]string{"topic"}, nil,
+		),
+		fn: fn,
+	})
+}
+
+// Unregister removes every collector registered by m
+func (m *Metrics) Unregister() {
+	if m == nil {
+		return
+	}
+	for _, c := range m.collectors {
+		m.registerer.Unregister(c)
+	}
+	m.collectors = nil
+}
+
+// AnnouncementPublished records the outcome of publishing an announcement
+func (m *Metrics) AnnouncementPublished(topic string, err error) {
+	if m == nil {
+		return
+	}
+	result := "published"
+	if err != nil {
+		result = "publish_failed"
+	}
+	m.announcements.WithLabelValues(topic, result).Inc()
+}
+
+// AnnouncementReceived records an announcement accepted from a remote peer
+func (m *Metrics) AnnouncementReceived(topic string) {
+	if m == nil {
+		return
+	}
+	m.announcements.WithLabelValues(topic, "received").Inc()
+}
+
+// AnnouncementRejected records an announcement that could not be used
+func (m *Metrics) AnnouncementRejected(topic string) {
+	if m == nil {
+		return
+	}
+	m.announcements.WithLabelValues(topic, "rejected").Inc()
+}
+
+// ObserveDHTLookup records the duration and result of a DHT provider lookup
+func (m *Metrics) ObserveDHTLookup(topic string, d time.Duration, found int, err error) {
+	if m == nil {
+		return
+	}
+	m.dhtLookupDuration.WithLabelValues(topic, result(err)).Observe(d.Seconds())
+	if err == nil {
+		m.dhtLookupPeers.WithLabelValues(topic).Observe(float64(found))
+	}
+}
+
+// PeerExchangeServed records a peer exchange request answered by this node
+func (m *Metrics) PeerExchangeServed(method string, err error) {
+	if m == nil {
+		return
+	}
+	m.peerExchange.WithLabelValues("served", method, result(err)).Inc()
+}
+
+// PeerExchangeMade records a peer exchange request sent by this node
+func (m *Metrics) PeerExchangeMade(method string, err error) {
+	if m == nil {
+		return
+	}
+	m.peerExchange.WithLabelValues("made", method, result(err)).Inc()
+}
+
+// StreamOpened records a stream opened for a service protocol. direction is
+// "inbound" or "outbound".
+func (m *Metrics) StreamOpened(protocol, direction string) {
+	if m == nil {
+		return
+	}
+	m.streams.WithLabelValues(protocol, direction).Inc()
+}
+
+// StreamRejected records an inbound stream rejected before it is served
+func (m *Metrics) StreamRejected(protocol, reason string) {
+	if m == nil {
+		return
+	}
+	m.streamsRejected.WithLabelValues(protocol, reason).Inc()
+}
+
+// CallRejected records an inbound RPC call rejected before dispatch
+func (m *Metrics) CallRejected(protocol, method, reason string) {
+	if m == nil {
+		return
+	}
+	m.callsRejected.WithLabelValues(protocol, method, reason).Inc()
+}
+
+// ObserveRPC records the latency of an RPC call. side is "client" or "server".
+func (m *Metrics) ObserveRPC(side, protocol, method string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.rpcDuration.WithLabelValues(side, protocol, method, result(err)).Observe(d.Seconds())
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// providersCollector reports provider counts computed at scrape time, so the
+// gauge never drifts from the node's view of peer TTLs.
+type providersCollector struct {
+	desc *prometheus.Desc
+	fn   func() map[string]int
+}
+
+func (c *providersCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *providersCollector) Collect(ch chan<- prometheus.Metric) {
+	for topic, n := range c.fn() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), topic)
+	}
+}
@@ -10,4 +10,13 @@ type PeerInfo struct {
 	ID       peer.ID
 	Addrs    []string
 	LastSeen time.Time
+	// Attestation is the encoded attestation admitting the peer as a
+	// provider, if it announced one
+	Attestation string
+	// Protocols are the versions of the service the peer provides, highest
+	// first, when they are known
+	Protocols []string
+	// Verified is unset for providers known only through peer exchange and
+	// not confirmed yet
+	Verified bool
 }
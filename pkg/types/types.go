@@ -1,6 +1,7 @@
 package types
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -10,10 +11,96 @@ import (
 type ServiceInfo struct {
 	Topic string
 	Peers map[peer.ID]PeerData
+	// Registered is when the node started discovering the topic
+	Registered time.Time
+}
+
+// ServiceDescription describes a protocol a node serves or advertises, as
+// returned by the reflection protocol
+type ServiceDescription struct {
+	Protocol string
+	// Version is the semantic version the protocol ID ends with, if any
+	Version    string
+	Metadata   map[string]string
+	Registered time.Time
+	// Handler is set when the node has a stream handler for the protocol;
+	// without one the protocol is a discovery-only topic
+	Handler bool
+	// Advertised is set when the node announces itself as a provider
+	Advertised bool
 }
 
 // PeerData holds information about a peer providing a service
 type PeerData struct {
 	LastSeen time.Time
 	Addrs    []string
+	// Sources lists the discovery backends that reported the peer
+	Sources []string
+	// Attestation is the encoded attestation the peer announced for the
+	// service, valid until AttestationExpires
+	Attestation        string
+	AttestationExpires time.Time
+	// Protocols are the versions the peer announced on a protocol family
+	// topic such as /calculator/1.x
+	Protocols []string
+	// Updated is when the entry last changed, in local time. Peer exchange
+	// syncs return the entries updated since the previous sync.
+	Updated time.Time
+	// Departed is set when a peer exchange tombstone removed the provider,
+	// until it is seen again
+	Departed time.Time
+	// Verified is unset while the provider is known only through peer
+	// exchange. It is set once the provider is found in the DHT, announces
+	// itself over pubsub, presents an attestation from a provider authority,
+	// is identified in direct contact or is reported by enough peers.
+	Verified bool
+	// Reporters are the peers that sent the provider through peer exchange
+	// while it was unverified
+	Reporters []peer.ID
+}
+
+// PeerExchangeLimits bound the responses of the peer exchange handler. Zero
+// values mean no limit.
+type PeerExchangeLimits struct {
+	// MaxPeers is the most providers in one response. Pages are cut to it,
+	// and a page size of 0 asks for it.
+	MaxPeers int `yaml:"max_peers"`
+	// MaxResponseBytes bounds the encoded size of the providers in one
+	// response. Pages are cut to fit, and syncs past it are truncated.
+	MaxResponseBytes int `yaml:"max_response_bytes"`
+	// RedactPrivateAddrs leaves loopback, private, link-local and
+	// unspecified addresses out of responses
+	RedactPrivateAddrs bool `yaml:"redact_private_addrs"`
+}
+
+// Validate reports the first negative limit
+func (l PeerExchangeLimits) Validate() error {
+	if l.MaxPeers < 0 {
+		return fmt.Errorf("max peers must not be negative, got %d", l.MaxPeers)
+	}
+	if l.MaxResponseBytes < 0 {
+		return fmt.Errorf("max response bytes must not be negative, got %d", l.MaxResponseBytes)
+	}
+	return nil
+}
+
+// PeerVerification controls how providers learned through peer exchange are
+// verified
+type PeerVerification struct {
+	// Reporters is how many distinct peers must send a provider through peer
+	// exchange to verify it; 0 verifies none this way
+	Reporters int `yaml:"reporters"`
+	// Probe connects to new unverified providers, verifying those that
+	// answer identify
+	Probe bool `yaml:"probe"`
+	// ExcludeUnverified leaves unverified providers out of FindPeers
+	ExcludeUnverified bool `yaml:"exclude_unverified"`
+}
+
+// Validate reports a negative number of reporters
+func (v PeerVerification) Validate() error {
+	if v.Reporters < 0 {
+		return fmt.Errorf("reporters must not be negative, got %d", v.Reporters)
+	}
+	return nil
 }